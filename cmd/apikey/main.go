@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+const usage = `usage:
+  apikey create -name NAME [-rate N] [-daily-jobs N] [-daily-bytes SIZE] [-types download,convert,...]
+  apikey list
+  apikey revoke ID
+
+Talks to the admin API at YOINK_API_URL using ADMIN_SECRET.`
+
+func main() {
+	godotenv.Load()
+	log.SetFlags(0)
+
+	apiURL := strings.TrimRight(os.Getenv("YOINK_API_URL"), "/")
+	if apiURL == "" {
+		apiURL = "http://localhost:3003"
+	}
+	secret := os.Getenv("ADMIN_SECRET")
+	if secret == "" {
+		log.Fatal("ADMIN_SECRET is required")
+	}
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	switch os.Args[1] {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		name := fs.String("name", "", "who the key is for")
+		rate := fs.Int("rate", 0, "requests per rate limit window, 0 for the server default")
+		dailyJobs := fs.Int("daily-jobs", 0, "jobs per day, 0 for no limit")
+		dailyBytes := fs.String("daily-bytes", "0", "bytes per day such as 500MB or 10GB, 0 for no limit")
+		types := fs.String("types", "", "comma separated job types the key may start, empty for all")
+		fs.Parse(os.Args[2:])
+		if *name == "" {
+			log.Fatal("-name is required")
+		}
+		limit, err := parseSize(*dailyBytes)
+		if err != nil {
+			log.Fatalf("Invalid -daily-bytes %q", *dailyBytes)
+		}
+		var jobTypes []string
+		for _, t := range strings.Split(*types, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				jobTypes = append(jobTypes, t)
+			}
+		}
+		call(apiURL, secret, "POST", "/api/admin/keys", map[string]interface{}{
+			"name":       *name,
+			"rateLimit":  *rate,
+			"dailyJobs":  *dailyJobs,
+			"dailyBytes": limit,
+			"jobTypes":   jobTypes,
+		})
+	case "list":
+		call(apiURL, secret, "GET", "/api/admin/keys", nil)
+	case "revoke":
+		if len(os.Args) < 3 {
+			log.Fatal(usage)
+		}
+		call(apiURL, secret, "DELETE", "/api/admin/keys/"+os.Args[2], nil)
+	default:
+		log.Fatal(usage)
+	}
+}
+
+// call sends an admin API request and prints the response.
+func call(apiURL, secret, method, path string, body interface{}) {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, apiURL+path, reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		out.Write(data)
+	}
+	fmt.Println(out.String())
+	if resp.StatusCode >= 300 {
+		os.Exit(1)
+	}
+}
+
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, mult = strings.TrimSuffix(s, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size")
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/joho/godotenv"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/routes"
+	"github.com/coah80/yoink/internal/worker"
+)
+
+func main() {
+	godotenv.Load()
+	config.Load()
+
+	apiURL := os.Getenv("YOINK_API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:3003"
+	}
+	secret := os.Getenv("WORKER_SECRET")
+	if secret == "" {
+		log.Fatal("WORKER_SECRET is required")
+	}
+	id := os.Getenv("WORKER_ID")
+	if id == "" {
+		id, _ = os.Hostname()
+		id = fmt.Sprintf("%s-%d", id, os.Getpid())
+	}
+	concurrency := 2
+	if v := os.Getenv("WORKER_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid WORKER_CONCURRENCY %q", v)
+		}
+		concurrency = n
+	}
+
+	// The temp dirs may be shared with an API server on this machine, so
+	// they're only created here, never cleared.
+	for _, dir := range config.TempDirs {
+		os.MkdirAll(dir, 0755)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	w := worker.New(worker.Config{
+		APIURL:      apiURL,
+		Secret:      secret,
+		ID:          id,
+		Concurrency: concurrency,
+		Run:         routes.RunWorkerJob,
+	})
+	fmt.Println("Worker is running. Press Ctrl+C to stop.")
+	w.Run(ctx)
+	fmt.Println("\nWorker stopped")
+}
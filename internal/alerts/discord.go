@@ -126,6 +126,14 @@ func PlaylistFailed(jobID, url string, err error) {
 	})
 }
 
+func BatchFailed(jobID string, items int, err error) {
+	send("batch", 5*time.Second, true, colorRed, "Batch Failed", err.Error(), map[string]string{
+		"Job":   jobID,
+		"Items": fmt.Sprintf("%d", items),
+		"Error": truncate(err.Error(), 500),
+	})
+}
+
 func ConversionFailed(jobID, format string, err error) {
 	send("conversion", 5*time.Second, true, colorRed, "Conversion Failed", err.Error(), map[string]string{
 		"Job":    jobID,
@@ -100,7 +100,7 @@ func parseJobResponse(data []byte, httpStatus int) (string, error) {
 	return resp.JobID, nil
 }
 
-func (a *apiClient) startDownload(rawURL, format, quality, container, audioFormat string, playlist bool) (string, error) {
+func (a *apiClient) startDownload(userID, rawURL, format, quality, container, audioFormat string, playlist bool) (string, error) {
 	body := map[string]interface{}{
 		"url":         rawURL,
 		"format":      format,
@@ -108,6 +108,7 @@ func (a *apiClient) startDownload(rawURL, format, quality, container, audioForma
 		"container":   container,
 		"audioFormat": audioFormat,
 		"playlist":    playlist,
+		"userId":      userID,
 	}
 
 	data, status, err := a.doJSON("POST", "/api/bot/download", body)
@@ -117,7 +118,7 @@ func (a *apiClient) startDownload(rawURL, format, quality, container, audioForma
 	return parseJobResponse(data, status)
 }
 
-func (a *apiClient) startPlaylistDownload(rawURL, format, quality, container, audioFormat string, resumeFrom int) (string, error) {
+func (a *apiClient) startPlaylistDownload(userID, rawURL, format, quality, container, audioFormat string, resumeFrom int) (string, error) {
 	if resumeFrom < 1 {
 		resumeFrom = 1
 	}
@@ -129,6 +130,7 @@ func (a *apiClient) startPlaylistDownload(rawURL, format, quality, container, au
 		"audioFormat":  audioFormat,
 		"audioBitrate": "320",
 		"resumeFrom":   resumeFrom,
+		"userId":       userID,
 	}
 
 	data, status, err := a.doJSON("POST", "/api/bot/download-playlist", body)
@@ -138,10 +140,11 @@ func (a *apiClient) startPlaylistDownload(rawURL, format, quality, container, au
 	return parseJobResponse(data, status)
 }
 
-func (a *apiClient) startBotConvert(fileURL, format string) (string, error) {
+func (a *apiClient) startBotConvert(userID, fileURL, format string) (string, error) {
 	body := map[string]interface{}{
 		"url":    fileURL,
 		"format": format,
+		"userId": userID,
 	}
 
 	data, status, err := a.doJSON("POST", "/api/bot/convert", body)
@@ -151,11 +154,12 @@ func (a *apiClient) startBotConvert(fileURL, format string) (string, error) {
 	return parseJobResponse(data, status)
 }
 
-func (a *apiClient) startBotCompress(fileURL string, targetMB int, preset string) (string, error) {
+func (a *apiClient) startBotCompress(userID, fileURL string, targetMB int, preset string) (string, error) {
 	body := map[string]interface{}{
 		"url":        fileURL,
 		"targetSize": fmt.Sprintf("%d", targetMB),
 		"preset":     preset,
+		"userId":     userID,
 	}
 
 	data, status, err := a.doJSON("POST", "/api/bot/compress", body)
@@ -165,11 +169,12 @@ func (a *apiClient) startBotCompress(fileURL string, targetMB int, preset string
 	return parseJobResponse(data, status)
 }
 
-func (a *apiClient) startBotCompressFromToken(downloadToken string, targetMB int) (string, error) {
+func (a *apiClient) startBotCompressFromToken(userID, downloadToken string, targetMB int) (string, error) {
 	body := map[string]interface{}{
 		"downloadToken": downloadToken,
 		"targetSize":    fmt.Sprintf("%d", targetMB),
 		"preset":        "fast",
+		"userId":        userID,
 	}
 
 	data, status, err := a.doJSON("POST", "/api/bot/compress", body)
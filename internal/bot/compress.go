@@ -52,7 +52,7 @@ func (b *Bot) handleCompress(s *discordgo.Session, i *discordgo.InteractionCreat
 func (b *Bot) processCompress(s *discordgo.Session, i *discordgo.InteractionCreate, attachment *discordgo.MessageAttachment, targetMB int, preset string) {
 	editEmbed(s, i, progressEmbed("Compressing...", 0, "", "", fmt.Sprintf("Compressing %s to %dMB", attachment.Filename, targetMB)))
 
-	jobID, err := b.api.startBotCompress(attachment.URL, targetMB, preset)
+	jobID, err := b.api.startBotCompress(interactionUserID(i), attachment.URL, targetMB, preset)
 	if err != nil {
 		editEmbed(s, i, errorEmbed("Compression Failed", err.Error()))
 		return
@@ -47,7 +47,7 @@ func (b *Bot) handleConvert(s *discordgo.Session, i *discordgo.InteractionCreate
 func (b *Bot) processConvert(s *discordgo.Session, i *discordgo.InteractionCreate, attachment *discordgo.MessageAttachment, format string) {
 	editEmbed(s, i, progressEmbed("Converting...", 0, "", "", fmt.Sprintf("Converting %s to %s", attachment.Filename, format)))
 
-	jobID, err := b.api.startBotConvert(attachment.URL, format)
+	jobID, err := b.api.startBotConvert(interactionUserID(i), attachment.URL, format)
 	if err != nil {
 		editEmbed(s, i, errorEmbed("Conversion Failed", err.Error()))
 		return
@@ -194,3 +194,15 @@ func requireGuild(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
 	}
 	return true
 }
+
+// interactionUserID returns the ID of the user who ran a command, whether
+// in a server or a DM.
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
@@ -71,9 +71,9 @@ func (b *Bot) processYoink(s *discordgo.Session, i *discordgo.InteractionCreate,
 	var err error
 
 	if isPlaylist {
-		jobID, err = b.api.startPlaylistDownload(url, apiFormat, quality, container, audioFormat, resumeFrom)
+		jobID, err = b.api.startPlaylistDownload(interactionUserID(i), url, apiFormat, quality, container, audioFormat, resumeFrom)
 	} else {
-		jobID, err = b.api.startDownload(url, apiFormat, quality, container, audioFormat, false)
+		jobID, err = b.api.startDownload(interactionUserID(i), url, apiFormat, quality, container, audioFormat, false)
 	}
 	if err != nil {
 		editEmbed(s, i, errorEmbed("Download Failed", err.Error()))
@@ -105,7 +105,7 @@ func (b *Bot) processYoink(s *discordgo.Session, i *discordgo.InteractionCreate,
 	if fileSize > maxDiscordFileSize {
 		editEmbed(s, i, progressEmbed("Compressing...", 0, "", "", "File too large for Discord, auto-compressing..."))
 
-		compressJobID, err := b.api.startBotCompressFromToken(status.DownloadToken, 24)
+		compressJobID, err := b.api.startBotCompressFromToken(interactionUserID(i), status.DownloadToken, 24)
 		if err != nil {
 			downloadURL := b.api.getDownloadURL(status.DownloadToken)
 			editEmbed(s, i, successEmbed("Yoinked", fileName, fileSize, downloadURL))
@@ -186,7 +186,7 @@ func (b *Bot) pollJob(s *discordgo.Session, i *discordgo.InteractionCreate, jobI
 		if status.Status == "complete" {
 			return status, nil
 		}
-		if status.Status == "error" {
+		if status.Status == "error" || status.Status == "interrupted" {
 			msg := status.Message
 			if msg == "" {
 				msg = status.Error
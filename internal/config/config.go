@@ -2,8 +2,10 @@ package config
 
 import (
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -15,9 +17,12 @@ var (
 	Port    string
 	EnvMode string
 
-	BotSecret    string
-	CobaltAPIKey string
-	OpenAIAPIKey string
+	BotSecret     string
+	WebhookSecret string
+	AdminSecret   string
+	WorkerSecret  string
+	CobaltAPIKey  string
+	OpenAIAPIKey  string
 
 	ProxyHost       string
 	ProxyPort       string
@@ -31,35 +36,127 @@ var (
 
 	SessionGeneratorURL string
 	SessionTokenRefresh time.Duration
+
+	StateDBPath string
+
+	// StateBackend is "memory" to keep sessions, jobs and download tokens
+	// in this process, or "sqlite" to share them with other replicas
+	// through the database at SharedStatePath.
+	StateBackend    string
+	SharedStatePath string
+
+	// OutputStorage is "local" to keep finished outputs under TempDir, or
+	// "s3" to move them to an S3-compatible bucket and hand their download
+	// tokens out as presigned links. S3PublicEndpoint is the address
+	// clients reach the bucket on, when it differs from S3Endpoint.
+	OutputStorage    string
+	S3Endpoint       string
+	S3PublicEndpoint string
+	S3Region         string
+	S3Bucket         string
+	S3AccessKey      string
+	S3SecretKey      string
+	S3Prefix         string
+
+	// DownloadTokenKeys sign download tokens. The first key signs new
+	// tokens and the rest are still accepted, so keys can be rotated by
+	// putting the new one first. DownloadTokenMaxUses caps how many times
+	// a token can be downloaded, zero for no cap.
+	DownloadTokenKeys    []string
+	DownloadTokenMaxUses int
+
+	// EgressRatePerTransfer and EgressRateTotal cap how fast files are
+	// sent, in bytes a second, to each client and to everyone together.
+	// Zero sends at full speed. MaxTransfersPerClient caps how many files
+	// one client can be sent at once.
+	EgressRatePerTransfer int64
+	EgressRateTotal       int64
+	MaxTransfersPerClient int
+
+	// DownloadKeepFor is how long a finished file stays after it's first
+	// downloaded in full, so the link can be used again. A file is removed
+	// sooner once it's been downloaded DeleteAfterDownloads times, unless
+	// that's zero.
+	DownloadKeepFor      time.Duration
+	DeleteAfterDownloads int
+
+	// WorkerMode is "local" to run downloads in this process, or "remote"
+	// to hand them to worker processes that claim them from /api/worker.
+	// Compress, convert and transcribe jobs always run in this process,
+	// since they work on files uploaded here.
+	WorkerMode string
 )
 
-var JobLimits = map[string]int{
-	"playlist":   2,
-	"convert":    2,
-	"compress":   1,
-	"transcribe": 1,
-	"fetchUrl":   2,
+// AdmissionMode picks how job slots are handed out. "resources" (the
+// default, ADMISSION_MODE) admits jobs while their JobCosts fit the
+// machine's cores, memory and disk, and Settings.JobLimits starts empty,
+// so any limit set there is a ceiling on top. "fixed" uses
+// Settings.JobLimits alone, starting from the built-in limits.
+var AdmissionMode string
+
+// CPUCores is how many cores jobs may use, CPU_CORES or every core.
+var CPUCores int
+
+// JobCost is what one running job of a type is expected to use. A CPU
+// cost of 0 marks a job that mostly waits on the network, which resource
+// admission doesn't hold back for busy cores, only for memory and disk.
+type JobCost struct {
+	CPU      float64
+	MemoryMB int
+	DiskMB   int
+}
+
+var JobCosts = map[string]JobCost{
+	"download":   {CPU: 0, MemoryMB: 150, DiskMB: 500},
+	"playlist":   {CPU: 1, MemoryMB: 300, DiskMB: 2000},
+	"batch":      {CPU: 1, MemoryMB: 300, DiskMB: 2000},
+	"convert":    {CPU: 2, MemoryMB: 500, DiskMB: 1000},
+	"compress":   {CPU: 4, MemoryMB: 1000, DiskMB: 1000},
+	"transcribe": {CPU: 2, MemoryMB: 1500, DiskMB: 200},
+	"fetchUrl":   {CPU: 0, MemoryMB: 100, DiskMB: 500},
+}
+
+// RateLimitCosts is how many rate limit tokens each kind of request
+// spends, so starting a compress counts for more than polling a status.
+// Requests the middleware doesn't recognise cost "default".
+var RateLimitCosts = map[string]float64{
+	"default":    1,
+	"heartbeat":  0,
+	"progress":   0,
+	"upload":     0.5,
+	"metadata":   1,
+	"download":   5,
+	"playlist":   10,
+	"convert":    10,
+	"jobs":       10,
+	"compress":   20,
+	"transcribe": 20,
 }
 
+// RateLimitAllowIPs and RateLimitAllowKeys are trusted hosts and API key
+// IDs that aren't rate limited at all. Proxies among the hosts are also
+// believed about which client they're forwarding for; nobody else is.
+var (
+	RateLimitAllowIPs  []*net.IPNet
+	RateLimitAllowKeys []string
+)
+
 const (
-	MaxQueueSize        = 50
-	DiskSpaceMinGB      = 5
 	FileSizeLimit       = 8 * 1024 * 1024 * 1024
-	FileRetention       = 20 * time.Minute
 	HeartbeatTimeout    = 30 * time.Second
 	SessionIdleTimeout  = 60 * time.Second
-	MaxPlaylistVideos   = 1000
-	MaxVideoDuration    = 4 * 60 * 60
-	MaxJobsPerClient    = 3
 	RateLimitWindow     = 60 * time.Second
-	RateLimitMax        = 60
 	MaxURLLength        = 2048
 	MaxSegments         = 20
+	MaxPipelineSteps    = 8
 	BotDownloadExpiry   = 5 * time.Minute
+	WebDownloadExpiry   = 15 * time.Minute
 	PlaylistDownloadExp = 12 * time.Hour
 	ChunkSize           = 50 * 1024 * 1024
 	ChunkTimeout        = 30 * time.Minute
-	AsyncJobTimeout     = 1 * time.Hour
+	WebhookMaxAttempts  = 6
+	WebhookRetryBase    = 5 * time.Second
+	WebhookTimeout      = 10 * time.Second
 )
 
 var QualityHeight = map[string]int{
@@ -97,6 +194,9 @@ var TempDirs = map[string]string{
 	"upload":     filepath.Join(TempDir, "uploads"),
 	"bot":        filepath.Join(TempDir, "bot"),
 	"transcribe": filepath.Join(TempDir, "transcribe"),
+	"pipeline":   filepath.Join(TempDir, "pipelines"),
+	"batch":      filepath.Join(TempDir, "batches"),
+	"cache":      filepath.Join(TempDir, "cache"),
 }
 
 type PresetConfig struct {
@@ -106,27 +206,6 @@ type PresetConfig struct {
 	X264Params   string
 }
 
-var CompressionPresets = map[string]PresetConfig{
-	"fast": {
-		FFmpegPreset: "ultrafast",
-		CRF:          map[string]int{"high": 26, "medium": 28, "low": 30},
-		Denoise:      "none",
-		X264Params:   "aq-mode=1",
-	},
-	"balanced": {
-		FFmpegPreset: "medium",
-		CRF:          map[string]int{"high": 22, "medium": 24, "low": 26},
-		Denoise:      "auto",
-		X264Params:   "aq-mode=3:aq-strength=0.9:psy-rd=1.0,0.0",
-	},
-	"quality": {
-		FFmpegPreset: "slow",
-		CRF:          map[string]int{"high": 20, "medium": 22, "low": 24},
-		Denoise:      "auto",
-		X264Params:   "aq-mode=3:aq-strength=0.9:psy-rd=1.0,0.0",
-	},
-}
-
 var DenoiseFilters = map[string]string{
 	"none":     "",
 	"light":    "hqdn3d=2:1.5:3:2.25",
@@ -134,13 +213,6 @@ var DenoiseFilters = map[string]string{
 	"heavy":    "hqdn3d=6:4:9:6",
 }
 
-var BitrateThresholds = map[int]int{
-	1080: 2500,
-	720:  1500,
-	480:  800,
-	360:  400,
-}
-
 var CobaltAPIs []string
 var ExtractorURL string
 
@@ -165,7 +237,67 @@ var BotDetectionErrors = []string{
 
 var HeavyJobTypes = []string{"playlist", "convert", "compress", "transcribe"}
 
+// builtinSettings are the Settings before env vars and CONFIG_FILE.
+func builtinSettings() Settings {
+	return Settings{
+		JobLimits: map[string]int{
+			"playlist":   2,
+			"batch":      2,
+			"convert":    2,
+			"compress":   1,
+			"transcribe": 1,
+			"fetchUrl":   2,
+		},
+		SchedulerWeights: map[string]float64{
+			"web": 3,
+			"bot": 1,
+		},
+		CompressionPresets: map[string]PresetConfig{
+			"fast": {
+				FFmpegPreset: "ultrafast",
+				CRF:          map[string]int{"high": 26, "medium": 28, "low": 30},
+				Denoise:      "none",
+				X264Params:   "aq-mode=1",
+			},
+			"balanced": {
+				FFmpegPreset: "medium",
+				CRF:          map[string]int{"high": 22, "medium": 24, "low": 26},
+				Denoise:      "auto",
+				X264Params:   "aq-mode=3:aq-strength=0.9:psy-rd=1.0,0.0",
+			},
+			"quality": {
+				FFmpegPreset: "slow",
+				CRF:          map[string]int{"high": 20, "medium": 22, "low": 24},
+				Denoise:      "auto",
+				X264Params:   "aq-mode=3:aq-strength=0.9:psy-rd=1.0,0.0",
+			},
+		},
+		BitrateThresholds: map[int]int{
+			1080: 2500,
+			720:  1500,
+			480:  800,
+			360:  400,
+		},
+
+		RateLimitMax:      60,
+		MaxJobsPerClient:  3,
+		MaxQueueSize:      50,
+		DiskSpaceMinGB:    5,
+		MaxPlaylistVideos: 1000,
+		MaxVideoDuration:  4 * 60 * 60,
+		MaxBatchItems:     50,
+		ResultCacheMaxMB:  2048,
+
+		FileRetention:   20 * time.Minute,
+		AsyncJobTimeout: 1 * time.Hour,
+		ShutdownGrace:   5 * time.Minute,
+		ReconnectGrace:  2 * time.Minute,
+	}
+}
+
 func Load() {
+	tunables := builtinSettings()
+
 	Port = envOrDefault("PORT", "3001")
 	EnvMode = envOrDefault("NODE_ENV", "development")
 
@@ -174,6 +306,14 @@ func Load() {
 		log.Println("[WARN] BOT_SECRET not set, bot endpoints will be unprotected")
 	}
 
+	WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	if WebhookSecret == "" {
+		WebhookSecret = BotSecret
+	}
+
+	AdminSecret = os.Getenv("ADMIN_SECRET")
+	WorkerSecret = os.Getenv("WORKER_SECRET")
+
 	CobaltAPIKey = os.Getenv("COBALT_API_KEY")
 	OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
 
@@ -210,6 +350,182 @@ func Load() {
 		refreshMin = 15
 	}
 	SessionTokenRefresh = time.Duration(refreshMin) * time.Minute
+
+	StateDBPath = envOrDefault("STATE_DB_PATH", filepath.Join(TempDir, "state.db"))
+
+	StateBackend = envOrDefault("STATE_BACKEND", "memory")
+	if StateBackend != "memory" && StateBackend != "sqlite" {
+		log.Printf("[WARN] Ignoring invalid STATE_BACKEND %q, using memory", StateBackend)
+		StateBackend = "memory"
+	}
+	SharedStatePath = envOrDefault("SHARED_STATE_PATH", filepath.Join(TempDir, "shared-state.db"))
+
+	if graceEnv := os.Getenv("SHUTDOWN_GRACE"); graceEnv != "" {
+		grace, err := time.ParseDuration(graceEnv)
+		if err != nil || grace < 0 {
+			log.Printf("[WARN] Ignoring invalid SHUTDOWN_GRACE %q, using %s", graceEnv, tunables.ShutdownGrace)
+		} else {
+			tunables.ShutdownGrace = grace
+		}
+	}
+
+	if graceEnv := os.Getenv("RECONNECT_GRACE"); graceEnv != "" {
+		grace, err := time.ParseDuration(graceEnv)
+		if err != nil || grace < 0 {
+			log.Printf("[WARN] Ignoring invalid RECONNECT_GRACE %q, using %s", graceEnv, tunables.ReconnectGrace)
+		} else {
+			tunables.ReconnectGrace = grace
+		}
+	}
+
+	WorkerMode = envOrDefault("WORKER_MODE", "local")
+	if WorkerMode != "local" && WorkerMode != "remote" {
+		log.Printf("[WARN] Ignoring invalid WORKER_MODE %q, using local", WorkerMode)
+		WorkerMode = "local"
+	}
+	if WorkerMode == "remote" && WorkerSecret == "" {
+		log.Println("[WARN] WORKER_MODE=remote needs WORKER_SECRET for workers to connect, running downloads locally")
+		WorkerMode = "local"
+	}
+
+	OutputStorage = envOrDefault("OUTPUT_STORAGE", "local")
+	S3Endpoint = strings.TrimRight(os.Getenv("S3_ENDPOINT"), "/")
+	S3PublicEndpoint = strings.TrimRight(envOrDefault("S3_PUBLIC_ENDPOINT", S3Endpoint), "/")
+	S3Region = envOrDefault("S3_REGION", "us-east-1")
+	S3Bucket = os.Getenv("S3_BUCKET")
+	S3AccessKey = os.Getenv("S3_ACCESS_KEY")
+	S3SecretKey = os.Getenv("S3_SECRET_KEY")
+	S3Prefix = envOrDefault("S3_PREFIX", "outputs/")
+	switch {
+	case OutputStorage != "local" && OutputStorage != "s3":
+		log.Printf("[WARN] Ignoring invalid OUTPUT_STORAGE %q, using local", OutputStorage)
+		OutputStorage = "local"
+	case OutputStorage == "s3" && (S3Endpoint == "" || S3Bucket == "" || S3AccessKey == "" || S3SecretKey == ""):
+		log.Println("[WARN] OUTPUT_STORAGE=s3 needs S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY, keeping outputs local")
+		OutputStorage = "local"
+	}
+
+	DownloadTokenKeys = nil
+	for _, key := range strings.Split(os.Getenv("DOWNLOAD_TOKEN_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			DownloadTokenKeys = append(DownloadTokenKeys, key)
+		}
+	}
+	if len(DownloadTokenKeys) == 0 {
+		log.Println("[WARN] DOWNLOAD_TOKEN_KEYS not set, download links will stop working on restart and can't be checked by other replicas")
+	}
+	DownloadTokenMaxUses = 0
+	if usesEnv := os.Getenv("DOWNLOAD_TOKEN_MAX_USES"); usesEnv != "" {
+		uses, err := strconv.Atoi(usesEnv)
+		if err != nil || uses < 0 {
+			log.Printf("[WARN] Ignoring invalid DOWNLOAD_TOKEN_MAX_USES %q", usesEnv)
+		} else {
+			DownloadTokenMaxUses = uses
+		}
+	}
+
+	EgressRatePerTransfer = envRate("EGRESS_RATE_PER_TRANSFER")
+	EgressRateTotal = envRate("EGRESS_RATE_TOTAL")
+	MaxTransfersPerClient = 4
+	if transfersEnv := os.Getenv("MAX_TRANSFERS_PER_CLIENT"); transfersEnv != "" {
+		transfers, err := strconv.Atoi(transfersEnv)
+		if err != nil || transfers < 0 {
+			log.Printf("[WARN] Ignoring invalid MAX_TRANSFERS_PER_CLIENT %q, using %d", transfersEnv, MaxTransfersPerClient)
+		} else {
+			MaxTransfersPerClient = transfers
+		}
+	}
+
+	DownloadKeepFor = 30 * time.Second
+	if keepEnv := os.Getenv("DOWNLOAD_KEEP_FOR"); keepEnv != "" {
+		keep, err := time.ParseDuration(keepEnv)
+		if err != nil || keep < 0 {
+			log.Printf("[WARN] Ignoring invalid DOWNLOAD_KEEP_FOR %q, using %s", keepEnv, DownloadKeepFor)
+		} else {
+			DownloadKeepFor = keep
+		}
+	}
+	DeleteAfterDownloads = 0
+	if deleteEnv := os.Getenv("DELETE_AFTER_DOWNLOADS"); deleteEnv != "" {
+		downloads, err := strconv.Atoi(deleteEnv)
+		if err != nil || downloads < 0 {
+			log.Printf("[WARN] Ignoring invalid DELETE_AFTER_DOWNLOADS %q", deleteEnv)
+		} else {
+			DeleteAfterDownloads = downloads
+		}
+	}
+
+	AdmissionMode = envOrDefault("ADMISSION_MODE", "resources")
+	if AdmissionMode != "resources" && AdmissionMode != "fixed" {
+		log.Printf("[WARN] Ignoring invalid ADMISSION_MODE %q, using resources", AdmissionMode)
+		AdmissionMode = "resources"
+	}
+	if AdmissionMode == "resources" {
+		tunables.JobLimits = map[string]int{}
+	}
+	CPUCores = runtime.NumCPU()
+	if coresEnv := os.Getenv("CPU_CORES"); coresEnv != "" {
+		cores, err := strconv.Atoi(coresEnv)
+		if err != nil || cores < 1 {
+			log.Printf("[WARN] Ignoring invalid CPU_CORES %q, using %d", coresEnv, CPUCores)
+		} else {
+			CPUCores = cores
+		}
+	}
+
+	if weightsEnv := os.Getenv("SCHEDULER_WEIGHTS"); weightsEnv != "" {
+		for _, pair := range strings.Split(weightsEnv, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || weight <= 0 {
+				log.Printf("[WARN] Ignoring invalid scheduler weight %q", pair)
+				continue
+			}
+			tunables.SchedulerWeights[strings.TrimSpace(name)] = weight
+		}
+	}
+
+	if costsEnv := os.Getenv("RATE_LIMIT_COSTS"); costsEnv != "" {
+		for _, pair := range strings.Split(costsEnv, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			cost, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if !ok || err != nil || cost < 0 {
+				log.Printf("[WARN] Ignoring invalid rate limit cost %q", pair)
+				continue
+			}
+			RateLimitCosts[strings.TrimSpace(name)] = cost
+		}
+	}
+
+	RateLimitAllowIPs, RateLimitAllowKeys = nil, nil
+	for _, entry := range strings.Split(os.Getenv("RATE_LIMIT_ALLOWLIST"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if keyID, ok := strings.CutPrefix(entry, "key:"); ok {
+			RateLimitAllowKeys = append(RateLimitAllowKeys, keyID)
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("[WARN] Ignoring invalid RATE_LIMIT_ALLOWLIST entry %q", entry)
+			continue
+		}
+		RateLimitAllowIPs = append(RateLimitAllowIPs, ipNet)
+	}
+
+	loadConfigFile(tunables)
 }
 
 func envOrDefault(key, fallback string) string {
@@ -219,6 +535,31 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
+// envRate reads a rate in bytes a second, such as "500KB" or "10MB",
+// from an env var. Unset or invalid means no limit.
+func envRate(key string) int64 {
+	raw := strings.ToUpper(strings.TrimSpace(os.Getenv(key)))
+	if raw == "" {
+		return 0
+	}
+	value, mult := strings.TrimSuffix(raw, "/S"), 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, mult = strings.TrimSuffix(value, unit.suffix), unit.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || n < 0 {
+		log.Printf("[WARN] Ignoring invalid %s %q", key, raw)
+		return 0
+	}
+	return int64(n * mult)
+}
+
 func Contains(slice []string, val string) bool {
 	for _, s := range slice {
 		if s == val {
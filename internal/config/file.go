@@ -0,0 +1,448 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigFile is an optional TOML file, set with CONFIG_FILE, that
+// overrides the tunables below. Values in it win over env vars.
+var ConfigFile string
+
+// RestartOnly names the settings outside Settings. They're read once at
+// startup and a reload leaves them as they were.
+var RestartOnly = []string{
+	"ADMISSION_MODE", "CPU_CORES", "job costs", "rate limit costs",
+	"EGRESS_RATE_PER_TRANSFER", "EGRESS_RATE_TOTAL", "MAX_TRANSFERS_PER_CLIENT",
+	"DOWNLOAD_TOKEN_KEYS", "DOWNLOAD_TOKEN_MAX_USES",
+}
+
+// Settings is every value CONFIG_FILE can override. They can change on
+// reload, so read them through Get when they're needed rather than
+// caching them. Anything else, like RestartOnly, needs a restart.
+type Settings struct {
+	// JobLimits caps how many jobs of each type run at once. Types
+	// without an entry are unlimited.
+	JobLimits map[string]int
+
+	// SchedulerWeights sets how queued job slots are shared between job
+	// origins. With web=3 and bot=1 the Discord bot gets at least a
+	// quarter of admissions for each job type while both are waiting.
+	SchedulerWeights   map[string]float64
+	CompressionPresets map[string]PresetConfig
+	BitrateThresholds  map[int]int
+
+	// RateLimitMax is how many rate limit tokens a client can spend per
+	// RateLimitWindow, and how many it can save up.
+	RateLimitMax      int
+	MaxJobsPerClient  int
+	MaxQueueSize      int
+	DiskSpaceMinGB    int
+	MaxPlaylistVideos int
+	MaxVideoDuration  int
+	MaxBatchItems     int
+
+	// ResultCacheMaxMB caps the finished-download cache. Zero turns it off.
+	ResultCacheMaxMB int
+
+	FileRetention   time.Duration
+	AsyncJobTimeout time.Duration
+	ShutdownGrace   time.Duration
+
+	// ReconnectGrace is how long a streaming download keeps running after
+	// its client disconnects, waiting for it to come back. Zero cancels it
+	// straight away.
+	ReconnectGrace time.Duration
+}
+
+var (
+	settings   atomic.Pointer[Settings]
+	muSettings sync.Mutex
+)
+
+// defaults holds the settings from env and code before CONFIG_FILE is
+// applied. Every read of the file starts from here, so deleting a key
+// from the file restores its default on the next reload.
+var defaults Settings
+
+func init() {
+	defaults = builtinSettings()
+	s := copySettings(defaults)
+	settings.Store(&s)
+}
+
+// Get returns the settings in effect. They're shared and must not be
+// modified; use Update to change them.
+func Get() *Settings {
+	return settings.Load()
+}
+
+// Update changes the settings in effect. change gets a copy of them, so
+// readers holding the old ones never see a half-made change.
+func Update(change func(s *Settings)) {
+	muSettings.Lock()
+	defer muSettings.Unlock()
+	s := copySettings(*settings.Load())
+	change(&s)
+	settings.Store(&s)
+}
+
+var knownJobTypes = []string{"download", "playlist", "batch", "convert", "compress", "transcribe", "fetchUrl"}
+
+var x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+
+// Current returns a copy of the settings in effect that the caller may
+// modify.
+func Current() Settings {
+	return copySettings(*Get())
+}
+
+// ReadSettings reads and validates a config file on top of the defaults.
+// All problems are reported together.
+func ReadSettings(path string) (Settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Settings{}, err
+	}
+	entries, err := parseTOML(data)
+	if err != nil {
+		return Settings{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s := copySettings(defaults)
+	var errs []error
+	for _, e := range entries {
+		if err := s.set(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, s.validate()...)
+	if len(errs) > 0 {
+		return Settings{}, fmt.Errorf("%s: %w", path, errors.Join(errs...))
+	}
+	return s, nil
+}
+
+func copySettings(s Settings) Settings {
+	c := s
+	c.JobLimits = maps.Clone(s.JobLimits)
+	c.SchedulerWeights = maps.Clone(s.SchedulerWeights)
+	c.BitrateThresholds = maps.Clone(s.BitrateThresholds)
+	c.CompressionPresets = make(map[string]PresetConfig, len(s.CompressionPresets))
+	for name, p := range s.CompressionPresets {
+		p.CRF = maps.Clone(p.CRF)
+		c.CompressionPresets[name] = p
+	}
+	return c
+}
+
+func (s *Settings) set(e tomlEntry) error {
+	switch e.table {
+	case "limits":
+		if e.key == "max_video_duration" {
+			d, err := e.asDuration()
+			if err != nil {
+				return err
+			}
+			s.MaxVideoDuration = int(d.Seconds())
+			return nil
+		}
+		target, ok := map[string]*int{
+			"rate_limit_max":      &s.RateLimitMax,
+			"max_jobs_per_client": &s.MaxJobsPerClient,
+			"max_queue_size":      &s.MaxQueueSize,
+			"disk_space_min_gb":   &s.DiskSpaceMinGB,
+			"max_playlist_videos": &s.MaxPlaylistVideos,
+			"max_batch_items":     &s.MaxBatchItems,
+			"result_cache_max_mb": &s.ResultCacheMaxMB,
+		}[e.key]
+		if !ok {
+			return e.errorf("unknown setting")
+		}
+		n, err := e.asInt()
+		if err != nil {
+			return err
+		}
+		*target = n
+
+	case "timeouts":
+		target, ok := map[string]*time.Duration{
+			"file_retention":    &s.FileRetention,
+			"async_job_timeout": &s.AsyncJobTimeout,
+			"shutdown_grace":    &s.ShutdownGrace,
+			"reconnect_grace":   &s.ReconnectGrace,
+		}[e.key]
+		if !ok {
+			return e.errorf("unknown setting")
+		}
+		d, err := e.asDuration()
+		if err != nil {
+			return err
+		}
+		*target = d
+
+	case "job_limits":
+		if !Contains(knownJobTypes, e.key) {
+			return e.errorf("unknown job type, expected one of %s", strings.Join(knownJobTypes, ", "))
+		}
+		n, err := e.asInt()
+		if err != nil {
+			return err
+		}
+		s.JobLimits[e.key] = n
+
+	case "scheduler_weights":
+		w, err := e.asFloat()
+		if err != nil {
+			return err
+		}
+		s.SchedulerWeights[e.key] = w
+
+	case "bitrate_thresholds":
+		height, err := strconv.Atoi(e.key)
+		if _, known := s.BitrateThresholds[height]; err != nil || !known {
+			return e.errorf("unknown height, expected one of 1080, 720, 480, 360")
+		}
+		n, err := e.asInt()
+		if err != nil {
+			return err
+		}
+		s.BitrateThresholds[height] = n
+
+	default:
+		if name, ok := strings.CutPrefix(e.table, "compression_presets."); ok {
+			return s.setPreset(name, e)
+		}
+		return e.errorf("unknown setting")
+	}
+	return nil
+}
+
+func (s *Settings) setPreset(table string, e tomlEntry) error {
+	name, sub, _ := strings.Cut(table, ".")
+	p, ok := s.CompressionPresets[name]
+	if !ok {
+		return e.errorf("unknown preset %q, expected one of %s", name, strings.Join(AllowedPresets, ", "))
+	}
+	defer func() { s.CompressionPresets[name] = p }()
+
+	if sub == "crf" {
+		if !Contains(AllowedQualities, e.key) {
+			return e.errorf("unknown quality, expected one of %s", strings.Join(AllowedQualities, ", "))
+		}
+		n, err := e.asInt()
+		if err != nil {
+			return err
+		}
+		p.CRF[e.key] = n
+		return nil
+	}
+	if sub != "" {
+		return e.errorf("unknown setting")
+	}
+
+	str, err := e.asString()
+	if err != nil {
+		return err
+	}
+	switch e.key {
+	case "ffmpeg_preset":
+		p.FFmpegPreset = str
+	case "denoise":
+		p.Denoise = str
+	case "x264_params":
+		p.X264Params = str
+	default:
+		return e.errorf("unknown setting")
+	}
+	return nil
+}
+
+func (s *Settings) validate() []error {
+	var errs []error
+	atLeast := func(name string, v, min int) {
+		if v < min {
+			errs = append(errs, fmt.Errorf("%s must be at least %d, got %d", name, min, v))
+		}
+	}
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, d))
+		}
+	}
+
+	atLeast("limits.rate_limit_max", s.RateLimitMax, 1)
+	atLeast("limits.max_jobs_per_client", s.MaxJobsPerClient, 1)
+	atLeast("limits.max_queue_size", s.MaxQueueSize, 0)
+	atLeast("limits.disk_space_min_gb", s.DiskSpaceMinGB, 0)
+	atLeast("limits.max_playlist_videos", s.MaxPlaylistVideos, 1)
+	atLeast("limits.max_video_duration", s.MaxVideoDuration, 1)
+	atLeast("limits.max_batch_items", s.MaxBatchItems, 1)
+	atLeast("limits.result_cache_max_mb", s.ResultCacheMaxMB, 0)
+	positive("timeouts.file_retention", s.FileRetention)
+	positive("timeouts.async_job_timeout", s.AsyncJobTimeout)
+	if s.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.shutdown_grace can't be negative"))
+	}
+	if s.ReconnectGrace < 0 {
+		errs = append(errs, fmt.Errorf("timeouts.reconnect_grace can't be negative"))
+	}
+
+	for _, jobType := range sortedKeys(s.JobLimits) {
+		atLeast("job_limits."+jobType, s.JobLimits[jobType], 1)
+	}
+	for _, origin := range sortedKeys(s.SchedulerWeights) {
+		if s.SchedulerWeights[origin] <= 0 {
+			errs = append(errs, fmt.Errorf("scheduler_weights.%s must be positive", origin))
+		}
+	}
+	for _, height := range sortedKeys(s.BitrateThresholds) {
+		atLeast(fmt.Sprintf("bitrate_thresholds.%d", height), s.BitrateThresholds[height], 1)
+	}
+	for _, name := range sortedKeys(s.CompressionPresets) {
+		p := s.CompressionPresets[name]
+		prefix := "compression_presets." + name
+		if !Contains(x264Presets, p.FFmpegPreset) {
+			errs = append(errs, fmt.Errorf("%s.ffmpeg_preset %q isn't an x264 preset", prefix, p.FFmpegPreset))
+		}
+		if _, ok := DenoiseFilters[p.Denoise]; !ok && p.Denoise != "auto" {
+			errs = append(errs, fmt.Errorf("%s.denoise must be one of %s", prefix, strings.Join(AllowedDenoise, ", ")))
+		}
+		for _, quality := range AllowedQualities {
+			if crf := p.CRF[quality]; crf < 0 || crf > 51 {
+				errs = append(errs, fmt.Errorf("%s.crf.%s must be between 0 and 51, got %d", prefix, quality, crf))
+			}
+		}
+	}
+	return errs
+}
+
+func sortedKeys[K int | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Limits changed through the admin API are kept across reloads of
+// CONFIG_FILE until the process restarts. A job limit of 0 means the type
+// is unlimited.
+var (
+	muOverrides       sync.Mutex
+	jobLimitOverrides = map[string]int{}
+	rateLimitOverride int
+)
+
+// OverrideJobLimit keeps a job type's limit at limit, 0 for unlimited,
+// whatever the config file says.
+func OverrideJobLimit(jobType string, limit int) {
+	muOverrides.Lock()
+	defer muOverrides.Unlock()
+	jobLimitOverrides[jobType] = limit
+}
+
+// OverrideRateLimitMax keeps RateLimitMax at limit whatever the config
+// file says.
+func OverrideRateLimitMax(limit int) {
+	muOverrides.Lock()
+	defer muOverrides.Unlock()
+	rateLimitOverride = limit
+}
+
+// ApplyOverrides puts the limits set through the admin API on top of s
+// and returns the names of the settings it kept.
+func ApplyOverrides(s *Settings) []string {
+	muOverrides.Lock()
+	defer muOverrides.Unlock()
+	var kept []string
+	if s.JobLimits == nil && len(jobLimitOverrides) > 0 {
+		s.JobLimits = make(map[string]int)
+	}
+	for _, jobType := range sortedKeys(jobLimitOverrides) {
+		if limit := jobLimitOverrides[jobType]; limit == 0 {
+			delete(s.JobLimits, jobType)
+		} else {
+			s.JobLimits[jobType] = limit
+		}
+		kept = append(kept, "job_limits."+jobType)
+	}
+	if rateLimitOverride > 0 {
+		s.RateLimitMax = rateLimitOverride
+		kept = append(kept, "rate_limit_max")
+	}
+	return kept
+}
+
+// loadConfigFile makes env the defaults and applies CONFIG_FILE over them
+// at startup. A bad file is fatal so the server never starts with
+// settings nobody asked for.
+func loadConfigFile(env Settings) {
+	defaults = copySettings(env)
+	ConfigFile = os.Getenv("CONFIG_FILE")
+	if ConfigFile == "" {
+		settings.Store(&env)
+		return
+	}
+	s, err := ReadSettings(ConfigFile)
+	if err != nil {
+		log.Fatalf("[Config] Invalid config file %v", err)
+	}
+	settings.Store(&s)
+	log.Printf("[Config] Loaded %s", ConfigFile)
+}
+
+// SetTunables applies the settings that are read fresh wherever they're
+// used and need no reconfiguring: everything except JobLimits,
+// SchedulerWeights and RateLimitMax, which belong to the queue and the
+// rate limiter. It returns the names of the settings that changed.
+func SetTunables(s Settings) []string {
+	var changed []string
+	Update(func(cur *Settings) {
+		setInt := func(name string, target *int, v int) {
+			if *target != v {
+				*target = v
+				changed = append(changed, name)
+			}
+		}
+		setDuration := func(name string, target *time.Duration, v time.Duration) {
+			if *target != v {
+				*target = v
+				changed = append(changed, name)
+			}
+		}
+
+		setInt("max_jobs_per_client", &cur.MaxJobsPerClient, s.MaxJobsPerClient)
+		setInt("max_queue_size", &cur.MaxQueueSize, s.MaxQueueSize)
+		setInt("disk_space_min_gb", &cur.DiskSpaceMinGB, s.DiskSpaceMinGB)
+		setInt("max_playlist_videos", &cur.MaxPlaylistVideos, s.MaxPlaylistVideos)
+		setInt("max_video_duration", &cur.MaxVideoDuration, s.MaxVideoDuration)
+		setInt("max_batch_items", &cur.MaxBatchItems, s.MaxBatchItems)
+		setInt("result_cache_max_mb", &cur.ResultCacheMaxMB, s.ResultCacheMaxMB)
+		setDuration("file_retention", &cur.FileRetention, s.FileRetention)
+		setDuration("async_job_timeout", &cur.AsyncJobTimeout, s.AsyncJobTimeout)
+		setDuration("shutdown_grace", &cur.ShutdownGrace, s.ShutdownGrace)
+		setDuration("reconnect_grace", &cur.ReconnectGrace, s.ReconnectGrace)
+
+		if !reflect.DeepEqual(cur.CompressionPresets, s.CompressionPresets) {
+			cur.CompressionPresets = copySettings(s).CompressionPresets
+			changed = append(changed, "compression_presets")
+		}
+		if !maps.Equal(cur.BitrateThresholds, s.BitrateThresholds) {
+			cur.BitrateThresholds = maps.Clone(s.BitrateThresholds)
+			changed = append(changed, "bitrate_thresholds")
+		}
+	})
+	return changed
+}
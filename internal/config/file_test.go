@@ -0,0 +1,245 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "yoink.toml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseTOML(t *testing.T) {
+	entries, err := parseTOML([]byte(`
+# comment
+[limits]
+max_queue_size = 1_000 # trailing comment
+[compression_presets.fast]
+x264_params = "aq-mode=1 # not a comment"
+denoise = 'none'
+crf.high = 18
+[scheduler_weights]
+"web" = 2.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tomlEntry{
+		{table: "limits", key: "max_queue_size", value: int64(1000)},
+		{table: "compression_presets.fast", key: "x264_params", value: "aq-mode=1 # not a comment"},
+		{table: "compression_presets.fast", key: "denoise", value: "none"},
+		{table: "compression_presets.fast.crf", key: "high", value: int64(18)},
+		{table: "scheduler_weights", key: "web", value: 2.5},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"bad header", "[limits\n", "line 2: expected '.' or ']' to end table name"},
+		{"no equals", "[limits]\n\nmax_queue_size\n", "line 3"},
+		{"missing value", "a =\n", "line 1 (last key \"a\"): expected value"},
+		{"unterminated string", "a = \"oops\n", "line 1 (last key \"a\"): strings cannot contain newlines"},
+		{"bad value", "a = twelve\n", `line 1 (last key "a"): expected value but found "twelve"`},
+		{"bad key", "a b = 1\n", "line 1"},
+		{"duplicate key", "[limits]\nmax_queue_size = 1\n\nmax_queue_size = 2\n", "line 4 (last key \"limits.max_queue_size\")"},
+		{"duplicate table", "[limits]\nmax_queue_size = 1\n[timeouts]\nfile_retention = 1\n[limits]\nmax_queue_size = 2\n", "line 5: Key 'limits' has already been defined"},
+	}
+	for _, tt := range tests {
+		_, err := parseTOML([]byte(tt.text))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestReadSettings(t *testing.T) {
+	s, err := ReadSettings(writeConfig(t, `
+[limits]
+max_queue_size = 10
+max_video_duration = "2h"
+
+[timeouts]
+file_retention = "5m"
+reconnect_grace = 30
+
+[job_limits]
+compress = 3
+
+[bitrate_thresholds]
+720 = 1200
+
+[compression_presets.fast.crf]
+high = 18
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MaxQueueSize != 10 || s.MaxVideoDuration != 2*60*60 {
+		t.Errorf("limits = %d, %d", s.MaxQueueSize, s.MaxVideoDuration)
+	}
+	if s.FileRetention != 5*time.Minute || s.ReconnectGrace != 30*time.Second {
+		t.Errorf("timeouts = %s, %s", s.FileRetention, s.ReconnectGrace)
+	}
+	if s.JobLimits["compress"] != 3 || s.JobLimits["playlist"] != defaults.JobLimits["playlist"] {
+		t.Errorf("job limits = %v", s.JobLimits)
+	}
+	if s.BitrateThresholds[720] != 1200 || s.BitrateThresholds[1080] != defaults.BitrateThresholds[1080] {
+		t.Errorf("bitrate thresholds = %v", s.BitrateThresholds)
+	}
+	if crf := s.CompressionPresets["fast"].CRF; crf["high"] != 18 || crf["low"] != defaults.CompressionPresets["fast"].CRF["low"] {
+		t.Errorf("fast CRF = %v", crf)
+	}
+	if defaults.JobLimits["compress"] == 3 || defaults.CompressionPresets["fast"].CRF["high"] == 18 {
+		t.Error("reading a file changed the defaults")
+	}
+}
+
+func TestReadSettingsRejects(t *testing.T) {
+	tests := []struct {
+		name, text string
+		want       []string
+	}{
+		{"unknown key", "[limits]\nmax_queue = 1\n", []string{"limits.max_queue: unknown setting"}},
+		{"unknown table", "[limit]\nmax_queue_size = 1\n", []string{"limit.max_queue_size: unknown setting"}},
+		{"unknown job type", "[job_limits]\nupload = 1\n", []string{"job_limits.upload: unknown job type"}},
+		{"unknown preset", "[compression_presets.tiny]\ndenoise = \"none\"\n", []string{`unknown preset "tiny"`}},
+		{"unknown height", "[bitrate_thresholds]\n2160 = 9000\n", []string{"bitrate_thresholds.2160: unknown height"}},
+		{"wrong type", "[limits]\nmax_queue_size = \"lots\"\n", []string{"limits.max_queue_size: expected an integer"}},
+		{"array", "[limits]\nmax_queue_size = [1, 2]\n", []string{"limits.max_queue_size: expected an integer"}},
+		{"bad duration", "[timeouts]\nfile_retention = \"soon\"\n", []string{`timeouts.file_retention: invalid duration "soon"`}},
+		{"out of range", `
+[limits]
+rate_limit_max = 0
+max_queue_size = -1
+
+[timeouts]
+async_job_timeout = "0s"
+shutdown_grace = "-1s"
+
+[job_limits]
+compress = 0
+
+[scheduler_weights]
+bot = 0
+
+[compression_presets.fast]
+ffmpeg_preset = "warp"
+denoise = "lots"
+
+[compression_presets.fast.crf]
+low = 52
+`, []string{
+			"limits.rate_limit_max must be at least 1, got 0",
+			"limits.max_queue_size must be at least 0, got -1",
+			"timeouts.async_job_timeout must be positive, got 0s",
+			"timeouts.shutdown_grace can't be negative",
+			"job_limits.compress must be at least 1, got 0",
+			"scheduler_weights.bot must be positive",
+			`compression_presets.fast.ffmpeg_preset "warp" isn't an x264 preset`,
+			"compression_presets.fast.denoise must be one of",
+			"compression_presets.fast.crf.low must be between 0 and 51, got 52",
+		}},
+	}
+	for _, tt := range tests {
+		path := writeConfig(t, tt.text)
+		_, err := ReadSettings(path)
+		if err == nil {
+			t.Errorf("%s: accepted", tt.name)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+": ") {
+			t.Errorf("%s: error doesn't name the file: %v", tt.name, err)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q doesn't contain %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestRemovedKeyRestoresDefault(t *testing.T) {
+	prev := Current()
+	t.Cleanup(func() { Update(func(s *Settings) { *s = prev }) })
+
+	path := writeConfig(t, "[limits]\nmax_batch_items = 5\n\n[timeouts]\nfile_retention = \"1m\"\n")
+	s, err := ReadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTunables(s)
+	if Get().MaxBatchItems != 5 || Get().FileRetention != time.Minute {
+		t.Fatalf("file not applied: %d, %s", Get().MaxBatchItems, Get().FileRetention)
+	}
+
+	if err := os.WriteFile(path, []byte("[timeouts]\nfile_retention = \"1m\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err = ReadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := SetTunables(s)
+	if Get().MaxBatchItems != defaults.MaxBatchItems {
+		t.Errorf("max_batch_items = %d after removing it, want the default %d", Get().MaxBatchItems, defaults.MaxBatchItems)
+	}
+	if len(changed) != 1 || changed[0] != "max_batch_items" {
+		t.Errorf("changed = %v, want [max_batch_items]", changed)
+	}
+}
+
+func TestUpdateLeavesOldSnapshotAlone(t *testing.T) {
+	prev := Current()
+	t.Cleanup(func() { Update(func(s *Settings) { *s = prev }) })
+
+	before := Get()
+	limit := before.JobLimits["compress"]
+	Update(func(s *Settings) { s.JobLimits["compress"] = limit + 1 })
+	if before.JobLimits["compress"] != limit {
+		t.Error("Update changed a snapshot a reader was holding")
+	}
+	if Get().JobLimits["compress"] != limit+1 {
+		t.Error("Update wasn't applied")
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	t.Cleanup(func() {
+		muOverrides.Lock()
+		jobLimitOverrides, rateLimitOverride = map[string]int{}, 0
+		muOverrides.Unlock()
+	})
+	OverrideJobLimit("compress", 5)
+	OverrideJobLimit("convert", 0)
+	OverrideRateLimitMax(200)
+
+	s := Settings{JobLimits: map[string]int{"compress": 1, "convert": 2, "playlist": 3}, RateLimitMax: 60}
+	kept := ApplyOverrides(&s)
+	if s.JobLimits["compress"] != 5 || s.JobLimits["playlist"] != 3 || s.RateLimitMax != 200 {
+		t.Errorf("settings after overrides = %+v", s)
+	}
+	if _, limited := s.JobLimits["convert"]; limited {
+		t.Error("convert was overridden to unlimited but kept a limit")
+	}
+	if got := strings.Join(kept, ","); got != "job_limits.compress,job_limits.convert,rate_limit_max" {
+		t.Errorf("kept = %s", got)
+	}
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// tomlEntry is one setting from the config file, with the table it was
+// set under.
+type tomlEntry struct {
+	table string
+	key   string
+	value interface{}
+}
+
+func (e tomlEntry) name() string {
+	if e.table == "" {
+		return e.key
+	}
+	return e.table + "." + e.key
+}
+
+func (e tomlEntry) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", e.name(), fmt.Sprintf(format, args...))
+}
+
+func (e tomlEntry) asInt() (int, error) {
+	n, ok := e.value.(int64)
+	if !ok {
+		return 0, e.errorf("expected an integer")
+	}
+	return int(n), nil
+}
+
+func (e tomlEntry) asFloat() (float64, error) {
+	switch v := e.value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, e.errorf("expected a number")
+}
+
+func (e tomlEntry) asString() (string, error) {
+	s, ok := e.value.(string)
+	if !ok {
+		return "", e.errorf("expected a string")
+	}
+	return s, nil
+}
+
+// asDuration accepts a Go duration string like "20m" or a number of seconds.
+func (e tomlEntry) asDuration() (time.Duration, error) {
+	switch v := e.value.(type) {
+	case int64:
+		return time.Duration(v) * time.Second, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, e.errorf("invalid duration %q", v)
+		}
+		return d, nil
+	}
+	return 0, e.errorf("expected a duration like \"20m\" or a number of seconds")
+}
+
+// parseTOML reads a config file into its settings, in the order they
+// appear. Tables only group settings, so they aren't entries themselves.
+func parseTOML(data []byte) ([]tomlEntry, error) {
+	var doc map[string]interface{}
+	md, err := toml.Decode(string(data), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tomlEntry
+	for _, key := range md.Keys() {
+		if md.Type(key...) == "Hash" {
+			continue
+		}
+		table := doc
+		for _, name := range key[:len(key)-1] {
+			table, _ = table[name].(map[string]interface{})
+		}
+		entries = append(entries, tomlEntry{
+			table: strings.Join(key[:len(key)-1], "."),
+			key:   key[len(key)-1],
+			value: table[key[len(key)-1]],
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,80 @@
+// Package metrics exposes yoink's counters and histograms at /metrics in
+// the Prometheus text format.
+package metrics
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+var (
+	JobsStarted = NewCounter("yoink_jobs_started_total",
+		"Jobs that got a slot, by job type.", "type")
+	JobsFinished = NewCounter("yoink_jobs_finished_total",
+		"Jobs that gave their slot back, whether they succeeded or not.", "type")
+	JobsFailed = NewCounter("yoink_jobs_failed_total",
+		"Jobs that failed, by job type.", "type")
+	JobDuration = NewHistogram("yoink_job_duration_seconds",
+		"Time a job held its slot.", durationBuckets, "type")
+
+	DownloadsStarted = NewCounter("yoink_downloads_started_total",
+		"Media downloads started, by source site.", "site")
+	DownloadsFinished = NewCounter("yoink_downloads_finished_total",
+		"Media downloads finished, by source site and result (ok, error or cancelled).", "site", "result")
+	StageDuration = NewHistogram("yoink_stage_duration_seconds",
+		"Time spent downloading from the source, encoding, and sending the file.", durationBuckets, "stage", "site")
+
+	CobaltFallbacks = NewCounter("yoink_cobalt_fallbacks_total",
+		"Downloads that fell back to Cobalt, by source site and whether Cobalt succeeded.", "site", "result")
+	CookieRefreshes = NewCounter("yoink_cookie_refreshes_total",
+		"Cookie refresh script runs, by result (ok, failed or missing).", "result")
+	RateLimitRejections = NewCounter("yoink_rate_limit_rejections_total",
+		"Requests rejected by the rate limiter, per client IP or API key.")
+	CounterLeaks = NewCounter("yoink_counter_leaks_total",
+		"Job slots found leaked and given back by counter reconciliation, by job type.", "type")
+)
+
+// Result maps an error to the result label used by the counters above.
+func Result(err error, cancelled bool) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case cancelled:
+		return "cancelled"
+	}
+	return "error"
+}
+
+// Site buckets a source URL into the sites with their own fast paths.
+func Site(rawURL string) string {
+	if rawURL == "" {
+		return "none"
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "generic"
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	is := func(domain string) bool {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+	switch {
+	case is("youtube.com") || is("youtu.be"):
+		return "youtube"
+	case is("tiktok.com"):
+		return "tiktok"
+	case is("twitter.com") || is("x.com"):
+		return "twitter"
+	case is("instagram.com"):
+		return "instagram"
+	}
+	return "generic"
+}
+
+// ObserveStage records how long a stage took, starting at start.
+func ObserveStage(stage, site string, start time.Time) {
+	StageDuration.Observe(time.Since(start).Seconds(), stage, site)
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests, by path.", "path")
+	c.Inc("/b")
+	c.Add(2.5, "/a")
+	c.Inc(`C:\tmp "quoted"` + "\nnext")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP test_requests_total Requests, by path.
+# TYPE test_requests_total counter
+test_requests_total{path="/a"} 2.5
+test_requests_total{path="/b"} 1
+test_requests_total{path="C:\\tmp \"quoted\"\nnext"} 1
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCounterWithoutLabels(t *testing.T) {
+	c := NewCounter("test_rejections_total", "Rejected requests.")
+	c.Inc()
+	c.Inc()
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	if !strings.HasSuffix(buf.String(), "\ntest_rejections_total 2\n") {
+		t.Errorf("got:\n%s", buf.String())
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Time taken.", []float64{1, 5}, "stage")
+	for _, v := range []float64{0.5, 1, 3, 10} {
+		h.Observe(v, "send")
+	}
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP test_duration_seconds Time taken.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{stage="send",le="1"} 2
+test_duration_seconds_bucket{stage="send",le="5"} 3
+test_duration_seconds_bucket{stage="send",le="+Inf"} 4
+test_duration_seconds_sum{stage="send"} 14.5
+test_duration_seconds_count{stage="send"} 4
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	c := NewCounter("test_labelled_total", "Labelled.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with too few label values didn't panic")
+		}
+	}()
+	c.Inc("only-one")
+}
+
+func TestHandler(t *testing.T) {
+	NewGaugeFunc("test_queue_depth", "Jobs waiting.", func() float64 { return 3 })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE test_queue_depth gauge\ntest_queue_depth 3\n",
+		"# TYPE yoink_jobs_failed_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape doesn't contain %q", want)
+		}
+	}
+}
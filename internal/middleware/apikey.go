@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coah80/yoink/internal/services"
+)
+
+// APIKeys authenticates requests that carry an X-API-Key header and
+// counts what they use against the key. Requests without one are left to
+// the per-IP limits.
+func APIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := r.Header.Get("X-API-Key")
+		if raw == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := services.Global.AuthenticateAPIKey(raw)
+		if key == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid API key"})
+			return
+		}
+
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(services.WithAPIKey(r.Context(), key)))
+		services.Global.RecordAPIKeyRequest(key.ID, cw.n)
+	})
+}
+
+// countingWriter counts the body bytes written through it. It passes
+// flushes through so progress streams and downloads still work.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
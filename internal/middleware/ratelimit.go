@@ -3,29 +3,71 @@ package middleware
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
 
-var (
-	rateLimitStore = make(map[string][]time.Time)
-	rateLimitMu    sync.Mutex
-)
+var rateLimitMu sync.Mutex
+
+// PeerAddr keeps the connection's own address for TrustedClientIP. It has
+// to run before chi's RealIP, which replaces RemoteAddr with whatever the
+// request's headers claim.
+func PeerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(util.WithPeerAddr(r.Context(), r.RemoteAddr)))
+	})
+}
 
+// RateLimit charges each request its cost from the client's token bucket.
+// Buckets hold RateLimitMax tokens and refill at RateLimitMax per
+// RateLimitWindow, so clients can burst up to the limit and then keep a
+// steady pace.
 func RateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := util.GetClientIP(r)
-		allowed, remaining, resetIn := checkRateLimit(ip)
+		// Workers poll and report progress far more often than people
+		// do, and authenticate with WORKER_SECRET instead.
+		if strings.HasPrefix(r.URL.Path, "/api/worker/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := util.TrustedClientIP(r)
+		key := services.APIKeyFrom(r.Context())
+		cost := requestCost(r)
+		if cost == 0 || allowlisted(ip, key) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Requests with an API key are limited per key instead, at the
+		// key's own limit if it has one.
+		bucket, capacity := clientBucket(ip), float64(RateLimitMax())
+		if key != nil {
+			bucket = "key:" + key.ID
+			if key.RateLimit > 0 {
+				capacity = float64(key.RateLimit)
+			}
+		}
+		rate := capacity / config.RateLimitWindow.Seconds()
+		allowed, remaining, wait := bucketStore().Take(bucket, cost, capacity, rate, time.Now())
 
-		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", config.RateLimitMax))
-		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", int(capacity)))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", int(remaining)))
 
 		if !allowed {
+			resetIn := int(math.Ceil(wait.Seconds()))
+			metrics.RateLimitRejections.Inc()
 			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", resetIn))
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", resetIn))
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(429)
 			json.NewEncoder(w).Encode(map[string]interface{}{
@@ -39,60 +81,174 @@ func RateLimit(next http.Handler) http.Handler {
 	})
 }
 
-const maxRateLimitEntries = 100000
+// routeCosts says which RateLimitCosts entry a request is charged. The
+// first match wins; a path ending in "/" matches everything under it.
+var routeCosts = []struct {
+	method, path, cost string
+}{
+	{"POST", "/api/heartbeat/", "heartbeat"},
+	{"GET", "/api/progress/", "progress"},
+	{"POST", "/api/upload/chunk/", "upload"},
+	{"GET", "/api/metadata", "metadata"},
+	{"GET", "/api/gallery/metadata", "metadata"},
+	{"GET", "/api/gallery/status", "metadata"},
+	{"GET", "/api/download", "download"},
+	{"GET", "/api/gallery/download", "download"},
+	{"GET", "/api/gallery/slideshow", "download"},
+	{"POST", "/api/bot/download", "download"},
+	{"POST", "/api/fetch-url", "download"},
+	{"POST", "/api/playlist/start", "playlist"},
+	{"POST", "/api/bot/download-playlist", "playlist"},
+	{"POST", "/api/batch/start", "playlist"},
+	{"POST", "/api/convert", "convert"},
+	{"POST", "/api/convert-chunked", "convert"},
+	{"POST", "/api/bot/convert", "convert"},
+	{"POST", "/api/compress", "compress"},
+	{"POST", "/api/compress-chunked", "compress"},
+	{"POST", "/api/bot/compress", "compress"},
+	{"POST", "/api/transcribe", "transcribe"},
+	{"POST", "/api/transcribe-chunked", "transcribe"},
+	{"POST", "/api/v2/jobs", "jobs"},
+}
+
+func requestCost(r *http.Request) float64 {
+	name := "default"
+	for _, route := range routeCosts {
+		if r.Method != route.method {
+			continue
+		}
+		if r.URL.Path == route.path || (strings.HasSuffix(route.path, "/") && strings.HasPrefix(r.URL.Path, route.path)) {
+			name = route.cost
+			break
+		}
+	}
+	if cost, ok := config.RateLimitCosts[name]; ok {
+		return cost
+	}
+	return config.RateLimitCosts["default"]
+}
+
+// clientBucket is the bucket an IP is limited under. IPv6 clients are
+// usually handed a whole /64, so addresses in one share a bucket.
+func clientBucket(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// allowlisted reports whether a request skips rate limiting. ip has to
+// come from TrustedClientIP so that a listed address can't be claimed
+// in a header.
+func allowlisted(ip string, key *services.APIKey) bool {
+	if key != nil && config.Contains(config.RateLimitAllowKeys, key.ID) {
+		return true
+	}
+	return util.IsTrustedIP(ip)
+}
+
+// BucketStore keeps the token buckets. The memory store is per process;
+// a shared one lets replicas enforce a single limit together.
+type BucketStore interface {
+	// Take spends cost tokens from key's bucket if it has them, after
+	// refilling it at rate tokens a second up to capacity. When it can't,
+	// wait is how long until it could.
+	Take(key string, cost, capacity, rate float64, now time.Time) (ok bool, remaining float64, wait time.Duration)
+	// Prune forgets buckets that have refilled, since a new one starts
+	// full anyway.
+	Prune(now time.Time)
+}
+
+var buckets BucketStore = newMemoryBuckets()
 
-func checkRateLimit(ip string) (allowed bool, remaining int, resetIn int) {
+func bucketStore() BucketStore {
 	rateLimitMu.Lock()
 	defer rateLimitMu.Unlock()
+	return buckets
+}
+
+// SetBucketStore swaps where token buckets are kept.
+func SetBucketStore(store BucketStore) {
+	rateLimitMu.Lock()
+	buckets = store
+	rateLimitMu.Unlock()
+}
+
+const maxRateLimitEntries = 100000
+
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64
+	updated  time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) float64 {
+	return math.Min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+}
 
-	now := time.Now()
-	windowStart := now.Add(-config.RateLimitWindow)
+type memoryBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newMemoryBuckets() *memoryBuckets {
+	return &memoryBuckets{buckets: make(map[string]*tokenBucket)}
+}
 
-	requests := rateLimitStore[ip]
-	filtered := requests[:0]
-	for _, t := range requests {
-		if t.After(windowStart) {
-			filtered = append(filtered, t)
+func (m *memoryBuckets) Take(key string, cost, capacity, rate float64, now time.Time) (bool, float64, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[key]
+	if b == nil {
+		if len(m.buckets) >= maxRateLimitEntries {
+			return false, 0, time.Minute
 		}
+		b = &tokenBucket{tokens: capacity, updated: now}
+		m.buckets[key] = b
 	}
+	b.capacity, b.rate = capacity, rate
+	b.tokens = b.refill(now)
+	b.updated = now
 
-	if len(filtered) >= config.RateLimitMax {
-		resetSec := int(filtered[0].Add(config.RateLimitWindow).Sub(now).Seconds()) + 1
-		rateLimitStore[ip] = filtered
-		return false, 0, resetSec
+	// A full bucket always pays for one request, however costly.
+	cost = math.Min(cost, capacity)
+	if b.tokens < cost {
+		return false, b.tokens, time.Duration((cost - b.tokens) / rate * float64(time.Second))
 	}
+	b.tokens -= cost
+	return true, b.tokens, 0
+}
 
-	if len(rateLimitStore) >= maxRateLimitEntries {
-		rateLimitStore[ip] = filtered
-		return false, 0, 60
+func (m *memoryBuckets) Prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, b := range m.buckets {
+		if b.refill(now) >= b.capacity {
+			delete(m.buckets, key)
+		}
 	}
+}
 
-	filtered = append(filtered, now)
-	rateLimitStore[ip] = filtered
-	return true, config.RateLimitMax - len(filtered), 0
+// RateLimitMax returns the current per-client token limit.
+func RateLimitMax() int {
+	return config.Get().RateLimitMax
+}
+
+// SetRateLimitMax changes the per-client token limit. Buckets pick up the
+// new size the next time they're used.
+func SetRateLimitMax(limit int) {
+	prev := RateLimitMax()
+	config.Update(func(c *config.Settings) { c.RateLimitMax = limit })
+	log.Printf("[RateLimit] Limit changed from %d to %d per %s", prev, limit, config.RateLimitWindow)
 }
 
 func StartRateLimitCleanup() {
 	go func() {
 		ticker := time.NewTicker(60 * time.Second)
 		for range ticker.C {
-			rateLimitMu.Lock()
-			now := time.Now()
-			windowStart := now.Add(-config.RateLimitWindow)
-			for ip, requests := range rateLimitStore {
-				filtered := requests[:0]
-				for _, t := range requests {
-					if t.After(windowStart) {
-						filtered = append(filtered, t)
-					}
-				}
-				if len(filtered) == 0 {
-					delete(rateLimitStore, ip)
-				} else {
-					rateLimitStore[ip] = filtered
-				}
-			}
-			rateLimitMu.Unlock()
+			bucketStore().Prune(time.Now())
 		}
 	}()
 }
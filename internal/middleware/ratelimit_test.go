@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/services"
+)
+
+func TestRequestCost(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         float64
+	}{
+		{"POST", "/api/heartbeat/abc", 0},
+		{"GET", "/api/progress/abc", 0},
+		{"GET", "/api/metadata", 1},
+		{"GET", "/api/download", 5},
+		{"POST", "/api/compress", 20},
+		{"POST", "/api/v2/jobs", 10},
+		{"GET", "/api/v2/jobs", 1},
+		{"GET", "/api/download/extra", 1},
+	}
+	for _, tt := range tests {
+		if got := requestCost(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s costs %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	b := newMemoryBuckets()
+	now := time.Now()
+	if ok, _, _ := b.Take("a", 10, 10, 1, now); !ok {
+		t.Fatal("full bucket refused")
+	}
+	ok, _, wait := b.Take("a", 5, 10, 1, now)
+	if ok || wait != 5*time.Second {
+		t.Fatalf("empty bucket: ok=%v wait=%s, want refusal for 5s", ok, wait)
+	}
+	if ok, remaining, _ := b.Take("a", 5, 10, 1, now.Add(6*time.Second)); !ok || remaining != 1 {
+		t.Errorf("after refilling: ok=%v remaining=%v, want 1 left", ok, remaining)
+	}
+	// A request dearer than the whole bucket still goes through when full.
+	if ok, _, _ := b.Take("b", 50, 10, 1, now); !ok {
+		t.Error("costly request refused from a full bucket")
+	}
+
+	b.Prune(now.Add(time.Hour))
+	if len(b.buckets) != 0 {
+		t.Errorf("%d refilled buckets kept after Prune", len(b.buckets))
+	}
+}
+
+func TestClientBucketGroupsIPv6(t *testing.T) {
+	a, b := clientBucket("2001:db8:1:2:aaaa::1"), clientBucket("2001:db8:1:2:bbbb::2")
+	if a != b || a != "2001:db8:1:2::/64" {
+		t.Errorf("same /64 got buckets %q and %q", a, b)
+	}
+	if clientBucket("2001:db8:1:3::1") == a {
+		t.Error("different /64 shares a bucket")
+	}
+	if got := clientBucket("203.0.113.7"); got != "203.0.113.7" {
+		t.Errorf("IPv4 bucket = %q", got)
+	}
+}
+
+// limitTo sets up a fresh limiter allowing limit tokens, with allow as
+// RATE_LIMIT_ALLOWLIST.
+func limitTo(t *testing.T, limit int, allowIPs []string, allowKeys []string) http.Handler {
+	t.Helper()
+	prevMax, prevIPs, prevKeys := RateLimitMax(), config.RateLimitAllowIPs, config.RateLimitAllowKeys
+	prevStore := bucketStore()
+	t.Cleanup(func() {
+		config.Update(func(s *config.Settings) { s.RateLimitMax = prevMax })
+		config.RateLimitAllowIPs, config.RateLimitAllowKeys = prevIPs, prevKeys
+		SetBucketStore(prevStore)
+	})
+	config.Update(func(s *config.Settings) { s.RateLimitMax = limit })
+	config.RateLimitAllowIPs, config.RateLimitAllowKeys = nil, allowKeys
+	for _, cidr := range allowIPs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.RateLimitAllowIPs = append(config.RateLimitAllowIPs, ipNet)
+	}
+	SetBucketStore(newMemoryBuckets())
+	return RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+func send(h http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAllowlistedKey(t *testing.T) {
+	h := limitTo(t, 1, nil, []string{"trusted"})
+	for i := 0; i < 5; i++ {
+		r := httptest.NewRequest("GET", "/api/metadata", nil)
+		r = r.WithContext(services.WithAPIKey(r.Context(), &services.APIKey{ID: "trusted"}))
+		if code := send(h, r); code != 200 {
+			t.Fatalf("allowlisted key got %d on request %d", code, i+1)
+		}
+	}
+	r := httptest.NewRequest("GET", "/api/metadata", nil)
+	r = r.WithContext(services.WithAPIKey(r.Context(), &services.APIKey{ID: "other"}))
+	send(h, r)
+	if code := send(h, r); code != 429 {
+		t.Errorf("other key got %d over its limit, want 429", code)
+	}
+}
+
+func TestAllowlistIgnoresSpoofedHeaders(t *testing.T) {
+	h := limitTo(t, 1, []string{"10.0.0.0/8"}, nil)
+	spoofed := func() *http.Request {
+		r := httptest.NewRequest("GET", "/api/metadata", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		r.Header.Set("X-Forwarded-For", "10.0.0.5")
+		r.Header.Set("X-Real-IP", "10.0.0.5")
+		r.Header.Set("CF-Connecting-IP", "10.0.0.5")
+		return r
+	}
+	send(h, spoofed())
+	if code := send(h, spoofed()); code != 429 {
+		t.Errorf("client claiming an allowlisted address got %d, want 429", code)
+	}
+
+	// The same headers from a listed proxy name the client to limit.
+	proxied := func(client string) *http.Request {
+		r := httptest.NewRequest("GET", "/api/metadata", nil)
+		r.RemoteAddr = "10.0.0.2:4000"
+		r.Header.Set("X-Forwarded-For", client)
+		return r
+	}
+	send(h, proxied("198.51.100.1"))
+	if code := send(h, proxied("198.51.100.1")); code != 429 {
+		t.Errorf("client behind a trusted proxy got %d over its limit, want 429", code)
+	}
+	if code := send(h, proxied("198.51.100.2")); code != 200 {
+		t.Errorf("another client behind the same proxy got %d", code)
+	}
+	direct := httptest.NewRequest("GET", "/api/metadata", nil)
+	direct.RemoteAddr = "10.0.0.3:4000"
+	for i := 0; i < 3; i++ {
+		if code := send(h, direct); code != 200 {
+			t.Fatalf("allowlisted host got %d", code)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/middleware"
+	"github.com/coah80/yoink/internal/services"
+)
+
+func AdminRoutes(r chi.Router) {
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(requireAdmin)
+		r.Get("/processes", handleAdminProcesses)
+		r.Get("/jobs", handleAdminJobs)
+		r.Get("/sessions", handleAdminSessions)
+		r.Get("/uploads", handleAdminUploads)
+		r.Post("/jobs/{jobId}/cancel", handleAdminCancel)
+		r.Post("/jobs/{jobId}/release", handleAdminRelease)
+		r.Delete("/clients/{clientId}", handleAdminPurgeClient)
+		r.Delete("/tokens/{token}", handleAdminRevokeToken)
+		r.Get("/keys", handleAdminKeys)
+		r.Post("/keys", handleAdminCreateKey)
+		r.Delete("/keys/{keyId}", handleAdminRevokeKey)
+		r.Get("/limits", handleAdminLimits)
+		r.Patch("/limits", handleAdminSetLimits)
+	})
+}
+
+// requireAdmin only lets requests carrying ADMIN_SECRET as a bearer token
+// through. With no secret configured the admin API is off.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminSecret == "" {
+			respondJSON(w, 404, map[string]string{"error": "Not found"})
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		expected := "Bearer " + config.AdminSecret
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(expected)) != 1 {
+			respondJSON(w, 401, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleAdminProcesses(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{
+		"processes": services.Global.ListProcesses(),
+		"queued":    services.Global.ListQueuedJobs(),
+		"active":    services.Global.GetJobsByType(),
+		"workers":   services.Workers.Status(),
+	})
+}
+
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{"jobs": services.Global.ListAsyncJobs()})
+}
+
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{"sessions": services.Global.ListSessions()})
+}
+
+func handleAdminUploads(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{"uploads": services.Global.ListChunkedUploads()})
+}
+
+// adminCancel cancels a job whoever owns it, including async jobs that
+// have no process or queue entry left to stop.
+func adminCancel(jobID string) bool {
+	cancelled := cancelJob(jobID)
+	if services.Global.MarkAsyncJobCancelled(jobID, "Cancelled by an admin") {
+		cancelled = true
+	}
+	return cancelled
+}
+
+func handleAdminCancel(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	if !adminCancel(jobID) {
+		respondJSON(w, 404, map[string]string{"error": "Job not found or already finished"})
+		return
+	}
+	log.Printf("[Admin] Cancelled job %s", jobID)
+	respondJSON(w, 200, map[string]string{"jobId": jobID, "status": "cancelled"})
+}
+
+// handleAdminRelease gives a job's slot back without stopping it, for jobs
+// whose process is stuck or already gone.
+func handleAdminRelease(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	if !services.Global.ReleaseJob(jobID) {
+		respondJSON(w, 404, map[string]string{"error": "Job is not holding a slot"})
+		return
+	}
+	log.Printf("[Admin] Released job %s", jobID)
+	respondJSON(w, 200, map[string]string{"jobId": jobID, "status": "released"})
+}
+
+func handleAdminPurgeClient(w http.ResponseWriter, r *http.Request) {
+	clientID := chi.URLParam(r, "clientId")
+	jobIDs, found := services.Global.PurgeClient(clientID)
+	if !found {
+		respondJSON(w, 404, map[string]string{"error": "Client not found"})
+		return
+	}
+	cancelled := []string{}
+	for _, jobID := range jobIDs {
+		if adminCancel(jobID) {
+			cancelled = append(cancelled, jobID)
+		}
+	}
+	log.Printf("[Admin] Purged client %s, cancelled %d jobs", clientID, len(cancelled))
+	respondJSON(w, 200, map[string]interface{}{"clientId": clientID, "cancelled": cancelled})
+}
+
+// handleAdminRevokeToken stops a download token from working before it
+// expires. Signed tokens go on the denylist, so copies of them are refused
+// on every replica, and the file is removed if this server has it.
+func handleAdminRevokeToken(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	claims, err := services.Tokens.Verify(token)
+	if err == nil {
+		services.Global.RevokeSignedToken(claims)
+	}
+	data := services.Global.GetBotDownload(token)
+	if data != nil {
+		services.Global.DeleteBotDownload(token)
+		services.DeleteOutput(data)
+	}
+	if err != nil && data == nil {
+		respondJSON(w, 404, map[string]string{"error": "Download not found or expired"})
+		return
+	}
+	log.Printf("[Admin] Revoked download token %s...", token[:min(8, len(token))])
+	respondJSON(w, 200, map[string]string{"status": "revoked"})
+}
+
+func handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{"keys": services.Global.ListAPIKeys()})
+}
+
+type adminKeyRequest struct {
+	Name       string   `json:"name"`
+	RateLimit  int      `json:"rateLimit"`
+	DailyBytes int64    `json:"dailyBytes"`
+	DailyJobs  int      `json:"dailyJobs"`
+	JobTypes   []string `json:"jobTypes"`
+}
+
+// handleAdminCreateKey makes an API key. The key itself is only ever in
+// this response.
+func handleAdminCreateKey(w http.ResponseWriter, r *http.Request) {
+	var body adminKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if body.Name == "" {
+		respondJSON(w, 400, map[string]string{"error": "name is required"})
+		return
+	}
+	if body.RateLimit < 0 || body.DailyBytes < 0 || body.DailyJobs < 0 {
+		respondJSON(w, 400, map[string]string{"error": "Limits can't be negative"})
+		return
+	}
+	for _, t := range body.JobTypes {
+		if !contains(jobTypes, t) {
+			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid job type %q. Allowed: %s", t, strings.Join(jobTypes, ", "))})
+			return
+		}
+	}
+
+	key, raw := services.Global.CreateAPIKey(services.APIKey{
+		Name:       body.Name,
+		RateLimit:  body.RateLimit,
+		DailyBytes: body.DailyBytes,
+		DailyJobs:  body.DailyJobs,
+		JobTypes:   body.JobTypes,
+	})
+	log.Printf("[Admin] Created API key %s (%s)", key.ID, key.Name)
+	info := key.Info(services.APIKeyUsage{})
+	info["key"] = raw
+	respondJSON(w, 201, info)
+}
+
+func handleAdminRevokeKey(w http.ResponseWriter, r *http.Request) {
+	keyID := chi.URLParam(r, "keyId")
+	if !services.Global.RevokeAPIKey(keyID) {
+		respondJSON(w, 404, map[string]string{"error": "API key not found"})
+		return
+	}
+	log.Printf("[Admin] Revoked API key %s", keyID)
+	respondJSON(w, 200, map[string]string{"id": keyID, "status": "revoked"})
+}
+
+func handleAdminLimits(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, 200, map[string]interface{}{
+		"jobLimits":      services.Global.JobLimits(),
+		"rateLimitMax":   middleware.RateLimitMax(),
+		"rateLimitCosts": config.RateLimitCosts,
+	})
+}
+
+type adminLimitsRequest struct {
+	JobLimits    map[string]*int `json:"jobLimits"`
+	RateLimitMax *int            `json:"rateLimitMax"`
+}
+
+// handleAdminSetLimits changes job and rate limits in place. Only the
+// fields sent are touched, and nothing is changed unless all of them are
+// valid. A job limit of 0 or null makes the type unlimited. Limits set
+// here are kept when the config file is reloaded.
+func handleAdminSetLimits(w http.ResponseWriter, r *http.Request) {
+	var body adminLimitsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	active := services.Global.GetJobsByType()
+	for jobType, limit := range body.JobLimits {
+		if _, known := active[jobType]; !known {
+			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Unknown job type: %s", jobType)})
+			return
+		}
+		if limit != nil && *limit < 0 {
+			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Limit for %s can't be negative", jobType)})
+			return
+		}
+	}
+	if body.RateLimitMax != nil && *body.RateLimitMax < 1 {
+		respondJSON(w, 400, map[string]string{"error": "rateLimitMax must be at least 1"})
+		return
+	}
+
+	for jobType, limit := range body.JobLimits {
+		n := 0
+		if limit != nil {
+			n = *limit
+		}
+		config.OverrideJobLimit(jobType, n)
+		services.Global.SetJobLimit(jobType, n)
+	}
+	if body.RateLimitMax != nil {
+		config.OverrideRateLimitMax(*body.RateLimitMax)
+		middleware.SetRateLimitMax(*body.RateLimitMax)
+	}
+	handleAdminLimits(w, r)
+}
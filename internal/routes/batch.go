@@ -0,0 +1,343 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/coah80/yoink/internal/alerts"
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
+	"github.com/coah80/yoink/internal/util"
+)
+
+func BatchRoutes(r chi.Router) {
+	r.Post("/api/batch/start", handleBatchStart)
+	r.Get("/api/batch/status/{jobId}", handlePlaylistStatus)
+}
+
+type batchRequest struct {
+	Items       []downloadRequest `json:"items"`
+	Filename    string            `json:"filename"`
+	ClientID    string            `json:"clientId"`
+	CallbackURL string            `json:"callbackUrl"`
+}
+
+func handleBatchStart(w http.ResponseWriter, r *http.Request) {
+	var body batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
+
+	if !allowKeyJob(w, r, "batch") {
+		return
+	}
+
+	if jobID, queued, ok := startBatchJob(w, r, body); ok {
+		services.Global.WatchJob(jobID, body.CallbackURL)
+		respondJSON(w, 200, map[string]interface{}{"jobId": jobID, "queued": queued})
+	}
+}
+
+// startBatchJob validates every item up front and starts the batch in the
+// background. On failure it has already written the error response.
+func startBatchJob(w http.ResponseWriter, r *http.Request, body batchRequest) (string, bool, bool) {
+	if len(body.Items) == 0 {
+		respondJSON(w, 400, map[string]string{"error": "At least one item is required"})
+		return "", false, false
+	}
+	if len(body.Items) > config.Get().MaxBatchItems {
+		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Too many items. Maximum %d per batch.", config.Get().MaxBatchItems)})
+		return "", false, false
+	}
+	for i, item := range body.Items {
+		if check := util.ValidateURL(item.URL); !check.Valid {
+			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Item %d: %s", i+1, check.Error)})
+			return "", false, false
+		}
+		if item.Playlist {
+			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Item %d: playlists aren't supported in a batch, use /api/playlist/start", i+1)})
+			return "", false, false
+		}
+		body.Items[i].NoCache = authenticatedRequest(r)
+	}
+
+	jobID := uuid.New().String()
+	clientID := effectiveClientID(r, body.ClientID)
+	if !services.Global.TryReserveClientJob(jobID, clientID, config.Get().MaxJobsPerClient) {
+		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.Get().MaxJobsPerClient)})
+		return "", false, false
+	}
+	ticket, jobCheck := services.Global.EnqueueJob(jobRequest("batch", jobID, clientID))
+	if !jobCheck.OK {
+		services.Global.UnlinkJobFromClient(jobID)
+		respondJSON(w, 503, map[string]string{"error": jobCheck.Reason})
+		return "", false, false
+	}
+
+	job := &services.AsyncJob{
+		Status:      "starting",
+		Message:     fmt.Sprintf("starting %d downloads...", len(body.Items)),
+		CreatedAt:   time.Now(),
+		Type:        "batch",
+		TotalVideos: len(body.Items),
+		StartVideo:  1,
+	}
+	if ticket.Queued() {
+		job.Status = "queued"
+		job.Message = "waiting in queue..."
+	}
+	services.Global.SetAsyncJob(jobID, job)
+
+	go processBatchJob(jobID, job, ticket, body)
+	return jobID, ticket.Queued(), true
+}
+
+// processBatchJob downloads each item through fetchMedia, so every site
+// keeps its fast path, and zips whatever succeeded. Failed items are
+// recorded in FailedVideos the same way playlist entries are.
+func processBatchJob(jobID string, job *services.AsyncJob, ticket *services.JobTicket, body batchRequest) {
+	if check := ticket.Wait(context.Background()); !check.OK {
+		job.Lock()
+		job.Status = "cancelled"
+		job.Message = check.Reason
+		job.Unlock()
+		services.Global.SendProgressSimple(jobID, "cancelled", check.Reason)
+		services.Global.UnlinkJobFromClient(jobID)
+		return
+	}
+
+	batchDir := filepath.Join(config.TempDirs["batch"], jobID)
+	os.MkdirAll(batchDir, 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processInfo := &services.ProcessInfo{
+		TempDir:    batchDir,
+		JobType:    "batch",
+		CancelFunc: cancel,
+	}
+	services.Global.SetProcess(jobID, processInfo)
+
+	total := len(body.Items)
+	log.Printf("[Batch] Job %s started with %d items", jobID, total)
+
+	job.Lock()
+	job.Status = "downloading"
+	job.Unlock()
+
+	var downloadedFiles []string
+	var failedVideos []services.FailedVideo
+	fail := func(num int, name, reason string) {
+		failedVideos = failBatchItem(job, failedVideos, num, name, reason)
+	}
+
+	for i, item := range body.Items {
+		if processInfo.IsCancelled() {
+			batchError(jobID, job, processInfo, batchDir, fmt.Errorf("Download cancelled"))
+			return
+		}
+		if processInfo.IsFinishEarly() {
+			log.Printf("[Batch] Job %s finishing early after %d items", jobID, len(downloadedFiles))
+			break
+		}
+
+		num := i + 1
+		name := batchItemName(item)
+		base := float64(i) / float64(total) * 100
+		job.Lock()
+		job.CurrentVideo = num
+		job.CurrentVideoTitle = name
+		job.Progress = base
+		job.Message = fmt.Sprintf("downloading %d/%d: %s", num, total, name)
+		job.Unlock()
+		services.Global.SendProgress(jobID, "downloading", fmt.Sprintf("Downloading %d/%d: %s", num, total, name),
+			&base, map[string]interface{}{
+				"totalVideos": total, "currentVideo": num, "currentVideoTitle": name,
+				"failedVideos": failedVideos, "failedCount": len(failedVideos),
+			})
+
+		report := func(stage, message string, progress *float64, extra map[string]interface{}) {
+			if progress == nil {
+				return
+			}
+			job.Lock()
+			job.Progress = base + *progress/float64(total)
+			if speed, ok := extra["speed"].(string); ok {
+				job.Speed = speed
+			}
+			if eta, ok := extra["eta"].(string); ok {
+				job.ETA = eta
+			}
+			job.Unlock()
+		}
+
+		itemID := fmt.Sprintf("%s-%03d", jobID, num)
+		result, err := fetchMedia(ctx, itemID, processInfo, item.mediaOpts(batchDir), report)
+		if err != nil {
+			if processInfo.IsCancelled() {
+				batchError(jobID, job, processInfo, batchDir, err)
+				return
+			}
+			log.Printf("[Batch] Job %s item %d failed: %s", jobID, num, err)
+			fail(num, name, util.ToUserError(err.Error()))
+			continue
+		}
+
+		itemFile := batchItemFile(batchDir, num, name, result.Ext)
+		if err := os.Rename(result.Path, itemFile); err != nil {
+			fail(num, name, "Download failed")
+			continue
+		}
+		downloadedFiles = append(downloadedFiles, itemFile)
+		job.Lock()
+		job.VideosCompleted = len(downloadedFiles)
+		job.Unlock()
+	}
+
+	if len(downloadedFiles) == 0 {
+		batchError(jobID, job, processInfo, batchDir, fmt.Errorf("No items were successfully downloaded"))
+		return
+	}
+
+	job.Lock()
+	job.Status = "zipping"
+	job.Progress = 95
+	job.Message = fmt.Sprintf("creating zip with %d files...", len(downloadedFiles))
+	job.Speed = ""
+	job.ETA = ""
+	job.Unlock()
+	services.Global.SendProgress(jobID, "zipping", fmt.Sprintf("Creating zip file with %d files...", len(downloadedFiles)),
+		ptrFloat(95), map[string]interface{}{"totalVideos": total, "downloadedCount": len(downloadedFiles)})
+
+	zipPath := filepath.Join(config.TempDirs["batch"], jobID+".zip")
+	if err := createZip(zipPath, downloadedFiles); err != nil {
+		batchError(jobID, job, processInfo, batchDir, fmt.Errorf("Failed to create zip: %v", err))
+		return
+	}
+	os.RemoveAll(batchDir)
+
+	stat, err := os.Stat(zipPath)
+	if err != nil {
+		batchError(jobID, job, processInfo, "", fmt.Errorf("zip file not found after creation"))
+		return
+	}
+	fileName := util.SanitizeFilename(orDefault(body.Filename, "yoink-batch")) + ".zip"
+
+	dl := &services.BotDownload{
+		FilePath:      zipPath,
+		FileName:      fileName,
+		FileSize:      stat.Size(),
+		MimeType:      "application/zip",
+		CreatedAt:     time.Now(),
+		IsWebPlaylist: true,
+	}
+	if err := services.SaveOutput(context.Background(), dl); err != nil {
+		os.Remove(zipPath)
+		batchError(jobID, job, processInfo, "", fmt.Errorf("Failed to store zip: %v", err))
+		return
+	}
+	token := issueDownloadToken(jobID, dl)
+
+	job.Lock()
+	job.Status = "complete"
+	job.Progress = 100
+	job.Message = fmt.Sprintf("%d files ready to download", len(downloadedFiles))
+	job.DownloadToken = token
+	job.FileName = fileName
+	job.FileSize = stat.Size()
+	job.Unlock()
+
+	services.Global.SendProgress(jobID, "complete", fmt.Sprintf("%d files ready!", len(downloadedFiles)),
+		ptrFloat(100), map[string]interface{}{
+			"totalVideos": total, "downloadedCount": len(downloadedFiles),
+			"failedVideos": failedVideos, "failedCount": len(failedVideos), "downloadToken": token,
+		})
+
+	services.Global.ReleaseJob(jobID)
+	log.Printf("[Batch] Job %s complete: %d ok, %d failed", jobID, len(downloadedFiles), len(failedVideos))
+}
+
+func batchError(jobID string, job *services.AsyncJob, processInfo *services.ProcessInfo, batchDir string, err error) {
+	cancelled := processInfo.IsCancelled()
+	userErr := util.ToUserError(err.Error())
+
+	job.Lock()
+	total := job.TotalVideos
+	if cancelled {
+		job.Status = "cancelled"
+		job.Message = "Cancelled"
+	} else {
+		job.Status = "error"
+		job.Message = userErr
+		job.Error = userErr
+	}
+	job.Unlock()
+
+	if !cancelled {
+		log.Printf("[Batch] Job %s failed: %s", jobID, err)
+		metrics.JobsFailed.Inc("batch")
+		alerts.BatchFailed(jobID, total, err)
+		services.Global.SendProgressSimple(jobID, "error", userErr)
+	}
+	services.Global.ReleaseJob(jobID)
+	os.RemoveAll(batchDir)
+}
+
+// batchItemName names an item's file in the zip, from its filename if
+// one was given and otherwise from the URL.
+func batchItemName(item downloadRequest) string {
+	name := item.Filename
+	if name == "" {
+		name = "download"
+		if u, err := url.Parse(item.URL); err == nil {
+			name = strings.TrimPrefix(u.Hostname(), "www.")
+			if seg := path.Base(u.Path); seg != "." && seg != "/" {
+				name += " " + seg
+			}
+		}
+	}
+	name = util.SanitizeFilename(name)
+	if len(name) > 100 {
+		cut := 100
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	return name
+}
+
+// batchItemFile is where item num is kept in the batch dir, numbered so
+// the zip lists items in the order they were asked for.
+func batchItemFile(batchDir string, num int, name, ext string) string {
+	return filepath.Join(batchDir, fmt.Sprintf("%03d - %s.%s", num, name, ext))
+}
+
+// failBatchItem adds an item that couldn't be downloaded to failed and
+// shows it on the job.
+func failBatchItem(job *services.AsyncJob, failed []services.FailedVideo, num int, name, reason string) []services.FailedVideo {
+	failed = append(failed, services.FailedVideo{Num: num, Title: name, Reason: reason})
+	job.Lock()
+	job.FailedVideos = failed
+	job.FailedCount = len(failed)
+	job.Unlock()
+	return failed
+}
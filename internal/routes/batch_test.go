@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/services"
+)
+
+// useSettings applies change to the settings in effect until t ends.
+func useSettings(t *testing.T, change func(s *config.Settings)) {
+	t.Helper()
+	prev := config.Current()
+	t.Cleanup(func() { config.Update(func(s *config.Settings) { *s = prev }) })
+	config.Update(change)
+}
+
+func TestStartBatchJobValidatesItems(t *testing.T) {
+	useSettings(t, func(s *config.Settings) { s.MaxBatchItems = 2 })
+	ok := downloadRequest{URL: "https://93.184.216.34/watch"}
+
+	tests := []struct {
+		name  string
+		items []downloadRequest
+		want  string
+	}{
+		{"no items", nil, "At least one item is required"},
+		{"too many", []downloadRequest{ok, ok, ok}, "Too many items. Maximum 2 per batch."},
+		{"bad url", []downloadRequest{ok, {URL: "http://192.168.1.1/video"}}, "Item 2: Private/local URLs are not allowed"},
+		{"no url", []downloadRequest{{}}, "Item 1: URL is required"},
+		{"playlist", []downloadRequest{{URL: ok.URL, Playlist: true}}, "Item 1: playlists aren't supported in a batch"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		_, _, started := startBatchJob(rec, httptest.NewRequest("POST", "/api/batch/start", nil), batchRequest{Items: tt.items})
+		if started || rec.Code != 400 {
+			t.Errorf("%s: started = %v, status = %d, want a 400", tt.name, started, rec.Code)
+			continue
+		}
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || !strings.Contains(body["error"], tt.want) {
+			t.Errorf("%s: body = %s, want %q", tt.name, rec.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestBatchItemName(t *testing.T) {
+	tests := []struct {
+		item downloadRequest
+		want string
+	}{
+		{downloadRequest{URL: "https://www.youtube.com/watch?v=abc", Filename: "my clip"}, "my clip"},
+		{downloadRequest{URL: "https://www.youtube.com/watch?v=abc"}, "youtube.com watch"},
+		{downloadRequest{URL: "https://vimeo.com/"}, "vimeo.com"},
+		{downloadRequest{URL: "https://x.com/user/status/123"}, "x.com 123"},
+		{downloadRequest{URL: "https://example.com/a", Filename: `what: "this"?`}, "what_ _this__"},
+	}
+	for _, tt := range tests {
+		if got := batchItemName(tt.item); got != tt.want {
+			t.Errorf("batchItemName(%+v) = %q, want %q", tt.item, got, tt.want)
+		}
+	}
+}
+
+func TestBatchItemNameKeepsRunesWhole(t *testing.T) {
+	name := batchItemName(downloadRequest{Filename: "a" + strings.Repeat("é", 60)})
+	if !utf8.ValidString(name) {
+		t.Fatalf("name was cut mid-rune: %q", name)
+	}
+	if len(name) != 99 {
+		t.Errorf("len(name) = %d, want 99, the longest whole-rune prefix under 100 bytes", len(name))
+	}
+}
+
+func TestBatchItemFile(t *testing.T) {
+	got := batchItemFile("batch", 7, "youtube.com watch", "mp4")
+	if want := filepath.Join("batch", "007 - youtube.com watch.mp4"); got != want {
+		t.Errorf("batchItemFile = %q, want %q", got, want)
+	}
+}
+
+func TestFailBatchItem(t *testing.T) {
+	job := &services.AsyncJob{}
+	var failed []services.FailedVideo
+	failed = failBatchItem(job, failed, 2, "first", "Video unavailable")
+	failed = failBatchItem(job, failed, 5, "second", "Download failed")
+
+	if job.FailedCount != 2 || len(job.FailedVideos) != 2 {
+		t.Fatalf("job shows %d failed (%d listed), want 2", job.FailedCount, len(job.FailedVideos))
+	}
+	if got := job.FailedVideos[1]; got != (services.FailedVideo{Num: 5, Title: "second", Reason: "Download failed"}) {
+		t.Errorf("second failure = %+v", got)
+	}
+	if len(failed) != 2 {
+		t.Errorf("returned %d failures, want 2", len(failed))
+	}
+}
@@ -2,10 +2,9 @@ package routes
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/subtle"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
@@ -25,6 +24,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -39,7 +39,12 @@ func BotRoutes(r chi.Router) {
 	r.Get("/api/bot/download/{token}", handleBotFileDownload)
 }
 
+// checkBotAuth lets the Discord bot in with BOT_SECRET, and other
+// integrations in with an API key.
 func checkBotAuth(r *http.Request) bool {
+	if services.APIKeyFrom(r.Context()) != nil {
+		return true
+	}
 	if config.BotSecret == "" {
 		return false
 	}
@@ -61,6 +66,8 @@ func handleBotDownload(w http.ResponseWriter, r *http.Request) {
 		Container   string `json:"container"`
 		AudioFormat string `json:"audioFormat"`
 		Playlist    bool   `json:"playlist"`
+		CallbackURL string `json:"callbackUrl"`
+		UserID      string `json:"userId"`
 	}
 	json.NewDecoder(r.Body).Decode(&body)
 
@@ -68,6 +75,9 @@ func handleBotDownload(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "URL required"})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 	check := util.ValidateURL(body.URL)
 	if !check.Valid {
 		respondJSON(w, 400, map[string]string{"error": check.Error})
@@ -87,7 +97,20 @@ func handleBotDownload(w http.ResponseWriter, r *http.Request) {
 		body.AudioFormat = "mp3"
 	}
 
+	if !allowKeyJob(w, r, "download") {
+		return
+	}
+
 	jobID := uuid.New().String()
+	requester := botRequester(r, body.UserID)
+	ticket, jobCheck := services.Global.EnqueueJob(services.JobRequest{
+		Type: "download", ID: jobID, ClientID: requester, Origin: services.OriginBot,
+	})
+	if !jobCheck.OK {
+		respondJSON(w, 503, map[string]string{"error": jobCheck.Reason})
+		return
+	}
+
 	isAudio := body.Format == "audio"
 	outputExt := body.Container
 	if isAudio {
@@ -100,16 +123,36 @@ func handleBotDownload(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: time.Now(),
 		URL:       body.URL,
 		Format:    outputExt,
+		Type:      "download",
+		Origin:    services.OriginBot,
+		Requester: requester,
+	}
+	if ticket.Queued() {
+		job.Status = "queued"
+		job.Message = "Waiting in queue..."
 	}
 	services.Global.SetAsyncJob(jobID, job)
+	services.Global.WatchJob(jobID, body.CallbackURL)
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
-	go processBotDownload(jobID, job, body.URL, isAudio, body.AudioFormat, outputExt, body.Quality, body.Container, body.Playlist)
+	go processBotDownload(jobID, job, ticket, body.URL, isAudio, body.AudioFormat, outputExt, body.Quality, body.Container, body.Playlist)
 }
 
-func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isAudio bool, audioFormat, outputExt, quality, container string, playlist bool) {
-	ctx := context.Background()
+func processBotDownload(jobID string, job *services.AsyncJob, ticket *services.JobTicket, rawURL string, isAudio bool, audioFormat, outputExt, quality, container string, playlist bool) {
+	if check := ticket.Wait(context.Background()); !check.OK {
+		botError(jobID, job, fmt.Errorf("%s", check.Reason))
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	services.Global.SetProcess(jobID, &services.ProcessInfo{JobType: "download", CancelFunc: cancel})
+	defer services.Global.ReleaseJob(jobID)
+
 	job.Lock()
+	if job.Status == "cancelled" {
+		job.Unlock()
+		return
+	}
 	job.Status = "downloading"
 	job.Message = "Downloading from source..."
 	job.Unlock()
@@ -186,7 +229,7 @@ func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isA
 			if err != nil {
 				log.Printf("[Bot] yt-dlp with proxy failed, falling back to Cobalt: %s", err)
 				job.SetMessage("Downloading via Cobalt...")
-				cobaltResult, cobaltErr := services.DownloadViaCobalt(ctx, rawURL, jobID, isAudio, func(progress float64, _, _ int64) {
+				cobaltResult, cobaltErr := cobaltFallback(ctx, rawURL, jobID, isAudio, func(progress float64, _, _ int64) {
 					job.SetProgress(progress)
 				}, services.CobaltDownloadOpts{})
 				if cobaltErr != nil {
@@ -228,6 +271,11 @@ func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isA
 	}
 
 	job.Lock()
+	if job.Status == "cancelled" {
+		job.Unlock()
+		os.Remove(downloadedPath)
+		return
+	}
 	job.Status = "processing"
 	job.Progress = 100
 	job.Message = "Processing..."
@@ -255,8 +303,6 @@ func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isA
 		return
 	}
 
-	token := makeBotToken()
-
 	title := "download"
 	isYT := strings.Contains(rawURL, "youtube.com") || strings.Contains(rawURL, "youtu.be")
 	args := append([]string{}, util.GetYouTubeAuthArgs()...)
@@ -293,15 +339,24 @@ func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isA
 		}
 	}
 
-	services.Global.SetBotDownload(token, &services.BotDownload{
+	dl := &services.BotDownload{
 		FilePath:  actualFinalFile,
 		FileName:  fileName,
 		FileSize:  stat.Size(),
 		MimeType:  mimeType,
 		CreatedAt: time.Now(),
-	})
+	}
+	if err := services.SaveOutput(context.Background(), dl); err != nil {
+		botError(jobID, job, fmt.Errorf("Failed to store output: %v", err))
+		return
+	}
+	token := issueDownloadToken(jobID, dl)
 
 	job.Lock()
+	if job.Status == "cancelled" {
+		job.Unlock()
+		return
+	}
 	job.Status = "complete"
 	job.Progress = 100
 	job.Message = "Ready for download"
@@ -315,11 +370,14 @@ func processBotDownload(jobID string, job *services.AsyncJob, rawURL string, isA
 
 func botError(jobID string, job *services.AsyncJob, err error) {
 	log.Printf("[Bot] Job %s failed: %s", jobID, err)
+	metrics.JobsFailed.Inc(job.Type)
 	alerts.BotJobFailed(jobID, job.URL, err)
 	job.Lock()
-	job.Status = "error"
-	job.Message = util.ToUserError(err.Error())
-	job.DebugError = err.Error()
+	if job.Status != "cancelled" {
+		job.Status = "error"
+		job.Message = util.ToUserError(err.Error())
+		job.DebugError = err.Error()
+	}
 	job.Unlock()
 
 	entries, _ := os.ReadDir(config.TempDirs["bot"])
@@ -344,6 +402,8 @@ func handleBotDownloadPlaylist(w http.ResponseWriter, r *http.Request) {
 		AudioFormat  string `json:"audioFormat"`
 		AudioBitrate string `json:"audioBitrate"`
 		ResumeFrom   int    `json:"resumeFrom"`
+		CallbackURL  string `json:"callbackUrl"`
+		UserID       string `json:"userId"`
 	}
 	json.NewDecoder(r.Body).Decode(&body)
 
@@ -351,6 +411,9 @@ func handleBotDownloadPlaylist(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "URL required"})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 	check := util.ValidateURL(body.URL)
 	if !check.Valid {
 		respondJSON(w, 400, map[string]string{"error": check.Error})
@@ -366,6 +429,10 @@ func handleBotDownloadPlaylist(w http.ResponseWriter, r *http.Request) {
 		body.ResumeFrom = 1
 	}
 
+	if !allowKeyJob(w, r, "playlist") {
+		return
+	}
+
 	jobID := uuid.New().String()
 	isAudio := body.Format == "audio"
 	outputExt := body.Container
@@ -379,17 +446,34 @@ func handleBotDownloadPlaylist(w http.ResponseWriter, r *http.Request) {
 		CreatedAt: time.Now(),
 		URL:       body.URL,
 		Format:    outputExt,
+		Type:      "playlist",
+		Origin:    services.OriginBot,
+		Requester: botRequester(r, body.UserID),
 	}
 	services.Global.SetAsyncJob(jobID, job)
+	services.Global.WatchJob(jobID, body.CallbackURL)
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
 	go processBotPlaylistAsync(jobID, job, body.URL, isAudio, body.AudioFormat, outputExt, body.Quality, body.Container, body.AudioBitrate, body.ResumeFrom)
 }
 
 func processBotPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, isAudio bool, audioFormat, outputExt, quality, container, audioBitrate string, resumeFrom int) {
+	if check := services.Global.WaitForJobSlot(context.Background(), jobRequest("playlist", jobID, "")); !check.OK {
+		botError(jobID, job, fmt.Errorf("%s", check.Reason))
+		return
+	}
+
 	playlistDir := filepath.Join(config.TempDirs["bot"], "playlist-"+jobID)
 	os.MkdirAll(playlistDir, 0755)
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	services.Global.SetProcess(jobID, &services.ProcessInfo{
+		TempDir:    playlistDir,
+		JobType:    "playlist",
+		CancelFunc: cancel,
+	})
+	defer services.Global.ReleaseJob(jobID)
 
 	isYT := strings.Contains(rawURL, "youtube.com") || strings.Contains(rawURL, "youtu.be")
 	playlistInfo, err := services.GetPlaylistInfo(ctx, rawURL, isYT)
@@ -415,8 +499,8 @@ func processBotPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string
 	}
 	startIdx := resumeFrom - 1
 	remainingVideos := len(playlistInfo.Entries) - startIdx
-	if remainingVideos > config.MaxPlaylistVideos {
-		botError(jobID, job, fmt.Errorf("Playlist chunk too large. Maximum %d videos allowed per run.", config.MaxPlaylistVideos))
+	if remainingVideos > config.Get().MaxPlaylistVideos {
+		botError(jobID, job, fmt.Errorf("Playlist chunk too large. Maximum %d videos allowed per run.", config.Get().MaxPlaylistVideos))
 		os.RemoveAll(playlistDir)
 		return
 	}
@@ -431,6 +515,11 @@ func processBotPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string
 	job.TotalVideos = totalVideos
 	job.StartVideo = startVideo
 	job.PlaylistInfo = map[string]interface{}{"title": playlistInfo.Title, "count": totalVideos, "startVideo": startVideo}
+	if job.Status == "cancelled" {
+		job.Unlock()
+		os.RemoveAll(playlistDir)
+		return
+	}
 	job.Message = msg
 	job.Status = "downloading"
 	job.Unlock()
@@ -485,7 +574,7 @@ func processBotPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string
 			})
 		}
 		if dlErr != nil && isYTVideo {
-			cobaltResult, cobaltErr := services.DownloadViaCobalt(ctx, videoURL, fmt.Sprintf("%s-v%d", jobID, videoNum), isAudio, nil,
+			cobaltResult, cobaltErr := cobaltFallback(ctx, videoURL, fmt.Sprintf("%s-v%d", jobID, videoNum), isAudio, nil,
 				services.CobaltDownloadOpts{OutputDir: playlistDir, MaxRetries: 2, RetryDelay: time.Second})
 			if cobaltErr != nil {
 				failedVideos = append(failedVideos, services.FailedVideo{Num: videoNum, Title: videoTitle, Reason: util.ToUserError(cobaltErr.Error())})
@@ -545,19 +634,28 @@ func processBotPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string
 		os.RemoveAll(playlistDir)
 		return
 	}
-	token := makeBotToken()
 	fileName := safePlaylistName + ".zip"
 
-	services.Global.SetBotDownload(token, &services.BotDownload{
+	dl := &services.BotDownload{
 		FilePath:   zipPath,
 		FileName:   fileName,
 		FileSize:   stat.Size(),
 		MimeType:   "application/zip",
 		CreatedAt:  time.Now(),
 		IsPlaylist: true,
-	})
+	}
+	if err := services.SaveOutput(context.Background(), dl); err != nil {
+		botError(jobID, job, fmt.Errorf("Failed to store output: %v", err))
+		os.RemoveAll(playlistDir)
+		return
+	}
+	token := issueDownloadToken(jobID, dl)
 
 	job.Lock()
+	if job.Status == "cancelled" {
+		job.Unlock()
+		return
+	}
 	job.Status = "complete"
 	job.Progress = 100
 	job.Message = fmt.Sprintf("Ready for download (%d videos)", len(downloadedFiles))
@@ -578,8 +676,10 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var body struct {
-		URL    string `json:"url"`
-		Format string `json:"format"`
+		URL         string `json:"url"`
+		Format      string `json:"format"`
+		CallbackURL string `json:"callbackUrl"`
+		UserID      string `json:"userId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid JSON body"})
@@ -590,6 +690,9 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "URL required"})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 	format := body.Format
 	if format == "" {
 		format = "mp4"
@@ -599,36 +702,49 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !allowKeyJob(w, r, "convert") {
+		return
+	}
+
 	jobID := uuid.New().String()
 	job := &services.AsyncJob{
 		Status:    "processing",
 		Progress:  0,
 		Message:   "Downloading file...",
 		CreatedAt: time.Now(),
+		Origin:    services.OriginBot,
+		Requester: botRequester(r, body.UserID),
 	}
 	services.Global.SetAsyncJob(jobID, job)
+	services.Global.WatchJob(jobID, body.CallbackURL)
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
 	go func() {
 		tempPath, originalName, err := downloadURLToTemp(body.URL, jobID)
 		if err != nil {
 			log.Printf("[BotConvert] Download failed: %s", err)
+			metrics.JobsFailed.Inc("convert")
 			alerts.ConversionFailed(jobID, format, err)
 			job.SetError("Failed to download file: " + err.Error())
 			return
 		}
 
-		job.SetProgressAndMessage(20, "Converting...")
-
 		isAudio := isAudioFmt(format)
 		outputPath := filepath.Join(config.TempDirs["convert"], jobID+"-converted."+format)
 
-		convertCheck := services.Global.CanStartJob("convert")
+		convertCheck := services.Global.WaitForJobSlot(context.Background(), jobRequest("convert", jobID, ""))
 		if !convertCheck.OK {
 			os.Remove(tempPath)
 			job.SetError(convertCheck.Reason)
 			return
 		}
+		if job.IsCancelled() {
+			os.Remove(tempPath)
+			services.Global.DecrementJob("convert")
+			return
+		}
+
+		job.SetProgressAndMessage(20, "Converting...")
 
 		processInfo := &services.ProcessInfo{TempFile: outputPath, JobType: "convert"}
 		services.Global.SetProcess(jobID, processInfo)
@@ -648,6 +764,7 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 			os.Remove(tempPath)
 			os.Remove(outputPath)
 			services.Global.ReleaseJob(jobID)
+			metrics.JobsFailed.Inc("convert")
 			alerts.ConversionFailed(jobID, format, err)
 			job.SetError("Conversion failed: " + err.Error())
 			return
@@ -667,13 +784,12 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		token := makeBotToken()
 		baseName := strings.TrimSuffix(originalName, filepath.Ext(originalName))
 		outputFilename := util.SanitizeFilename(baseName) + "." + format
 
 		mimeType := services.GetMimeType(format, isAudio, false)
 
-		services.Global.SetBotDownload(token, &services.BotDownload{
+		token := issueDownloadToken(jobID, &services.BotDownload{
 			FilePath:  actualOutput,
 			FileName:  outputFilename,
 			FileSize:  stat.Size(),
@@ -682,6 +798,12 @@ func handleBotConvert(w http.ResponseWriter, r *http.Request) {
 		})
 
 		job.Lock()
+		if job.Status == "cancelled" {
+			job.Unlock()
+			os.Remove(actualOutput)
+			services.Global.ReleaseJob(jobID)
+			return
+		}
 		job.Status = "complete"
 		job.Progress = 100
 		job.Message = "Conversion complete"
@@ -709,6 +831,8 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 		DownloadToken string `json:"downloadToken"`
 		TargetSize    string `json:"targetSize"`
 		Preset        string `json:"preset"`
+		CallbackURL   string `json:"callbackUrl"`
+		UserID        string `json:"userId"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid JSON body"})
@@ -719,6 +843,9 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "URL or downloadToken required"})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 
 	targetSize := body.TargetSize
 	if targetSize == "" {
@@ -732,14 +859,21 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 		preset = "fast"
 	}
 
+	if !allowKeyJob(w, r, "compress") {
+		return
+	}
+
 	jobID := uuid.New().String()
 	job := &services.AsyncJob{
 		Status:    "processing",
 		Progress:  0,
 		Message:   "Preparing compression...",
 		CreatedAt: time.Now(),
+		Origin:    services.OriginBot,
+		Requester: botRequester(r, body.UserID),
 	}
 	services.Global.SetAsyncJob(jobID, job)
+	services.Global.WatchJob(jobID, body.CallbackURL)
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
 	go func() {
@@ -751,13 +885,20 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 				job.SetError("Download token not found or expired")
 				return
 			}
-			inputPath = dl.FilePath
+			path, cleanup, err := services.FetchOutput(context.Background(), dl, config.TempDirs["bot"])
+			if err != nil {
+				job.SetError("Download token file is no longer available")
+				return
+			}
+			defer cleanup()
+			inputPath = path
 			originalName = dl.FileName
 		} else {
 			var err error
 			inputPath, originalName, err = downloadURLToTemp(body.URL, jobID)
 			if err != nil {
 				log.Printf("[BotCompress] Download failed: %s", err)
+				metrics.JobsFailed.Inc("compress")
 				alerts.CompressionFailed(jobID, err)
 				job.SetError("Failed to download file: " + err.Error())
 				return
@@ -768,9 +909,10 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 		durationStr := fmt.Sprintf("%.2f", probe.duration)
 
 		err := handleCompressAsync(inputPath, originalName, "", targetSize, durationStr,
-			"size", "medium", preset, "auto", false, jobID)
+			"size", "medium", preset, "auto", false, jobID, job)
 		if err != nil {
 			log.Printf("[BotCompress] Job %s failed: %s", jobID, err)
+			metrics.JobsFailed.Inc("compress")
 			alerts.CompressionFailed(jobID, err)
 			job.SetError(err.Error())
 			return
@@ -791,8 +933,7 @@ func handleBotCompressEndpoint(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		token := makeBotToken()
-		services.Global.SetBotDownload(token, &services.BotDownload{
+		token := issueDownloadToken(jobID, &services.BotDownload{
 			FilePath:  outputPath,
 			FileName:  outputFilename,
 			FileSize:  stat.Size(),
@@ -904,6 +1045,9 @@ func handleBotStatus(w http.ResponseWriter, r *http.Request) {
 func handleDownloadPage(w http.ResponseWriter, r *http.Request) {
 	token := chi.URLParam(r, "token")
 	data := services.Global.GetBotDownload(token)
+	if claims, err := services.Tokens.Verify(token); data == nil && err == nil {
+		data = claims.Download()
+	}
 	if data == nil {
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(404)
@@ -915,42 +1059,147 @@ func handleDownloadPage(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, botDownloadHTML, html.EscapeString(data.FileName), html.EscapeString(downloadURL))
 }
 
-func handleBotFileDownload(w http.ResponseWriter, r *http.Request) {
-	token := chi.URLParam(r, "token")
-	data := services.Global.GetBotDownload(token)
-	if data == nil {
-		respondJSON(w, 404, map[string]string{"error": "Download not found or expired"})
-		return
+// lookupDownload finds the download a token is for, writing an error
+// response when there isn't one. Signed tokens are checked against their
+// signature, denylist and download limit, and still work where there's no
+// record of them, such as on another replica. Older random tokens only
+// work through their record. Nothing is counted against the token until
+// claimDownload.
+func lookupDownload(w http.ResponseWriter, token string) (*services.BotDownload, bool) {
+	if !services.IsSignedToken(token) {
+		data := services.Global.GetBotDownload(token)
+		if data == nil {
+			respondJSON(w, 404, map[string]string{"error": "Download not found or expired"})
+			return nil, false
+		}
+		return data, true
+	}
+
+	claims, err := services.Tokens.Verify(token)
+	if err == nil {
+		err = services.Global.CheckSignedToken(claims)
+	}
+	switch {
+	case errors.Is(err, services.ErrTokenRevoked), errors.Is(err, services.ErrTokenUsedUp):
+		respondJSON(w, 410, map[string]string{"error": err.Error()})
+		return nil, false
+	case err != nil:
+		respondJSON(w, 404, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	if data := services.Global.GetBotDownload(token); data != nil {
+		return data, true
+	}
+	return claims.Download(), true
+}
+
+// claimDownload counts a download against a signed token's limit as the
+// transfer starts, so requests made at the same time can't all get in
+// under it. The func it returns gives the download back, for transfers
+// that fail.
+func claimDownload(token string) (func(), error) {
+	if !services.IsSignedToken(token) {
+		return func() {}, nil
 	}
-	stat, err := os.Stat(data.FilePath)
+	claims, err := services.Tokens.Verify(token)
 	if err != nil {
-		services.Global.DeleteBotDownload(token)
-		respondJSON(w, 404, map[string]string{"error": "File no longer available"})
-		return
+		return nil, err
+	}
+	if err := services.Global.UseSignedToken(claims); err != nil {
+		return nil, err
 	}
-	asciiFilename := toASCIIFilename(data.FileName)
+	return func() { services.Global.ReturnSignedToken(claims) }, nil
+}
 
-	w.Header().Set("Content-Type", data.MimeType)
-	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, asciiFilename, url.PathEscape(data.FileName)))
+func handleBotFileDownload(w http.ResponseWriter, r *http.Request) {
+	serveTokenDownload(w, r, chi.URLParam(r, "token"), "Bot")
+}
 
-	f, err := os.Open(data.FilePath)
-	if err != nil {
-		http.Error(w, "File read error", http.StatusInternalServerError)
+// serveTokenDownload sends the file behind a download token, removing it
+// once it has been downloaded (see services.Delivery).
+func serveTokenDownload(w http.ResponseWriter, r *http.Request, token, tag string) {
+	data, ok := lookupDownload(w, token)
+	if !ok {
+		return
+	}
+	if !data.IsLocal() {
+		serveStoredOutput(w, r, token, data)
+		return
+	}
+	if !allowKeyBytes(w, r, data.FileSize) {
 		return
 	}
-	defer f.Close()
-	io.Copy(w, f)
 
-	data.Downloaded = true
-	go func() {
-		time.Sleep(30 * time.Second)
-		if services.Global.GetBotDownload(token) != nil {
+	sendStart := time.Now()
+	_, err := services.ServeFile(w, r, services.Delivery{
+		Path:     data.FilePath,
+		Name:     data.FileName,
+		MimeType: data.MimeType,
+		Key:      token,
+		Claim:    func() (func(), error) { return claimDownload(token) },
+		OnComplete: func() {
+			metrics.ObserveStage("send", "none", sendStart)
+			data.Downloaded = true
+		},
+		Remove: func() {
 			os.Remove(data.FilePath)
 			services.Global.DeleteBotDownload(token)
-			log.Printf("[Bot] Token %s... cleaned up after download", token[:min(8, len(token))])
+			log.Printf("[%s] Token %s... cleaned up after download", tag, token[:min(8, len(token))])
+		},
+	})
+	if errors.Is(err, services.ErrFileGone) {
+		services.Global.DeleteBotDownload(token)
+	}
+}
+
+// serveStoredOutput sends a token's file that was saved to the output
+// store, redirecting to the store when it can link to the file directly.
+// Stored files stay until their token expires rather than being removed
+// after the first download.
+func serveStoredOutput(w http.ResponseWriter, r *http.Request, token string, data *services.BotDownload) {
+	release, err := claimDownload(token)
+	if err != nil {
+		respondJSON(w, 410, map[string]string{"error": err.Error()})
+		return
+	}
+	if link, ok := services.Outputs.URL(data.StorageKey, data.FileName, data.Expiry()-time.Since(data.CreatedAt)); ok {
+		if !chargeKeyBytes(w, r, data.FileSize) {
+			release()
+			return
 		}
-	}()
+		data.Downloaded = true
+		http.Redirect(w, r, link, http.StatusFound)
+		return
+	}
+	if !allowKeyBytes(w, r, data.FileSize) {
+		release()
+		return
+	}
+	tw, done, ok := beginTransfer(w, r)
+	if !ok {
+		release()
+		return
+	}
+	defer done()
+	body, size, err := services.Outputs.Open(r.Context(), data.StorageKey)
+	if err != nil {
+		release()
+		log.Printf("[Outputs] Failed to open %s: %v", data.StorageKey, err)
+		respondJSON(w, 404, map[string]string{"error": "File no longer available"})
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", data.MimeType)
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.Header().Set("Content-Disposition", services.ContentDisposition(data.FileName))
+	if n, err := io.Copy(tw, body); err == nil && (size < 0 || n == size) {
+		data.Downloaded = true
+	} else {
+		release()
+	}
 }
 
 func StartBotDownloadExpiry() {
@@ -958,14 +1207,15 @@ func StartBotDownloadExpiry() {
 		ticker := time.NewTicker(30 * time.Second)
 		for range ticker.C {
 			now := time.Now()
+			services.Global.PruneSignedTokens(now)
 			services.Global.ForEachBotDownload(func(token string, dl *services.BotDownload) bool {
-				if now.Sub(dl.CreatedAt) > config.BotDownloadExpiry && !dl.IsWebPlaylist && !dl.IsPlaylist {
+				if now.Sub(dl.CreatedAt) > dl.Expiry() && !dl.IsWebPlaylist && !dl.IsPlaylist {
 					short := token
 					if len(short) > 8 {
 						short = short[:8]
 					}
 					log.Printf("[Bot] Download token %s... expired", short)
-					os.Remove(dl.FilePath)
+					services.DeleteOutput(dl)
 					return true
 				}
 				return false
@@ -986,7 +1236,7 @@ func StartPlaylistDownloadExpiry() {
 						short = short[:8]
 					}
 					log.Printf("[Playlist] Download token %s... expired", short)
-					os.Remove(dl.FilePath)
+					services.DeleteOutput(dl)
 					return true
 				}
 				return false
@@ -995,12 +1245,6 @@ func StartPlaylistDownloadExpiry() {
 	}()
 }
 
-func makeBotToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return hex.EncodeToString(b)
-}
-
 func defaults(s *string, def string) {
 	if *s == "" {
 		*s = def
@@ -1,13 +1,14 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -20,6 +21,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -304,34 +306,20 @@ func handleJobDownload(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 404, map[string]string{"error": "Output file not found"})
 		return
 	}
-	stat, err := os.Stat(outputPath)
-	if err != nil {
-		respondJSON(w, 404, map[string]string{"error": "Output file not found"})
-		return
-	}
 	if mimeType == "" {
 		mimeType = "video/mp4"
 	}
 
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
-		outputFilename, url.PathEscape(outputFilename)))
-
-	f, err := os.Open(outputPath)
-	if err != nil {
-		respondJSON(w, 500, map[string]string{"error": "Failed to read file"})
-		return
-	}
-	defer f.Close()
-
-	io.Copy(w, f)
-
-	go func() {
-		time.Sleep(5 * time.Second)
-		os.Remove(outputPath)
-		services.Global.DeleteAsyncJob(jobID)
-	}()
+	services.ServeFile(w, r, services.Delivery{
+		Path:     outputPath,
+		Name:     outputFilename,
+		MimeType: mimeType,
+		Key:      jobID,
+		Remove: func() {
+			os.Remove(outputPath)
+			services.Global.DeleteAsyncJob(jobID)
+		},
+	})
 }
 
 func handleFetchURL(w http.ResponseWriter, r *http.Request) {
@@ -349,13 +337,17 @@ func handleFetchURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fetchCheck := services.Global.CanStartJob("fetchUrl")
+	if !allowKeyJob(w, r, "download") {
+		return
+	}
+
+	id := "fetch-" + uuid.New().String()
+	fetchCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("fetchUrl", id, effectiveClientID(r, "")))
 	if !fetchCheck.OK {
 		respondJSON(w, 503, map[string]string{"error": fetchCheck.Reason})
 		return
 	}
 
-	id := "fetch-" + uuid.New().String()
 	isYouTube := strings.Contains(trimmedURL, "youtube.com") || strings.Contains(trimmedURL, "youtu.be")
 	log.Printf("[%s] Fetching URL (yt-dlp)\n", id)
 
@@ -407,7 +399,7 @@ func handleFetchURL(w http.ResponseWriter, r *http.Request) {
 		}
 		if fetchErr != nil {
 			log.Printf("[%s] yt-dlp failed, falling back to Cobalt: %s\n", id, fetchErr.Error())
-			result, cobaltErr := services.DownloadViaCobalt(r.Context(), trimmedURL, id, false, nil, services.CobaltDownloadOpts{OutputDir: config.TempDirs["upload"]})
+			result, cobaltErr := cobaltFallback(r.Context(), trimmedURL, id, false, nil, services.CobaltDownloadOpts{OutputDir: config.TempDirs["upload"]})
 			if cobaltErr != nil {
 				services.Global.DecrementJob("fetchUrl")
 				respondJSON(w, 400, map[string]string{"error": fetchErr.Error()})
@@ -486,10 +478,10 @@ func handleConvert(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if clientID != "" {
-		if services.Global.GetClientJobCount(clientID) >= config.MaxJobsPerClient {
+		if services.Global.GetClientJobCount(clientID) >= config.Get().MaxJobsPerClient {
 			os.Remove(filePath)
 			respondJSON(w, 429, map[string]string{
-				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.MaxJobsPerClient),
+				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.Get().MaxJobsPerClient),
 			})
 			return
 		}
@@ -503,14 +495,19 @@ func handleConvert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	convertCheck := services.Global.CanStartJob("convert")
+	if !allowKeyJob(w, r, "convert") {
+		os.Remove(filePath)
+		return
+	}
+
+	convertID := uuid.New().String()
+	convertCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("convert", convertID, effectiveClientID(r, clientID)))
 	if !convertCheck.OK {
 		os.Remove(filePath)
 		respondJSON(w, 503, map[string]string{"error": convertCheck.Reason})
 		return
 	}
 
-	convertID := uuid.New().String()
 	outputPath := filepath.Join(config.TempDirs["convert"], convertID+"-converted."+format)
 
 	if clientID != "" {
@@ -600,50 +597,44 @@ func handleConvert(w http.ResponseWriter, r *http.Request) {
 
 	ffmpegArgs = append(ffmpegArgs, outputPath)
 
+	processInfo := &services.ProcessInfo{JobType: "convert"}
+	disk, err := services.Global.ReserveDisk(convertID, config.TempDirs["convert"],
+		services.EstimateFileJobBytes(filePath, convertDiskGrowth(format)), services.AbortProcess(processInfo))
+	if err != nil {
+		os.Remove(filePath)
+		services.Global.DecrementJob("convert")
+		services.Global.UnlinkJobFromClient(convertID)
+		respondJSON(w, 503, map[string]string{"error": err.Error()})
+		return
+	}
+	defer disk.Release()
+
 	cmd := exec.Command("ffmpeg", ffmpegArgs...)
+	processInfo.SetCmd(cmd)
 	if err := cmd.Run(); err != nil {
+		metrics.JobsFailed.Inc("convert")
 		alerts.ConversionFailed(convertID, format, fmt.Errorf("ffmpeg conversion failed: %w", err))
 		os.Remove(filePath)
 		os.Remove(outputPath)
 		services.Global.DecrementJob("convert")
 		services.Global.UnlinkJobFromClient(convertID)
 		if !isHeaderSent(w) {
-			respondJSON(w, 500, map[string]string{"error": "Conversion failed"})
+			respondJSON(w, 500, map[string]string{"error": disk.Check(fmt.Errorf("Conversion failed")).Error()})
 		}
 		return
 	}
 
 	os.Remove(filePath)
 
-	stat, err := os.Stat(outputPath)
-	if err != nil {
-		services.Global.DecrementJob("convert")
-		services.Global.UnlinkJobFromClient(convertID)
-		if !isHeaderSent(w) {
-			respondJSON(w, 500, map[string]string{"error": "Output file not found"})
-		}
-		return
-	}
 	baseName := strings.TrimSuffix(filepath.Base(originalName), filepath.Ext(originalName))
 	outputFilename := util.SanitizeFilename(baseName) + "." + format
 	mimeType := getMimeForFormat(format, isAudioFormat)
-
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
-		outputFilename, url.PathEscape(outputFilename)))
-
-	f, err := os.Open(outputPath)
+	_, err = services.ServeFile(w, r, services.Delivery{Path: outputPath, Name: outputFilename, MimeType: mimeType})
 	if err != nil {
 		services.Global.DecrementJob("convert")
 		services.Global.UnlinkJobFromClient(convertID)
-		if !isHeaderSent(w) {
-			respondJSON(w, 500, map[string]string{"error": "Failed to read output file"})
-		}
 		return
 	}
-	defer f.Close()
-	io.Copy(w, f)
 
 	log.Printf("[%s] Conversion complete\n", convertID)
 	services.Global.DecrementJob("convert")
@@ -695,28 +686,26 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 	targetMB, _ := strconv.ParseFloat(targetSize, 64)
 	videoDuration, _ := strconv.ParseFloat(durationStr, 64)
 
-	if videoDuration > float64(config.MaxVideoDuration) {
+	if videoDuration > float64(config.Get().MaxVideoDuration) {
 		os.Remove(filePath)
 		respondJSON(w, 400, map[string]string{
-			"error": fmt.Sprintf("Video too long. Maximum duration is %d hours.", config.MaxVideoDuration/3600),
+			"error": fmt.Sprintf("Video too long. Maximum duration is %d hours.", config.Get().MaxVideoDuration/3600),
 		})
 		return
 	}
 
 	if clientID != "" {
-		if services.Global.GetClientJobCount(clientID) >= config.MaxJobsPerClient {
+		if services.Global.GetClientJobCount(clientID) >= config.Get().MaxJobsPerClient {
 			os.Remove(filePath)
 			respondJSON(w, 429, map[string]string{
-				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.MaxJobsPerClient),
+				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.Get().MaxJobsPerClient),
 			})
 			return
 		}
 	}
 
-	compressCheck := services.Global.CanStartJob("compress")
-	if !compressCheck.OK {
+	if !allowKeyJob(w, r, "compress") {
 		os.Remove(filePath)
-		respondJSON(w, 503, map[string]string{"error": compressCheck.Reason})
 		return
 	}
 
@@ -724,6 +713,14 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 	if compressID == "" {
 		compressID = uuid.New().String()
 	}
+
+	compressCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("compress", compressID, effectiveClientID(r, clientID)))
+	if !compressCheck.OK {
+		os.Remove(filePath)
+		respondJSON(w, 503, map[string]string{"error": compressCheck.Reason})
+		return
+	}
+
 	outputPath := filepath.Join(config.TempDirs["compress"], compressID+"-compressed.mp4")
 	passLogFile := filepath.Join(config.TempDirs["compress"], compressID+"-pass")
 
@@ -737,6 +734,17 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 	processInfo := &services.ProcessInfo{TempFile: outputPath, JobType: "compress"}
 	services.Global.SetProcess(compressID, processInfo)
 
+	disk, err := services.Global.ReserveDisk(compressID, config.TempDirs["compress"],
+		services.EstimateFileJobBytes(filePath, compressDiskGrowth), services.AbortProcess(processInfo))
+	if err != nil {
+		os.Remove(filePath)
+		services.Global.SendProgressSimple(compressID, "error", err.Error())
+		services.Global.ReleaseJob(compressID)
+		respondJSON(w, 503, map[string]string{"error": err.Error()})
+		return
+	}
+	defer disk.Release()
+
 	services.Global.SendProgressWithPercent(compressID, "compressing", "Analyzing video...", 0)
 
 	if !util.ValidateVideoFile(filePath) {
@@ -755,7 +763,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 	sourceFileSizeMB := float64(fileSizeBytes(filePath)) / (1024 * 1024)
 	sourceBitrateMbps := (sourceFileSizeMB * 8) / actualDuration
 
-	presetConfig := config.CompressionPresets[preset]
+	presetConfig := config.Get().CompressionPresets[preset]
 	denoiseFilter := util.GetDenoiseFilter(denoise, probe.height, sourceBitrateMbps, presetConfig.Denoise)
 	var downscaleWidth int
 	if shouldDownscale {
@@ -772,7 +780,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 		err := runCrfEncode(filePath, outputPath, crf, presetConfig.FFmpegPreset, vfArg,
 			presetConfig.X264Params, processInfo, compressID, actualDuration)
 		if err != nil {
-			compressError(w, compressID, processInfo, err, filePath, outputPath, passLogFile)
+			compressError(w, compressID, processInfo, disk.Check(err), filePath, outputPath, passLogFile)
 			return
 		}
 	} else {
@@ -781,7 +789,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 			cmd := exec.Command("ffmpeg", "-y", "-i", filePath, "-c:v", "copy", "-c:a", "copy", "-movflags", "+faststart", outputPath)
 			processInfo.SetCmd(cmd)
 			if err := cmd.Run(); err != nil {
-				compressError(w, compressID, processInfo, fmt.Errorf("Remux failed"), filePath, outputPath, passLogFile)
+				compressError(w, compressID, processInfo, disk.Check(fmt.Errorf("Remux failed")), filePath, outputPath, passLogFile)
 				return
 			}
 		} else {
@@ -800,7 +808,7 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 				presetConfig.FFmpegPreset, vfArg, presetConfig.X264Params,
 				processInfo, compressID, actualDuration)
 			if err != nil {
-				compressError(w, compressID, processInfo, err, filePath, outputPath, passLogFile)
+				compressError(w, compressID, processInfo, disk.Check(err), filePath, outputPath, passLogFile)
 				return
 			}
 		}
@@ -825,21 +833,11 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("[%s] Complete: %.2fMB\n", compressID, float64(stat.Size())/(1024*1024))
 
-	w.Header().Set("Content-Type", "video/mp4")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
-		outputFilename, url.PathEscape(outputFilename)))
-
-	f, err := os.Open(outputPath)
+	_, err = services.ServeFile(w, r, services.Delivery{Path: outputPath, Name: outputFilename, MimeType: "video/mp4"})
 	if err != nil {
 		services.Global.ReleaseJob(compressID)
-		if !isHeaderSent(w) {
-			respondJSON(w, 500, map[string]string{"error": "Failed to read output file"})
-		}
 		return
 	}
-	defer f.Close()
-	io.Copy(w, f)
 
 	services.Global.SendProgressWithPercent(compressID, "complete", "Compression complete!", 100)
 	services.Global.ReleaseJob(compressID)
@@ -850,24 +848,75 @@ func handleCompress(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
-func handleConvertChunked(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FilePath     string           `json:"filePath"`
-		FileName     string           `json:"fileName"`
-		Format       string           `json:"format"`
-		ClientID     string           `json:"clientId"`
-		Quality      string           `json:"quality"`
-		Reencode     string           `json:"reencode"`
-		StartTime    string           `json:"startTime"`
-		EndTime      string           `json:"endTime"`
-		AudioBitrate string           `json:"audioBitrate"`
-		CropRatio    string           `json:"cropRatio"`
-		CropX        *int             `json:"cropX"`
-		CropY        *int             `json:"cropY"`
-		CropW        *int             `json:"cropW"`
-		CropH        *int             `json:"cropH"`
-		Segments     []convertSegment `json:"segments"`
+type convertRequest struct {
+	FilePath     string           `json:"filePath"`
+	FileName     string           `json:"fileName"`
+	Format       string           `json:"format"`
+	ClientID     string           `json:"clientId"`
+	Quality      string           `json:"quality"`
+	Reencode     string           `json:"reencode"`
+	StartTime    string           `json:"startTime"`
+	EndTime      string           `json:"endTime"`
+	AudioBitrate string           `json:"audioBitrate"`
+	CropRatio    string           `json:"cropRatio"`
+	CropX        *int             `json:"cropX"`
+	CropY        *int             `json:"cropY"`
+	CropW        *int             `json:"cropW"`
+	CropH        *int             `json:"cropH"`
+	Segments     []convertSegment `json:"segments"`
+	CallbackURL  string           `json:"callbackUrl"`
+}
+
+// normalize fills in defaults and rejects options handleConvertAsync
+// would refuse anyway, so callers can answer with a 400 up front.
+func (c *convertRequest) normalize() error {
+	c.Format = defaultStr(c.Format, "mp4")
+	c.Quality = defaultStr(c.Quality, "medium")
+	c.Reencode = defaultStr(c.Reencode, "auto")
+	c.AudioBitrate = defaultStr(c.AudioBitrate, "192")
+	if !config.Contains(config.AllowedAudioBitrates, c.AudioBitrate) {
+		c.AudioBitrate = "192"
+	}
+
+	if !config.Contains(config.AllowedFormats, c.Format) {
+		return fmt.Errorf("Invalid format. Allowed: %s", strings.Join(config.AllowedFormats, ", "))
 	}
+	if !config.Contains(config.AllowedReencodes, c.Reencode) {
+		return fmt.Errorf("Invalid reencode option. Allowed: %s", strings.Join(config.AllowedReencodes, ", "))
+	}
+	if !config.Contains(config.AllowedQualities, c.Quality) {
+		return fmt.Errorf("Invalid quality. Allowed: %s", strings.Join(config.AllowedQualities, ", "))
+	}
+	if c.CropRatio != "" && !config.Contains(config.AllowedCropRatios, c.CropRatio) {
+		return fmt.Errorf("Invalid crop ratio. Allowed: %s", strings.Join(config.AllowedCropRatios, ", "))
+	}
+
+	hasRawCrop := c.CropX != nil && c.CropY != nil && c.CropW != nil && c.CropH != nil
+	if hasRawCrop {
+		cx, cy, cw, ch := *c.CropX, *c.CropY, *c.CropW, *c.CropH
+		if cx < 0 || cy < 0 || cw <= 0 || ch <= 0 {
+			return fmt.Errorf("Invalid crop parameters: values must be positive")
+		}
+		if cw%2 != 0 || ch%2 != 0 {
+			return fmt.Errorf("Invalid crop parameters: width and height must be even")
+		}
+	}
+
+	if len(c.Segments) > 0 {
+		if len(c.Segments) > config.MaxSegments {
+			return fmt.Errorf("Too many segments (max %d)", config.MaxSegments)
+		}
+		for _, seg := range c.Segments {
+			if seg.End <= seg.Start {
+				return fmt.Errorf("Invalid segment: each must have numeric start < end")
+			}
+		}
+	}
+	return nil
+}
+
+func handleConvertChunked(w http.ResponseWriter, r *http.Request) {
+	var body convertRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
 		return
@@ -883,65 +932,21 @@ func handleConvertChunked(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	format := defaultStr(body.Format, "mp4")
-	quality := defaultStr(body.Quality, "medium")
-	reencode := defaultStr(body.Reencode, "auto")
-	audioBitrate := defaultStr(body.AudioBitrate, "192")
-	if !config.Contains(config.AllowedAudioBitrates, audioBitrate) {
-		audioBitrate = "192"
-	}
-
-	if !config.Contains(config.AllowedFormats, format) {
-		os.Remove(validPath)
-		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid format. Allowed: %s", strings.Join(config.AllowedFormats, ", "))})
-		return
-	}
-	if !config.Contains(config.AllowedReencodes, reencode) {
+	if err := body.normalize(); err != nil {
 		os.Remove(validPath)
-		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid reencode option. Allowed: %s", strings.Join(config.AllowedReencodes, ", "))})
+		respondJSON(w, 400, map[string]string{"error": err.Error()})
 		return
 	}
-	if !config.Contains(config.AllowedQualities, quality) {
+	if !checkCallbackURL(w, body.CallbackURL) {
 		os.Remove(validPath)
-		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid quality. Allowed: %s", strings.Join(config.AllowedQualities, ", "))})
 		return
 	}
-	if body.CropRatio != "" && !config.Contains(config.AllowedCropRatios, body.CropRatio) {
+
+	if !allowKeyJob(w, r, "convert") {
 		os.Remove(validPath)
-		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid crop ratio. Allowed: %s", strings.Join(config.AllowedCropRatios, ", "))})
 		return
 	}
 
-	hasRawCrop := body.CropX != nil && body.CropY != nil && body.CropW != nil && body.CropH != nil
-	if hasRawCrop {
-		cx, cy, cw, ch := *body.CropX, *body.CropY, *body.CropW, *body.CropH
-		if cx < 0 || cy < 0 || cw <= 0 || ch <= 0 {
-			os.Remove(validPath)
-			respondJSON(w, 400, map[string]string{"error": "Invalid crop parameters: values must be positive"})
-			return
-		}
-		if cw%2 != 0 || ch%2 != 0 {
-			os.Remove(validPath)
-			respondJSON(w, 400, map[string]string{"error": "Invalid crop parameters: width and height must be even"})
-			return
-		}
-	}
-
-	if len(body.Segments) > 0 {
-		if len(body.Segments) > config.MaxSegments {
-			os.Remove(validPath)
-			respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Too many segments (max %d)", config.MaxSegments)})
-			return
-		}
-		for _, seg := range body.Segments {
-			if seg.End <= seg.Start {
-				os.Remove(validPath)
-				respondJSON(w, 400, map[string]string{"error": "Invalid segment: each must have numeric start < end"})
-				return
-			}
-		}
-	}
-
 	jobID := uuid.New().String()
 	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
 		Status:    "processing",
@@ -949,38 +954,46 @@ func handleConvertChunked(w http.ResponseWriter, r *http.Request) {
 		Message:   "Starting conversion...",
 		CreatedAt: time.Now(),
 	})
+	services.Global.WatchJob(jobID, body.CallbackURL)
 
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
-	go func() {
-		err := handleConvertAsync(validPath, defaultStr(body.FileName, "video.mp4"),
-			format, body.ClientID, quality, reencode, body.StartTime, body.EndTime,
-			audioBitrate, body.CropRatio, body.CropX, body.CropY, body.CropW, body.CropH,
-			body.Segments, jobID)
-		if err != nil {
-			log.Printf("[AsyncJob] Convert job %s failed: %s\n", jobID, err.Error())
-			alerts.ConversionFailed(jobID, format, err)
-			job := services.Global.GetAsyncJob(jobID)
-			if job != nil {
-				job.SetError(err.Error())
-			}
-		}
-	}()
+	go runConvertJob(jobID, validPath, body)
 }
 
-func handleCompressChunked(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		FilePath   string      `json:"filePath"`
-		FileName   string      `json:"fileName"`
-		ClientID   string      `json:"clientId"`
-		TargetSize string      `json:"targetSize"`
-		Duration   string      `json:"duration"`
-		Mode       string      `json:"mode"`
-		Quality    string      `json:"quality"`
-		Preset     string      `json:"preset"`
-		Denoise    string      `json:"denoise"`
-		Downscale  interface{} `json:"downscale"`
+func runConvertJob(jobID, validPath string, body convertRequest) {
+	job := services.Global.GetAsyncJob(jobID)
+	if job == nil {
+		return
 	}
+	err := handleConvertAsync(validPath, defaultStr(body.FileName, "video.mp4"),
+		body.Format, body.ClientID, body.Quality, body.Reencode, body.StartTime, body.EndTime,
+		body.AudioBitrate, body.CropRatio, body.CropX, body.CropY, body.CropW, body.CropH,
+		body.Segments, jobID, job)
+	if err != nil {
+		log.Printf("[AsyncJob] Convert job %s failed: %s\n", jobID, err.Error())
+		metrics.JobsFailed.Inc("convert")
+		alerts.ConversionFailed(jobID, body.Format, err)
+		job.SetError(err.Error())
+	}
+}
+
+type compressRequest struct {
+	FilePath    string      `json:"filePath"`
+	FileName    string      `json:"fileName"`
+	ClientID    string      `json:"clientId"`
+	TargetSize  string      `json:"targetSize"`
+	Duration    string      `json:"duration"`
+	Mode        string      `json:"mode"`
+	Quality     string      `json:"quality"`
+	Preset      string      `json:"preset"`
+	Denoise     string      `json:"denoise"`
+	Downscale   interface{} `json:"downscale"`
+	CallbackURL string      `json:"callbackUrl"`
+}
+
+func handleCompressChunked(w http.ResponseWriter, r *http.Request) {
+	var body compressRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
 		return
@@ -995,6 +1008,15 @@ func handleCompressChunked(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "File not found. Complete chunked upload first."})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		os.Remove(validPath)
+		return
+	}
+
+	if !allowKeyJob(w, r, "compress") {
+		os.Remove(validPath)
+		return
+	}
 
 	jobID := uuid.New().String()
 	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
@@ -1003,24 +1025,33 @@ func handleCompressChunked(w http.ResponseWriter, r *http.Request) {
 		Message:   "Starting compression...",
 		CreatedAt: time.Now(),
 	})
+	services.Global.WatchJob(jobID, body.CallbackURL)
 
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
-	go func() {
-		err := handleCompressAsync(validPath, defaultStr(body.FileName, "video.mp4"),
-			body.ClientID, defaultStr(body.TargetSize, "50"), defaultStr(body.Duration, "0"),
-			defaultStr(body.Mode, "size"), defaultStr(body.Quality, "medium"),
-			defaultStr(body.Preset, "balanced"), defaultStr(body.Denoise, "auto"),
-			isTruthy(body.Downscale), jobID)
-		if err != nil {
-			log.Printf("[AsyncJob] Compress job %s failed: %s\n", jobID, err.Error())
-			alerts.CompressionFailed(jobID, err)
-			job := services.Global.GetAsyncJob(jobID)
-			if job != nil {
-				job.SetError(err.Error())
-			}
-		}
-	}()
+	go runCompressJob(jobID, validPath, body)
+}
+
+func runCompressJob(jobID, validPath string, body compressRequest) {
+	job := services.Global.GetAsyncJob(jobID)
+	if job == nil {
+		return
+	}
+	if err := body.compress(jobID, validPath, job); err != nil {
+		log.Printf("[AsyncJob] Compress job %s failed: %s\n", jobID, err.Error())
+		metrics.JobsFailed.Inc("compress")
+		alerts.CompressionFailed(jobID, err)
+		job.SetError(err.Error())
+	}
+}
+
+// compress runs handleCompressAsync with the request's defaults filled in.
+func (c compressRequest) compress(jobID, inputPath string, job *services.AsyncJob) error {
+	return handleCompressAsync(inputPath, defaultStr(c.FileName, "video.mp4"),
+		c.ClientID, defaultStr(c.TargetSize, "50"), defaultStr(c.Duration, "0"),
+		defaultStr(c.Mode, "size"), defaultStr(c.Quality, "medium"),
+		defaultStr(c.Preset, "balanced"), defaultStr(c.Denoise, "auto"),
+		isTruthy(c.Downscale), jobID, job)
 }
 
 type convertSegment struct {
@@ -1031,22 +1062,22 @@ type convertSegment struct {
 func handleConvertAsync(inputPath, originalName, format, clientID, quality, reencode,
 	startTime, endTime, audioBitrate, cropRatio string,
 	cropX, cropY, cropW, cropH *int,
-	segments []convertSegment, jobID string) error {
-
-	job := services.Global.GetAsyncJob(jobID)
-	if job == nil {
-		return nil
-	}
+	segments []convertSegment, jobID string, job *services.AsyncJob) error {
 
 	convertID := jobID
 	outputPath := filepath.Join(config.TempDirs["convert"], convertID+"-converted."+format)
 
-	convertCheck := services.Global.CanStartJob("convert")
+	convertCheck := services.Global.WaitForJobSlot(context.Background(), jobRequest("convert", jobID, clientID))
 	if !convertCheck.OK {
 		os.Remove(inputPath)
 		job.SetError(convertCheck.Reason)
 		return nil
 	}
+	if job.IsCancelled() {
+		os.Remove(inputPath)
+		services.Global.DecrementJob("convert")
+		return nil
+	}
 
 	if clientID != "" {
 		services.Global.RegisterClient(clientID)
@@ -1168,6 +1199,19 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 		services.Global.UnlinkJobFromClient(convertID)
 	}
 
+	processInfo := &services.ProcessInfo{JobType: "convert"}
+	disk, err := services.Global.ReserveDisk(convertID, config.TempDirs["convert"],
+		services.EstimateFileJobBytes(inputPath, convertDiskGrowth(format)), services.AbortProcess(processInfo))
+	if err != nil {
+		cleanupOnError()
+		job.SetError(err.Error())
+		return nil
+	}
+	defer disk.Release()
+	failed := func(reason string) string {
+		return disk.Check(errors.New(reason)).Error()
+	}
+
 	if hasSegments {
 		log.Printf("[%s] Processing %d segments\n", convertID, len(segments))
 		job.SetProgressAndMessage(10, fmt.Sprintf("Processing segment 1/%d...", len(segments)))
@@ -1192,10 +1236,11 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 			job.SetMessage(fmt.Sprintf("Processing segment %d/%d...", i+1, len(segments)))
 
 			cmd := exec.Command("ffmpeg", segArgs...)
+			processInfo.SetCmd(cmd)
 			stderrPipe, _ := cmd.StderrPipe()
 			if err := cmd.Start(); err != nil {
 				cleanupOnError()
-				job.SetError(fmt.Sprintf("Segment %d failed", i+1))
+				job.SetError(failed(fmt.Sprintf("Segment %d failed", i+1)))
 				return nil
 			}
 
@@ -1226,7 +1271,7 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 
 			if err := cmd.Wait(); err != nil {
 				cleanupOnError()
-				job.SetError(fmt.Sprintf("Segment %d failed", i+1))
+				job.SetError(failed(fmt.Sprintf("Segment %d failed", i+1)))
 				return nil
 			}
 			processedDuration += segDuration
@@ -1249,9 +1294,10 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 		concatArgs = append(concatArgs, outputPath)
 
 		cmd := exec.Command("ffmpeg", concatArgs...)
+		processInfo.SetCmd(cmd)
 		if err := cmd.Run(); err != nil {
 			cleanupOnError()
-			job.SetError("Failed to join segments")
+			job.SetError(failed("Failed to join segments"))
 			return nil
 		}
 
@@ -1291,10 +1337,11 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 		job.SetProgressAndMessage(10, "Converting...")
 
 		cmd := exec.Command("ffmpeg", finalArgs...)
+		processInfo.SetCmd(cmd)
 		stderrPipe, _ := cmd.StderrPipe()
 		if err := cmd.Start(); err != nil {
 			cleanupOnError()
-			job.SetError("Conversion failed")
+			job.SetError(failed("Conversion failed"))
 			return nil
 		}
 
@@ -1340,7 +1387,7 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 
 		if err := cmd.Wait(); err != nil {
 			cleanupOnError()
-			job.SetError("Conversion failed")
+			job.SetError(failed("Conversion failed"))
 			return nil
 		}
 	}
@@ -1368,12 +1415,7 @@ func handleConvertAsync(inputPath, originalName, format, clientID, quality, reen
 }
 
 func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durationStr,
-	mode, quality, preset, denoise string, shouldDownscale bool, jobID string) error {
-
-	job := services.Global.GetAsyncJob(jobID)
-	if job == nil {
-		return nil
-	}
+	mode, quality, preset, denoise string, shouldDownscale bool, jobID string, job *services.AsyncJob) error {
 
 	targetMB, _ := strconv.ParseFloat(targetSizeStr, 64)
 	videoDuration, _ := strconv.ParseFloat(durationStr, 64)
@@ -1393,12 +1435,17 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 		return nil
 	}
 
-	compressCheck := services.Global.CanStartJob("compress")
+	compressCheck := services.Global.WaitForJobSlot(context.Background(), jobRequest("compress", jobID, clientID))
 	if !compressCheck.OK {
 		os.Remove(inputPath)
 		job.SetError(compressCheck.Reason)
 		return nil
 	}
+	if job.IsCancelled() {
+		os.Remove(inputPath)
+		services.Global.DecrementJob("compress")
+		return nil
+	}
 
 	if clientID != "" {
 		services.Global.RegisterClient(clientID)
@@ -1410,6 +1457,16 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 	processInfo := &services.ProcessInfo{TempFile: outputPath, JobType: "compress"}
 	services.Global.SetProcess(compressID, processInfo)
 
+	disk, err := services.Global.ReserveDisk(compressID, config.TempDirs["compress"],
+		services.EstimateFileJobBytes(inputPath, compressDiskGrowth), services.AbortProcess(processInfo))
+	if err != nil {
+		os.Remove(inputPath)
+		services.Global.ReleaseJob(compressID)
+		job.SetError(err.Error())
+		return nil
+	}
+	defer disk.Release()
+
 	cleanupOnError := func() {
 		os.Remove(inputPath)
 		os.Remove(outputPath)
@@ -1434,9 +1491,9 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 	sourceFileSizeMB := float64(fileSizeBytes(inputPath)) / (1024 * 1024)
 	sourceBitrateMbps := (sourceFileSizeMB * 8) / actualDuration
 
-	presetConfig, ok := config.CompressionPresets[preset]
+	presetConfig, ok := config.Get().CompressionPresets[preset]
 	if !ok {
-		presetConfig = config.CompressionPresets["balanced"]
+		presetConfig = config.Get().CompressionPresets["balanced"]
 	}
 	denoiseFilter := util.GetDenoiseFilter(denoise, probe.height, sourceBitrateMbps, presetConfig.Denoise)
 	var downscaleWidth int
@@ -1454,7 +1511,7 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 			presetConfig.X264Params, processInfo, actualDuration, job)
 		if err != nil {
 			cleanupOnError()
-			job.SetError(err.Error())
+			job.SetError(disk.Check(err).Error())
 			return nil
 		}
 	} else {
@@ -1464,7 +1521,7 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 			processInfo.SetCmd(cmd)
 			if err := cmd.Run(); err != nil {
 				cleanupOnError()
-				job.SetError("Remux failed")
+				job.SetError(disk.Check(fmt.Errorf("Remux failed")).Error())
 				return nil
 			}
 		} else {
@@ -1481,7 +1538,7 @@ func handleCompressAsync(inputPath, originalName, clientID, targetSizeStr, durat
 				processInfo, actualDuration, job)
 			if err != nil {
 				cleanupOnError()
-				job.SetError(err.Error())
+				job.SetError(disk.Check(err).Error())
 				return nil
 			}
 		}
@@ -2068,6 +2125,19 @@ func isHeaderSent(w http.ResponseWriter) bool {
 	return false
 }
 
+// compressDiskGrowth covers CRF encodes that come out bigger than a
+// well-compressed source, plus the two-pass log.
+const compressDiskGrowth = 1.5
+
+// convertDiskGrowth is how much bigger than the upload a conversion's
+// output may get. Decoding to wav or flac is the worst case.
+func convertDiskGrowth(format string) float64 {
+	if format == "wav" || format == "flac" {
+		return 12
+	}
+	return 3
+}
+
 func fileSizeBytes(path string) int64 {
 	info, err := os.Stat(path)
 	if err != nil {
@@ -2090,6 +2160,7 @@ func isTruthy(v interface{}) bool {
 func compressError(w http.ResponseWriter, compressID string, processInfo *services.ProcessInfo, err error,
 	inputPath, outputPath, passLogFile string) {
 	log.Printf("[%s] Error: %s\n", compressID, err.Error())
+	metrics.JobsFailed.Inc("compress")
 	alerts.CompressionFailed(compressID, err)
 	services.Global.ReleaseJob(compressID)
 	go func() {
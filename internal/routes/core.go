@@ -21,14 +21,19 @@ func CoreRoutes(r chi.Router) {
 	r.Post("/api/heartbeat/{clientId}", handleHeartbeat)
 	r.Get("/api/queue-status", handleQueueStatus)
 	r.Get("/api/limits", handleLimits)
+	r.Get("/api/key/usage", handleKeyUsage)
 	r.Get("/api/progress/{id}", handleProgress)
 	r.Post("/api/cancel/{id}", handleCancel)
 	r.Post("/api/finish-early/{id}", handleFinishEarly)
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, 200, map[string]interface{}{
-		"status":  "ok",
+	status, code := "ok", 200
+	if services.Global.IsDraining() {
+		status, code = "draining", 503
+	}
+	respondJSON(w, code, map[string]interface{}{
+		"status":  status,
 		"version": "1.0.0",
 		"queue":   services.Global.GetQueueStatus(),
 	})
@@ -50,15 +55,9 @@ func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	services.Global.RegisterClient(clientID)
 	services.Global.UpdateHeartbeat(clientID)
 
-	session := services.Global.GetClientSession(clientID)
-	activeJobs := 0
-	if session != nil {
-		activeJobs = len(session.ActiveJobs)
-	}
-
 	respondJSON(w, 200, map[string]interface{}{
 		"success":    true,
-		"activeJobs": activeJobs,
+		"activeJobs": services.Global.GetClientJobCount(clientID),
 	})
 }
 
@@ -68,13 +67,24 @@ func handleQueueStatus(w http.ResponseWriter, r *http.Request) {
 
 func handleLimits(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, 200, map[string]interface{}{
-		"limits":            config.JobLimits,
+		"limits":            services.Global.JobLimits(),
 		"maxFileSize":       15 * 1024 * 1024 * 1024,
-		"maxPlaylistVideos": config.MaxPlaylistVideos,
-		"maxVideoDuration":  config.MaxVideoDuration,
+		"maxPlaylistVideos": config.Get().MaxPlaylistVideos,
+		"maxVideoDuration":  config.Get().MaxVideoDuration,
 	})
 }
 
+// handleKeyUsage shows the caller's API key limits and what it has used
+// today.
+func handleKeyUsage(w http.ResponseWriter, r *http.Request) {
+	key := services.APIKeyFrom(r.Context())
+	if key == nil {
+		respondJSON(w, 401, map[string]string{"error": "An X-API-Key header is required"})
+		return
+	}
+	respondJSON(w, 200, key.Info(services.Global.APIKeyUsage(key.ID)))
+}
+
 func handleProgress(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 
@@ -89,21 +99,28 @@ func handleProgress(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	flusher.Flush()
 
-	resumedJob := services.Global.GetResumedJob(id)
-	if resumedJob != nil {
+	if resumedJob := services.Global.GetResumedJob(id); resumedJob != nil {
+		message := "Reconnected! Resuming download..."
+		progress, _ := services.Global.PendingProgress(id)
+		if resumedJob.Finished() {
+			message = "Reconnected! Your file is ready"
+			progress = 100
+		}
 		data, _ := json.Marshal(map[string]interface{}{
 			"stage":    "resuming",
-			"message":  "Reconnected! Resuming download...",
-			"progress": resumedJob.Progress,
+			"message":  message,
+			"progress": progress,
 		})
 		fmt.Fprintf(w, "data: %s\n\n", data)
 		flusher.Flush()
-		resumedJob.ClientReconnected = true
-		resumedJob.Response = w
 	}
 
 	dw := services.Global.RegisterDownload(id, w, flusher)
 
+	// A job running on another replica sends its progress through the
+	// shared state instead.
+	remote := services.Global.SubscribeProgress(r.Context(), id)
+
 	ticker := time.NewTicker(15 * time.Second)
 	defer ticker.Stop()
 
@@ -116,6 +133,8 @@ func handleProgress(w http.ResponseWriter, r *http.Request) {
 				select {
 				case <-ticker.C:
 					dw.WriteKeepAlive()
+				case data := <-remote:
+					dw.Write(data)
 				case <-r.Context().Done():
 					close(done)
 					return
@@ -138,6 +157,34 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if cancelJob(id) {
+		respondJSON(w, 200, map[string]interface{}{"success": true, "message": "Download cancelled"})
+	} else {
+		respondJSON(w, 200, map[string]interface{}{"success": false, "message": "Download not found or already completed"})
+	}
+}
+
+// cancelJob stops a running job or takes it out of the queue, asking the
+// other replicas to when it isn't here. It reports false when there was
+// nothing left to cancel.
+func cancelJob(id string) bool {
+	return cancelLocalJob(id) || services.Global.RequestCancel(id)
+}
+
+// HandleRemoteCancels cancels jobs running here when a client asks
+// another replica to. The job is marked cancelled too, so one that's
+// between processes here stops at its next step.
+func HandleRemoteCancels() {
+	services.Global.HandleCancelRequests(func(id string) bool {
+		if job := services.Global.GetAsyncJob(id); job != nil {
+			job.Cancel()
+		}
+		return cancelLocalJob(id)
+	})
+}
+
+// cancelLocalJob is cancelJob for jobs running on this replica.
+func cancelLocalJob(id string) bool {
 	processInfo := services.Global.GetProcess(id)
 	if processInfo != nil {
 		log.Printf("[%s] Cancelling download...\n", id)
@@ -155,11 +202,14 @@ func handleCancel(w http.ResponseWriter, r *http.Request) {
 			time.Sleep(time.Second)
 			util.CleanupJobFiles(id)
 		}()
-
-		respondJSON(w, 200, map[string]interface{}{"success": true, "message": "Download cancelled"})
-	} else {
-		respondJSON(w, 200, map[string]interface{}{"success": false, "message": "Download not found or already completed"})
+		return true
+	}
+	if services.Global.CancelQueuedJob(id) {
+		log.Printf("[%s] Removed from queue\n", id)
+		services.Global.SendProgressSimple(id, "cancelled", "Download cancelled")
+		return true
 	}
+	return false
 }
 
 func handleFinishEarly(w http.ResponseWriter, r *http.Request) {
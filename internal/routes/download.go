@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -21,6 +20,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -28,6 +28,7 @@ import (
 func DownloadRoutes(r chi.Router) {
 	r.Get("/api/metadata", handleMetadata)
 	r.Get("/api/download", handleDownload)
+	r.Get("/api/download/{id}/resume", handleDownloadResume)
 }
 
 func handleMetadata(w http.ResponseWriter, r *http.Request) {
@@ -48,27 +49,49 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Identical lookups running at the same time share one fetch. It isn't
+	// tied to any one request, so the first caller leaving doesn't cancel
+	// it for the rest.
+	key := rawURL
+	if downloadPlaylist {
+		key = "playlist:" + rawURL
+	}
+	resp, _ := metadataFlights.Do(key, func() (metadataResponse, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Minute)
+		defer cancel()
+		return fetchMetadata(ctx, rawURL, downloadPlaylist), nil
+	})
+	respondJSON(w, resp.code, resp.body)
+}
+
+// metadataResponse is a metadata lookup's status code and JSON body.
+type metadataResponse struct {
+	code int
+	body interface{}
+}
+
+var metadataFlights services.FlightGroup[metadataResponse]
+
+func fetchMetadata(ctx context.Context, rawURL string, downloadPlaylist bool) metadataResponse {
 	isYouTube := strings.Contains(rawURL, "youtube.com") || strings.Contains(rawURL, "youtu.be")
 	isClip := strings.Contains(rawURL, "/clip/")
-	ctx := r.Context()
 
 	if isClip {
 		clipData, err := services.ParseYouTubeClip(ctx, rawURL)
 		if err != nil {
-			respondJSON(w, 200, map[string]interface{}{
+			return metadataResponse{200, map[string]interface{}{
 				"isClip":       true,
 				"title":        "YouTube Clip",
 				"usingCookies": false,
 				"clipNote":     "Clip will be downloaded via yt-dlp.",
-			})
-			return
+			}}
 		}
 
 		clipDuration := float64(clipData.EndTimeMs-clipData.StartTimeMs) / 1000
 
 		cobaltMeta, err := services.FetchMetadataViaCobalt(ctx, clipData.FullVideoURL)
 		if err == nil {
-			respondJSON(w, 200, map[string]interface{}{
+			return metadataResponse{200, map[string]interface{}{
 				"title":            cobaltMeta.Title,
 				"ext":              cobaltMeta.Ext,
 				"id":               cobaltMeta.ID,
@@ -86,11 +109,10 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 				"fullVideoUrl":     clipData.FullVideoURL,
 				"usingCookies":     false,
 				"clipNote":         "Clip will download full video then trim to clip portion.",
-			})
-			return
+			}}
 		}
 
-		respondJSON(w, 200, map[string]interface{}{
+		return metadataResponse{200, map[string]interface{}{
 			"isClip":          true,
 			"clipStartTime":   float64(clipData.StartTimeMs) / 1000,
 			"clipEndTime":     float64(clipData.EndTimeMs) / 1000,
@@ -102,8 +124,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 			"thumbnail":       fmt.Sprintf("https://i.ytimg.com/vi/%s/maxresdefault.jpg", clipData.VideoID),
 			"usingCookies":    false,
 			"clipNote":        "Clip will download full video then trim to clip portion.",
-		})
-		return
+		}}
 	}
 
 	if isYouTube && !downloadPlaylist {
@@ -121,8 +142,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 				"usingCookies": false,
 			}
 			services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-			respondJSON(w, 200, result)
-			return
+			return metadataResponse{200, result}
 		}
 		log.Printf("[Metadata] Cobalt failed for YouTube, falling back to yt-dlp: %s", err)
 	}
@@ -139,8 +159,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 				"isPlaylist": false,
 			}
 			services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-			respondJSON(w, 200, result)
-			return
+			return metadataResponse{200, result}
 		}
 		log.Printf("[Metadata] Instagram extractor failed, falling back to yt-dlp: %s", err)
 	}
@@ -156,8 +175,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 			"isAudio":    true,
 		}
 		services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-		respondJSON(w, 200, result)
-		return
+		return metadataResponse{200, result}
 	}
 
 	if services.IsTikTokURL(rawURL) {
@@ -180,8 +198,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 				"imageCount":  meta.ImageCount,
 			}
 			services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-			respondJSON(w, 200, result)
-			return
+			return metadataResponse{200, result}
 		}
 	}
 
@@ -199,8 +216,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 				"isPlaylist": false,
 			}
 			services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-			respondJSON(w, 200, result)
-			return
+			return metadataResponse{200, result}
 		}
 		log.Printf("[Metadata] Twitter extractor failed, falling back to yt-dlp: %s", err)
 	}
@@ -262,14 +278,12 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 	outText, errOutput, timedOut, err := runYtdlpMetadata()
 	if err != nil {
 		if timedOut {
-			respondJSON(w, 504, map[string]string{"error": "Metadata fetch timed out (30s)"})
-			return
+			return metadataResponse{504, map[string]string{"error": "Metadata fetch timed out (30s)"}}
 		}
 		if util.NeedsCookiesRetry(errOutput) && util.RefreshCookies("YouTube bot detection during metadata fetch") {
 			outText, errOutput, timedOut, err = runYtdlpMetadata()
 			if timedOut {
-				respondJSON(w, 504, map[string]string{"error": "Metadata fetch timed out (30s)"})
-				return
+				return metadataResponse{504, map[string]string{"error": "Metadata fetch timed out (30s)"}}
 			}
 		}
 	}
@@ -277,13 +291,11 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 		if !downloadPlaylist {
 			galleryMeta, galleryErr := tryGalleryDlMetadata(ctx, rawURL)
 			if galleryErr == nil {
-				respondJSON(w, 200, galleryMeta)
-				return
+				return metadataResponse{200, galleryMeta}
 			}
 			log.Printf("[Metadata] gallery-dl fallback also failed: %s", galleryErr)
 		}
-		respondJSON(w, 500, map[string]string{"error": util.ToUserError(errOutput)})
-		return
+		return metadataResponse{500, map[string]string{"error": util.ToUserError(errOutput)}}
 	}
 
 	lines := strings.Split(strings.TrimSpace(outText), "\n")
@@ -296,8 +308,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 			} `json:"entries"`
 		}
 		if err := json.Unmarshal([]byte(outText), &raw); err != nil {
-			respondJSON(w, 500, map[string]string{"error": "Failed to parse playlist info"})
-			return
+			return metadataResponse{500, map[string]string{"error": "Failed to parse playlist info"}}
 		}
 		playlistTitle := orDefault(raw.Title, "Playlist")
 		videoCount := raw.PlaylistCount
@@ -314,13 +325,13 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 		if videoCount == 0 {
 			videoCount = len(raw.Entries)
 		}
-		respondJSON(w, 200, map[string]interface{}{
+		return metadataResponse{200, map[string]interface{}{
 			"title":        playlistTitle,
 			"isPlaylist":   true,
 			"videoCount":   videoCount,
 			"videoTitles":  videoTitles,
 			"usingCookies": usingCookies,
-		})
+		}}
 	} else {
 		get := func(i int) string {
 			if i < len(lines) {
@@ -339,7 +350,7 @@ func handleMetadata(w http.ResponseWriter, r *http.Request) {
 			"usingCookies": usingCookies,
 		}
 		services.MetadataCache.Set(rawURL, result, 10*time.Minute)
-		respondJSON(w, 200, result)
+		return metadataResponse{200, result}
 	}
 }
 
@@ -357,6 +368,35 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	twitterGifs := q.Get("twitterGifs") != "false"
 	downloadPlaylist := q.Get("playlist") == "true"
 
+	if !allowKeyJob(w, r, "download") {
+		return
+	}
+
+	if q.Get("async") == "true" {
+		callbackURL := q.Get("callbackUrl")
+		if !checkCallbackURL(w, callbackURL) {
+			return
+		}
+		body := downloadRequest{
+			URL:          rawURL,
+			Format:       format,
+			Quality:      quality,
+			Container:    container,
+			AudioFormat:  audioFormat,
+			AudioBitrate: audioBitrate,
+			Filename:     filename,
+			ClientID:     clientID,
+			ProgressID:   progressID,
+			TwitterGifs:  &twitterGifs,
+			Playlist:     downloadPlaylist,
+		}
+		if jobID, ok := startDownloadJob(w, r, body); ok {
+			services.Global.WatchJob(jobID, callbackURL)
+			respondJSON(w, 202, jobCreated(jobID, "download", false))
+		}
+		return
+	}
+
 	downloadID := progressID
 	if downloadID == "" {
 		downloadID = uuid.New().String()
@@ -368,14 +408,49 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !services.Global.TryReserveClientJob(downloadID, clientID, config.MaxJobsPerClient) {
-		services.Global.SendProgressSimple(downloadID, "error", fmt.Sprintf("too many active jobs, max %d at once per person", config.MaxJobsPerClient))
-		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.MaxJobsPerClient)})
+	opts := mediaOpts{
+		URL:          rawURL,
+		Format:       format,
+		Quality:      quality,
+		Container:    container,
+		AudioFormat:  audioFormat,
+		AudioBitrate: audioBitrate,
+		TwitterGifs:  twitterGifs,
+		Playlist:     downloadPlaylist,
+		Dir:          config.TempDirs["download"],
+		NoCache:      authenticatedRequest(r),
+	}
+
+	// A cached result goes straight out without taking a job slot.
+	if key, ok := opts.resultKey(); ok {
+		if hit, ok := services.Results.Get(key); ok {
+			log.Printf("[%s] Serving cached result", downloadID)
+			cached := &mediaResult{Path: hit.Path, Ext: hit.Ext, IsAudio: hit.IsAudio, IsGif: hit.IsGif}
+			services.StreamFile(w, r, hit.Path, orDefault(filename, "download"), hit.Ext,
+				cached.mimeType(), downloadID, rawURL, "download", nil)
+			return
+		}
+	}
+
+	if !services.Global.TryReserveClientJob(downloadID, clientID, config.Get().MaxJobsPerClient) {
+		services.Global.SendProgressSimple(downloadID, "error", fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient))
+		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient)})
+		return
+	}
+
+	// An identical download that's already running is followed rather
+	// than started again, and doesn't take a job slot of its own.
+	flight, leader := joinDownload(opts, downloadID)
+	if !leader {
+		services.Global.UnlinkJobFromClient(downloadID)
+		followDownload(w, r, flight, downloadID, filename, rawURL)
 		return
 	}
+	defer finishDownload(flight, nil, fmt.Errorf("Download failed"))
 
-	jobCheck := services.Global.CanStartJob("download")
+	jobCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("download", downloadID, clientID))
 	if !jobCheck.OK {
+		finishDownload(flight, nil, fmt.Errorf("%s", jobCheck.Reason))
 		services.Global.UnlinkJobFromClient(downloadID)
 		services.Global.SendProgressSimple(downloadID, "error", jobCheck.Reason)
 		respondJSON(w, 503, map[string]string{"error": jobCheck.Reason})
@@ -392,7 +467,9 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	finalFile := filepath.Join(config.TempDirs["download"], fmt.Sprintf("%s-final.%s", downloadID, outputExt))
 
-	ctx, cancel := context.WithCancel(r.Context())
+	// The job isn't tied to the request so it can outlive a dropped
+	// connection; see the disconnect watcher below.
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	processInfo := &services.ProcessInfo{
@@ -427,51 +504,15 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 
 		services.Global.SendProgressWithPercent(downloadID, "downloading", "Fetching thumbnail...", 0)
 
-		thumbURLs := []string{
-			fmt.Sprintf("https://i.ytimg.com/vi/%s/maxresdefault.jpg", videoID),
-			fmt.Sprintf("https://i.ytimg.com/vi/%s/sddefault.jpg", videoID),
-			fmt.Sprintf("https://i.ytimg.com/vi/%s/hqdefault.jpg", videoID),
-		}
-
 		thumbPath := filepath.Join(config.TempDirs["download"], fmt.Sprintf("%s-thumb.jpg", downloadID))
-		var thumbErr error
-		for _, thumbURL := range thumbURLs {
-			resp, err := http.Get(thumbURL)
-			if err != nil {
-				thumbErr = err
-				continue
-			}
-			if resp.StatusCode != 200 {
-				resp.Body.Close()
-				continue
-			}
-			out, err := os.Create(thumbPath)
-			if err != nil {
-				resp.Body.Close()
-				thumbErr = err
-				break
-			}
-			_, err = io.Copy(out, resp.Body)
-			resp.Body.Close()
-			out.Close()
-			if err != nil {
-				thumbErr = err
-				break
-			}
-			thumbErr = nil
-			break
-		}
-
-		if thumbErr != nil || func() bool { _, err := os.Stat(thumbPath); return os.IsNotExist(err) }() {
-			errMsg := "Could not download YouTube thumbnail"
-			if thumbErr != nil {
-				errMsg = thumbErr.Error()
-			}
-			services.Global.SendProgressSimple(downloadID, "error", errMsg)
+		if err := fetchYouTubeThumbnail(videoID, thumbPath); err != nil {
+			finishDownload(flight, nil, err)
+			services.Global.SendProgressSimple(downloadID, "error", err.Error())
 			services.Global.ReleaseJob(downloadID)
-			respondJSON(w, 500, map[string]string{"error": errMsg})
+			respondJSON(w, 500, map[string]string{"error": err.Error()})
 			return
 		}
+		finishDownload(flight, &mediaResult{Path: thumbPath, Ext: "jpg"}, nil)
 
 		p := float64(100)
 		services.Global.SendProgress(downloadID, "downloading", "Thumbnail downloaded", &p, nil)
@@ -479,314 +520,135 @@ func handleDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go func() {
-		<-r.Context().Done()
+	stop := func() {
+		if flight != nil && flight.Waiting() > 0 {
+			// Others are still waiting on this download.
+			return
+		}
 		if !processInfo.IsCancelled() {
 			processInfo.SetCancelled(true)
 			cancel()
 			processInfo.KillProcess()
 		}
-	}()
-
-	services.Global.SendProgressWithPercent(downloadID, "downloading", "Downloading from source...", 0)
-
-	var downloadedPath, downloadedExt string
-
-	if isYouTube && !downloadPlaylist {
-		isClip := strings.Contains(rawURL, "/clip/")
-
-		if isClip {
-			clipData, err := services.ParseYouTubeClip(ctx, rawURL)
-			if err != nil {
-				handleDownloadError(w, downloadID, outputExt, err)
-				return
-			}
-			services.Global.SendProgressWithPercent(downloadID, "downloading", "Trimming clip from stream...", 0)
-			result, err := services.HandleClipDownload(ctx, clipData, downloadID, config.TempDirs["download"], func(progress float64, speed, eta string) {
-				services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Trimming... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
-				services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-			})
-			if err != nil {
-				handleDownloadError(w, downloadID, outputExt, err)
-				return
-			}
-			downloadedPath = result.Path
-			downloadedExt = result.Ext
-		} else {
-			services.Global.SendProgressWithPercent(downloadID, "downloading", "Downloading...", 0)
-			onProgress := func(progress float64, speed, eta string) {
-				msg := fmt.Sprintf("Downloading... %.0f%%", progress)
-				if speed != "" {
-					msg += fmt.Sprintf(" • %s", speed)
-				}
-				if eta != "" {
-					msg += fmt.Sprintf(" • ETA %s", eta)
-				}
-				services.Global.SendProgress(downloadID, "downloading", msg, &progress, map[string]interface{}{"speed": speed, "eta": eta})
-				services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-			}
-			result, err := services.DownloadViaYtdlp(ctx, rawURL, downloadID, services.DownloadOpts{
-				IsAudio:     isAudio,
-				AudioFormat: audioFormat,
-				Quality:     quality,
-				Container:   container,
-				TempDir:     config.TempDirs["download"],
-				ProcessInfo: processInfo,
-				Playlist:    false,
-				UseProxy:    false,
-				OnProgress:  onProgress,
-			})
-			if err != nil {
-				if processInfo.IsCancelled() {
-					handleDownloadError(w, downloadID, outputExt, fmt.Errorf("Download cancelled"))
-					return
-				}
-				// Clean up partial files from failed attempt
-				if entries, cleanErr := os.ReadDir(config.TempDirs["download"]); cleanErr == nil {
-					for _, e := range entries {
-						if strings.HasPrefix(e.Name(), downloadID) {
-							os.Remove(filepath.Join(config.TempDirs["download"], e.Name()))
-						}
-					}
-				}
-				if util.HasProxy() {
-					log.Printf("[%s] yt-dlp failed, retrying with proxy: %s", downloadID, err)
-					services.Global.SendProgressWithPercent(downloadID, "downloading", "Retrying with proxy...", 0)
-					result, err = services.DownloadViaYtdlp(ctx, rawURL, downloadID, services.DownloadOpts{
-						IsAudio:     isAudio,
-						AudioFormat: audioFormat,
-						Quality:     quality,
-						Container:   container,
-						TempDir:     config.TempDirs["download"],
-						ProcessInfo: processInfo,
-						Playlist:    false,
-						UseProxy:    true,
-						OnProgress:  onProgress,
-					})
-				}
-			}
-			if err != nil {
-				log.Printf("[%s] yt-dlp with proxy failed, falling back to Cobalt: %s", downloadID, err)
-				services.Global.SendProgressWithPercent(downloadID, "downloading", "Downloading via Cobalt...", 0)
-				cobaltResult, cobaltErr := services.DownloadViaCobalt(ctx, rawURL, downloadID, isAudio, func(progress float64, downloaded, total int64) {
-					services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, nil)
-					services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-				}, services.CobaltDownloadOpts{})
-				if cobaltErr != nil {
-					handleDownloadError(w, downloadID, outputExt, cobaltErr)
-					return
-				}
-				downloadedPath = cobaltResult.FilePath
-				downloadedExt = cobaltResult.Ext
-			} else {
-				downloadedPath = result.Path
-				downloadedExt = result.Ext
-			}
-			p := float64(100)
-			services.Global.SendProgress(downloadID, "downloading", "Download complete", &p, nil)
-		}
-	} else if services.IsTikTokMusicURL(rawURL) {
-		services.Global.SendProgressWithPercent(downloadID, "downloading", "Fetching TikTok audio...", 0)
-		result, err := services.DownloadTikTokMusic(ctx, rawURL, downloadID, config.TempDirs["download"], func(progress float64, downloaded, total int64) {
-			services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading audio... %.0f%%", progress), &progress, nil)
-			services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-		})
-		if err != nil {
-			handleDownloadError(w, downloadID, outputExt, err)
+	}
+	// When the client drops mid-job the job is parked for ReconnectGrace
+	// instead of being stopped, so it can come back for the file. The
+	// watcher always hands back whether it parked the job, and is joined
+	// before the job's result is looked at.
+	fetched := make(chan struct{})
+	detached := make(chan *services.ResumedJob, 1)
+	go func() {
+		select {
+		case <-fetched:
+			detached <- nil
 			return
+		case <-r.Context().Done():
 		}
-		downloadedPath = result.Path
-		downloadedExt = result.Ext
-		isAudio = true
-		p := float64(100)
-		services.Global.SendProgress(downloadID, "downloading", "Download complete", &p, nil)
-	} else if services.IsTikTokURL(rawURL) {
-		label := "Downloading TikTok video..."
-		if isAudio {
-			label = "Downloading TikTok audio..."
-		}
-		services.Global.SendProgressWithPercent(downloadID, "downloading", label, 0)
-		result, err := services.DownloadTikTokVideo(ctx, rawURL, downloadID, config.TempDirs["download"], isAudio, func(progress float64, downloaded, total int64) {
-			services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, nil)
-			services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-		})
-		if err != nil {
-			handleDownloadError(w, downloadID, outputExt, err)
+		if config.Get().ReconnectGrace <= 0 {
+			stop()
+			detached <- nil
 			return
 		}
-		downloadedPath = result.Path
-		downloadedExt = result.Ext
-		p := float64(100)
-		services.Global.SendProgress(downloadID, "downloading", "Download complete", &p, nil)
-	} else if services.IsTwitterURL(rawURL) {
-		services.Global.SendProgressWithPercent(downloadID, "downloading", "Downloading Twitter media...", 0)
-		result, err := services.DownloadTwitterMedia(ctx, rawURL, downloadID, config.TempDirs["download"], isAudio, twitterGifs, func(progress float64, downloaded, total int64) {
-			services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, nil)
-			services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-		})
+		detached <- services.Global.DetachJob(downloadID, clientID, stop)
+	}()
+
+	result, err := fetchMedia(ctx, downloadID, processInfo, opts, sharedProgress(flight, sseProgress(downloadID)))
+	finishDownload(flight, result, userError(err))
+	close(fetched)
+
+	if resumed := <-detached; resumed != nil {
+		var file *services.ResumedFile
 		if err != nil {
-			log.Printf("[%s] Twitter fxtwitter failed, falling back to yt-dlp: %s", downloadID, err)
-			services.Global.SendProgressWithPercent(downloadID, "downloading", "Retrying via yt-dlp...", 0)
-			ytResult, ytErr := services.DownloadViaYtdlp(ctx, rawURL, downloadID, services.DownloadOpts{
-				IsAudio:     isAudio,
-				AudioFormat: audioFormat,
-				Quality:     quality,
-				Container:   container,
-				TempDir:     config.TempDirs["download"],
-				ProcessInfo: processInfo,
-				Playlist:    false,
-				UseProxy:    false,
-				OnProgress: func(progress float64, speed, eta string) {
-					services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
-					services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-				},
-			})
-			if ytErr != nil {
-				handleDownloadError(w, downloadID, outputExt, ytErr)
-				return
-			}
-			downloadedPath = ytResult.Path
-			downloadedExt = ytResult.Ext
+			handleDownloadError(w, downloadID, outputExt, err)
 		} else {
-			downloadedPath = result.Path
-			downloadedExt = result.Ext
-		}
-		p := float64(100)
-		services.Global.SendProgress(downloadID, "downloading", "Download complete", &p, nil)
-	} else if services.IsInstagramURL(rawURL) {
-		services.Global.SendProgressWithPercent(downloadID, "downloading", "Downloading Instagram media...", 0)
-		result, err := services.DownloadInstagramMedia(ctx, rawURL, downloadID, config.TempDirs["download"], isAudio, func(progress float64, downloaded, total int64) {
-			services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, nil)
-			services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-		})
-		if err != nil {
-			log.Printf("[%s] Instagram Cobalt failed, falling back to yt-dlp: %s", downloadID, err)
-			services.Global.SendProgressWithPercent(downloadID, "downloading", "Retrying via yt-dlp...", 0)
-			ytResult, ytErr := services.DownloadViaYtdlp(ctx, rawURL, downloadID, services.DownloadOpts{
-				IsAudio:     isAudio,
-				AudioFormat: audioFormat,
-				Quality:     quality,
-				Container:   container,
-				TempDir:     config.TempDirs["download"],
-				ProcessInfo: processInfo,
-				Playlist:    false,
-				UseProxy:    false,
-				OnProgress: func(progress float64, speed, eta string) {
-					services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
-					services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-				},
-			})
-			if ytErr != nil {
-				handleDownloadError(w, downloadID, outputExt, ytErr)
-				return
+			services.Global.ReleaseJob(downloadID)
+			services.Global.SendProgressSimple(downloadID, "ready", "Your file is ready, reconnect to get it")
+			file = &services.ResumedFile{
+				Path:      result.Path,
+				Filename:  orDefault(filename, "download"),
+				Ext:       result.Ext,
+				MimeType:  result.mimeType(),
+				SourceURL: rawURL,
 			}
-			downloadedPath = ytResult.Path
-			downloadedExt = ytResult.Ext
-		} else {
-			downloadedPath = result.Path
-			downloadedExt = result.Ext
 		}
-		p := float64(100)
-		services.Global.SendProgress(downloadID, "downloading", "Download complete", &p, nil)
-	} else {
-		result, err := services.DownloadViaYtdlp(ctx, rawURL, downloadID, services.DownloadOpts{
-			IsAudio:     isAudio,
-			AudioFormat: audioFormat,
-			Quality:     quality,
-			Container:   container,
-			TempDir:     config.TempDirs["download"],
-			ProcessInfo: processInfo,
-			Playlist:    downloadPlaylist,
-			UseProxy:    isYouTube,
-			OnProgress: func(progress float64, speed, eta string) {
-				services.Global.SendProgress(downloadID, "downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
-				services.Global.UpdatePendingJob(downloadID, progress, "downloading")
-			},
-		})
-		if err != nil {
-			handleDownloadError(w, downloadID, outputExt, err)
-			return
-		}
-		downloadedPath = result.Path
-		downloadedExt = result.Ext
-	}
-
-	if downloadedPath == "" {
-		handleDownloadError(w, downloadID, outputExt, fmt.Errorf("Downloaded file not found"))
-		return
-	}
-	if _, err := os.Stat(downloadedPath); os.IsNotExist(err) {
-		handleDownloadError(w, downloadID, outputExt, fmt.Errorf("Downloaded file not found"))
+		resumed.Finish(file, err)
 		return
 	}
 
-	if downloadedExt == "zip" {
-		services.StreamFile(w, r, downloadedPath, orDefault(filename, "download"), "zip", "application/zip", downloadID, rawURL, "download", nil)
+	if err != nil {
+		handleDownloadError(w, downloadID, outputExt, err)
 		return
 	}
 
-	isTwitter := strings.Contains(rawURL, "twitter.com") || strings.Contains(rawURL, "x.com")
-	isGif := false
-	if isTwitter && !isAudio && twitterGifs {
-		// Skip ffprobe for files > 20MB — real GIFs are short/small
-		if fi, err := os.Stat(downloadedPath); err == nil && fi.Size() < 20*1024*1024 {
-			isGif = services.ProbeForGif(downloadedPath)
-		}
-	}
+	services.StreamFile(w, r, result.Path, orDefault(filename, "download"), result.Ext,
+		result.mimeType(), downloadID, rawURL, "download", nil)
+}
 
-	actualOutputExt := outputExt
-	actualFinalFile := finalFile
-	if isGif {
-		actualOutputExt = "gif"
-		actualFinalFile = filepath.Join(config.TempDirs["download"], fmt.Sprintf("%s-final.gif", downloadID))
-	}
+// followDownload serves a request by waiting on the identical download
+// that's already running and sending its own copy of the file.
+func followDownload(w http.ResponseWriter, r *http.Request, flight *services.Flight[*mediaResult], downloadID, filename, rawURL string) {
+	log.Printf("[%s] Joining an identical download already in progress", downloadID)
+	services.Global.SendProgressSimple(downloadID, "downloading", "Same download already in progress, joining it...")
 
-	msg := "Processing video..."
-	if isGif {
-		msg = "Converting to GIF..."
+	result, err := flight.Wait(r.Context(), downloadID)
+	if r.Context().Err() != nil {
+		flight.Leave(downloadID)
+		util.CleanupJobFiles(downloadID)
+		return
 	}
-	p := float64(100)
-	services.Global.SendProgress(downloadID, "processing", msg, &p, nil)
-
-	processed, err := services.ProcessVideo(downloadedPath, actualFinalFile, services.ProcessVideoOpts{
-		IsAudio:      isAudio,
-		IsGif:        isGif,
-		AudioFormat:  audioFormat,
-		AudioBitrate: audioBitrate,
-		Container:    container,
-		JobID:        downloadID,
-	})
 	if err != nil {
-		handleDownloadError(w, downloadID, outputExt, err)
+		services.Global.SendProgressSimple(downloadID, "error", err.Error())
+		respondJSON(w, 500, map[string]string{"error": err.Error()})
 		return
 	}
+	services.StreamFile(w, r, result.Path, orDefault(filename, "download"), result.Ext,
+		result.mimeType(), downloadID, rawURL, "download", nil)
+}
 
-	if !processed.Skipped {
-		os.Remove(downloadedPath)
-	}
+// handleDownloadResume delivers a streaming download whose client lost its
+// connection, waiting for the job if it's still running. The job is looked
+// up by the ID the original request used as progressId.
+func handleDownloadResume(w http.ResponseWriter, r *http.Request) {
+	downloadID := chi.URLParam(r, "id")
+	clientID := effectiveClientID(r, r.URL.Query().Get("clientId"))
 
-	streamPath := actualFinalFile
-	if processed.Skipped {
-		streamPath = processed.Path
+	resumed := services.Global.GetResumedJob(downloadID)
+	if resumed == nil {
+		respondJSON(w, 404, map[string]string{"error": "Nothing to resume, the download already finished or expired"})
+		return
 	}
-
-	if _, err := os.Stat(streamPath); os.IsNotExist(err) {
-		handleDownloadError(w, downloadID, outputExt, fmt.Errorf("Processing failed - output file not created"))
+	if resumed.ClientID != clientID {
+		respondJSON(w, 403, map[string]string{"error": "This download belongs to someone else"})
 		return
 	}
-
-	if processInfo.IsCancelled() {
-		handleDownloadError(w, downloadID, outputExt, fmt.Errorf("Download cancelled"))
+	if !resumed.Attach() {
+		respondJSON(w, 409, map[string]string{"error": "This download is already being resumed"})
 		return
 	}
 
-	services.StreamFile(w, r, streamPath, orDefault(filename, "download"), actualOutputExt,
-		services.GetMimeType(actualOutputExt, isAudio, isGif),
-		downloadID, rawURL, "download", nil)
+	log.Printf("[Reconnect] Client came back for job %s", downloadID)
+	file, err := resumed.Wait(r.Context())
+	if r.Context().Err() != nil {
+		resumed.Detach()
+		return
+	}
+	if err != nil {
+		services.Global.DeleteResumedJob(downloadID)
+		respondJSON(w, 500, map[string]string{"error": util.ToUserError(err.Error())})
+		return
+	}
+	// Until the file has gone out in full the job stays parked, so the
+	// client can come back again for the rest with Range.
+	if services.StreamFile(w, r, file.Path, file.Filename, file.Ext, file.MimeType, downloadID, file.SourceURL, "download", nil) {
+		services.Global.DeleteResumedJob(downloadID)
+	} else {
+		resumed.Detach()
+	}
 }
 
 func handleDownloadError(w http.ResponseWriter, downloadID, outputExt string, err error) {
 	log.Printf("[%s] Error: %s", downloadID, err)
+	metrics.JobsFailed.Inc("download")
 	alerts.DownloadFailed(downloadID, "", err)
 	if util.NeedsCookiesRetry(err.Error()) {
 		util.TriggerCookieRefresh("YouTube bot detection during download")
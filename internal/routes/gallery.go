@@ -21,6 +21,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -185,6 +186,23 @@ func handleGalleryDownload(w http.ResponseWriter, r *http.Request) {
 	clientID := effectiveClientID(r, r.URL.Query().Get("clientId"))
 	filename := r.URL.Query().Get("filename")
 
+	if !allowKeyJob(w, r, "gallery") {
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		callbackURL := r.URL.Query().Get("callbackUrl")
+		if !checkCallbackURL(w, callbackURL) {
+			return
+		}
+		body := galleryRequest{URL: rawURL, Filename: filename, ClientID: clientID, ProgressID: progressID}
+		if jobID, ok := startGalleryJob(w, r, body); ok {
+			services.Global.WatchJob(jobID, callbackURL)
+			respondJSON(w, 202, jobCreated(jobID, "gallery", false))
+		}
+		return
+	}
+
 	if !util.GalleryDlAvailable {
 		respondJSON(w, 503, map[string]string{"error": "gallery-dl not installed on server"})
 		return
@@ -200,14 +218,14 @@ func handleGalleryDownload(w http.ResponseWriter, r *http.Request) {
 		downloadID = uuid.New().String()
 	}
 
-	if !services.Global.TryReserveClientJob(downloadID, clientID, config.MaxJobsPerClient) {
+	if !services.Global.TryReserveClientJob(downloadID, clientID, config.Get().MaxJobsPerClient) {
 		respondJSON(w, 429, map[string]string{
-			"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.MaxJobsPerClient),
+			"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient),
 		})
 		return
 	}
 
-	jobCheck := services.Global.CanStartJob("download")
+	jobCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("download", downloadID, clientID))
 	if !jobCheck.OK {
 		services.Global.UnlinkJobFromClient(downloadID)
 		services.Global.SendProgressSimple(downloadID, "error", jobCheck.Reason)
@@ -233,7 +251,7 @@ func handleGalleryDownload(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	err := runGalleryDl(rawURL, galleryDir, downloadID, processInfo, r)
+	err := runGalleryDl(r.Context(), rawURL, galleryDir, downloadID, processInfo, sseProgress(downloadID))
 	if err != nil {
 		galleryError(w, downloadID, processInfo, err, cleanup)
 		return
@@ -246,9 +264,9 @@ func handleGalleryDownload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(allFiles) == 1 {
-		sendGallerySingleFile(w, allFiles[0], filename, downloadID, cleanup)
+		sendGallerySingleFile(w, r, allFiles[0], filename, downloadID, cleanup)
 	} else {
-		sendGalleryZipFile(w, allFiles, filename, rawURL, downloadID, cleanup)
+		sendGalleryZipFile(w, r, allFiles, filename, rawURL, downloadID, cleanup)
 	}
 }
 
@@ -258,6 +276,23 @@ func handleSlideshow(w http.ResponseWriter, r *http.Request) {
 	clientID := effectiveClientID(r, r.URL.Query().Get("clientId"))
 	filename := r.URL.Query().Get("filename")
 
+	if !allowKeyJob(w, r, "gallery") {
+		return
+	}
+
+	if r.URL.Query().Get("async") == "true" {
+		callbackURL := r.URL.Query().Get("callbackUrl")
+		if !checkCallbackURL(w, callbackURL) {
+			return
+		}
+		body := galleryRequest{URL: rawURL, Filename: filename, ClientID: clientID, ProgressID: progressID}
+		if jobID, ok := startGalleryJob(w, r, body); ok {
+			services.Global.WatchJob(jobID, callbackURL)
+			respondJSON(w, 202, jobCreated(jobID, "gallery", false))
+		}
+		return
+	}
+
 	if !util.GalleryDlAvailable {
 		respondJSON(w, 503, map[string]string{"error": "gallery-dl not installed on server"})
 		return
@@ -273,14 +308,14 @@ func handleSlideshow(w http.ResponseWriter, r *http.Request) {
 		downloadID = uuid.New().String()
 	}
 
-	if !services.Global.TryReserveClientJob(downloadID, clientID, config.MaxJobsPerClient) {
+	if !services.Global.TryReserveClientJob(downloadID, clientID, config.Get().MaxJobsPerClient) {
 		respondJSON(w, 429, map[string]string{
-			"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.MaxJobsPerClient),
+			"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient),
 		})
 		return
 	}
 
-	jobCheck := services.Global.CanStartJob("download")
+	jobCheck := services.Global.WaitForJobSlot(r.Context(), jobRequest("download", downloadID, clientID))
 	if !jobCheck.OK {
 		services.Global.UnlinkJobFromClient(downloadID)
 		services.Global.SendProgressSimple(downloadID, "error", jobCheck.Reason)
@@ -306,7 +341,7 @@ func handleSlideshow(w http.ResponseWriter, r *http.Request) {
 		}()
 	}
 
-	err := runGalleryDl(rawURL, galleryDir, downloadID, processInfo, r)
+	err := runGalleryDl(r.Context(), rawURL, galleryDir, downloadID, processInfo, sseProgress(downloadID))
 	if err != nil {
 		galleryError(w, downloadID, processInfo, err, cleanup)
 		return
@@ -339,9 +374,9 @@ func handleSlideshow(w http.ResponseWriter, r *http.Request) {
 	if len(audioFiles) == 0 {
 		log.Printf("[%s] No audio found, falling back to gallery download\n", downloadID)
 		if len(allFiles) == 1 {
-			sendGallerySingleFile(w, allFiles[0], filename, downloadID, cleanup)
+			sendGallerySingleFile(w, r, allFiles[0], filename, downloadID, cleanup)
 		} else {
-			sendGalleryZipFile(w, allFiles, filename, rawURL, downloadID, cleanup)
+			sendGalleryZipFile(w, r, allFiles, filename, rawURL, downloadID, cleanup)
 		}
 		return
 	}
@@ -433,10 +468,10 @@ func handleSlideshow(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendGallerySingleFile(w, outputFile, filename, downloadID, cleanup)
+	sendGallerySingleFile(w, r, outputFile, filename, downloadID, cleanup)
 }
 
-func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.ProcessInfo, r *http.Request) error {
+func runGalleryDl(ctx context.Context, rawURL, galleryDir, downloadID string, processInfo *services.ProcessInfo, report progressFunc) error {
 	args := []string{
 		"-d", galleryDir,
 		"--filename", "{num:03d}_{filename}.{extension}",
@@ -449,6 +484,9 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 	}
 
 	log.Printf("[%s] gallery-dl starting\n", downloadID)
+	site := metrics.Site(rawURL)
+	metrics.DownloadsStarted.Inc(site)
+	start := time.Now()
 
 	cmd := exec.Command("gallery-dl", args...)
 	processInfo.SetCmd(cmd)
@@ -457,6 +495,7 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 	stderrPipe, _ := cmd.StderrPipe()
 
 	if err := cmd.Start(); err != nil {
+		metrics.DownloadsFinished.Inc(site, "error")
 		return fmt.Errorf("failed to start gallery-dl: %w", err)
 	}
 
@@ -472,8 +511,7 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 					downloadedCount++
 					if time.Since(lastUpdate) > 500*time.Millisecond {
 						lastUpdate = time.Now()
-						services.Global.SendProgress(downloadID, "downloading",
-							fmt.Sprintf("Downloaded %d images...", downloadedCount),
+						report("downloading", fmt.Sprintf("Downloaded %d images...", downloadedCount),
 							nil, map[string]interface{}{"downloadedCount": downloadedCount})
 					}
 				}
@@ -492,7 +530,7 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 	done := make(chan struct{})
 	go func() {
 		select {
-		case <-r.Context().Done():
+		case <-ctx.Done():
 			processInfo.SetCancelled(true)
 			if cmd.Process != nil {
 				cmd.Process.Kill()
@@ -503,6 +541,7 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 
 	err := cmd.Wait()
 	close(done)
+	metrics.DownloadsFinished.Inc(site, metrics.Result(err, processInfo.IsCancelled()))
 
 	if processInfo.IsCancelled() {
 		return fmt.Errorf("Download cancelled")
@@ -512,6 +551,7 @@ func runGalleryDl(rawURL, galleryDir, downloadID string, processInfo *services.P
 		log.Printf("[%s] gallery-dl exited with error: %s\n", downloadID, truncStr(errMsg, 200))
 		return fmt.Errorf("gallery-dl failed: %s", truncStr(errMsg, 200))
 	}
+	metrics.ObserveStage("download", site, start)
 	return nil
 }
 
@@ -529,23 +569,9 @@ func collectDownloadedFiles(dir string) []string {
 	return files
 }
 
-func sendGallerySingleFile(w http.ResponseWriter, filePath, filename, downloadID string, cleanup func()) {
+func sendGallerySingleFile(w http.ResponseWriter, r *http.Request, filePath, filename, downloadID string, cleanup func()) {
 	ext := strings.ToLower(filepath.Ext(filePath))
-	mimeTypes := map[string]string{
-		".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png",
-		".gif": "image/gif", ".webp": "image/webp", ".mp4": "video/mp4", ".webm": "video/webm",
-	}
-	mimeType := mimeTypes[ext]
-	if mimeType == "" {
-		mimeType = "application/octet-stream"
-	}
-
-	stat, err := os.Stat(filePath)
-	if err != nil {
-		services.Global.SendProgressSimple(downloadID, "error", "Failed to send file")
-		cleanup()
-		return
-	}
+	mimeType := galleryMimeType(ext)
 
 	safeName := util.SanitizeFilename(filename)
 	if safeName == "" {
@@ -554,38 +580,21 @@ func sendGallerySingleFile(w http.ResponseWriter, filePath, filename, downloadID
 	safeName += ext
 
 	services.Global.SendProgressSimple(downloadID, "sending", "Sending file...")
-
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, safeName, url.PathEscape(safeName)))
-
-	f, err := os.Open(filePath)
-	if err != nil {
-		services.Global.SendProgressSimple(downloadID, "error", "Failed to send file")
+	if _, err := services.ServeFile(w, r, services.Delivery{Path: filePath, Name: safeName, MimeType: mimeType}); err != nil {
+		services.Global.SendProgressSimple(downloadID, "error", err.Error())
 		cleanup()
 		return
 	}
-	defer f.Close()
-
-	io.Copy(w, f)
 	services.Global.SendProgressSimple(downloadID, "complete", "Download complete!")
 	cleanup()
 }
 
-func sendGalleryZipFile(w http.ResponseWriter, allFiles []string, filename, rawURL, downloadID string, cleanup func()) {
+func sendGalleryZipFile(w http.ResponseWriter, r *http.Request, allFiles []string, filename, rawURL, downloadID string, cleanup func()) {
 	services.Global.SendProgressWithPercent(downloadID, "zipping",
 		fmt.Sprintf("Creating zip with %d images...", len(allFiles)), 90)
 
 	zipPath := filepath.Join(config.TempDirs["gallery"], downloadID+".zip")
-	parsed, _ := url.Parse(rawURL)
-	hostname := strings.TrimPrefix(parsed.Hostname(), "www.")
-	safeZipName := util.SanitizeFilename(filename)
-	if safeZipName == "" {
-		safeZipName = util.SanitizeFilename(hostname)
-	}
-	if safeZipName == "" {
-		safeZipName = "gallery"
-	}
+	safeZipName := galleryZipName(filename, rawURL)
 
 	zipFile, err := os.Create(zipPath)
 	if err != nil {
@@ -613,30 +622,40 @@ func sendGalleryZipFile(w http.ResponseWriter, allFiles []string, filename, rawU
 
 	services.Global.SendProgressSimple(downloadID, "sending", "Sending zip file...")
 
-	stat, err := os.Stat(zipPath)
+	_, err = services.ServeFile(w, r, services.Delivery{Path: zipPath, Name: safeZipName + ".zip", MimeType: "application/zip"})
 	if err != nil {
-		services.Global.SendProgressSimple(downloadID, "error", "Failed to send zip")
+		services.Global.SendProgressSimple(downloadID, "error", err.Error())
 		cleanup()
 		return
 	}
+	services.Global.SendProgressSimple(downloadID, "complete",
+		fmt.Sprintf("Downloaded %d images!", len(allFiles)))
+	cleanup()
+}
 
-	zipFilename := safeZipName + ".zip"
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, zipFilename, url.PathEscape(zipFilename)))
+var galleryMIMEs = map[string]string{
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png",
+	".gif": "image/gif", ".webp": "image/webp", ".mp4": "video/mp4", ".webm": "video/webm",
+}
 
-	f, err := os.Open(zipPath)
-	if err != nil {
-		services.Global.SendProgressSimple(downloadID, "error", "Failed to send zip")
-		cleanup()
-		return
+func galleryMimeType(ext string) string {
+	if mimeType := galleryMIMEs[ext]; mimeType != "" {
+		return mimeType
 	}
-	defer f.Close()
+	return "application/octet-stream"
+}
 
-	io.Copy(w, f)
-	services.Global.SendProgressSimple(downloadID, "complete",
-		fmt.Sprintf("Downloaded %d images!", len(allFiles)))
-	cleanup()
+func galleryZipName(filename, rawURL string) string {
+	parsed, _ := url.Parse(rawURL)
+	hostname := strings.TrimPrefix(parsed.Hostname(), "www.")
+	safeZipName := util.SanitizeFilename(filename)
+	if safeZipName == "" {
+		safeZipName = util.SanitizeFilename(hostname)
+	}
+	if safeZipName == "" {
+		safeZipName = "gallery"
+	}
+	return safeZipName
 }
 
 func runSlideshowFfmpeg(args []string, downloadID string, processInfo *services.ProcessInfo) error {
@@ -693,6 +712,7 @@ func runSlideshowFfmpeg(args []string, downloadID string, processInfo *services.
 func galleryError(w http.ResponseWriter, downloadID string, processInfo *services.ProcessInfo, err error, cleanup func()) {
 	log.Printf("[%s] Gallery error: %s\n", downloadID, err.Error())
 	if !processInfo.IsCancelled() {
+		metrics.JobsFailed.Inc("gallery")
 		alerts.GalleryFailed(downloadID, "", err)
 		services.Global.SendProgressSimple(downloadID, "error", err.Error())
 	}
@@ -1,14 +1,13 @@
 package routes
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"regexp"
 	"strconv"
-	"strings"
 
+	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
 
@@ -69,6 +68,113 @@ func effectiveClientID(r *http.Request, clientID string) string {
 	return "ip:" + util.GetClientIP(r)
 }
 
+// allowKeyJob counts a new job against the API key the request was made
+// with, writing a 403 or 429 if the key can't start it. Requests without
+// a key always pass.
+func allowKeyJob(w http.ResponseWriter, r *http.Request, jobType string) bool {
+	key := services.APIKeyFrom(r.Context())
+	if key == nil {
+		return true
+	}
+	if err := services.Global.UseAPIKeyJob(key, jobType); err != nil {
+		code := 429
+		if errors.Is(err, services.ErrJobTypeNotAllowed) {
+			code = 403
+		}
+		respondJSON(w, code, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// allowKeyBytes writes a 429 if sending size bytes would take the
+// request's API key past its daily byte quota. The bytes themselves are
+// counted once they've been written (see middleware.APIKeys).
+func allowKeyBytes(w http.ResponseWriter, r *http.Request, size int64) bool {
+	key := services.APIKeyFrom(r.Context())
+	if key == nil {
+		return true
+	}
+	if err := services.Global.CheckAPIKeyBytes(key, size); err != nil {
+		respondJSON(w, 429, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// chargeKeyBytes counts size bytes against the request's API key for a
+// file it's about to be redirected to, writing a 429 if they don't fit in
+// what's left of its daily byte quota.
+func chargeKeyBytes(w http.ResponseWriter, r *http.Request, size int64) bool {
+	key := services.APIKeyFrom(r.Context())
+	if key == nil {
+		return true
+	}
+	if err := services.Global.ChargeAPIKeyBytes(key, size); err != nil {
+		respondJSON(w, 429, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// beginTransfer is services.BeginTransfer, writing a 429 when the client
+// is already at its limit of simultaneous downloads.
+func beginTransfer(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	tw, done, err := services.BeginTransfer(w, r)
+	if err != nil {
+		respondJSON(w, 429, map[string]string{"error": err.Error()})
+		return nil, nil, false
+	}
+	return tw, done, true
+}
+
+// authenticatedRequest reports whether a request carries credentials,
+// either an Authorization header or an API key. What it gets back may be
+// private to the caller, so it skips the result cache.
+func authenticatedRequest(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Key") != "" ||
+		services.APIKeyFrom(r.Context()) != nil
+}
+
+// checkCallbackURL validates an optional callbackUrl, writing a 400 when
+// it can't be used.
+func checkCallbackURL(w http.ResponseWriter, callbackURL string) bool {
+	if callbackURL == "" {
+		return true
+	}
+	if check := util.ValidateURL(callbackURL); !check.Valid {
+		respondJSON(w, 400, map[string]string{"error": "Invalid callbackUrl: " + check.Error})
+		return false
+	}
+	return true
+}
+
+// jobRequest describes a job asking for a slot. Jobs created by the bot
+// routes carry OriginBot so the scheduler can give them their share, and
+// the user they were started for so one user can't take all of it.
+func jobRequest(jobType, jobID, clientID string) services.JobRequest {
+	req := services.JobRequest{Type: jobType, ID: jobID, ClientID: clientID, Origin: services.OriginWeb}
+	if job := services.Global.GetAsyncJob(jobID); job != nil && job.Origin != "" {
+		req.Origin = job.Origin
+		if clientID == "" {
+			req.ClientID = orDefault(job.Requester, job.Origin)
+		}
+	}
+	return req
+}
+
+// botRequester is who a bot route's job is for: the Discord user the bot
+// passed along, or else the API key it called with.
+func botRequester(r *http.Request, userID string) string {
+	if userID != "" {
+		return "user:" + userID
+	}
+	if key := services.APIKeyFrom(r.Context()); key != nil {
+		return "key:" + key.ID
+	}
+	return services.OriginBot
+}
+
 func contains(slice []string, val string) bool {
 	for _, s := range slice {
 		if s == val {
@@ -78,20 +184,10 @@ func contains(slice []string, val string) bool {
 	return false
 }
 
-func toASCIIFilename(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		if r >= 0x20 && r <= 0x7E {
-			b.WriteRune(r)
-		} else {
-			b.WriteRune('_')
-		}
-	}
-	return b.String()
-}
-
-func randomToken() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+// issueDownloadToken signs a download token for dl and keeps a record of
+// it, so the token can also be listed, restored and expired like before.
+func issueDownloadToken(jobID string, dl *services.BotDownload) string {
+	token := services.Tokens.Sign(services.ClaimsFor(jobID, dl))
+	services.Global.SetBotDownload(token, dl)
+	return token
 }
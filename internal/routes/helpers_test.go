@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coah80/yoink/internal/services"
+)
+
+func TestAuthenticatedRequest(t *testing.T) {
+	plain := httptest.NewRequest("POST", "/api/download", nil)
+	if authenticatedRequest(plain) {
+		t.Error("request without credentials counted as authenticated")
+	}
+
+	withHeader := httptest.NewRequest("POST", "/api/download", nil)
+	withHeader.Header.Set("X-API-Key", "yk_abc_def")
+	withKey := plain.WithContext(services.WithAPIKey(plain.Context(), &services.APIKey{ID: "abc"}))
+	withAuth := httptest.NewRequest("POST", "/api/download", nil)
+	withAuth.Header.Set("Authorization", "Bearer secret")
+	for name, r := range map[string]*http.Request{"X-API-Key": withHeader, "API key": withKey, "Authorization": withAuth} {
+		if !authenticatedRequest(r) {
+			t.Errorf("request with %s not counted as authenticated", name)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/coah80/yoink/internal/alerts"
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
+	"github.com/coah80/yoink/internal/util"
+)
+
+var jobTypes = []string{"download", "playlist", "batch", "convert", "compress", "gallery", "transcribe", "pipeline"}
+
+func JobsRoutes(r chi.Router) {
+	r.Post("/api/v2/jobs", handleCreateJob)
+	r.Get("/api/v2/jobs/{jobId}", handleGetJob)
+	r.Delete("/api/v2/jobs/{jobId}", handleDeleteJob)
+	r.Get("/api/v2/jobs/{jobId}/result", handleJobResult)
+}
+
+type downloadRequest struct {
+	URL          string `json:"url"`
+	Format       string `json:"format"`
+	Quality      string `json:"quality"`
+	Container    string `json:"container"`
+	AudioFormat  string `json:"audioFormat"`
+	AudioBitrate string `json:"audioBitrate"`
+	Filename     string `json:"filename"`
+	ClientID     string `json:"clientId"`
+	ProgressID   string `json:"progressId"`
+	TwitterGifs  *bool  `json:"twitterGifs"`
+	Playlist     bool   `json:"playlist"`
+	NoCache      bool   `json:"-"`
+}
+
+type galleryRequest struct {
+	URL        string `json:"url"`
+	Filename   string `json:"filename"`
+	ClientID   string `json:"clientId"`
+	ProgressID string `json:"progressId"`
+}
+
+type transcribeRequest struct {
+	FilePath           string  `json:"filePath"`
+	FileName           string  `json:"fileName"`
+	ClientID           string  `json:"clientId"`
+	OutputMode         string  `json:"outputMode"`
+	Model              string  `json:"model"`
+	SubtitleFormat     string  `json:"subtitleFormat"`
+	Language           string  `json:"language"`
+	CaptionSize        int     `json:"captionSize"`
+	MaxWordsPerCaption int     `json:"maxWordsPerCaption"`
+	MaxCharsPerLine    int     `json:"maxCharsPerLine"`
+	MinDuration        float64 `json:"minDuration"`
+	CaptionGap         float64 `json:"captionGap"`
+}
+
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	var spec struct {
+		Type        string `json:"type"`
+		CallbackURL string `json:"callbackUrl"`
+	}
+	if err != nil || json.Unmarshal(raw, &spec) != nil {
+		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if !checkCallbackURL(w, spec.CallbackURL) {
+		return
+	}
+
+	if contains(jobTypes, spec.Type) && !allowKeyJob(w, r, spec.Type) {
+		return
+	}
+
+	var jobID string
+	var queued, ok bool
+	switch spec.Type {
+	case "download":
+		var body downloadRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startDownloadJob(w, r, body)
+	case "playlist":
+		var body playlistRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, queued, ok = startPlaylistJob(w, r, body)
+	case "batch":
+		var body batchRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, queued, ok = startBatchJob(w, r, body)
+	case "gallery":
+		var body galleryRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startGalleryJob(w, r, body)
+	case "convert":
+		var body convertRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startConvertJob(w, r, body)
+	case "compress":
+		var body compressRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startCompressJob(w, r, body)
+	case "transcribe":
+		var body transcribeRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startTranscribeJob(w, r, body)
+	case "pipeline":
+		var body pipelineRequest
+		if json.Unmarshal(raw, &body) != nil {
+			respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
+			return
+		}
+		jobID, ok = startPipelineJob(w, r, body)
+	default:
+		respondJSON(w, 400, map[string]string{"error": fmt.Sprintf("Invalid job type. Allowed: %s", strings.Join(jobTypes, ", "))})
+		return
+	}
+	if !ok {
+		return
+	}
+	services.Global.WatchJob(jobID, spec.CallbackURL)
+
+	respondJSON(w, 202, jobCreated(jobID, spec.Type, queued))
+}
+
+func jobCreated(jobID, jobType string, queued bool) map[string]interface{} {
+	return map[string]interface{}{
+		"jobId":     jobID,
+		"type":      jobType,
+		"queued":    queued,
+		"statusUrl": "/api/v2/jobs/" + jobID,
+		"resultUrl": "/api/v2/jobs/" + jobID + "/result",
+	}
+}
+
+// newJobID uses the client's progress ID when it is free, so SSE progress
+// subscribed before the job started still reaches it.
+func newJobID(progressID string) string {
+	if progressID == "" || services.Global.GetAsyncJob(progressID) != nil || services.Global.GetProcess(progressID) != nil {
+		return uuid.New().String()
+	}
+	return progressID
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	job := services.Global.GetAsyncJob(jobID)
+	if job == nil {
+		respondJSON(w, 404, map[string]string{"error": "Job not found or expired"})
+		return
+	}
+	status := job.GetJobStatus()
+	status["id"] = jobID
+	respondJSON(w, 200, status)
+}
+
+func handleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	job := services.Global.GetAsyncJob(jobID)
+	if job == nil {
+		respondJSON(w, 404, map[string]string{"error": "Job not found or expired"})
+		return
+	}
+
+	clientID := effectiveClientID(r, r.URL.Query().Get("clientId"))
+	if owner := services.Global.GetJobOwner(jobID); owner != "" && owner != clientID {
+		respondJSON(w, 403, map[string]string{"error": "Not authorized to cancel this job"})
+		return
+	}
+
+	// Marking the job first covers the stretches where there's nothing to
+	// kill: bot downloads, setup, and the gaps between pipeline steps.
+	if !job.Cancel() {
+		status, _, _, _, _ := job.GetStatus()
+		respondJSON(w, 409, map[string]string{"error": "Job has already finished", "status": status})
+		return
+	}
+	if !cancelJob(jobID) {
+		services.Global.SendProgressSimple(jobID, "cancelled", "Cancelled")
+	}
+	respondJSON(w, 200, map[string]string{"jobId": jobID, "status": "cancelled"})
+}
+
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobId")
+	job := services.Global.GetAsyncJob(jobID)
+	if job == nil {
+		respondJSON(w, 404, map[string]string{"error": "Job not found or expired"})
+		return
+	}
+
+	job.Lock()
+	status, token, jobType, outputPath := job.Status, job.DownloadToken, job.Type, job.OutputPath
+	job.Unlock()
+
+	if status != "complete" {
+		respondJSON(w, 409, map[string]string{"error": "Job not complete yet", "status": status})
+		return
+	}
+
+	switch {
+	case token != "":
+		downloadPath := "/api/bot/download/"
+		if jobType == "playlist" || jobType == "batch" {
+			downloadPath = "/api/playlist/download/"
+		}
+		http.Redirect(w, r, downloadPath+token, http.StatusSeeOther)
+	case outputPath != "":
+		handleJobDownload(w, r)
+	default:
+		respondJSON(w, 404, map[string]string{"error": "Output file not found"})
+	}
+}
+
+func (d downloadRequest) mediaOpts(dir string) mediaOpts {
+	return mediaOpts{
+		URL:          d.URL,
+		Format:       orDefault(d.Format, "video"),
+		Quality:      orDefault(d.Quality, "1080p"),
+		Container:    orDefault(d.Container, "mp4"),
+		AudioFormat:  orDefault(d.AudioFormat, "mp3"),
+		AudioBitrate: orDefault(d.AudioBitrate, "320"),
+		TwitterGifs:  d.TwitterGifs == nil || *d.TwitterGifs,
+		Playlist:     d.Playlist,
+		Dir:          dir,
+		NoCache:      d.NoCache,
+	}
+}
+
+func startDownloadJob(w http.ResponseWriter, r *http.Request, body downloadRequest) (string, bool) {
+	check := util.ValidateURL(body.URL)
+	if !check.Valid {
+		respondJSON(w, 400, map[string]string{"error": check.Error})
+		return "", false
+	}
+
+	body.NoCache = body.NoCache || authenticatedRequest(r)
+	opts := body.mediaOpts(config.TempDirs["download"])
+	outputExt := opts.Container
+	if opts.Format == "audio" {
+		outputExt = opts.AudioFormat
+	}
+
+	jobID := newJobID(body.ProgressID)
+	clientID := effectiveClientID(r, body.ClientID)
+	if !services.Global.TryReserveClientJob(jobID, clientID, config.Get().MaxJobsPerClient) {
+		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient)})
+		return "", false
+	}
+
+	job := &services.AsyncJob{
+		Status:    "starting",
+		Message:   "Initializing download...",
+		CreatedAt: time.Now(),
+		Type:      "download",
+		URL:       body.URL,
+		Format:    outputExt,
+	}
+	services.Global.SetAsyncJob(jobID, job)
+
+	go processDownloadJob(jobID, job, clientID, opts, body.Filename)
+	return jobID, true
+}
+
+func processDownloadJob(jobID string, job *services.AsyncJob, clientID string, opts mediaOpts, filename string) {
+	flight, leader := joinDownload(opts, jobID)
+	if !leader {
+		followDownloadJob(jobID, job, flight, filename)
+		return
+	}
+	defer finishDownload(flight, nil, fmt.Errorf("Download failed"))
+
+	if check := services.Global.WaitForJobSlot(context.Background(), jobRequest("download", jobID, clientID)); !check.OK {
+		finishDownload(flight, nil, fmt.Errorf("%s", check.Reason))
+		slotDenied(jobID, job, check.Reason)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processInfo := &services.ProcessInfo{JobType: "download", CancelFunc: cancel}
+	services.Global.SetProcess(jobID, processInfo)
+	defer services.Global.ReleaseJob(jobID)
+
+	result, err := fetchMedia(ctx, jobID, processInfo, opts, sharedProgress(flight, asyncProgress(jobID, job)))
+	finishDownload(flight, result, userError(err))
+	if err != nil {
+		asyncJobError(jobID, job, processInfo, opts.Dir, err, alerts.DownloadFailed)
+		return
+	}
+
+	fileName := util.SanitizeFilename(orDefault(filename, "download")) + "." + result.Ext
+	completeWithToken(jobID, job, result.Path, fileName, result.mimeType())
+}
+
+// followDownloadJob completes an async download from the identical
+// download that's already running, without taking a job slot.
+func followDownloadJob(jobID string, job *services.AsyncJob, flight *services.Flight[*mediaResult], filename string) {
+	defer services.Global.UnlinkJobFromClient(jobID)
+	log.Printf("[AsyncJob] Download job %s joined an identical download already in progress", jobID)
+	job.Lock()
+	job.Status = "downloading"
+	job.Message = "Same download already in progress, joining it..."
+	job.Unlock()
+
+	result, err := flight.Wait(context.Background(), jobID)
+	if err != nil {
+		job.Lock()
+		job.Status = "error"
+		job.Message = err.Error()
+		job.Error = err.Error()
+		job.Unlock()
+		return
+	}
+	fileName := util.SanitizeFilename(orDefault(filename, "download")) + "." + result.Ext
+	completeWithToken(jobID, job, result.Path, fileName, result.mimeType())
+}
+
+func startGalleryJob(w http.ResponseWriter, r *http.Request, body galleryRequest) (string, bool) {
+	if !util.GalleryDlAvailable {
+		respondJSON(w, 503, map[string]string{"error": "gallery-dl not installed on server"})
+		return "", false
+	}
+	if validation := util.ValidateURL(body.URL); !validation.Valid {
+		respondJSON(w, 400, map[string]string{"error": validation.Error})
+		return "", false
+	}
+
+	jobID := newJobID(body.ProgressID)
+	clientID := effectiveClientID(r, body.ClientID)
+	if !services.Global.TryReserveClientJob(jobID, clientID, config.Get().MaxJobsPerClient) {
+		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient)})
+		return "", false
+	}
+
+	job := &services.AsyncJob{
+		Status:    "starting",
+		Message:   "Starting gallery download...",
+		CreatedAt: time.Now(),
+		Type:      "gallery",
+		URL:       body.URL,
+	}
+	services.Global.SetAsyncJob(jobID, job)
+
+	go processGalleryJob(jobID, job, clientID, body.URL, body.Filename)
+	return jobID, true
+}
+
+func processGalleryJob(jobID string, job *services.AsyncJob, clientID, rawURL, filename string) {
+	if check := services.Global.WaitForJobSlot(context.Background(), jobRequest("download", jobID, clientID)); !check.OK {
+		slotDenied(jobID, job, check.Reason)
+		return
+	}
+
+	galleryDir := filepath.Join(config.TempDirs["gallery"], "gallery-"+jobID)
+	os.MkdirAll(galleryDir, 0755)
+	defer os.RemoveAll(galleryDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	processInfo := &services.ProcessInfo{TempDir: galleryDir, JobType: "download", CancelFunc: cancel}
+	services.Global.SetProcess(jobID, processInfo)
+	defer services.Global.ReleaseJob(jobID)
+
+	report := asyncProgress(jobID, job)
+	report("downloading", "Starting gallery download...", nil, nil)
+
+	if err := runGalleryDl(ctx, rawURL, galleryDir, jobID, processInfo, report); err != nil {
+		asyncJobError(jobID, job, processInfo, config.TempDirs["gallery"], err, alerts.GalleryFailed)
+		return
+	}
+
+	allFiles := collectDownloadedFiles(galleryDir)
+	if len(allFiles) == 0 {
+		asyncJobError(jobID, job, processInfo, config.TempDirs["gallery"], fmt.Errorf("No images were downloaded"), alerts.GalleryFailed)
+		return
+	}
+
+	if len(allFiles) == 1 {
+		ext := strings.ToLower(filepath.Ext(allFiles[0]))
+		outPath := filepath.Join(config.TempDirs["gallery"], jobID+"-final"+ext)
+		if err := os.Rename(allFiles[0], outPath); err != nil {
+			asyncJobError(jobID, job, processInfo, config.TempDirs["gallery"], err, alerts.GalleryFailed)
+			return
+		}
+		safeName := util.SanitizeFilename(filename)
+		if safeName == "" {
+			safeName = util.SanitizeFilename(strings.TrimSuffix(filepath.Base(allFiles[0]), ext))
+		}
+		completeWithToken(jobID, job, outPath, safeName+ext, galleryMimeType(ext))
+		return
+	}
+
+	report("zipping", fmt.Sprintf("Creating zip with %d images...", len(allFiles)), ptrFloat(90), nil)
+	zipPath := filepath.Join(config.TempDirs["gallery"], jobID+".zip")
+	if err := createZip(zipPath, allFiles); err != nil {
+		asyncJobError(jobID, job, processInfo, config.TempDirs["gallery"], fmt.Errorf("Failed to create zip"), alerts.GalleryFailed)
+		return
+	}
+	completeWithToken(jobID, job, zipPath, galleryZipName(filename, rawURL)+".zip", "application/zip")
+}
+
+func startConvertJob(w http.ResponseWriter, r *http.Request, body convertRequest) (string, bool) {
+	body.ClientID = effectiveClientID(r, body.ClientID)
+	validPath, ok := resolveJobInput(w, body.FilePath)
+	if !ok {
+		return "", false
+	}
+	if err := body.normalize(); err != nil {
+		os.Remove(validPath)
+		respondJSON(w, 400, map[string]string{"error": err.Error()})
+		return "", false
+	}
+
+	jobID := uuid.New().String()
+	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
+		Status:    "processing",
+		Message:   "Starting conversion...",
+		CreatedAt: time.Now(),
+		Type:      "convert",
+		Format:    body.Format,
+	})
+	go runConvertJob(jobID, validPath, body)
+	return jobID, true
+}
+
+func startCompressJob(w http.ResponseWriter, r *http.Request, body compressRequest) (string, bool) {
+	body.ClientID = effectiveClientID(r, body.ClientID)
+	validPath, ok := resolveJobInput(w, body.FilePath)
+	if !ok {
+		return "", false
+	}
+
+	jobID := uuid.New().String()
+	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
+		Status:    "processing",
+		Message:   "Starting compression...",
+		CreatedAt: time.Now(),
+		Type:      "compress",
+	})
+	go runCompressJob(jobID, validPath, body)
+	return jobID, true
+}
+
+func startTranscribeJob(w http.ResponseWriter, r *http.Request, body transcribeRequest) (string, bool) {
+	body.ClientID = effectiveClientID(r, body.ClientID)
+	validPath, ok := resolveJobInput(w, body.FilePath)
+	if !ok {
+		return "", false
+	}
+
+	opts := body.opts()
+
+	jobID := uuid.New().String()
+	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
+		Status:    "processing",
+		Message:   "Starting transcription...",
+		CreatedAt: time.Now(),
+		Type:      "transcribe",
+	})
+	go runTranscribeJob(jobID, validPath, orDefault(body.FileName, "media"), opts)
+	return jobID, true
+}
+
+func (t transcribeRequest) opts() transcribeOpts {
+	opts := transcribeOpts{
+		OutputMode:         orDefault(t.OutputMode, "text"),
+		Model:              orDefault(t.Model, "base"),
+		SubtitleFormat:     orDefault(t.SubtitleFormat, "srt"),
+		Language:           t.Language,
+		CaptionSize:        t.CaptionSize,
+		MaxWordsPerCaption: t.MaxWordsPerCaption,
+		MaxCharsPerLine:    t.MaxCharsPerLine,
+		MinDuration:        t.MinDuration,
+		CaptionGap:         t.CaptionGap,
+		ClientID:           t.ClientID,
+	}
+	if opts.CaptionSize == 0 {
+		opts.CaptionSize = 72
+	}
+	return opts
+}
+
+// resolveJobInput turns an upload path or file token into a checked path
+// under the upload dir, writing a 400 when it can't.
+func resolveJobInput(w http.ResponseWriter, input string) (string, bool) {
+	validPath := resolveFilePath(input)
+	if validPath == "" {
+		respondJSON(w, 400, map[string]string{"error": "Invalid file path"})
+		return "", false
+	}
+	if _, err := os.Stat(validPath); err != nil {
+		respondJSON(w, 400, map[string]string{"error": "File not found. Complete chunked upload first."})
+		return "", false
+	}
+	return validPath, true
+}
+
+// completeWithToken hands a finished file out through a download token,
+// the same way bot downloads are served.
+func completeWithToken(jobID string, job *services.AsyncJob, filePath, fileName, mimeType string) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		job.SetError("Output file not found")
+		return
+	}
+
+	dl := &services.BotDownload{
+		FilePath:      filePath,
+		FileName:      fileName,
+		FileSize:      stat.Size(),
+		MimeType:      mimeType,
+		CreatedAt:     time.Now(),
+		IsWebDownload: true,
+	}
+	if err := services.SaveOutput(context.Background(), dl); err != nil {
+		log.Printf("[AsyncJob] Failed to store output of job %s: %v", jobID, err)
+		os.Remove(filePath)
+		job.SetError("Failed to store output")
+		return
+	}
+	token := issueDownloadToken(jobID, dl)
+
+	job.Lock()
+	if job.Status == "cancelled" {
+		job.Unlock()
+		return
+	}
+	job.Status = "complete"
+	job.Progress = 100
+	job.Message = "Ready for download"
+	job.FileName = fileName
+	job.FileSize = stat.Size()
+	job.DownloadToken = token
+	job.Speed = ""
+	job.ETA = ""
+	job.Unlock()
+
+	services.Global.SendProgressSimple(jobID, "complete", "Ready for download")
+	log.Printf("[AsyncJob] %s job %s complete, token: %s...", job.Type, jobID, token[:8])
+}
+
+// slotDenied records why a job never got a slot. A job cancelled while
+// queued keeps its cancelled status.
+func slotDenied(jobID string, job *services.AsyncJob, reason string) {
+	services.Global.UnlinkJobFromClient(jobID)
+	job.Lock()
+	if job.Status != "cancelled" {
+		job.Status = "error"
+		job.Message = reason
+		job.Error = reason
+	}
+	job.Unlock()
+}
+
+func asyncJobError(jobID string, job *services.AsyncJob, processInfo *services.ProcessInfo, dir string, err error, alert func(jobID, url string, err error)) {
+	defer func() {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if strings.Contains(e.Name(), jobID) {
+				os.RemoveAll(filepath.Join(dir, e.Name()))
+			}
+		}
+	}()
+
+	if processInfo.IsCancelled() {
+		job.Lock()
+		job.Status = "cancelled"
+		job.Message = "Cancelled"
+		job.Unlock()
+		return
+	}
+
+	log.Printf("[AsyncJob] %s job %s failed: %s", job.Type, jobID, err)
+	metrics.JobsFailed.Inc(job.Type)
+	alert(jobID, job.URL, err)
+	if util.NeedsCookiesRetry(err.Error()) {
+		util.TriggerCookieRefresh("YouTube bot detection during download")
+	}
+
+	userErr := util.ToUserError(err.Error())
+	job.Lock()
+	job.Status = "error"
+	job.Message = userErr
+	job.Error = userErr
+	job.DebugError = err.Error()
+	job.Unlock()
+	services.Global.SendProgressSimple(jobID, "error", userErr)
+}
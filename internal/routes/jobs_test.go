@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/services"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+func deleteJob(jobID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("DELETE", "/api/v2/jobs/"+jobID, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("jobId", jobID)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	handleDeleteJob(w, r)
+	return w
+}
+
+func TestDeleteJobCancelsJobWithNothingRunning(t *testing.T) {
+	jobID := uuid.New().String()
+	job := &services.AsyncJob{Status: "processing", Message: "Starting conversion...", CreatedAt: time.Now(), Type: "convert"}
+	services.Global.SetAsyncJob(jobID, job)
+	t.Cleanup(func() { services.Global.DeleteAsyncJob(jobID) })
+
+	if w := deleteJob(jobID); w.Code != 200 {
+		t.Fatalf("cancelling a job still setting up = %d %s, want 200", w.Code, w.Body)
+	}
+	if !job.IsCancelled() {
+		t.Fatal("job wasn't marked cancelled")
+	}
+
+	if w := deleteJob(jobID); w.Code != 409 {
+		t.Fatalf("cancelling a cancelled job = %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,522 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
+	"github.com/coah80/yoink/internal/util"
+)
+
+// progressFunc reports a job's progress. progress may be nil for
+// messages without a percentage.
+type progressFunc func(stage, message string, progress *float64, extra map[string]interface{})
+
+func sseProgress(id string) progressFunc {
+	return func(stage, message string, progress *float64, extra map[string]interface{}) {
+		services.Global.SendProgress(id, stage, message, progress, extra)
+		if progress != nil && stage == "downloading" {
+			services.Global.UpdatePendingJob(id, *progress, "downloading")
+		}
+	}
+}
+
+// asyncProgress sends progress over SSE and mirrors it onto the AsyncJob
+// so pollers see the same thing.
+func asyncProgress(id string, job *services.AsyncJob) progressFunc {
+	return func(stage, message string, progress *float64, extra map[string]interface{}) {
+		services.Global.SendProgress(id, stage, message, progress, extra)
+		job.Lock()
+		defer job.Unlock()
+		if job.Status == "cancelled" {
+			return
+		}
+		job.Status = stage
+		job.Message = message
+		if progress != nil {
+			job.Progress = *progress
+		}
+		if speed, ok := extra["speed"].(string); ok {
+			job.Speed = speed
+		}
+		if eta, ok := extra["eta"].(string); ok {
+			job.ETA = eta
+		}
+	}
+}
+
+type mediaOpts struct {
+	URL          string
+	Format       string
+	Quality      string
+	Container    string
+	AudioFormat  string
+	AudioBitrate string
+	TwitterGifs  bool
+	Playlist     bool
+	Dir          string
+
+	// NoCache keeps the result out of the result cache, for requests
+	// whose results may be private to the caller.
+	NoCache bool
+}
+
+// resultKey is the result cache key for opts. ok is false for requests
+// that bypass the cache: playlists and authenticated requests.
+func (o mediaOpts) resultKey() (key services.ResultKey, ok bool) {
+	if o.Playlist || o.NoCache {
+		return key, false
+	}
+	return services.ResultKey{
+		URL:          o.URL,
+		Format:       o.Format,
+		Quality:      o.Quality,
+		Container:    o.Container,
+		AudioFormat:  o.AudioFormat,
+		AudioBitrate: o.AudioBitrate,
+		TwitterGifs:  o.TwitterGifs,
+	}, true
+}
+
+type mediaResult struct {
+	Path    string
+	Ext     string
+	IsAudio bool
+	IsGif   bool
+}
+
+func (m *mediaResult) mimeType() string {
+	switch m.Ext {
+	case "zip":
+		return "application/zip"
+	case "jpg":
+		return "image/jpeg"
+	}
+	return services.GetMimeType(m.Ext, m.IsAudio, m.IsGif)
+}
+
+// downloadFlights lets identical downloads running at the same time share
+// one job. The leader holds the job slot and does the work; followers get
+// its progress and a copy of its file.
+var downloadFlights services.FlightGroup[*mediaResult]
+
+// joinDownload joins the running download identical to opts, or starts
+// one led by id. Downloads that can't share results always lead, with a
+// nil flight.
+func joinDownload(opts mediaOpts, id string) (*services.Flight[*mediaResult], bool) {
+	key, ok := opts.resultKey()
+	if !ok {
+		return nil, true
+	}
+	return downloadFlights.Join(key.Hash(), id)
+}
+
+// finishDownload hands a leader's result to its followers, each as a hard
+// link named with the follower's ID so it can send and clean up its own
+// copy. err should already be fit to show users.
+func finishDownload(f *services.Flight[*mediaResult], result *mediaResult, err error) {
+	if f == nil {
+		return
+	}
+	f.Finish(func(id string) (*mediaResult, error) {
+		if err != nil {
+			return nil, err
+		}
+		dst := filepath.Join(filepath.Dir(result.Path), fmt.Sprintf("%s-final.%s", id, result.Ext))
+		if linkErr := services.LinkOrCopy(result.Path, dst); linkErr != nil {
+			log.Printf("[%s] Failed to copy shared download: %v", id, linkErr)
+			return nil, fmt.Errorf("Download failed")
+		}
+		shared := *result
+		shared.Path = dst
+		return &shared, nil
+	})
+}
+
+// userError is err as users should see it, for handing to followers.
+func userError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s", util.ToUserError(err.Error()))
+}
+
+// sharedProgress sends a leader's progress to its followers as well.
+func sharedProgress(f *services.Flight[*mediaResult], report progressFunc) progressFunc {
+	if f == nil {
+		return report
+	}
+	return func(stage, message string, progress *float64, extra map[string]interface{}) {
+		report(stage, message, progress, extra)
+		for _, id := range f.Members() {
+			if job := services.Global.GetAsyncJob(id); job != nil {
+				asyncProgress(id, job)(stage, message, progress, extra)
+			} else {
+				sseProgress(id)(stage, message, progress, extra)
+			}
+		}
+	}
+}
+
+// fetchMedia downloads a URL into opts.Dir using the per-site fast paths,
+// falling back to yt-dlp and Cobalt, then remuxes or transcodes the result.
+// Temp disk is reserved for it from the duration /api/metadata cached;
+// without one the reservation is a guess and doesn't cap the download.
+// Results are shared through the result cache where opts allow it. In
+// WORKER_MODE=remote the download itself runs on a worker process.
+func fetchMedia(ctx context.Context, id string, processInfo *services.ProcessInfo, opts mediaOpts, report progressFunc) (*mediaResult, error) {
+	key, cacheable := opts.resultKey()
+	if cacheable {
+		if hit, ok := services.Results.Link(key, opts.Dir, id); ok {
+			log.Printf("[%s] Using cached result", id)
+			report("downloading", "Download complete", ptrFloat(100), nil)
+			return &mediaResult{Path: hit.Path, Ext: hit.Ext, IsAudio: hit.IsAudio, IsGif: hit.IsGif}, nil
+		}
+	}
+
+	duration := services.MetadataCache.Duration(opts.URL)
+	estimate := services.EstimateMediaBytes(duration, opts.Quality, opts.Format == "audio", opts.AudioFormat)
+	abort := services.AbortProcess(processInfo)
+	if duration <= 0 {
+		abort = nil
+	}
+	disk, err := services.Global.ReserveDisk(id, opts.Dir, estimate, abort)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Release()
+
+	site := metrics.Site(opts.URL)
+	metrics.DownloadsStarted.Inc(site)
+	var result *mediaResult
+	if config.WorkerMode == "remote" {
+		result, err = remoteMedia(ctx, id, opts, report)
+	} else {
+		result, err = downloadMedia(ctx, id, site, processInfo, opts, report)
+	}
+	if err != nil {
+		err = disk.Check(err)
+	}
+	metrics.DownloadsFinished.Inc(site, metrics.Result(err, processInfo.IsCancelled()))
+	if err == nil && cacheable && result.Ext != "zip" {
+		services.Results.Put(key, result.Path, result.Ext, result.IsAudio, result.IsGif)
+	}
+	return result, err
+}
+
+func downloadMedia(ctx context.Context, id, site string, processInfo *services.ProcessInfo, opts mediaOpts, report progressFunc) (*mediaResult, error) {
+	rawURL := opts.URL
+	dir := opts.Dir
+	isAudio := opts.Format == "audio"
+	if services.IsTikTokMusicURL(rawURL) {
+		isAudio = true
+	}
+	outputExt := opts.Container
+	if isAudio {
+		outputExt = opts.AudioFormat
+	}
+	finalFile := filepath.Join(dir, fmt.Sprintf("%s-final.%s", id, outputExt))
+
+	isYouTube := strings.Contains(rawURL, "youtube.com") || strings.Contains(rawURL, "youtu.be")
+	complete := func() {
+		p := float64(100)
+		report("downloading", "Download complete", &p, nil)
+	}
+	ytdlpProgress := func(progress float64, speed, eta string) {
+		report("downloading", fmt.Sprintf("Downloading... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
+	}
+	byteProgress := func(label string) func(float64, int64, int64) {
+		return func(progress float64, downloaded, total int64) {
+			report("downloading", fmt.Sprintf("%s %.0f%%", label, progress), &progress, nil)
+		}
+	}
+	ytdlpOpts := services.DownloadOpts{
+		IsAudio:     isAudio,
+		AudioFormat: opts.AudioFormat,
+		Quality:     opts.Quality,
+		Container:   opts.Container,
+		TempDir:     dir,
+		ProcessInfo: processInfo,
+		OnProgress:  ytdlpProgress,
+	}
+
+	if opts.Format == "photo" && isYouTube {
+		videoID := extractYouTubeVideoID(rawURL)
+		if videoID == "" {
+			return nil, fmt.Errorf("Could not extract YouTube video ID")
+		}
+		report("downloading", "Fetching thumbnail...", ptrFloat(0), nil)
+		thumbPath := filepath.Join(dir, fmt.Sprintf("%s-thumb.jpg", id))
+		if err := fetchYouTubeThumbnail(videoID, thumbPath); err != nil {
+			return nil, err
+		}
+		report("downloading", "Thumbnail downloaded", ptrFloat(100), nil)
+		return &mediaResult{Path: thumbPath, Ext: "jpg"}, nil
+	}
+
+	report("downloading", "Downloading from source...", ptrFloat(0), nil)
+	downloadStart := time.Now()
+
+	var downloadedPath, downloadedExt string
+
+	if isYouTube && !opts.Playlist {
+		isClip := strings.Contains(rawURL, "/clip/")
+
+		if isClip {
+			clipData, err := services.ParseYouTubeClip(ctx, rawURL)
+			if err != nil {
+				return nil, err
+			}
+			report("downloading", "Trimming clip from stream...", ptrFloat(0), nil)
+			result, err := services.HandleClipDownload(ctx, clipData, id, dir, func(progress float64, speed, eta string) {
+				report("downloading", fmt.Sprintf("Trimming... %.0f%%", progress), &progress, map[string]interface{}{"speed": speed, "eta": eta})
+			})
+			if err != nil {
+				return nil, err
+			}
+			downloadedPath = result.Path
+			downloadedExt = result.Ext
+		} else {
+			report("downloading", "Downloading...", ptrFloat(0), nil)
+			ytOpts := ytdlpOpts
+			ytOpts.OnProgress = func(progress float64, speed, eta string) {
+				msg := fmt.Sprintf("Downloading... %.0f%%", progress)
+				if speed != "" {
+					msg += fmt.Sprintf(" • %s", speed)
+				}
+				if eta != "" {
+					msg += fmt.Sprintf(" • ETA %s", eta)
+				}
+				report("downloading", msg, &progress, map[string]interface{}{"speed": speed, "eta": eta})
+			}
+			result, err := services.DownloadViaYtdlp(ctx, rawURL, id, ytOpts)
+			if err != nil {
+				if processInfo.IsCancelled() {
+					return nil, fmt.Errorf("Download cancelled")
+				}
+				// Clean up partial files from failed attempt
+				if entries, cleanErr := os.ReadDir(dir); cleanErr == nil {
+					for _, e := range entries {
+						if strings.HasPrefix(e.Name(), id) {
+							os.Remove(filepath.Join(dir, e.Name()))
+						}
+					}
+				}
+				if util.HasProxy() {
+					log.Printf("[%s] yt-dlp failed, retrying with proxy: %s", id, err)
+					report("downloading", "Retrying with proxy...", ptrFloat(0), nil)
+					ytOpts.UseProxy = true
+					result, err = services.DownloadViaYtdlp(ctx, rawURL, id, ytOpts)
+				}
+			}
+			if err != nil {
+				log.Printf("[%s] yt-dlp with proxy failed, falling back to Cobalt: %s", id, err)
+				report("downloading", "Downloading via Cobalt...", ptrFloat(0), nil)
+				cobaltResult, cobaltErr := cobaltFallback(ctx, rawURL, id, isAudio, byteProgress("Downloading..."), services.CobaltDownloadOpts{})
+				if cobaltErr != nil {
+					return nil, cobaltErr
+				}
+				downloadedPath = cobaltResult.FilePath
+				downloadedExt = cobaltResult.Ext
+			} else {
+				downloadedPath = result.Path
+				downloadedExt = result.Ext
+			}
+			complete()
+		}
+	} else if services.IsTikTokMusicURL(rawURL) {
+		report("downloading", "Fetching TikTok audio...", ptrFloat(0), nil)
+		result, err := services.DownloadTikTokMusic(ctx, rawURL, id, dir, byteProgress("Downloading audio..."))
+		if err != nil {
+			return nil, err
+		}
+		downloadedPath = result.Path
+		downloadedExt = result.Ext
+		complete()
+	} else if services.IsTikTokURL(rawURL) {
+		label := "Downloading TikTok video..."
+		if isAudio {
+			label = "Downloading TikTok audio..."
+		}
+		report("downloading", label, ptrFloat(0), nil)
+		result, err := services.DownloadTikTokVideo(ctx, rawURL, id, dir, isAudio, byteProgress("Downloading..."))
+		if err != nil {
+			return nil, err
+		}
+		downloadedPath = result.Path
+		downloadedExt = result.Ext
+		complete()
+	} else if services.IsTwitterURL(rawURL) {
+		report("downloading", "Downloading Twitter media...", ptrFloat(0), nil)
+		result, err := services.DownloadTwitterMedia(ctx, rawURL, id, dir, isAudio, opts.TwitterGifs, byteProgress("Downloading..."))
+		if err != nil {
+			log.Printf("[%s] Twitter fxtwitter failed, falling back to yt-dlp: %s", id, err)
+			report("downloading", "Retrying via yt-dlp...", ptrFloat(0), nil)
+			ytResult, ytErr := services.DownloadViaYtdlp(ctx, rawURL, id, ytdlpOpts)
+			if ytErr != nil {
+				return nil, ytErr
+			}
+			downloadedPath = ytResult.Path
+			downloadedExt = ytResult.Ext
+		} else {
+			downloadedPath = result.Path
+			downloadedExt = result.Ext
+		}
+		complete()
+	} else if services.IsInstagramURL(rawURL) {
+		report("downloading", "Downloading Instagram media...", ptrFloat(0), nil)
+		result, err := services.DownloadInstagramMedia(ctx, rawURL, id, dir, isAudio, byteProgress("Downloading..."))
+		if err != nil {
+			log.Printf("[%s] Instagram Cobalt failed, falling back to yt-dlp: %s", id, err)
+			report("downloading", "Retrying via yt-dlp...", ptrFloat(0), nil)
+			ytResult, ytErr := services.DownloadViaYtdlp(ctx, rawURL, id, ytdlpOpts)
+			if ytErr != nil {
+				return nil, ytErr
+			}
+			downloadedPath = ytResult.Path
+			downloadedExt = ytResult.Ext
+		} else {
+			downloadedPath = result.Path
+			downloadedExt = result.Ext
+		}
+		complete()
+	} else {
+		ytOpts := ytdlpOpts
+		ytOpts.Playlist = opts.Playlist
+		ytOpts.UseProxy = isYouTube
+		result, err := services.DownloadViaYtdlp(ctx, rawURL, id, ytOpts)
+		if err != nil {
+			return nil, err
+		}
+		downloadedPath = result.Path
+		downloadedExt = result.Ext
+	}
+
+	if downloadedPath == "" {
+		return nil, fmt.Errorf("Downloaded file not found")
+	}
+	if _, err := os.Stat(downloadedPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Downloaded file not found")
+	}
+	metrics.ObserveStage("download", site, downloadStart)
+
+	if downloadedExt == "zip" {
+		return &mediaResult{Path: downloadedPath, Ext: "zip"}, nil
+	}
+
+	isTwitter := strings.Contains(rawURL, "twitter.com") || strings.Contains(rawURL, "x.com")
+	isGif := false
+	if isTwitter && !isAudio && opts.TwitterGifs {
+		// Skip ffprobe for files > 20MB — real GIFs are short/small
+		if fi, err := os.Stat(downloadedPath); err == nil && fi.Size() < 20*1024*1024 {
+			isGif = services.ProbeForGif(downloadedPath)
+		}
+	}
+
+	actualOutputExt := outputExt
+	actualFinalFile := finalFile
+	if isGif {
+		actualOutputExt = "gif"
+		actualFinalFile = filepath.Join(dir, fmt.Sprintf("%s-final.gif", id))
+	}
+
+	msg := "Processing video..."
+	if isGif {
+		msg = "Converting to GIF..."
+	}
+	report("processing", msg, ptrFloat(100), nil)
+
+	encodeStart := time.Now()
+	processed, err := services.ProcessVideo(downloadedPath, actualFinalFile, services.ProcessVideoOpts{
+		IsAudio:      isAudio,
+		IsGif:        isGif,
+		AudioFormat:  opts.AudioFormat,
+		AudioBitrate: opts.AudioBitrate,
+		Container:    opts.Container,
+		JobID:        id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics.ObserveStage("encode", site, encodeStart)
+
+	if !processed.Skipped {
+		os.Remove(downloadedPath)
+	}
+
+	outPath := actualFinalFile
+	if processed.Skipped {
+		outPath = processed.Path
+	}
+
+	if _, err := os.Stat(outPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("Processing failed - output file not created")
+	}
+
+	if processInfo.IsCancelled() {
+		return nil, fmt.Errorf("Download cancelled")
+	}
+
+	return &mediaResult{Path: outPath, Ext: actualOutputExt, IsAudio: isAudio, IsGif: isGif}, nil
+}
+
+// cobaltFallback is DownloadViaCobalt for when the primary downloader has
+// already failed, so the fallback rate shows up in metrics.
+func cobaltFallback(ctx context.Context, rawURL, id string, isAudio bool, progressCb func(float64, int64, int64), opts services.CobaltDownloadOpts) (*services.CobaltDownloadResult, error) {
+	result, err := services.DownloadViaCobalt(ctx, rawURL, id, isAudio, progressCb, opts)
+	metrics.CobaltFallbacks.Inc(metrics.Site(rawURL), metrics.Result(err, false))
+	return result, err
+}
+
+func fetchYouTubeThumbnail(videoID, thumbPath string) error {
+	thumbURLs := []string{
+		fmt.Sprintf("https://i.ytimg.com/vi/%s/maxresdefault.jpg", videoID),
+		fmt.Sprintf("https://i.ytimg.com/vi/%s/sddefault.jpg", videoID),
+		fmt.Sprintf("https://i.ytimg.com/vi/%s/hqdefault.jpg", videoID),
+	}
+
+	var thumbErr error
+	for _, thumbURL := range thumbURLs {
+		resp, err := http.Get(thumbURL)
+		if err != nil {
+			thumbErr = err
+			continue
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			continue
+		}
+		out, err := os.Create(thumbPath)
+		if err != nil {
+			resp.Body.Close()
+			thumbErr = err
+			break
+		}
+		_, err = io.Copy(out, resp.Body)
+		resp.Body.Close()
+		out.Close()
+		if err != nil {
+			thumbErr = err
+			break
+		}
+		thumbErr = nil
+		break
+	}
+
+	if thumbErr != nil {
+		return thumbErr
+	}
+	if _, err := os.Stat(thumbPath); os.IsNotExist(err) {
+		return fmt.Errorf("Could not download YouTube thumbnail")
+	}
+	return nil
+}
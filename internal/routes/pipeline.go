@@ -0,0 +1,381 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/coah80/yoink/internal/alerts"
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
+	"github.com/coah80/yoink/internal/util"
+)
+
+var pipelineStepTypes = []string{"download", "trim", "compress", "transcribe"}
+
+type pipelineRequest struct {
+	FilePath string            `json:"filePath"`
+	FileName string            `json:"fileName"`
+	ClientID string            `json:"clientId"`
+	Steps    []json.RawMessage `json:"steps"`
+}
+
+type trimRequest struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// pipelineStep is one parsed step. Only the options for its kind are set.
+type pipelineStep struct {
+	kind       string
+	download   downloadRequest
+	trim       trimRequest
+	compress   compressRequest
+	transcribe transcribeRequest
+}
+
+// stageOutput is the file a step hands to the next one.
+type stageOutput struct {
+	path     string
+	fileName string
+	mimeType string
+	text     string
+}
+
+func parsePipelineSteps(raw []json.RawMessage) ([]pipelineStep, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("Pipeline needs at least one step")
+	}
+	if len(raw) > config.MaxPipelineSteps {
+		return nil, fmt.Errorf("Too many steps (max %d)", config.MaxPipelineSteps)
+	}
+
+	steps := make([]pipelineStep, len(raw))
+	for i, data := range raw {
+		var head struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &head) != nil {
+			return nil, fmt.Errorf("Step %d: invalid step", i+1)
+		}
+
+		step := pipelineStep{kind: head.Type}
+		var err error
+		switch head.Type {
+		case "download":
+			if i != 0 {
+				return nil, fmt.Errorf("Step %d: download can only be the first step", i+1)
+			}
+			if err = json.Unmarshal(data, &step.download); err != nil {
+				break
+			}
+			if check := util.ValidateURL(step.download.URL); !check.Valid {
+				return nil, fmt.Errorf("Step %d: %s", i+1, check.Error)
+			}
+			if step.download.Playlist {
+				return nil, fmt.Errorf("Step %d: playlists can't be used in a pipeline", i+1)
+			}
+		case "trim":
+			if err = json.Unmarshal(data, &step.trim); err != nil {
+				break
+			}
+			if step.trim.Start == "" && step.trim.End == "" {
+				return nil, fmt.Errorf("Step %d: trim needs a start or end time", i+1)
+			}
+			if step.trim.Start != "" && util.ValidateTimeParam(step.trim.Start) == "" {
+				return nil, fmt.Errorf("Step %d: invalid start time", i+1)
+			}
+			if step.trim.End != "" && util.ValidateTimeParam(step.trim.End) == "" {
+				return nil, fmt.Errorf("Step %d: invalid end time", i+1)
+			}
+		case "compress":
+			if err = json.Unmarshal(data, &step.compress); err != nil {
+				break
+			}
+			c := step.compress
+			if c.Mode != "" && !config.Contains(config.AllowedModes, c.Mode) {
+				return nil, fmt.Errorf("Step %d: invalid mode. Allowed: %s", i+1, strings.Join(config.AllowedModes, ", "))
+			}
+			if c.Preset != "" && !config.Contains(config.AllowedPresets, c.Preset) {
+				return nil, fmt.Errorf("Step %d: invalid preset. Allowed: %s", i+1, strings.Join(config.AllowedPresets, ", "))
+			}
+			if c.Denoise != "" && !config.Contains(config.AllowedDenoise, c.Denoise) {
+				return nil, fmt.Errorf("Step %d: invalid denoise. Allowed: %s", i+1, strings.Join(config.AllowedDenoise, ", "))
+			}
+		case "transcribe":
+			if err = json.Unmarshal(data, &step.transcribe); err != nil {
+				break
+			}
+			mode := orDefault(step.transcribe.OutputMode, "text")
+			if !contains(allowedOutputModes, mode) {
+				return nil, fmt.Errorf("Step %d: invalid output mode. Allowed: %s", i+1, strings.Join(allowedOutputModes, ", "))
+			}
+			if mode != "captions" && i != len(raw)-1 {
+				return nil, fmt.Errorf("Step %d: only captions output can feed another step", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("Step %d: invalid step type. Allowed: %s", i+1, strings.Join(pipelineStepTypes, ", "))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Step %d: invalid options", i+1)
+		}
+		steps[i] = step
+	}
+	return steps, nil
+}
+
+func startPipelineJob(w http.ResponseWriter, r *http.Request, body pipelineRequest) (string, bool) {
+	steps, err := parsePipelineSteps(body.Steps)
+	if err != nil {
+		respondJSON(w, 400, map[string]string{"error": err.Error()})
+		return "", false
+	}
+
+	var input, baseName string
+	if steps[0].kind == "download" {
+		steps[0].download.NoCache = authenticatedRequest(r)
+		baseName = orDefault(steps[0].download.Filename, "download")
+	} else {
+		validPath, ok := resolveJobInput(w, body.FilePath)
+		if !ok {
+			return "", false
+		}
+		input = validPath
+		baseName = strings.TrimSuffix(filepath.Base(orDefault(body.FileName, "media")), filepath.Ext(body.FileName))
+	}
+
+	jobID := uuid.New().String()
+	clientID := effectiveClientID(r, body.ClientID)
+	if !services.Global.TryReserveClientJob(jobID, clientID, config.Get().MaxJobsPerClient) {
+		if input != "" {
+			os.Remove(input)
+		}
+		respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("too many active jobs, max %d at once per person", config.Get().MaxJobsPerClient)})
+		return "", false
+	}
+
+	stages := make([]services.PipelineStage, len(steps))
+	for i, step := range steps {
+		stages[i] = services.PipelineStage{Type: step.kind, Status: "pending"}
+	}
+	job := &services.AsyncJob{
+		Status:    "processing",
+		Message:   "Starting pipeline...",
+		CreatedAt: time.Now(),
+		Type:      "pipeline",
+		URL:       steps[0].download.URL,
+		Stages:    stages,
+	}
+	services.Global.SetAsyncJob(jobID, job)
+
+	go processPipelineJob(jobID, job, clientID, input, util.SanitizeFilename(baseName), steps)
+	return jobID, true
+}
+
+// processPipelineJob runs each step against the previous step's output.
+// Every intermediate file lives in one workspace dir, which is removed
+// whether the chain finishes or fails. The job stays linked to its client
+// from the first step to the last, though each step unlinks it when done.
+func processPipelineJob(jobID string, job *services.AsyncJob, clientID, input, baseName string, steps []pipelineStep) {
+	defer services.Global.KeepJobLinked(jobID)()
+
+	workspace := filepath.Join(config.TempDirs["pipeline"], jobID)
+	if err := os.MkdirAll(workspace, 0755); err != nil {
+		pipelineFailed(jobID, job, 0, err)
+		return
+	}
+	if input != "" {
+		moved := filepath.Join(workspace, "0-input"+filepath.Ext(input))
+		if err := os.Rename(input, moved); err != nil {
+			os.Remove(input)
+			pipelineFailed(jobID, job, 0, err)
+			return
+		}
+		input = moved
+	}
+
+	log.Printf("[Pipeline] Job %s started with %d steps", jobID, len(steps))
+
+	var out *stageOutput
+	for i, step := range steps {
+		if status, _, _, _, _ := job.GetStatus(); status == "cancelled" {
+			pipelineFailed(jobID, job, i, errors.New("Cancelled"))
+			return
+		}
+		updateStage(job, i, "running", 0, "Starting...")
+
+		scratch := &services.AsyncJob{Status: "processing", CreatedAt: time.Now()}
+		stop := followStage(job, i, scratch)
+		var err error
+		out, err = runPipelineStep(jobID, clientID, step, input, baseName, workspace, scratch)
+		stop()
+
+		if err != nil {
+			pipelineFailed(jobID, job, i, err)
+			return
+		}
+
+		dst := filepath.Join(workspace, fmt.Sprintf("%d-%s%s", i+1, step.kind, filepath.Ext(out.path)))
+		if err := os.Rename(out.path, dst); err != nil {
+			os.Remove(out.path)
+			pipelineFailed(jobID, job, i, err)
+			return
+		}
+		out.path = dst
+		input = dst
+		updateStage(job, i, "complete", 100, "Done")
+	}
+
+	finalPath := filepath.Join(config.TempDirs["pipeline"], jobID+"-final"+filepath.Ext(out.path))
+	err := os.Rename(out.path, finalPath)
+	os.RemoveAll(workspace)
+	if err != nil {
+		pipelineFailed(jobID, job, len(steps)-1, err)
+		return
+	}
+
+	job.Lock()
+	job.TextContent = out.text
+	job.Unlock()
+	completeWithToken(jobID, job, finalPath, out.fileName, out.mimeType)
+}
+
+// runPipelineStep runs one step through the same code its standalone job
+// type uses. The step reports into scratch rather than the pipeline job so
+// its completion doesn't look like the whole pipeline finishing.
+func runPipelineStep(jobID, clientID string, step pipelineStep, input, baseName, workspace string, scratch *services.AsyncJob) (*stageOutput, error) {
+	switch step.kind {
+	case "download":
+		if check := services.Global.WaitForJobSlot(context.Background(), jobRequest("download", jobID, clientID)); !check.OK {
+			return nil, errors.New(check.Reason)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		processInfo := &services.ProcessInfo{JobType: "download", CancelFunc: cancel}
+		services.Global.SetProcess(jobID, processInfo)
+		defer services.Global.ReleaseJob(jobID)
+
+		result, err := fetchMedia(ctx, jobID, processInfo, step.download.mediaOpts(workspace), asyncProgress(jobID, scratch))
+		if err != nil {
+			if processInfo.IsCancelled() {
+				return nil, errors.New("Cancelled")
+			}
+			metrics.JobsFailed.Inc("download")
+			alerts.DownloadFailed(jobID, step.download.URL, err)
+			if util.NeedsCookiesRetry(err.Error()) {
+				util.TriggerCookieRefresh("YouTube bot detection during download")
+			}
+			return nil, err
+		}
+		return &stageOutput{path: result.Path, fileName: baseName + "." + result.Ext, mimeType: result.mimeType()}, nil
+
+	case "trim":
+		format := strings.TrimPrefix(filepath.Ext(input), ".")
+		req := convertRequest{Format: format, StartTime: step.trim.Start, EndTime: step.trim.End}
+		if req.normalize() != nil {
+			return nil, fmt.Errorf("Can't trim a .%s file", format)
+		}
+		err := handleConvertAsync(input, baseName+"."+format, req.Format, clientID, req.Quality, req.Reencode,
+			req.StartTime, req.EndTime, req.AudioBitrate, "", nil, nil, nil, nil, nil, jobID, scratch)
+		if err != nil {
+			return nil, err
+		}
+
+	case "compress":
+		req := step.compress
+		req.FileName = baseName + filepath.Ext(input)
+		req.ClientID = clientID
+		if req.Duration == "" {
+			req.Duration = fmt.Sprintf("%.2f", probeVideoFull(input).duration)
+		}
+		if err := req.compress(jobID, input, scratch); err != nil {
+			return nil, err
+		}
+
+	case "transcribe":
+		opts := step.transcribe.opts()
+		opts.ClientID = clientID
+		if err := handleTranscribeAsync(input, baseName+filepath.Ext(input), opts, jobID, scratch); err != nil {
+			return nil, err
+		}
+	}
+
+	status, _, _, errMsg, text := scratch.GetStatus()
+	if status != "complete" {
+		return nil, errors.New(orDefault(errMsg, "Step failed"))
+	}
+	outputPath, outputFilename, mimeType, _ := scratch.GetDownloadInfo()
+	return &stageOutput{path: outputPath, fileName: outputFilename, mimeType: mimeType, text: text}, nil
+}
+
+// followStage copies a step's progress into the pipeline job until stopped.
+func followStage(job *services.AsyncJob, index int, scratch *services.AsyncJob) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, progress, message, _, _ := scratch.GetStatus()
+				updateStage(job, index, "running", progress, message)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func updateStage(job *services.AsyncJob, index int, status string, progress float64, message string) {
+	job.Lock()
+	defer job.Unlock()
+	stage := &job.Stages[index]
+	stage.Status = status
+	stage.Progress = progress
+	stage.Message = message
+	job.CurrentStage = index
+	job.Progress = math.Round((float64(index)*100 + progress) / float64(len(job.Stages)))
+	job.Message = fmt.Sprintf("Step %d/%d (%s): %s", index+1, len(job.Stages), stage.Type, message)
+}
+
+// pipelineFailed removes everything the chain produced and marks the step
+// that broke. A job cancelled through the API keeps its cancelled status.
+func pipelineFailed(jobID string, job *services.AsyncJob, index int, err error) {
+	util.CleanupJobFiles(jobID)
+
+	userErr := util.ToUserError(err.Error())
+	job.Lock()
+	cancelled := job.Status == "cancelled" || err.Error() == "Cancelled"
+	if cancelled {
+		job.Stages[index].Status = "cancelled"
+		job.Status = "cancelled"
+		job.Message = "Cancelled"
+	} else {
+		job.Stages[index].Status = "error"
+		job.Stages[index].Message = userErr
+		job.Status = "error"
+		job.Message = fmt.Sprintf("Step %d (%s) failed: %s", index+1, job.Stages[index].Type, userErr)
+		job.Error = job.Message
+		job.DebugError = err.Error()
+	}
+	job.Unlock()
+
+	if cancelled {
+		log.Printf("[Pipeline] Job %s cancelled at step %d", jobID, index+1)
+		return
+	}
+	log.Printf("[Pipeline] Job %s failed at step %d: %s", jobID, index+1, err)
+	services.Global.SendProgressSimple(jobID, "error", userErr)
+}
@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func rawSteps(steps ...string) []json.RawMessage {
+	raw := make([]json.RawMessage, len(steps))
+	for i, s := range steps {
+		raw[i] = json.RawMessage(s)
+	}
+	return raw
+}
+
+const testDownloadStep = `{"type":"download","url":"https://93.184.216.34/watch"}`
+
+func TestParsePipelineSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []json.RawMessage
+		want  string
+	}{
+		{"no steps", nil, "Pipeline needs at least one step"},
+		{"unknown type", rawSteps(`{"type":"upload"}`), "Step 1: invalid step type"},
+		{"not an object", rawSteps(`"trim"`), "Step 1: invalid step"},
+		{"bad options", rawSteps(`{"type":"trim","start":5}`), "Step 1: invalid options"},
+		{"download after first", rawSteps(`{"type":"trim","start":"0:05"}`, testDownloadStep), "Step 2: download can only be the first step"},
+		{"download private url", rawSteps(`{"type":"download","url":"http://127.0.0.1/video"}`), "Step 1: Private/local URLs are not allowed"},
+		{"download no url", rawSteps(`{"type":"download"}`), "Step 1: URL is required"},
+		{"download playlist", rawSteps(`{"type":"download","url":"https://93.184.216.34/list","playlist":true}`), "Step 1: playlists can't be used"},
+		{"trim no times", rawSteps(`{"type":"trim"}`), "Step 1: trim needs a start or end time"},
+		{"trim bad start", rawSteps(`{"type":"trim","start":"soon"}`), "Step 1: invalid start time"},
+		{"trim bad end", rawSteps(`{"type":"trim","end":"later"}`), "Step 1: invalid end time"},
+		{"compress bad mode", rawSteps(`{"type":"compress","mode":"tiny"}`), "Step 1: invalid mode"},
+		{"compress bad preset", rawSteps(`{"type":"compress","preset":"warp"}`), "Step 1: invalid preset"},
+		{"compress bad denoise", rawSteps(`{"type":"compress","denoise":"lots"}`), "Step 1: invalid denoise"},
+		{"transcribe bad mode", rawSteps(`{"type":"transcribe","outputMode":"poem"}`), "Step 1: invalid output mode"},
+		{"text feeding a step", rawSteps(`{"type":"transcribe"}`, `{"type":"compress"}`), "Step 1: only captions output can feed another step"},
+	}
+	for _, tt := range tests {
+		_, err := parsePipelineSteps(tt.steps)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParsePipelineStepsMaxSteps(t *testing.T) {
+	trims := make([]string, config.MaxPipelineSteps)
+	for i := range trims {
+		trims[i] = `{"type":"trim","start":"1"}`
+	}
+	if _, err := parsePipelineSteps(rawSteps(trims...)); err != nil {
+		t.Fatalf("%d steps refused: %v", len(trims), err)
+	}
+	trims = append(trims, trims[0])
+	if _, err := parsePipelineSteps(rawSteps(trims...)); err == nil || !strings.Contains(err.Error(), "Too many steps") {
+		t.Errorf("%d steps: err = %v", len(trims), err)
+	}
+}
+
+func TestParsePipelineStepsChain(t *testing.T) {
+	steps, err := parsePipelineSteps(rawSteps(
+		testDownloadStep,
+		`{"type":"trim","start":"0:05","end":"0:30"}`,
+		`{"type":"transcribe","outputMode":"captions"}`,
+		`{"type":"compress","mode":"quality","preset":"fast"}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, step := range steps {
+		kinds = append(kinds, step.kind)
+	}
+	if got := strings.Join(kinds, ","); got != "download,trim,transcribe,compress" {
+		t.Fatalf("kinds = %s", got)
+	}
+	if steps[0].download.URL != "https://93.184.216.34/watch" || steps[1].trim.End != "0:30" || steps[3].compress.Preset != "fast" {
+		t.Errorf("step options not parsed: %+v", steps)
+	}
+}
+
+func TestStartPipelineJobRejectsBadSteps(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/jobs", nil)
+	_, ok := startPipelineJob(rec, req, pipelineRequest{Steps: rawSteps(`{"type":"upload"}`)})
+	if ok || rec.Code != 400 {
+		t.Fatalf("ok = %v, status = %d, want a 400", ok, rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || !strings.Contains(body["error"], "invalid step type") {
+		t.Errorf("body = %s", rec.Body.String())
+	}
+}
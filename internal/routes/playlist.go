@@ -8,10 +8,8 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +18,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -30,22 +29,41 @@ func PlaylistRoutes(r chi.Router) {
 	r.Get("/api/playlist/download/{token}", handlePlaylistDownload)
 }
 
+type playlistRequest struct {
+	URL          string `json:"url"`
+	Format       string `json:"format"`
+	Quality      string `json:"quality"`
+	Container    string `json:"container"`
+	AudioFormat  string `json:"audioFormat"`
+	AudioBitrate string `json:"audioBitrate"`
+	ClientID     string `json:"clientId"`
+	ResumeFrom   int    `json:"resumeFrom"`
+	CallbackURL  string `json:"callbackUrl"`
+}
+
 func handlePlaylistStart(w http.ResponseWriter, r *http.Request) {
-	var body struct {
-		URL          string `json:"url"`
-		Format       string `json:"format"`
-		Quality      string `json:"quality"`
-		Container    string `json:"container"`
-		AudioFormat  string `json:"audioFormat"`
-		AudioBitrate string `json:"audioBitrate"`
-		ClientID     string `json:"clientId"`
-		ResumeFrom   int    `json:"resumeFrom"`
-	}
+	var body playlistRequest
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 
+	if !allowKeyJob(w, r, "playlist") {
+		return
+	}
+
+	if jobID, queued, ok := startPlaylistJob(w, r, body); ok {
+		services.Global.WatchJob(jobID, body.CallbackURL)
+		respondJSON(w, 200, map[string]interface{}{"jobId": jobID, "queued": queued})
+	}
+}
+
+// startPlaylistJob validates a playlist request and starts it in the
+// background. On failure it has already written the error response.
+func startPlaylistJob(w http.ResponseWriter, r *http.Request, body playlistRequest) (string, bool, bool) {
 	if body.Format == "" {
 		body.Format = "video"
 	}
@@ -68,23 +86,23 @@ func handlePlaylistStart(w http.ResponseWriter, r *http.Request) {
 	check := util.ValidateURL(body.URL)
 	if !check.Valid {
 		respondJSON(w, 400, map[string]string{"error": check.Error})
-		return
+		return "", false, false
 	}
 
 	if body.ClientID != "" {
-		if services.Global.GetClientJobCount(body.ClientID) >= config.MaxJobsPerClient {
-			respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.MaxJobsPerClient)})
-			return
+		if services.Global.GetClientJobCount(body.ClientID) >= config.Get().MaxJobsPerClient {
+			respondJSON(w, 429, map[string]string{"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.Get().MaxJobsPerClient)})
+			return "", false, false
 		}
 	}
 
-	jobCheck := services.Global.CanStartJob("playlist")
+	jobID := uuid.New().String()
+	ticket, jobCheck := services.Global.EnqueueJob(jobRequest("playlist", jobID, effectiveClientID(r, body.ClientID)))
 	if !jobCheck.OK {
 		respondJSON(w, 503, map[string]string{"error": jobCheck.Reason})
-		return
+		return "", false, false
 	}
 
-	jobID := uuid.New().String()
 	isAudio := body.Format == "audio"
 	outputExt := body.Container
 	if isAudio {
@@ -104,14 +122,27 @@ func handlePlaylistStart(w http.ResponseWriter, r *http.Request) {
 		Format:    outputExt,
 		Type:      "playlist",
 	}
+	if ticket.Queued() {
+		job.Status = "queued"
+		job.Message = "waiting in queue..."
+	}
 	services.Global.SetAsyncJob(jobID, job)
 
-	respondJSON(w, 200, map[string]string{"jobId": jobID})
-
-	go processPlaylistAsync(jobID, job, body.URL, isAudio, body.AudioFormat, outputExt, body.Quality, body.Container, body.AudioBitrate, body.ResumeFrom)
+	go processPlaylistAsync(jobID, job, ticket, body.URL, isAudio, body.AudioFormat, outputExt, body.Quality, body.Container, body.AudioBitrate, body.ResumeFrom)
+	return jobID, ticket.Queued(), true
 }
 
-func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, isAudio bool, audioFormat, outputExt, quality, container, audioBitrate string, resumeFrom int) {
+func processPlaylistAsync(jobID string, job *services.AsyncJob, ticket *services.JobTicket, rawURL string, isAudio bool, audioFormat, outputExt, quality, container, audioBitrate string, resumeFrom int) {
+	if check := ticket.Wait(context.Background()); !check.OK {
+		job.Lock()
+		job.Status = "cancelled"
+		job.Message = check.Reason
+		job.Unlock()
+		services.Global.SendProgressSimple(jobID, "cancelled", check.Reason)
+		services.Global.UnlinkJobFromClient(jobID)
+		return
+	}
+
 	playlistDir := filepath.Join(config.TempDirs["playlist"], jobID)
 	os.MkdirAll(playlistDir, 0755)
 
@@ -149,11 +180,29 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 	}
 	startIdx := resumeFrom - 1
 	remainingVideos := len(playlistInfo.Entries) - startIdx
-	if remainingVideos > config.MaxPlaylistVideos {
-		playlistError(jobID, job, processInfo, playlistDir, fmt.Errorf("Playlist chunk too large. Maximum %d videos allowed per run. Start later in the playlist or finish early.", config.MaxPlaylistVideos))
+	if remainingVideos > config.Get().MaxPlaylistVideos {
+		playlistError(jobID, job, processInfo, playlistDir, fmt.Errorf("Playlist chunk too large. Maximum %d videos allowed per run. Start later in the playlist or finish early.", config.Get().MaxPlaylistVideos))
 		return
 	}
 
+	// The zip is built next to the videos, which the estimate's headroom
+	// for processed copies covers. Entries without a duration make it a
+	// guess, which doesn't cap the job.
+	var estimate int64
+	abort := services.AbortProcess(processInfo)
+	for _, entry := range playlistInfo.Entries[startIdx:] {
+		estimate += services.EstimateMediaBytes(entry.Duration, quality, isAudio, audioFormat)
+		if entry.Duration <= 0 {
+			abort = nil
+		}
+	}
+	disk, err := services.Global.ReserveDisk(jobID, config.TempDirs["playlist"], estimate, abort)
+	if err != nil {
+		playlistError(jobID, job, processInfo, playlistDir, err)
+		return
+	}
+	defer disk.Release()
+
 	playlistTitle := playlistInfo.Title
 	isResuming := startIdx > 0
 	startVideo := startIdx + 1
@@ -191,6 +240,10 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 			playlistError(jobID, job, processInfo, playlistDir, fmt.Errorf("Download cancelled"))
 			return
 		}
+		if err := disk.Err(); err != nil {
+			playlistError(jobID, job, processInfo, playlistDir, err)
+			return
+		}
 		if processInfo.IsFinishEarly() {
 			log.Printf("[%s] Finishing early after %d videos", jobID, len(downloadedFiles))
 			break
@@ -246,7 +299,7 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 					},
 				})
 				if err != nil {
-					cobaltResult, cobaltErr := services.DownloadViaCobalt(ctx, actualURL, fmt.Sprintf("%s-v%d", jobID, videoNum), isAudio, nil,
+					cobaltResult, cobaltErr := cobaltFallback(ctx, actualURL, fmt.Sprintf("%s-v%d", jobID, videoNum), isAudio, nil,
 						services.CobaltDownloadOpts{OutputDir: playlistDir, MaxRetries: 3, RetryDelay: 2 * time.Second})
 					if cobaltErr != nil {
 						return cobaltErr
@@ -319,6 +372,10 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 		}
 	}
 
+	if err := disk.Err(); err != nil {
+		playlistError(jobID, job, processInfo, playlistDir, err)
+		return
+	}
 	if len(downloadedFiles) == 0 {
 		playlistError(jobID, job, processInfo, playlistDir, fmt.Errorf("No videos were successfully downloaded"))
 		return
@@ -336,8 +393,9 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 	zipPath := filepath.Join(config.TempDirs["playlist"], fmt.Sprintf("%s.zip", jobID))
 	safePlaylistName := util.SanitizeFilename(orDefault(playlistTitle, "playlist"))
 
-	if err := createZip(zipPath, downloadedFiles); err != nil {
-		playlistError(jobID, job, processInfo, playlistDir, fmt.Errorf("Failed to create zip: %v", err))
+	if err := createZip(zipPath, downloadedFiles); err != nil || disk.Err() != nil {
+		os.Remove(zipPath)
+		playlistError(jobID, job, processInfo, playlistDir, disk.Check(fmt.Errorf("Failed to create zip: %v", err)))
 		return
 	}
 
@@ -348,17 +406,22 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 		playlistError(jobID, job, processInfo, "", fmt.Errorf("zip file not found after creation"))
 		return
 	}
-	token := randomToken()
 	fileName := safePlaylistName + ".zip"
 
-	services.Global.SetBotDownload(token, &services.BotDownload{
+	dl := &services.BotDownload{
 		FilePath:      zipPath,
 		FileName:      fileName,
 		FileSize:      stat.Size(),
 		MimeType:      "application/zip",
 		CreatedAt:     time.Now(),
 		IsWebPlaylist: true,
-	})
+	}
+	if err := services.SaveOutput(context.Background(), dl); err != nil {
+		os.Remove(zipPath)
+		playlistError(jobID, job, processInfo, "", fmt.Errorf("Failed to store zip: %v", err))
+		return
+	}
+	token := issueDownloadToken(jobID, dl)
 
 	job.Lock()
 	job.Status = "complete"
@@ -385,6 +448,7 @@ func processPlaylistAsync(jobID string, job *services.AsyncJob, rawURL string, i
 
 func playlistError(jobID string, job *services.AsyncJob, processInfo *services.ProcessInfo, playlistDir string, err error) {
 	log.Printf("[%s] Async playlist error: %s", jobID, err)
+	metrics.JobsFailed.Inc("playlist")
 	alerts.PlaylistFailed(jobID, "", err)
 	job.Lock()
 	job.Status = "error"
@@ -409,43 +473,7 @@ func handlePlaylistStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePlaylistDownload(w http.ResponseWriter, r *http.Request) {
-	token := chi.URLParam(r, "token")
-	data := services.Global.GetBotDownload(token)
-	if data == nil {
-		respondJSON(w, 404, map[string]string{"error": "Download not found or expired"})
-		return
-	}
-	stat, err := os.Stat(data.FilePath)
-	if err != nil {
-		services.Global.DeleteBotDownload(token)
-		respondJSON(w, 404, map[string]string{"error": "File no longer available"})
-		return
-	}
-	asciiFilename := toASCIIFilename(data.FileName)
-
-	w.Header().Set("Content-Type", data.MimeType)
-	w.Header().Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, asciiFilename, url.PathEscape(data.FileName)))
-
-	f, err := os.Open(data.FilePath)
-	if err != nil {
-		respondJSON(w, 500, map[string]string{"error": "Failed to open file"})
-		return
-	}
-	defer f.Close()
-	io.Copy(w, f)
-
-	data.Downloaded = true
-	go func() {
-		time.Sleep(30 * time.Second)
-		services.Global.DeleteBotDownload(token)
-		os.Remove(data.FilePath)
-		short := token
-		if len(short) > 8 {
-			short = short[:8]
-		}
-		log.Printf("[Playlist] Token %s... cleaned up after download", short)
-	}()
+	serveTokenDownload(w, r, chi.URLParam(r, "token"), "Playlist")
 }
 
 func createZip(zipPath string, files []string) error {
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
@@ -91,17 +93,28 @@ func handleTranscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	callbackURL := r.FormValue("callbackUrl")
+	if !checkCallbackURL(w, callbackURL) {
+		os.Remove(filePath)
+		return
+	}
+
 	clientID := r.FormValue("clientId")
 	if clientID != "" {
-		if services.Global.GetClientJobCount(clientID) >= config.MaxJobsPerClient {
+		if services.Global.GetClientJobCount(clientID) >= config.Get().MaxJobsPerClient {
 			os.Remove(filePath)
 			respondJSON(w, 429, map[string]string{
-				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.MaxJobsPerClient),
+				"error": fmt.Sprintf("Too many active jobs. Maximum %d concurrent jobs per user.", config.Get().MaxJobsPerClient),
 			})
 			return
 		}
 	}
 
+	if !allowKeyJob(w, r, "transcribe") {
+		os.Remove(filePath)
+		return
+	}
+
 	jobID := uuid.New().String()
 	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
 		Status:    "processing",
@@ -109,27 +122,20 @@ func handleTranscribe(w http.ResponseWriter, r *http.Request) {
 		Message:   "Starting transcription...",
 		CreatedAt: time.Now(),
 	})
+	services.Global.WatchJob(jobID, callbackURL)
 
 	opts := extractTranscribeOpts(r)
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
-	go func() {
-		if err := handleTranscribeAsync(filePath, originalName, opts, jobID); err != nil {
-			log.Printf("[AsyncJob] Transcribe job %s failed: %s\n", jobID, err.Error())
-			alerts.TranscriptionFailed(jobID, err)
-			job := services.Global.GetAsyncJob(jobID)
-			if job != nil {
-				job.SetError(err.Error())
-			}
-		}
-	}()
+	go runTranscribeJob(jobID, filePath, originalName, opts)
 }
 
 func handleTranscribeChunked(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		FilePath string `json:"filePath"`
-		FileName string `json:"fileName"`
-		ClientID string `json:"clientId"`
+		FilePath    string `json:"filePath"`
+		FileName    string `json:"fileName"`
+		ClientID    string `json:"clientId"`
+		CallbackURL string `json:"callbackUrl"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		respondJSON(w, 400, map[string]string{"error": "Invalid request body"})
@@ -146,12 +152,19 @@ func handleTranscribeChunked(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, 400, map[string]string{"error": "File not found. Complete chunked upload first."})
 		return
 	}
+	if !checkCallbackURL(w, body.CallbackURL) {
+		return
+	}
 
 	fileName := body.FileName
 	if fileName == "" {
 		fileName = "media"
 	}
 
+	if !allowKeyJob(w, r, "transcribe") {
+		return
+	}
+
 	jobID := uuid.New().String()
 	services.Global.SetAsyncJob(jobID, &services.AsyncJob{
 		Status:    "processing",
@@ -159,6 +172,7 @@ func handleTranscribeChunked(w http.ResponseWriter, r *http.Request) {
 		Message:   "Starting transcription...",
 		CreatedAt: time.Now(),
 	})
+	services.Global.WatchJob(jobID, body.CallbackURL)
 
 	opts := transcribeOpts{
 		OutputMode:     "text",
@@ -169,24 +183,23 @@ func handleTranscribeChunked(w http.ResponseWriter, r *http.Request) {
 	}
 	respondJSON(w, 200, map[string]string{"jobId": jobID})
 
-	go func() {
-		if err := handleTranscribeAsync(validPath, fileName, opts, jobID); err != nil {
-			log.Printf("[AsyncJob] Transcribe job %s failed: %s\n", jobID, err.Error())
-			alerts.TranscriptionFailed(jobID, err)
-			job := services.Global.GetAsyncJob(jobID)
-			if job != nil {
-				job.SetError(err.Error())
-			}
-		}
-	}()
+	go runTranscribeJob(jobID, validPath, fileName, opts)
 }
 
-func handleTranscribeAsync(inputPath, originalName string, opts transcribeOpts, jobID string) error {
+func runTranscribeJob(jobID, inputPath, originalName string, opts transcribeOpts) {
 	job := services.Global.GetAsyncJob(jobID)
 	if job == nil {
-		return nil
+		return
 	}
+	if err := handleTranscribeAsync(inputPath, originalName, opts, jobID, job); err != nil {
+		log.Printf("[AsyncJob] Transcribe job %s failed: %s\n", jobID, err.Error())
+		metrics.JobsFailed.Inc("transcribe")
+		alerts.TranscriptionFailed(jobID, err)
+		job.SetError(err.Error())
+	}
+}
 
+func handleTranscribeAsync(inputPath, originalName string, opts transcribeOpts, jobID string, job *services.AsyncJob) error {
 	outputMode := opts.OutputMode
 	model := opts.Model
 	subtitleFormat := opts.SubtitleFormat
@@ -243,12 +256,17 @@ func handleTranscribeAsync(inputPath, originalName string, opts transcribeOpts,
 		}
 	}
 
-	transcribeCheck := services.Global.CanStartJob("transcribe")
+	transcribeCheck := services.Global.WaitForJobSlot(context.Background(), jobRequest("transcribe", jobID, clientID))
 	if !transcribeCheck.OK {
 		os.Remove(inputPath)
 		job.SetError(transcribeCheck.Reason)
 		return nil
 	}
+	if job.IsCancelled() {
+		os.Remove(inputPath)
+		services.Global.DecrementJob("transcribe")
+		return nil
+	}
 
 	transcribeID := jobID
 
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+	"github.com/coah80/yoink/internal/services"
+)
+
+// WorkerRoutes is the API worker processes use in WORKER_MODE=remote:
+// they long-poll /claim for a job, post progress while running it, then
+// upload the file or report the failure.
+func WorkerRoutes(r chi.Router) {
+	r.Route("/api/worker", func(r chi.Router) {
+		r.Use(requireWorker)
+		r.Post("/claim", handleWorkerClaim)
+		r.Post("/jobs/{id}/progress", handleWorkerProgress)
+		r.Put("/jobs/{id}/result", handleWorkerResult)
+		r.Post("/jobs/{id}/fail", handleWorkerFail)
+	})
+}
+
+// requireWorker only lets requests carrying WORKER_SECRET as a bearer
+// token and an X-Worker-ID through. With no secret the worker API is off.
+func requireWorker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.WorkerSecret == "" {
+			respondJSON(w, 404, map[string]string{"error": "Not found"})
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		expected := "Bearer " + config.WorkerSecret
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(expected)) != 1 {
+			respondJSON(w, 401, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		if r.Header.Get("X-Worker-ID") == "" {
+			respondJSON(w, 400, map[string]string{"error": "X-Worker-ID header is required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleWorkerClaim(w http.ResponseWriter, r *http.Request) {
+	job := services.Workers.Claim(r.Context(), r.Header.Get("X-Worker-ID"))
+	if job == nil {
+		w.WriteHeader(204)
+		return
+	}
+	respondJSON(w, 200, job)
+}
+
+func handleWorkerProgress(w http.ResponseWriter, r *http.Request) {
+	var ev services.WorkerEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		respondJSON(w, 400, map[string]string{"error": "Invalid progress event"})
+		return
+	}
+	cancel, ok := services.Workers.Progress(chi.URLParam(r, "id"), r.Header.Get("X-Worker-ID"), ev)
+	if !ok {
+		respondJSON(w, 404, map[string]string{"error": "Job not found"})
+		return
+	}
+	respondJSON(w, 200, map[string]bool{"cancel": cancel})
+}
+
+func handleWorkerResult(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	err := services.Workers.Complete(chi.URLParam(r, "id"), r.Header.Get("X-Worker-ID"), r.Body, services.RemoteResult{
+		Ext:     q.Get("ext"),
+		IsAudio: q.Get("audio") == "true",
+		IsGif:   q.Get("gif") == "true",
+	})
+	if err != nil {
+		log.Printf("[Workers] Failed to take result for job %s: %v", chi.URLParam(r, "id"), err)
+		respondJSON(w, 400, map[string]string{"error": err.Error()})
+		return
+	}
+	respondJSON(w, 200, map[string]bool{"ok": true})
+}
+
+func handleWorkerFail(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if body.Error == "" {
+		body.Error = "Download failed"
+	}
+	if !services.Workers.Fail(chi.URLParam(r, "id"), r.Header.Get("X-Worker-ID"), body.Error) {
+		respondJSON(w, 404, map[string]string{"error": "Job not found"})
+		return
+	}
+	respondJSON(w, 200, map[string]bool{"ok": true})
+}
+
+// remoteMedia runs downloadMedia on a worker process, leaving the result
+// in opts.Dir as if it had run here.
+func remoteMedia(ctx context.Context, id string, opts mediaOpts, report progressFunc) (*mediaResult, error) {
+	job := &services.RemoteJob{
+		ID:   id,
+		Kind: "download",
+		Media: services.MediaSpec{
+			URL:          opts.URL,
+			Format:       opts.Format,
+			Quality:      opts.Quality,
+			Container:    opts.Container,
+			AudioFormat:  opts.AudioFormat,
+			AudioBitrate: opts.AudioBitrate,
+			TwitterGifs:  opts.TwitterGifs,
+			Playlist:     opts.Playlist,
+		},
+	}
+	report("downloading", "Waiting for a worker...", ptrFloat(0), nil)
+	result, err := services.Workers.Run(ctx, job, opts.Dir, func(ev services.WorkerEvent) {
+		report(ev.Stage, ev.Message, ev.Progress, ev.Extra)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mediaResult{Path: result.Path, Ext: result.Ext, IsAudio: result.IsAudio, IsGif: result.IsGif}, nil
+}
+
+// RunWorkerJob runs a job claimed from the API in a worker process and
+// returns the file it made.
+func RunWorkerJob(ctx context.Context, job *services.RemoteJob, report func(services.WorkerEvent)) (*services.RemoteResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	processInfo := &services.ProcessInfo{JobType: "download", CancelFunc: cancel}
+	stop := context.AfterFunc(ctx, func() {
+		processInfo.SetCancelled(true)
+		processInfo.KillProcess()
+	})
+	defer stop()
+
+	opts := mediaOpts{
+		URL:          job.Media.URL,
+		Format:       job.Media.Format,
+		Quality:      job.Media.Quality,
+		Container:    job.Media.Container,
+		AudioFormat:  job.Media.AudioFormat,
+		AudioBitrate: job.Media.AudioBitrate,
+		TwitterGifs:  job.Media.TwitterGifs,
+		Playlist:     job.Media.Playlist,
+		Dir:          config.TempDirs["download"],
+	}
+	result, err := downloadMedia(ctx, job.ID, metrics.Site(opts.URL), processInfo, opts,
+		func(stage, message string, progress *float64, extra map[string]interface{}) {
+			report(services.WorkerEvent{Stage: stage, Message: message, Progress: progress, Extra: extra})
+		})
+	if err != nil {
+		return nil, err
+	}
+	return &services.RemoteResult{Path: result.Path, Ext: result.Ext, IsAudio: result.IsAudio, IsGif: result.IsGif}, nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"log"
+	"maps"
+	"strings"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/middleware"
+	"github.com/coah80/yoink/internal/services"
+)
+
+// reloadConfig re-reads CONFIG_FILE and applies what changed. An invalid
+// file is logged and ignored so a typo can't take down a running server.
+func reloadConfig() {
+	if config.ConfigFile == "" {
+		log.Println("[Config] Got SIGHUP but CONFIG_FILE isn't set, nothing to reload")
+		return
+	}
+	next, err := config.ReadSettings(config.ConfigFile)
+	if err != nil {
+		log.Printf("[Config] Reload failed, keeping current settings: %v", err)
+		return
+	}
+	if kept := config.ApplyOverrides(&next); len(kept) > 0 {
+		log.Printf("[Config] Keeping what the admin API set for %s", strings.Join(kept, ", "))
+	}
+
+	var changed []string
+	if !maps.Equal(services.Global.JobLimits(), next.JobLimits) {
+		services.Global.SetJobLimits(next.JobLimits)
+		changed = append(changed, "job_limits")
+	}
+	if !maps.Equal(config.Get().SchedulerWeights, next.SchedulerWeights) {
+		services.Global.SetSchedulerWeights(next.SchedulerWeights)
+		changed = append(changed, "scheduler_weights")
+	}
+	if middleware.RateLimitMax() != next.RateLimitMax {
+		middleware.SetRateLimitMax(next.RateLimitMax)
+		changed = append(changed, "rate_limit_max")
+	}
+	changed = append(changed, config.SetTunables(next)...)
+	log.Printf("[Config] %s need a restart to change", strings.Join(config.RestartOnly, ", "))
+
+	if len(changed) == 0 {
+		log.Printf("[Config] Reloaded %s, nothing changed", config.ConfigFile)
+		return
+	}
+	log.Printf("[Config] Reloaded %s, changed: %s", config.ConfigFile, strings.Join(changed, ", "))
+}
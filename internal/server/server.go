@@ -1,39 +1,54 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
 
+	"github.com/coah80/yoink/internal/alerts"
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/middleware"
 	"github.com/coah80/yoink/internal/routes"
+	"github.com/coah80/yoink/internal/services"
 	"github.com/coah80/yoink/internal/util"
 )
 
 func New() *http.Server {
 	r := chi.NewRouter()
 
+	r.Use(middleware.PeerAddr)
 	r.Use(chimw.RealIP)
 	r.Use(chimw.Logger)
 	r.Use(chimw.Recoverer)
 	r.Use(securityHeaders)
 	r.Use(middleware.LoadCORS())
+	r.Use(middleware.APIKeys)
 	r.Use(middleware.RateLimit)
 
 	routes.CoreRoutes(r)
 	routes.DownloadRoutes(r)
 	routes.PlaylistRoutes(r)
+	routes.BatchRoutes(r)
 	routes.ConvertRoutes(r)
 	routes.GalleryRoutes(r)
 	routes.TranscribeRoutes(r)
 	routes.BotRoutes(r)
+	routes.JobsRoutes(r)
+	routes.AdminRoutes(r)
+	routes.WorkerRoutes(r)
+	r.Handle("/metrics", metrics.Handler())
 
 	publicDir := filepath.Join(filepath.Dir(os.Args[0]), "public")
 	if info, err := os.Stat(publicDir); err == nil && info.IsDir() {
@@ -63,6 +78,72 @@ func New() *http.Server {
 	}
 }
 
+// Run serves srv until SIGINT or SIGTERM, then drains: new jobs are
+// refused and /health reports draining while running jobs get
+// ShutdownGrace to finish. Jobs still running after that are
+// checkpointed as interrupted so they can be resumed after the restart.
+// A second signal skips the rest of the grace period. SIGHUP reloads
+// CONFIG_FILE.
+func Run(srv *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-quit:
+		log.Printf("[Drain] Received %s, draining for up to %s", sig, config.Get().ShutdownGrace)
+	}
+
+	alerts.ServerStopping()
+	services.Global.StartDraining()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Get().ShutdownGrace)
+	go func() {
+		select {
+		case <-quit:
+			log.Println("[Drain] Second signal, skipping the rest of the grace period")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	drained := services.Global.WaitForDrain(ctx)
+	cancel()
+	services.Global.StopWebhooks()
+
+	if drained {
+		services.Global.CloseStore()
+	} else {
+		services.Global.Checkpoint()
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+	}
+	services.Global.CloseBackend()
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
 func securityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -73,7 +154,33 @@ func securityHeaders(next http.Handler) http.Handler {
 }
 
 func EnsureTempDirs() {
-	util.ClearTempDir()
+	openSharedState()
+	services.SetupOutputs()
+	services.SetupTokens()
+	os.MkdirAll(filepath.Dir(config.StateDBPath), 0755)
+	if err := services.Global.OpenStore(config.StateDBPath); err != nil {
+		log.Printf("[Store] WARNING: could not open job store, jobs will not survive a restart: %v", err)
+	}
+	keep := services.Global.RestoreFromStore()
+	util.ClearTempDir(keep)
+}
+
+// openSharedState shares sessions, jobs and download tokens with other
+// replicas when STATE_BACKEND asks for it. Each replica still needs its
+// own STATE_DB_PATH, and TEMP_DIR on storage they can all read.
+func openSharedState() {
+	if config.StateBackend != "sqlite" {
+		return
+	}
+	os.MkdirAll(filepath.Dir(config.SharedStatePath), 0755)
+	backend, err := services.OpenSQLiteBackend(config.SharedStatePath)
+	if err != nil {
+		log.Printf("[SharedState] WARNING: could not open %s, state will not be shared with other replicas: %v", config.SharedStatePath, err)
+		return
+	}
+	services.Global.UseBackend(backend)
+	routes.HandleRemoteCancels()
+	log.Printf("[SharedState] Sharing state through %s", config.SharedStatePath)
 }
 
 func PrintBanner() {
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"log"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func (s *State) jobOwners() map[string]string {
+	return s.backend.JobOwners()
+}
+
+func ageSeconds(since time.Time) int {
+	if since.IsZero() {
+		return 0
+	}
+	return int(time.Since(since).Seconds())
+}
+
+func sortByAge(list []map[string]interface{}) {
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["ageSeconds"].(int) > list[j]["ageSeconds"].(int)
+	})
+}
+
+// ListProcesses returns every job holding a process, oldest first.
+func (s *State) ListProcesses() []map[string]interface{} {
+	owners := s.jobOwners()
+
+	s.muProcesses.Lock()
+	list := make([]map[string]interface{}, 0, len(s.activeProcesses))
+	for id, p := range s.activeProcesses {
+		list = append(list, map[string]interface{}{
+			"id":         id,
+			"type":       p.JobType,
+			"owner":      owners[id],
+			"ageSeconds": ageSeconds(p.startedAt),
+			"cancelled":  p.IsCancelled(),
+		})
+	}
+	s.muProcesses.Unlock()
+
+	for _, entry := range list {
+		entry["progress"] = s.jobProgress(entry["id"].(string))
+	}
+	sortByAge(list)
+	return list
+}
+
+// jobProgress is a job's last reported progress: from its progress
+// events, or its async job for jobs that don't send any.
+func (s *State) jobProgress(jobID string) float64 {
+	s.muProgress.Lock()
+	progress, ok := s.lastProgress[jobID]
+	s.muProgress.Unlock()
+	if ok {
+		return progress
+	}
+	if job := s.GetAsyncJob(jobID); job != nil {
+		job.mu.RLock()
+		defer job.mu.RUnlock()
+		return job.Progress
+	}
+	return 0
+}
+
+// ListQueuedJobs returns every job waiting for a slot, longest wait first.
+func (s *State) ListQueuedJobs() []map[string]interface{} {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	var list []map[string]interface{}
+	for jobType, lane := range s.queues {
+		for _, entry := range lane {
+			list = append(list, map[string]interface{}{
+				"id":         entry.id,
+				"type":       jobType,
+				"owner":      entry.clientID,
+				"origin":     entry.origin,
+				"ageSeconds": ageSeconds(entry.enqueued),
+			})
+		}
+	}
+	sortByAge(list)
+	return list
+}
+
+// ListAsyncJobs returns every async job, including finished ones that
+// haven't expired yet, oldest first.
+func (s *State) ListAsyncJobs() []map[string]interface{} {
+	owners := s.jobOwners()
+
+	s.muAsync.RLock()
+	defer s.muAsync.RUnlock()
+	list := make([]map[string]interface{}, 0, len(s.asyncJobs))
+	for id, job := range s.asyncJobs {
+		job.mu.RLock()
+		list = append(list, map[string]interface{}{
+			"id":         id,
+			"type":       job.Type,
+			"status":     job.Status,
+			"progress":   job.Progress,
+			"message":    job.Message,
+			"url":        job.URL,
+			"origin":     job.Origin,
+			"owner":      owners[id],
+			"ageSeconds": ageSeconds(job.CreatedAt),
+		})
+		job.mu.RUnlock()
+	}
+	sortByAge(list)
+	return list
+}
+
+// ListSessions returns every connected client and the jobs it holds.
+func (s *State) ListSessions() []map[string]interface{} {
+	sessions := s.backend.Sessions()
+	list := make([]map[string]interface{}, 0, len(sessions))
+	for clientID, session := range sessions {
+		jobs := make([]string, 0, len(session.ActiveJobs))
+		for jobID := range session.ActiveJobs {
+			jobs = append(jobs, jobID)
+		}
+		sort.Strings(jobs)
+		list = append(list, map[string]interface{}{
+			"clientId":             clientID,
+			"activeJobs":           jobs,
+			"lastHeartbeatSeconds": ageSeconds(session.LastHeartbeat),
+			"idleSeconds":          ageSeconds(session.LastActivity),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["clientId"].(string) < list[j]["clientId"].(string)
+	})
+	return list
+}
+
+// ListChunkedUploads returns every upload still receiving chunks.
+func (s *State) ListChunkedUploads() []map[string]interface{} {
+	s.muChunked.Lock()
+	defer s.muChunked.Unlock()
+	list := make([]map[string]interface{}, 0, len(s.chunkedUploads))
+	for id, u := range s.chunkedUploads {
+		u.mu.Lock()
+		list = append(list, map[string]interface{}{
+			"id":             id,
+			"fileName":       u.FileName,
+			"fileSize":       u.FileSize,
+			"receivedChunks": len(u.ReceivedChunks),
+			"totalChunks":    u.TotalChunks,
+			"idleSeconds":    ageSeconds(u.LastActivity),
+		})
+		u.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["idleSeconds"].(int) > list[j]["idleSeconds"].(int)
+	})
+	return list
+}
+
+// MarkAsyncJobCancelled marks an unfinished async job as cancelled. It
+// reports false if there is no such job or it had already finished.
+func (s *State) MarkAsyncJobCancelled(jobID, message string) bool {
+	job := s.GetAsyncJob(jobID)
+	if job == nil {
+		return false
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if isFinishedStatus(job.Status) {
+		return false
+	}
+	job.Status = "cancelled"
+	job.Message = message
+	return true
+}
+
+// PurgeClient drops a client's session and returns the jobs it held so
+// the caller can cancel them.
+func (s *State) PurgeClient(clientID string) ([]string, bool) {
+	return s.backend.RemoveClient(clientID)
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// JobLimits returns a copy of the per-type job limits.
+func (s *State) JobLimits() map[string]int {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	limits := make(map[string]int, len(config.Get().JobLimits))
+	for k, v := range config.Get().JobLimits {
+		limits[k] = v
+	}
+	return limits
+}
+
+// SetJobLimit changes how many jobs of a type may run at once, with 0
+// removing the limit. Raising a limit admits queued jobs straight away;
+// lowering it lets running jobs finish.
+func (s *State) SetJobLimit(jobType string, limit int) {
+	limits := s.JobLimits()
+	if limit == 0 {
+		delete(limits, jobType)
+	} else {
+		limits[jobType] = limit
+	}
+	s.SetJobLimits(limits)
+}
+
+// SetJobLimits replaces every per-type job limit at once, admitting queued
+// jobs for any type whose limit went up.
+func (s *State) SetJobLimits(limits map[string]int) {
+	s.muJobs.Lock()
+	prevLimits := config.Get().JobLimits
+	config.Update(func(c *config.Settings) { c.JobLimits = maps.Clone(limits) })
+	var admittedTypes []string
+	for jobType, limit := range limits {
+		prev, had := prevLimits[jobType]
+		if had && prev == limit {
+			continue
+		}
+		if had {
+			log.Printf("[Queue] %s limit changed from %d to %d", jobType, prev, limit)
+		} else {
+			log.Printf("[Queue] %s limit set to %d", jobType, limit)
+		}
+		if s.admitQueuedLocked(jobType) > 0 {
+			admittedTypes = append(admittedTypes, jobType)
+		}
+	}
+	for jobType := range prevLimits {
+		if _, kept := limits[jobType]; !kept {
+			log.Printf("[Queue] %s limit removed", jobType)
+			if s.admitQueuedLocked(jobType) > 0 {
+				admittedTypes = append(admittedTypes, jobType)
+			}
+		}
+	}
+	s.muJobs.Unlock()
+
+	for _, jobType := range admittedTypes {
+		s.announceQueue(jobType)
+	}
+}
+
+// SetSchedulerWeights replaces the origin weights used to pick the next
+// queued job. Jobs already running are unaffected.
+func (s *State) SetSchedulerWeights(weights map[string]float64) {
+	s.muJobs.Lock()
+	config.Update(func(c *config.Settings) { c.SchedulerWeights = maps.Clone(weights) })
+	s.muJobs.Unlock()
+	log.Printf("[Queue] Scheduler weights set to %v", weights)
+}
@@ -0,0 +1,228 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+const (
+	// resourceSampleTTL is how long a load, memory and disk sample is
+	// reused. Admissions in between charge their cost against it.
+	resourceSampleTTL = 2 * time.Second
+
+	// admissionRetry is how often waiting jobs recheck resources that free
+	// up without a job finishing, like load dropping or memory released.
+	admissionRetry = 5 * time.Second
+
+	// starvationAge is how long the oldest job in a lane may wait before
+	// smaller jobs stop being let in ahead of it.
+	starvationAge = time.Minute
+)
+
+var defaultJobCost = config.JobCost{CPU: 1, MemoryMB: 250, DiskMB: 500}
+
+// resourceSample is the machine's state the last time it was read. A
+// negative value means it couldn't be read and isn't checked.
+type resourceSample struct {
+	at       time.Time
+	load     float64
+	memoryMB int
+	diskMB   int
+}
+
+func resourceAdmission() bool {
+	return config.AdmissionMode == "resources"
+}
+
+func jobCost(jobType string) config.JobCost {
+	if cost, ok := config.JobCosts[jobType]; ok {
+		return cost
+	}
+	return defaultJobCost
+}
+
+func cpuCores() float64 {
+	if config.CPUCores < 1 {
+		return 1
+	}
+	return float64(config.CPUCores)
+}
+
+// jobCPU is a job's CPU cost, capped at the whole machine so that a job
+// heavier than the box can still run on its own.
+func jobCPU(jobType string) float64 {
+	return math.Min(jobCost(jobType).CPU, cpuCores())
+}
+
+func (s *State) sampleResourcesLocked() *resourceSample {
+	r := &s.resources
+	if time.Since(r.at) < resourceSampleTTL {
+		return r
+	}
+	r.at = time.Now()
+	r.load = -1
+	if load, err := util.GetLoadAverage(); err == nil {
+		r.load = load
+	}
+	r.memoryMB = -1
+	if mem, err := util.GetAvailableMemoryMB(); err == nil {
+		r.memoryMB = mem
+	}
+	r.diskMB = -1
+	if ds, err := util.GetDiskSpace(config.TempDir); err == nil {
+		r.diskMB = int(ds.AvailGB * 1024)
+	}
+	return r
+}
+
+func (s *State) reservedCPULocked() float64 {
+	var total float64
+	for jobType, n := range s.jobsByType {
+		total += float64(n) * jobCPU(jobType)
+	}
+	return total
+}
+
+// atLimitLocked reports whether a type already has as many jobs running
+// as its JobLimits entry allows. It applies in both admission modes.
+func (s *State) atLimitLocked(jobType string) bool {
+	limit, exists := config.Get().JobLimits[jobType]
+	return exists && s.jobsByType[jobType] >= limit
+}
+
+// hasRoomLocked reports whether one more job of a type may start. It
+// can't go over the type's JobLimits entry. With resource admission a job
+// that uses CPU also has to fit in the cores not already promised to
+// running jobs and the machine can't already be saturated, and every job
+// needs memory and disk. When nothing is running a job is always let in,
+// so an oversized job can't wait forever.
+func (s *State) hasRoomLocked(jobType string) bool {
+	if s.atLimitLocked(jobType) {
+		return false
+	}
+	if !resourceAdmission() {
+		return true
+	}
+
+	running := 0
+	for _, n := range s.jobsByType {
+		running += n
+	}
+	if running == 0 {
+		return true
+	}
+
+	cost := jobCost(jobType)
+	r := s.sampleResourcesLocked()
+	if cost.CPU > 0 {
+		cores := cpuCores()
+		if s.reservedCPULocked()+jobCPU(jobType) > cores {
+			return false
+		}
+		if r.load >= 0 && r.load >= cores {
+			return false
+		}
+	}
+	if r.memoryMB >= 0 && r.memoryMB < cost.MemoryMB {
+		return false
+	}
+	reservedMB := int(s.outstandingDiskLocked() >> 20)
+	if r.diskMB >= 0 && r.diskMB-reservedMB-cost.DiskMB < config.Get().DiskSpaceMinGB*1024 {
+		return false
+	}
+	return true
+}
+
+// chargeResourcesLocked takes a newly admitted job's memory and disk off
+// the current sample so a burst of admissions can't all count the same
+// free memory.
+func (s *State) chargeResourcesLocked(jobType string) {
+	if !resourceAdmission() {
+		return
+	}
+	cost := jobCost(jobType)
+	r := s.sampleResourcesLocked()
+	if r.memoryMB >= 0 {
+		r.memoryMB -= cost.MemoryMB
+	}
+	if r.diskMB >= 0 {
+		r.diskMB -= cost.DiskMB
+	}
+}
+
+// slotEstimateLocked is roughly how many jobs of a type run side by side,
+// used for queue ETAs. Jobs without a CPU cost are guessed at one a core.
+func (s *State) slotEstimateLocked(jobType string) int {
+	if !resourceAdmission() {
+		return config.Get().JobLimits[jobType]
+	}
+	slots := max(1, int(cpuCores()))
+	if cpu := jobCPU(jobType); cpu > 0 {
+		slots = max(1, int(cpuCores()/cpu))
+	}
+	if limit, ok := config.Get().JobLimits[jobType]; ok {
+		slots = min(slots, limit)
+	}
+	return slots
+}
+
+// admitAllLocked admits queued jobs of every type, oldest lane first.
+// Smaller jobs may fill in around a lane that doesn't fit yet, until that
+// lane has waited starvationAge. It returns the types that admitted jobs.
+func (s *State) admitAllLocked() []string {
+	var types []string
+	for jobType, lane := range s.queues {
+		if len(lane) > 0 {
+			types = append(types, jobType)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return s.queues[types[i]][0].enqueued.Before(s.queues[types[j]][0].enqueued)
+	})
+
+	var admitted []string
+	for _, jobType := range types {
+		if s.admitQueuedLocked(jobType) > 0 {
+			admitted = append(admitted, jobType)
+		}
+		lane := s.queues[jobType]
+		if !s.draining && len(lane) > 0 && time.Since(lane[0].enqueued) > starvationAge {
+			break
+		}
+	}
+	return admitted
+}
+
+// admitWaiting retries admission for every lane and pushes new positions
+// to the ones that moved.
+func (s *State) admitWaiting() {
+	s.muJobs.Lock()
+	admitted := s.admitAllLocked()
+	s.muJobs.Unlock()
+	for _, jobType := range admitted {
+		s.announceQueue(jobType)
+	}
+}
+
+func (s *State) resourceStatusLocked() map[string]interface{} {
+	status := map[string]interface{}{
+		"mode":     config.AdmissionMode,
+		"cpuCores": config.CPUCores,
+	}
+	if !resourceAdmission() {
+		return status
+	}
+	r := s.sampleResourcesLocked()
+	status["reservedCpu"] = math.Round(s.reservedCPULocked()*100) / 100
+	if r.load >= 0 {
+		status["loadAverage"] = r.load
+	}
+	if r.memoryMB >= 0 {
+		status["freeMemoryMB"] = r.memoryMB
+	}
+	return status
+}
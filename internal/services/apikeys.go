@@ -0,0 +1,292 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrJobTypeNotAllowed = errors.New("This API key isn't allowed to start that type of job")
+	ErrKeyQuotaExceeded  = errors.New("This API key has used up its daily quota")
+)
+
+// APIKey is a credential for an integration. Keys are handed out as
+// "yk_<id>_<secret>" and only a hash of that is kept. Zero limits mean
+// the server-wide defaults apply.
+type APIKey struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Hash       string    `json:"hash"`
+	RateLimit  int       `json:"rateLimit"`
+	DailyBytes int64     `json:"dailyBytes"`
+	DailyJobs  int       `json:"dailyJobs"`
+	JobTypes   []string  `json:"jobTypes"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// APIKeyUsage is what a key has used so far on Day, a UTC date.
+type APIKeyUsage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Jobs     int    `json:"jobs"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (k *APIKey) AllowsJobType(jobType string) bool {
+	if len(k.JobTypes) == 0 {
+		return true
+	}
+	for _, t := range k.JobTypes {
+		if t == jobType {
+			return true
+		}
+	}
+	return false
+}
+
+// Info is the key as shown to admins and to the key's holder, without
+// its hash.
+func (k *APIKey) Info(usage APIKeyUsage) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        k.ID,
+		"name":      k.Name,
+		"createdAt": k.CreatedAt,
+		"limits": map[string]interface{}{
+			"rateLimit":  k.RateLimit,
+			"dailyBytes": k.DailyBytes,
+			"dailyJobs":  k.DailyJobs,
+			"jobTypes":   k.JobTypes,
+		},
+		"usage": usage,
+	}
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+type apiKeyContextKey struct{}
+
+func WithAPIKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+// APIKeyFrom returns the key a request was authenticated with, if any.
+func APIKeyFrom(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// CreateAPIKey saves key under a new ID and returns the full key, which
+// is the only time it's available.
+func (s *State) CreateAPIKey(key APIKey) (*APIKey, string) {
+	idBytes := make([]byte, 6)
+	rand.Read(idBytes)
+	secret := make([]byte, 24)
+	rand.Read(secret)
+
+	key.ID = hex.EncodeToString(idBytes)
+	raw := fmt.Sprintf("yk_%s_%s", key.ID, hex.EncodeToString(secret))
+	key.Hash = hashAPIKey(raw)
+	key.CreatedAt = time.Now()
+
+	s.muKeys.Lock()
+	s.apiKeys[key.ID] = &key
+	s.muKeys.Unlock()
+	if s.store != nil {
+		s.store.put(tableAPIKeys, key.ID, &key)
+	}
+	s.share(tableAPIKeys, key.ID, &key)
+	return &key, raw
+}
+
+func (s *State) RevokeAPIKey(id string) bool {
+	s.muKeys.Lock()
+	_, ok := s.apiKeys[id]
+	if !ok {
+		var shared APIKey
+		ok = s.sharedRecord(tableAPIKeys, id, &shared)
+	}
+	delete(s.apiKeys, id)
+	delete(s.keyUsage, id)
+	s.muKeys.Unlock()
+	if s.store != nil {
+		s.store.remove(tableAPIKeys, id)
+		s.store.remove(tableAPIKeyUsage, id)
+	}
+	s.unshare(tableAPIKeys, id)
+	s.unshare(tableAPIKeyUsage, id)
+	return ok
+}
+
+// apiKeyLocked finds a key, checking with other replicas first when
+// shared since any of them may have revoked it. Callers hold muKeys.
+func (s *State) apiKeyLocked(id string) *APIKey {
+	if s.shared {
+		var shared APIKey
+		if !s.sharedRecord(tableAPIKeys, id, &shared) {
+			delete(s.apiKeys, id)
+			return nil
+		}
+		s.apiKeys[id] = &shared
+		return &shared
+	}
+	return s.apiKeys[id]
+}
+
+// AuthenticateAPIKey returns the key raw is, or nil if it isn't one.
+func (s *State) AuthenticateAPIKey(raw string) *APIKey {
+	rest, ok := strings.CutPrefix(raw, "yk_")
+	if !ok {
+		return nil
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil
+	}
+	s.muKeys.Lock()
+	key := s.apiKeyLocked(id)
+	s.muKeys.Unlock()
+	if key == nil || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKey(raw))) != 1 {
+		return nil
+	}
+	return key
+}
+
+func (s *State) ListAPIKeys() []map[string]interface{} {
+	s.muKeys.Lock()
+	keys := make([]*APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	s.muKeys.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	out := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, key.Info(s.APIKeyUsage(key.ID)))
+	}
+	return out
+}
+
+// usageLocked is today's usage for a key, starting afresh when the day
+// has changed. Callers hold muKeys.
+func (s *State) usageLocked(id string) *APIKeyUsage {
+	today := usageDay(time.Now())
+	usage := s.keyUsage[id]
+	var shared APIKeyUsage
+	if s.sharedRecord(tableAPIKeyUsage, id, &shared) {
+		usage = &shared
+	}
+	if usage == nil || usage.Day != today {
+		usage = &APIKeyUsage{Day: today}
+	}
+	s.keyUsage[id] = usage
+	return usage
+}
+
+// updateUsageLocked runs change on today's usage for a key and saves it if
+// change reports a change, with no other replica able to count against
+// the key in between. Callers hold muKeys.
+func (s *State) updateUsageLocked(id string, change func(usage *APIKeyUsage) bool) {
+	var usage APIKeyUsage
+	if local := s.keyUsage[id]; local != nil {
+		usage = *local
+	}
+	saved := s.modifyShared(tableAPIKeyUsage, id, &usage, func() bool {
+		if today := usageDay(time.Now()); usage.Day != today {
+			usage = APIKeyUsage{Day: today}
+		}
+		return change(&usage)
+	})
+	if !saved {
+		return
+	}
+	s.keyUsage[id] = &usage
+	if s.store != nil {
+		s.store.put(tableAPIKeyUsage, id, &usage)
+	}
+}
+
+func (s *State) APIKeyUsage(id string) APIKeyUsage {
+	s.muKeys.Lock()
+	defer s.muKeys.Unlock()
+	return *s.usageLocked(id)
+}
+
+// UseAPIKeyJob counts a new job against a key, refusing it if the key
+// can't run that type of job or is out of jobs or bytes for the day.
+func (s *State) UseAPIKeyJob(key *APIKey, jobType string) error {
+	if !key.AllowsJobType(jobType) {
+		return ErrJobTypeNotAllowed
+	}
+	s.muKeys.Lock()
+	defer s.muKeys.Unlock()
+	var err error
+	s.updateUsageLocked(key.ID, func(usage *APIKeyUsage) bool {
+		if (key.DailyJobs > 0 && usage.Jobs >= key.DailyJobs) || (key.DailyBytes > 0 && usage.Bytes >= key.DailyBytes) {
+			err = ErrKeyQuotaExceeded
+			return false
+		}
+		usage.Jobs++
+		return true
+	})
+	return err
+}
+
+// CheckAPIKeyBytes fails if sending size more bytes would take a key past
+// its daily byte quota, without counting them.
+func (s *State) CheckAPIKeyBytes(key *APIKey, size int64) error {
+	if key.DailyBytes <= 0 {
+		return nil
+	}
+	s.muKeys.Lock()
+	defer s.muKeys.Unlock()
+	if s.usageLocked(key.ID).Bytes+size > key.DailyBytes {
+		return ErrKeyQuotaExceeded
+	}
+	return nil
+}
+
+// ChargeAPIKeyBytes counts bytes a key is sent from somewhere other than
+// this server, like a bucket it was redirected to, refusing them if they
+// would take the key past its daily byte quota.
+func (s *State) ChargeAPIKeyBytes(key *APIKey, size int64) error {
+	s.muKeys.Lock()
+	defer s.muKeys.Unlock()
+	var err error
+	s.updateUsageLocked(key.ID, func(usage *APIKeyUsage) bool {
+		if key.DailyBytes > 0 && usage.Bytes+size > key.DailyBytes {
+			err = ErrKeyQuotaExceeded
+			return false
+		}
+		usage.Bytes += size
+		return true
+	})
+	return err
+}
+
+// RecordAPIKeyRequest counts a finished request and the bytes sent back
+// for it.
+func (s *State) RecordAPIKeyRequest(id string, bytes int64) {
+	s.muKeys.Lock()
+	defer s.muKeys.Unlock()
+	s.updateUsageLocked(id, func(usage *APIKeyUsage) bool {
+		usage.Requests++
+		usage.Bytes += bytes
+		return true
+	})
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAPIKeyQuotas(t *testing.T) {
+	s := newTestState()
+	key, raw := s.CreateAPIKey(APIKey{Name: "slack", DailyJobs: 2, DailyBytes: 1000, JobTypes: []string{"download"}})
+
+	if got := s.AuthenticateAPIKey(raw); got == nil || got.ID != key.ID {
+		t.Fatalf("key didn't authenticate: %v", got)
+	}
+	if s.AuthenticateAPIKey(raw+"x") != nil || s.AuthenticateAPIKey("yk_"+key.ID+"_wrong") != nil {
+		t.Error("wrong secret authenticated")
+	}
+
+	if err := s.UseAPIKeyJob(key, "transcribe"); !errors.Is(err, ErrJobTypeNotAllowed) {
+		t.Errorf("disallowed job type: err = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.UseAPIKeyJob(key, "download"); err != nil {
+			t.Fatalf("job %d refused: %v", i+1, err)
+		}
+	}
+	if err := s.UseAPIKeyJob(key, "download"); !errors.Is(err, ErrKeyQuotaExceeded) {
+		t.Errorf("job over the daily limit: err = %v", err)
+	}
+
+	other, _ := s.CreateAPIKey(APIKey{Name: "archiver", DailyBytes: 1000})
+	s.RecordAPIKeyRequest(other.ID, 1500)
+	if err := s.UseAPIKeyJob(other, "playlist"); !errors.Is(err, ErrKeyQuotaExceeded) {
+		t.Errorf("job after the byte quota ran out: err = %v", err)
+	}
+	if usage := s.APIKeyUsage(other.ID); usage.Requests != 1 || usage.Bytes != 1500 {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	if !s.RevokeAPIKey(key.ID) || s.AuthenticateAPIKey(raw) != nil {
+		t.Error("revoked key still authenticates")
+	}
+}
+
+func TestAPIKeyByteQuota(t *testing.T) {
+	s := newTestState()
+	key, _ := s.CreateAPIKey(APIKey{Name: "archiver", DailyBytes: 1000})
+
+	if err := s.CheckAPIKeyBytes(key, 1000); err != nil {
+		t.Errorf("file that fits the quota refused: %v", err)
+	}
+	if err := s.CheckAPIKeyBytes(key, 1001); !errors.Is(err, ErrKeyQuotaExceeded) {
+		t.Errorf("file bigger than the quota: err = %v", err)
+	}
+
+	if err := s.ChargeAPIKeyBytes(key, 600); err != nil {
+		t.Fatalf("redirected download refused: %v", err)
+	}
+	if err := s.ChargeAPIKeyBytes(key, 600); !errors.Is(err, ErrKeyQuotaExceeded) {
+		t.Errorf("redirected download past the quota: err = %v", err)
+	}
+	if err := s.CheckAPIKeyBytes(key, 500); !errors.Is(err, ErrKeyQuotaExceeded) {
+		t.Errorf("file bigger than what's left: err = %v", err)
+	}
+	if usage := s.APIKeyUsage(key.ID); usage.Bytes != 600 || usage.Requests != 0 {
+		t.Errorf("usage = %+v, want only the first redirect counted", usage)
+	}
+
+	unlimited, _ := s.CreateAPIKey(APIKey{Name: "slack"})
+	if err := s.ChargeAPIKeyBytes(unlimited, 1<<40); err != nil {
+		t.Errorf("key without a byte quota refused: %v", err)
+	}
+}
@@ -0,0 +1,511 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+// StateBackend holds the state every API replica has to agree on: client
+// sessions and the jobs they own, records of async jobs, download tokens,
+// file refs and streaming jobs, and the progress and cancel messages that
+// have to reach whichever replica is running a job. Processes, job slots
+// and open progress streams always stay in the replica that has them.
+type StateBackend interface {
+	// RegisterClient creates a session for clientID or marks it active,
+	// and reports whether it was created.
+	RegisterClient(clientID string) bool
+	// Heartbeat records a heartbeat, reporting false if there's no session.
+	Heartbeat(clientID string) bool
+	// ClientJobs is the jobs clientID holds, and whether it has a session.
+	ClientJobs(clientID string) ([]string, bool)
+	// LinkJob gives jobID to clientID if it has a session.
+	LinkJob(jobID, clientID string)
+	// ReserveJob gives jobID to clientID, creating its session if needed,
+	// unless it already holds maxJobs jobs.
+	ReserveJob(jobID, clientID string, maxJobs int) (ok, created bool)
+	JobOwner(jobID string) string
+	JobOwners() map[string]string
+	UnlinkJob(jobID string)
+	Sessions() map[string]ClientSession
+	// RemoveClient drops a session and every job it owns, returning them.
+	RemoveClient(clientID string) ([]string, bool)
+	// ExpireSessions drops sessions that missed their heartbeat while
+	// holding jobs or sat idle without any, and returns them.
+	ExpireSessions(now time.Time) []ExpiredSession
+
+	Put(table, key string, data []byte)
+	Get(table, key string) ([]byte, bool)
+	Delete(table, key string)
+	// Modify replaces a record with what change makes of it, with no
+	// other replica able to change it in between. change gets nil when
+	// there's no record, and returns nil to leave it as it is.
+	Modify(table, key string, change func(data []byte) []byte)
+
+	// Publish sends data to everyone subscribed to channel on any replica.
+	Publish(channel string, data []byte)
+	// Subscribe delivers what's published to channel until ctx ends.
+	Subscribe(ctx context.Context, channel string) <-chan []byte
+
+	Close()
+}
+
+// ExpiredSession is a session ExpireSessions dropped. Idle sessions held
+// no jobs; the others lost their heartbeat with JobIDs still running.
+type ExpiredSession struct {
+	ClientID string
+	JobIDs   []string
+	Idle     bool
+}
+
+// memoryBackend keeps everything in this process. It's the default, for
+// running a single API server.
+type memoryBackend struct {
+	muSessions  sync.Mutex
+	sessions    map[string]*ClientSession
+	jobToClient map[string]string
+
+	muRecords sync.RWMutex
+	records   map[string]map[string][]byte
+
+	muSubs sync.Mutex
+	subs   map[string]map[chan []byte]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		sessions:    make(map[string]*ClientSession),
+		jobToClient: make(map[string]string),
+		records:     make(map[string]map[string][]byte),
+		subs:        make(map[string]map[chan []byte]bool),
+	}
+}
+
+func newClientSession(clientID string) *ClientSession {
+	return &ClientSession{
+		LastHeartbeat: time.Now(),
+		LastActivity:  time.Now(),
+		ActiveJobs:    make(map[string]bool),
+		SkipHeartbeat: strings.HasPrefix(clientID, "ip:"),
+	}
+}
+
+func (m *memoryBackend) RegisterClient(clientID string) bool {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	if session, exists := m.sessions[clientID]; exists {
+		session.LastActivity = time.Now()
+		return false
+	}
+	m.sessions[clientID] = newClientSession(clientID)
+	return true
+}
+
+func (m *memoryBackend) Heartbeat(clientID string) bool {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	session, exists := m.sessions[clientID]
+	if !exists {
+		return false
+	}
+	session.LastHeartbeat = time.Now()
+	return true
+}
+
+func (m *memoryBackend) ClientJobs(clientID string) ([]string, bool) {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	session, exists := m.sessions[clientID]
+	if !exists {
+		return nil, false
+	}
+	jobIDs := make([]string, 0, len(session.ActiveJobs))
+	for jobID := range session.ActiveJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	return jobIDs, true
+}
+
+func (m *memoryBackend) LinkJob(jobID, clientID string) {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	session, exists := m.sessions[clientID]
+	if !exists {
+		return
+	}
+	session.ActiveJobs[jobID] = true
+	session.LastActivity = time.Now()
+	m.jobToClient[jobID] = clientID
+}
+
+func (m *memoryBackend) ReserveJob(jobID, clientID string, maxJobs int) (ok, created bool) {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	session, exists := m.sessions[clientID]
+	if !exists {
+		session = newClientSession(clientID)
+		m.sessions[clientID] = session
+	}
+	if len(session.ActiveJobs) >= maxJobs {
+		return false, !exists
+	}
+	session.ActiveJobs[jobID] = true
+	session.LastActivity = time.Now()
+	m.jobToClient[jobID] = clientID
+	return true, !exists
+}
+
+func (m *memoryBackend) JobOwner(jobID string) string {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	return m.jobToClient[jobID]
+}
+
+func (m *memoryBackend) JobOwners() map[string]string {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	owners := make(map[string]string, len(m.jobToClient))
+	for jobID, clientID := range m.jobToClient {
+		owners[jobID] = clientID
+	}
+	return owners
+}
+
+func (m *memoryBackend) UnlinkJob(jobID string) {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	clientID, exists := m.jobToClient[jobID]
+	if !exists {
+		return
+	}
+	if session, ok := m.sessions[clientID]; ok {
+		delete(session.ActiveJobs, jobID)
+		session.LastActivity = time.Now()
+	}
+	delete(m.jobToClient, jobID)
+}
+
+func (m *memoryBackend) Sessions() map[string]ClientSession {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	out := make(map[string]ClientSession, len(m.sessions))
+	for clientID, session := range m.sessions {
+		cp := *session
+		cp.ActiveJobs = make(map[string]bool, len(session.ActiveJobs))
+		for jobID := range session.ActiveJobs {
+			cp.ActiveJobs[jobID] = true
+		}
+		out[clientID] = cp
+	}
+	return out
+}
+
+func (m *memoryBackend) RemoveClient(clientID string) ([]string, bool) {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	session, exists := m.sessions[clientID]
+	var jobIDs []string
+	for jobID, owner := range m.jobToClient {
+		if owner == clientID {
+			jobIDs = append(jobIDs, jobID)
+			delete(m.jobToClient, jobID)
+		}
+	}
+	delete(m.sessions, clientID)
+	if exists {
+		for jobID := range session.ActiveJobs {
+			if !contains(jobIDs, jobID) {
+				jobIDs = append(jobIDs, jobID)
+			}
+		}
+	}
+	return jobIDs, exists || len(jobIDs) > 0
+}
+
+func (m *memoryBackend) ExpireSessions(now time.Time) []ExpiredSession {
+	m.muSessions.Lock()
+	defer m.muSessions.Unlock()
+	var expired []ExpiredSession
+	for clientID, session := range m.sessions {
+		hasActive := len(session.ActiveJobs) > 0
+		if hasActive && !session.SkipHeartbeat && now.Sub(session.LastHeartbeat) > config.HeartbeatTimeout {
+			var jobIDs []string
+			for jobID := range session.ActiveJobs {
+				jobIDs = append(jobIDs, jobID)
+			}
+			expired = append(expired, ExpiredSession{ClientID: clientID, JobIDs: jobIDs})
+			delete(m.sessions, clientID)
+		} else if !hasActive && now.Sub(session.LastActivity) > config.SessionIdleTimeout {
+			expired = append(expired, ExpiredSession{ClientID: clientID, Idle: true})
+			delete(m.sessions, clientID)
+		}
+	}
+	return expired
+}
+
+func (m *memoryBackend) Put(table, key string, data []byte) {
+	m.muRecords.Lock()
+	defer m.muRecords.Unlock()
+	if m.records[table] == nil {
+		m.records[table] = make(map[string][]byte)
+	}
+	m.records[table][key] = data
+}
+
+func (m *memoryBackend) Get(table, key string) ([]byte, bool) {
+	m.muRecords.RLock()
+	defer m.muRecords.RUnlock()
+	data, ok := m.records[table][key]
+	return data, ok
+}
+
+func (m *memoryBackend) Delete(table, key string) {
+	m.muRecords.Lock()
+	defer m.muRecords.Unlock()
+	delete(m.records[table], key)
+}
+
+func (m *memoryBackend) Modify(table, key string, change func(data []byte) []byte) {
+	m.muRecords.Lock()
+	defer m.muRecords.Unlock()
+	next := change(m.records[table][key])
+	if next == nil {
+		return
+	}
+	if m.records[table] == nil {
+		m.records[table] = make(map[string][]byte)
+	}
+	m.records[table][key] = next
+}
+
+// Publish hands data to this process's subscribers, skipping any that
+// aren't keeping up rather than blocking the sender.
+func (m *memoryBackend) Publish(channel string, data []byte) {
+	m.muSubs.Lock()
+	defer m.muSubs.Unlock()
+	for ch := range m.subs[channel] {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
+
+func (m *memoryBackend) Subscribe(ctx context.Context, channel string) <-chan []byte {
+	ch := make(chan []byte, 64)
+	m.muSubs.Lock()
+	if m.subs[channel] == nil {
+		m.subs[channel] = make(map[chan []byte]bool)
+	}
+	m.subs[channel][ch] = true
+	m.muSubs.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		m.muSubs.Lock()
+		delete(m.subs[channel], ch)
+		if len(m.subs[channel]) == 0 {
+			delete(m.subs, channel)
+		}
+		m.muSubs.Unlock()
+	})
+	return ch
+}
+
+func (m *memoryBackend) Close() {}
+
+const (
+	cancelChannel   = "cancel"
+	lostJobsChannel = "lost-jobs"
+)
+
+func progressChannel(jobID string) string {
+	return "progress:" + jobID
+}
+
+// UseBackend shares this replica's state through b. It has to be called
+// at startup, before any sessions or jobs exist.
+func (s *State) UseBackend(b StateBackend) {
+	s.backend = b
+	s.shared = true
+
+	ctx, stop := context.WithCancel(context.Background())
+	s.stopSharing = stop
+	go s.shareAsyncJobs(ctx)
+}
+
+// shareAsyncJobs refreshes the other replicas' copies of async jobs every
+// second until ctx ends. Later changes to a finished job are shared where
+// they're made.
+func (s *State) shareAsyncJobs(ctx context.Context) {
+	s.syncAsyncJobs(ctx, time.Second, func(id string, data []byte) {
+		s.backend.Put(tableAsyncJobs, id, data)
+	})
+}
+
+// syncAsyncJobs passes write the record of each async job that has
+// changed since it was last written, every interval until ctx ends. Async
+// jobs change in place, so this is how those changes get out. A job isn't
+// looked at again once it has been written finished.
+func (s *State) syncAsyncJobs(ctx context.Context, interval time.Duration, write func(id string, data []byte)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	sent := make(map[string][]byte)
+	finished := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.muAsync.RLock()
+		jobs := make(map[string]*AsyncJob, len(s.asyncJobs))
+		for id, job := range s.asyncJobs {
+			if !finished[id] {
+				jobs[id] = job
+			}
+		}
+		for id := range finished {
+			if s.asyncJobs[id] == nil {
+				delete(finished, id)
+			}
+		}
+		s.muAsync.RUnlock()
+		for id := range sent {
+			if jobs[id] == nil {
+				delete(sent, id)
+			}
+		}
+
+		for id, job := range jobs {
+			rec := job.record()
+			data, err := json.Marshal(rec)
+			if err != nil {
+				continue
+			}
+			if !bytes.Equal(data, sent[id]) {
+				write(id, data)
+				sent[id] = data
+			}
+			if isFinishedStatus(rec.Status) {
+				finished[id] = true
+				delete(sent, id)
+			}
+		}
+	}
+}
+
+// CloseBackend stops sharing and closes the backend once nothing will use
+// it again.
+func (s *State) CloseBackend() {
+	if s.stopSharing != nil {
+		s.stopSharing()
+	}
+	s.backend.Close()
+}
+
+// share copies a record to the backend so other replicas can find it.
+// With nothing to share with, the local maps are all there is.
+func (s *State) share(table, key string, v interface{}) {
+	if !s.shared {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[SharedState] Failed to encode %s/%s: %v", table, key, err)
+		return
+	}
+	s.backend.Put(table, key, data)
+}
+
+func (s *State) unshare(table, key string) {
+	if s.shared {
+		s.backend.Delete(table, key)
+	}
+}
+
+// modifyShared runs change on v and saves v, with no other replica able
+// to change the record in between. v is first overwritten by the shared
+// record, if there is one. change reports whether to save v, and
+// modifyShared whether it was saved. With nothing to share with, change
+// just runs on v.
+func (s *State) modifyShared(table, key string, v interface{}, change func() bool) bool {
+	if !s.shared {
+		return change()
+	}
+	saved := false
+	s.backend.Modify(table, key, func(data []byte) []byte {
+		if data != nil && json.Unmarshal(data, v) != nil {
+			return nil
+		}
+		if !change() {
+			return nil
+		}
+		next, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("[SharedState] Failed to encode %s/%s: %v", table, key, err)
+			return nil
+		}
+		saved = true
+		return next
+	})
+	return saved
+}
+
+// sharedRecord loads a record another replica shared into v.
+func (s *State) sharedRecord(table, key string, v interface{}) bool {
+	if !s.shared {
+		return false
+	}
+	data, ok := s.backend.Get(table, key)
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+// SubscribeProgress delivers the progress events for a job running on
+// another replica until ctx ends.
+func (s *State) SubscribeProgress(ctx context.Context, jobID string) <-chan []byte {
+	if !s.shared {
+		return nil
+	}
+	return s.backend.Subscribe(ctx, progressChannel(jobID))
+}
+
+// RequestCancel asks the other replicas to cancel a job that isn't
+// running here, reporting false if none of them knows it.
+func (s *State) RequestCancel(jobID string) bool {
+	if !s.shared {
+		return false
+	}
+	_, pending := s.backend.Get(tablePendingJobs, jobID)
+	known := pending || s.GetJobOwner(jobID) != ""
+	if job := s.GetAsyncJob(jobID); job != nil {
+		status, _, _, _, _ := job.GetStatus()
+		known = known || !isFinishedStatus(status)
+	}
+	if known {
+		s.backend.Publish(cancelChannel, []byte(jobID))
+	}
+	return known
+}
+
+// HandleCancelRequests runs cancel for every job another replica was
+// asked to cancel. cancel should only look at jobs running here.
+func (s *State) HandleCancelRequests(cancel func(jobID string) bool) {
+	if !s.shared {
+		return
+	}
+	requests := s.backend.Subscribe(context.Background(), cancelChannel)
+	go func() {
+		for data := range requests {
+			jobID := string(data)
+			if cancel(jobID) {
+				log.Printf("[SharedState] Cancelled job %s for another replica", jobID)
+			}
+		}
+	}()
+}
@@ -0,0 +1,253 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+var ErrFileGone = errors.New("File no longer available")
+
+// Delivery is a finished file to send to a client.
+type Delivery struct {
+	Path     string
+	Name     string // what the client saves it as, extension included
+	MimeType string
+
+	// Key names the file across requests, such as its download token, so
+	// its completed downloads are counted together. It defaults to Path.
+	Key string
+
+	// OnComplete runs after each request that sends the file through to
+	// its last byte. A download resumed with Range counts once the part
+	// that finishes it has been sent.
+	OnComplete func()
+
+	// Claim runs before any of the file is sent, and refuses the request
+	// with a 410 when it returns an error, such as a token with no
+	// downloads left. Every request but HEAD makes a claim, so a download
+	// resumed over several requests makes several. The func it returns
+	// gives the claim back, and runs when the response doesn't go out in
+	// full.
+	Claim func() (release func(), err error)
+
+	// Remove deletes the file and anything pointing at it. It runs
+	// DownloadKeepFor after the first completed download, or as soon as
+	// there have been DeleteAfterDownloads of them. Leave it nil when the
+	// caller cleans up itself.
+	Remove func()
+}
+
+// ServeFile sends d, answering Range and conditional requests and
+// pacing it to the egress limits. It reports whether the whole file went
+// out. When the file can't be sent at all it writes the error response
+// itself and returns the error, so callers only need to clean up.
+func ServeFile(w http.ResponseWriter, r *http.Request, d Delivery) (bool, error) {
+	f, err := os.Open(d.Path)
+	if err != nil {
+		writeDeliveryError(w, 404, ErrFileGone)
+		return false, ErrFileGone
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		writeDeliveryError(w, 404, ErrFileGone)
+		return false, ErrFileGone
+	}
+
+	tw, done, err := BeginTransfer(w, r)
+	if err != nil {
+		writeDeliveryError(w, 429, err)
+		return false, err
+	}
+	defer done()
+	dw := &deliveryWriter{ResponseWriter: tw, status: 200}
+
+	if d.Claim != nil && r.Method != "HEAD" {
+		release, err := d.Claim()
+		if err != nil {
+			writeDeliveryError(w, 410, err)
+			return false, err
+		}
+		defer func() {
+			if !dw.sentInFull() {
+				release()
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", d.MimeType)
+	w.Header().Set("Content-Disposition", ContentDisposition(d.Name))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	w.Header().Set("Cache-Control", "private")
+
+	http.ServeContent(dw, r, d.Name, info.ModTime(), f)
+
+	complete := r.Method != "HEAD" && dw.servedToEnd(info.Size())
+	if !complete {
+		return false, nil
+	}
+	if d.OnComplete != nil {
+		d.OnComplete()
+	}
+	if d.Remove != nil {
+		key := d.Key
+		if key == "" {
+			key = d.Path
+		}
+		countDelivery(key, d.Remove)
+	}
+	return true, nil
+}
+
+func writeDeliveryError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// deliveryWriter records the status and how much of the body was sent,
+// to tell whether the client got the file to its end.
+type deliveryWriter struct {
+	http.ResponseWriter
+	status int
+	sent   int64
+}
+
+func (dw *deliveryWriter) WriteHeader(code int) {
+	dw.status = code
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *deliveryWriter) Write(b []byte) (int, error) {
+	n, err := dw.ResponseWriter.Write(b)
+	dw.sent += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the zero-copy path ServeContent would have taken when
+// the writer underneath has one, which it does when egress isn't
+// throttled.
+func (dw *deliveryWriter) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := dw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{dw.ResponseWriter}, src)
+	}
+	dw.sent += n
+	return n, err
+}
+
+func (dw *deliveryWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// sentInFull reports whether the response carried a body and all of it,
+// whichever part of the file it was.
+func (dw *deliveryWriter) sentInFull() bool {
+	if dw.status != 200 && dw.status != 206 {
+		return false
+	}
+	length, err := strconv.ParseInt(dw.Header().Get("Content-Length"), 10, 64)
+	return err == nil && dw.sent == length
+}
+
+// servedToEnd reports whether the response carried the file up to its
+// last byte: all of it, or a single range that runs to the end.
+func (dw *deliveryWriter) servedToEnd(size int64) bool {
+	switch dw.status {
+	case 200:
+		return dw.sent == size
+	case 206:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(dw.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+			return false
+		}
+		return end == total-1 && dw.sent == end-start+1
+	}
+	return false
+}
+
+// ContentDisposition is an attachment header for name following RFC
+// 6266: an ASCII stand-in in filename for older clients and the real
+// name, percent-encoded, in filename*.
+func ContentDisposition(name string) string {
+	var ascii, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7E || r == '"' || r == '\\' {
+			ascii.WriteRune('_')
+		} else {
+			ascii.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, ascii.String(), encoded.String())
+}
+
+// isAttrChar is RFC 5987's attr-char, the bytes filename* leaves as is.
+func isAttrChar(b byte) bool {
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z', b >= '0' && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+var (
+	muDeliveries sync.Mutex
+	deliveries   = make(map[string]*delivered)
+)
+
+// delivered counts the completed downloads of a file that's due to be
+// removed.
+type delivered struct {
+	count int
+	timer *time.Timer
+}
+
+func countDelivery(key string, remove func()) {
+	muDeliveries.Lock()
+	defer muDeliveries.Unlock()
+	d := deliveries[key]
+	if d == nil {
+		d = &delivered{}
+		deliveries[key] = d
+	}
+	d.count++
+
+	if config.DeleteAfterDownloads > 0 && d.count >= config.DeleteAfterDownloads {
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+		delete(deliveries, key)
+		go remove()
+		return
+	}
+	if d.timer == nil {
+		d.timer = time.AfterFunc(config.DownloadKeepFor, func() {
+			muDeliveries.Lock()
+			if deliveries[key] == d {
+				delete(deliveries, key)
+			}
+			muDeliveries.Unlock()
+			remove()
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestServeFile(t *testing.T) {
+	prevDeletes, prevKeep := config.DeleteAfterDownloads, config.DownloadKeepFor
+	config.DeleteAfterDownloads, config.DownloadKeepFor = 2, time.Hour
+	defer func() { config.DeleteAfterDownloads, config.DownloadKeepFor = prevDeletes, prevKeep }()
+
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	completed := 0
+	removed := make(chan struct{})
+	d := Delivery{
+		Path:       path,
+		Name:       `clip "final" é.mp4`,
+		MimeType:   "video/mp4",
+		OnComplete: func() { completed++ },
+		Remove:     func() { close(removed) },
+	}
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/job/abc/download", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		if _, err := ServeFile(w, r, d); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := serve("", "")
+	if w.Code != 200 || w.Body.String() != "0123456789" {
+		t.Fatalf("full download: %d %q", w.Code, w.Body.String())
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="clip _final_ _.mp4"; filename*=UTF-8''clip%20%22final%22%20%C3%A9.mp4`; got != want {
+		t.Errorf("Content-Disposition = %s, want %s", got, want)
+	}
+	etag := w.Header().Get("ETag")
+	if w := serve("If-None-Match", etag); w.Code != 304 {
+		t.Errorf("request with a matching ETag: %d", w.Code)
+	}
+
+	// A download resumed partway only counts once its last part is sent.
+	if w := serve("Range", "bytes=0-4"); w.Code != 206 || w.Body.String() != "01234" {
+		t.Fatalf("first half: %d %q", w.Code, w.Body.String())
+	}
+	if completed != 1 {
+		t.Errorf("partial download counted as complete")
+	}
+	if w := serve("Range", "bytes=5-"); w.Code != 206 || w.Body.String() != "56789" {
+		t.Fatalf("second half: %d %q", w.Code, w.Body.String())
+	}
+	if completed != 2 {
+		t.Errorf("completed = %d after a resumed download, want 2", completed)
+	}
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Error("file wasn't removed after DeleteAfterDownloads downloads")
+	}
+}
+
+// droppedWriter is a client that goes away as soon as the body starts.
+type droppedWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (dw droppedWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestServeFileClaimsEachTransfer(t *testing.T) {
+	s := newTestState()
+	claims := ClaimsFor("job1", &BotDownload{CreatedAt: time.Now()})
+	claims.MaxDownloads = 2
+
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	d := Delivery{
+		Path:     path,
+		Name:     "out.mp4",
+		MimeType: "video/mp4",
+		Claim: func() (func(), error) {
+			if err := s.UseSignedToken(&claims); err != nil {
+				return nil, err
+			}
+			return func() { s.ReturnSignedToken(&claims) }, nil
+		},
+	}
+	serve := func(w http.ResponseWriter, method, header, value string) error {
+		r := httptest.NewRequest(method, "/api/bot/download/abc", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		_, err := ServeFile(w, r, d)
+		return err
+	}
+	uses := func() int {
+		if use := s.signedTokens[claims.ID]; use != nil {
+			return use.Uses
+		}
+		return 0
+	}
+
+	first := httptest.NewRecorder()
+	serve(first, "GET", "", "")
+	if uses() != 1 {
+		t.Fatalf("uses = %d after a full download, want 1", uses())
+	}
+	serve(httptest.NewRecorder(), "HEAD", "", "")
+	serve(httptest.NewRecorder(), "GET", "If-None-Match", first.Header().Get("ETag"))
+	serve(droppedWriter{httptest.NewRecorder()}, "GET", "", "")
+	if uses() != 1 {
+		t.Errorf("uses = %d after HEAD, 304 and a dropped transfer, want 1", uses())
+	}
+
+	// The last byte alone is a transfer like any other.
+	if err := serve(httptest.NewRecorder(), "GET", "Range", "bytes=9-"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := serve(w, "GET", "", ""); !errors.Is(err, ErrTokenUsedUp) || w.Code != 410 {
+		t.Errorf("download past the limit: %d %v", w.Code, err)
+	}
+	if uses() != 2 {
+		t.Errorf("uses = %d, want 2", uses())
+	}
+}
+
+func TestServeFileClaimsAreAtomic(t *testing.T) {
+	s := newTestState()
+	claims := ClaimsFor("job1", &BotDownload{CreatedAt: time.Now()})
+	claims.MaxDownloads = 3
+
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	d := Delivery{
+		Path:     path,
+		Name:     "out.mp4",
+		MimeType: "video/mp4",
+		Claim: func() (func(), error) {
+			if err := s.UseSignedToken(&claims); err != nil {
+				return nil, err
+			}
+			return func() { s.ReturnSignedToken(&claims) }, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	var served atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/api/bot/download/abc", nil)
+			if _, err := ServeFile(httptest.NewRecorder(), r, d); err == nil {
+				served.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if served.Load() != 3 {
+		t.Errorf("%d of 20 simultaneous downloads served under a limit of 3", served.Load())
+	}
+}
@@ -0,0 +1,234 @@
+package services
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+var diskCheckInterval = 3 * time.Second
+
+const (
+	minReservation  = 50 * 1024 * 1024
+	mediaDiskFactor = 2 // the download and its processed copy sit side by side
+)
+
+// sourceBitratesK are generous guesses at what a site serves for each
+// quality, in kbps, so estimates err on the side of reserving too much.
+var sourceBitratesK = map[int]int{
+	2160: 25000,
+	1440: 12000,
+	1080: 6000,
+	720:  3000,
+	480:  1500,
+	360:  1000,
+}
+
+// DiskReservation is temp-disk space set aside for a job while it writes
+// its files. Admission counts the part of it the job hasn't written yet,
+// so jobs can't all start on the same free space. Once released, what the
+// job wrote shows up in the disk's free space instead.
+type DiskReservation struct {
+	s        *State
+	jobID    string
+	dir      string
+	bytes    int64
+	abort    func()
+	used     atomic.Int64
+	exceeded atomic.Bool
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// EstimateMediaBytes guesses how much temp disk a download of duration
+// seconds needs at a quality. With no duration it falls back to the
+// download job's disk cost.
+func EstimateMediaBytes(duration float64, quality string, isAudio bool, audioFormat string) int64 {
+	if duration <= 0 {
+		return int64(jobCost("download").DiskMB) * 1024 * 1024
+	}
+	duration = min(duration, float64(config.Get().MaxVideoDuration))
+
+	bitrateK := sourceBitratesK[config.QualityHeight[quality]]
+	if bitrateK == 0 {
+		bitrateK = sourceBitratesK[1080]
+	}
+	if isAudio {
+		bitrateK = 320
+		if audioFormat == "wav" || audioFormat == "flac" {
+			bitrateK = 1500
+		}
+	}
+	return max(int64(duration*float64(bitrateK)*1000/8)*mediaDiskFactor, minReservation)
+}
+
+// EstimateFileJobBytes is the reservation for a job that turns an input
+// file into an output file at most growth times its size.
+func EstimateFileJobBytes(inputPath string, growth float64) int64 {
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		return minReservation
+	}
+	return max(int64(float64(info.Size())*growth), minReservation)
+}
+
+// ReserveDisk sets aside bytes of temp disk for jobID, whose files are the
+// entries in dir named with the job ID as a prefix. It fails if the space
+// isn't there once other jobs' reservations and DiskSpaceMinGB are taken
+// out. While the reservation is held the job's files are measured, and
+// abort is called if they grow past it. With a nil abort the reservation
+// only holds space for admission: a job that outgrows it carries on, for
+// estimates that are too rough to stop a job over.
+func (s *State) ReserveDisk(jobID, dir string, bytes int64, abort func()) (*DiskReservation, error) {
+	r := &DiskReservation{
+		s:     s,
+		jobID: jobID,
+		dir:   dir,
+		bytes: bytes,
+		abort: abort,
+		stop:  make(chan struct{}),
+	}
+
+	s.muJobs.Lock()
+	if ds, err := util.GetDiskSpace(config.TempDir); err == nil {
+		free := int64(ds.AvailGB * (1 << 30))
+		outstanding := s.outstandingDiskLocked()
+		spare := free - outstanding - int64(config.Get().DiskSpaceMinGB)*(1<<30)
+		if bytes > spare {
+			s.muJobs.Unlock()
+			return nil, fmt.Errorf("Not enough temp disk space for this job (needs about %s, %s free after other jobs), try again later",
+				formatBytes(bytes), formatBytes(max(spare, 0)))
+		}
+	}
+	if prev := s.diskReservations[jobID]; prev != nil {
+		prev.stopWatching()
+	}
+	s.diskReservations[jobID] = r
+	s.muJobs.Unlock()
+
+	go r.watch()
+	return r, nil
+}
+
+func (s *State) outstandingDiskLocked() int64 {
+	var total int64
+	for _, r := range s.diskReservations {
+		total += max(r.bytes-r.used.Load(), 0)
+	}
+	return total
+}
+
+// ReservedDiskBytes is the reserved temp disk jobs haven't written yet.
+func (s *State) ReservedDiskBytes() int64 {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	return s.outstandingDiskLocked()
+}
+
+func (r *DiskReservation) watch() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			used := jobDiskUsage(r.dir, r.jobID)
+			r.used.Store(used)
+			if used > r.bytes && r.abort != nil {
+				r.exceeded.Store(true)
+				log.Printf("[Disk] Job %s wrote %s, over its %s reservation, stopping it", r.jobID, formatBytes(used), formatBytes(r.bytes))
+				r.abort()
+				return
+			}
+		}
+	}
+}
+
+func (r *DiskReservation) stopWatching() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// Release gives the reservation back. It's safe to call more than once.
+func (r *DiskReservation) Release() {
+	if r == nil {
+		return
+	}
+	r.stopWatching()
+	r.s.muJobs.Lock()
+	if r.s.diskReservations[r.jobID] == r {
+		delete(r.s.diskReservations, r.jobID)
+	}
+	r.s.muJobs.Unlock()
+}
+
+// Err reports whether the job was stopped for outgrowing its reservation.
+func (r *DiskReservation) Err() error {
+	if r == nil || !r.exceeded.Load() {
+		return nil
+	}
+	return fmt.Errorf("This job needed more temp disk space than expected (over %s) and was stopped. Try a lower quality or a shorter video.", formatBytes(r.bytes))
+}
+
+// Check returns Err if the job outgrew its reservation, otherwise err, so
+// the job's failure says why it was stopped.
+func (r *DiskReservation) Check(err error) error {
+	if exceeded := r.Err(); exceeded != nil {
+		return exceeded
+	}
+	return err
+}
+
+// AbortProcess is the abort hook for jobs run through a ProcessInfo.
+func AbortProcess(p *ProcessInfo) func() {
+	return func() {
+		if p.CancelFunc != nil {
+			p.CancelFunc()
+		}
+		p.KillProcess()
+	}
+}
+
+// jobDiskUsage adds up the entries in dir named with prefix, walking into
+// directories.
+func jobDiskUsage(dir, prefix string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		filepath.WalkDir(filepath.Join(dir, e.Name()), func(_ string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.0f MB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%d KB", n/1024)
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+func TestReserveDiskCountsOutstandingSpace(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.DiskSpaceMinGB = 0 })
+
+	if _, err := util.GetDiskSpace(config.TempDir); err != nil {
+		t.Skipf("can't read free space for %s: %v", config.TempDir, err)
+	}
+
+	dir := t.TempDir()
+	r, err := state.ReserveDisk("job-1", dir, 10<<20, nil)
+	if err != nil {
+		t.Skipf("temp dir's disk has no room for a 10MB reservation: %v", err)
+	}
+	if got := state.ReservedDiskBytes(); got != 10<<20 {
+		t.Fatalf("reserved = %d, want %d", got, 10<<20)
+	}
+	if _, err := state.ReserveDisk("job-2", dir, 1<<60, nil); err == nil {
+		t.Fatal("reservation bigger than the disk was allowed")
+	}
+
+	r.Release()
+	r.Release()
+	if got := state.ReservedDiskBytes(); got != 0 {
+		t.Fatalf("reserved after release = %d, want 0", got)
+	}
+}
+
+func TestJobDiskUsageOnlyCountsTheJobsFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "job-1-final.mp4"), make([]byte, 3000), 0644)
+	os.MkdirAll(filepath.Join(dir, "job-1", "videos"), 0755)
+	os.WriteFile(filepath.Join(dir, "job-1", "videos", "001.mp4"), make([]byte, 2000), 0644)
+	os.WriteFile(filepath.Join(dir, "job-2-final.mp4"), make([]byte, 5000), 0644)
+
+	if got := jobDiskUsage(dir, "job-1"); got != 5000 {
+		t.Fatalf("usage = %d, want 5000", got)
+	}
+}
+
+func TestUnknownDurationDownloadIsNotCapped(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.DiskSpaceMinGB = 0 })
+	prevInterval := diskCheckInterval
+	defer func() { diskCheckInterval = prevInterval }()
+	diskCheckInterval = 10 * time.Millisecond
+
+	estimate := EstimateMediaBytes(0, "1080p", false, "")
+	dir := t.TempDir()
+	// A sparse file, so the test doesn't need 600MB of real disk.
+	if err := os.Truncate(createFile(t, filepath.Join(dir, "job-1-video.mp4")), estimate+100<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := state.ReserveDisk("job-1", dir, estimate, nil)
+	if err != nil {
+		t.Skipf("no room for the fallback reservation: %v", err)
+	}
+	defer r.Release()
+	time.Sleep(100 * time.Millisecond)
+	if err := r.Err(); err != nil {
+		t.Fatalf("download with no known duration was stopped: %v", err)
+	}
+	if got := state.ReservedDiskBytes(); got != 0 {
+		t.Errorf("outstanding = %d once the job wrote past its guess, want 0", got)
+	}
+
+	aborted := make(chan struct{})
+	capped, err := state.ReserveDisk("job-1", dir, estimate, func() { close(aborted) })
+	if err != nil {
+		t.Skipf("no room for the second reservation: %v", err)
+	}
+	defer capped.Release()
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Error("download with a known size wasn't stopped for outgrowing it")
+	}
+}
+
+func createFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return path
+}
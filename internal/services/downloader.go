@@ -239,9 +239,10 @@ type PlaylistInfo struct {
 }
 
 type PlaylistEntry struct {
-	Title string `json:"title"`
-	URL   string `json:"url"`
-	ID    string `json:"id"`
+	Title    string  `json:"title"`
+	URL      string  `json:"url"`
+	ID       string  `json:"id"`
+	Duration float64 `json:"duration"`
 }
 
 func GetPlaylistInfo(ctx context.Context, url string, useProxy bool) (*PlaylistInfo, error) {
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// StartDraining stops admitting new jobs ahead of a shutdown. Jobs that
+// are already running keep going, including the later steps of pipelines
+// that have started; jobs still waiting in a queue stay there. It reports
+// false if the server was already draining.
+func (s *State) StartDraining() bool {
+	running := s.runningJobIDs()
+
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	if s.draining {
+		return false
+	}
+	s.draining = true
+	s.drainExempt = running
+	log.Printf("[Drain] Draining, %d jobs in flight", len(running))
+	return true
+}
+
+func (s *State) IsDraining() bool {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	return s.draining
+}
+
+func (s *State) drainExemptLocked(lane []*queuedJob) []*queuedJob {
+	var exempt []*queuedJob
+	for _, entry := range lane {
+		if s.drainExempt[entry.id] {
+			exempt = append(exempt, entry)
+		}
+	}
+	return exempt
+}
+
+// runningJobIDs returns every job that holds a process or whose async job
+// has started and not yet finished. Queued jobs are not included.
+func (s *State) runningJobIDs() map[string]bool {
+	ids := make(map[string]bool)
+
+	s.muProcesses.Lock()
+	for id := range s.activeProcesses {
+		ids[id] = true
+	}
+	s.muProcesses.Unlock()
+
+	s.muAsync.RLock()
+	for id, job := range s.asyncJobs {
+		job.mu.RLock()
+		status := job.Status
+		job.mu.RUnlock()
+		if !isFinishedStatus(status) && status != "queued" {
+			ids[id] = true
+		}
+	}
+	s.muAsync.RUnlock()
+	return ids
+}
+
+// WaitForDrain blocks until no jobs are running or ctx is done, and
+// reports whether everything finished.
+func (s *State) WaitForDrain(ctx context.Context) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastLogged := time.Now()
+	for {
+		running := len(s.runningJobIDs())
+		if running == 0 {
+			log.Println("[Drain] All jobs finished")
+			return true
+		}
+		if time.Since(lastLogged) >= 30*time.Second {
+			log.Printf("[Drain] Waiting on %d jobs", running)
+			lastLogged = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checkpoint marks every job that didn't finish as interrupted, so it is
+// restored as resumable on the next start, writes that to the store and
+// then stops the store and every running process. Nothing a job does
+// after this point is persisted.
+func (s *State) Checkpoint() int {
+	s.muAsync.RLock()
+	jobs := make([]*AsyncJob, 0, len(s.asyncJobs))
+	for _, job := range s.asyncJobs {
+		jobs = append(jobs, job)
+	}
+	s.muAsync.RUnlock()
+
+	checkpointed := 0
+	for _, job := range jobs {
+		job.mu.Lock()
+		if !isFinishedStatus(job.Status) {
+			markInterrupted(job)
+			checkpointed++
+		}
+		job.mu.Unlock()
+	}
+	s.CloseStore()
+
+	s.muProcesses.Lock()
+	processes := make([]*ProcessInfo, 0, len(s.activeProcesses))
+	for _, p := range s.activeProcesses {
+		processes = append(processes, p)
+	}
+	s.muProcesses.Unlock()
+	for _, p := range processes {
+		p.SetCancelled(true)
+		if p.CancelFunc != nil {
+			p.CancelFunc()
+		}
+		p.KillProcess()
+	}
+
+	log.Printf("[Drain] Checkpointed %d jobs, stopped %d processes", checkpointed, len(processes))
+	return checkpointed
+}
+
+// CloseStore stops the periodic flush, flushes every async job one last
+// time and closes the job store.
+func (s *State) CloseStore() {
+	if s.store == nil {
+		return
+	}
+	if s.stopFlushing != nil {
+		s.stopFlushing()
+	}
+	s.FlushStore()
+	s.store.close()
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"sync"
+)
+
+// FlightGroup lets identical requests share one piece of work. The first
+// request for a key leads and does the work; requests for the same key
+// that arrive while it runs follow it and get its result.
+type FlightGroup[T any] struct {
+	mu      sync.Mutex
+	flights map[string]*Flight[T]
+}
+
+// Flight is one piece of work in a FlightGroup.
+type Flight[T any] struct {
+	g        *FlightGroup[T]
+	key      string
+	done     chan struct{}
+	mu       sync.Mutex
+	members  map[string]bool
+	results  map[string]flightResult[T]
+	finished bool
+}
+
+type flightResult[T any] struct {
+	value T
+	err   error
+}
+
+// Join returns the running flight for key with id added as a follower,
+// or starts a new flight with id as its leader. leader reports which.
+func (g *FlightGroup[T]) Join(key, id string) (f *Flight[T], leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f := g.flights[key]; f != nil {
+		f.mu.Lock()
+		f.members[id] = true
+		f.mu.Unlock()
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*Flight[T])
+	}
+	f = &Flight[T]{
+		g:       g,
+		key:     key,
+		done:    make(chan struct{}),
+		members: make(map[string]bool),
+	}
+	g.flights[key] = f
+	return f, true
+}
+
+// Do runs fn once for every caller that arrives while it's running, and
+// gives them all its result.
+func (g *FlightGroup[T]) Do(key string, fn func() (T, error)) (T, error) {
+	f, leader := g.Join(key, "")
+	if !leader {
+		return f.Wait(context.Background(), "")
+	}
+	value, err := fn()
+	f.Finish(func(string) (T, error) { return value, err })
+	return value, err
+}
+
+// Members is the IDs following the flight.
+func (f *Flight[T]) Members() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.members))
+	for id := range f.members {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Waiting is how many requests are following the flight.
+func (f *Flight[T]) Waiting() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.members)
+}
+
+// Leave drops a follower that no longer wants the result.
+func (f *Flight[T]) Leave(id string) {
+	f.mu.Lock()
+	delete(f.members, id)
+	f.mu.Unlock()
+}
+
+// Finish ends the flight. resultFor is called once for each follower
+// still waiting, before any of them are woken, so it can hand each one
+// its own copy of the result. Requests that arrive from now on start a
+// new flight. Only the first call does anything.
+func (f *Flight[T]) Finish(resultFor func(id string) (T, error)) {
+	f.g.mu.Lock()
+	if f.g.flights[f.key] == f {
+		delete(f.g.flights, f.key)
+	}
+	f.g.mu.Unlock()
+
+	f.mu.Lock()
+	if f.finished {
+		f.mu.Unlock()
+		return
+	}
+	f.finished = true
+	members := make([]string, 0, len(f.members))
+	for id := range f.members {
+		members = append(members, id)
+	}
+	f.mu.Unlock()
+
+	results := make(map[string]flightResult[T], len(members))
+	for _, id := range members {
+		value, err := resultFor(id)
+		results[id] = flightResult[T]{value, err}
+	}
+
+	f.mu.Lock()
+	f.results = results
+	f.mu.Unlock()
+	close(f.done)
+}
+
+// Wait blocks until the flight finishes and returns id's result, or
+// returns ctx's error if ctx ends first. A follower that stops waiting
+// should Leave.
+func (f *Flight[T]) Wait(ctx context.Context, id string) (T, error) {
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.results[id]
+	if !ok {
+		var zero T
+		return zero, context.Canceled
+	}
+	return r.value, r.err
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestFlightGivesEachFollowerItsOwnResult(t *testing.T) {
+	var g FlightGroup[string]
+	f, leader := g.Join("key", "leader")
+	if !leader {
+		t.Fatal("first request didn't lead")
+	}
+	if _, leader := g.Join("key", "a"); leader {
+		t.Fatal("identical request led a second flight")
+	}
+	g.Join("key", "b")
+	g.Join("key", "gone")
+	f.Leave("gone")
+
+	var wg sync.WaitGroup
+	results := make(map[string]string)
+	var mu sync.Mutex
+	for _, id := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := f.Wait(context.Background(), id)
+			if err != nil {
+				t.Errorf("%s: %v", id, err)
+			}
+			mu.Lock()
+			results[id] = v
+			mu.Unlock()
+		}()
+	}
+
+	var calls []string
+	f.Finish(func(id string) (string, error) {
+		calls = append(calls, id)
+		return "file-" + id, nil
+	})
+	wg.Wait()
+
+	if len(calls) != 2 {
+		t.Fatalf("result handed out %d times, want 2 (calls: %v)", len(calls), calls)
+	}
+	if results["a"] != "file-a" || results["b"] != "file-b" {
+		t.Fatalf("results = %v", results)
+	}
+	if _, leader := g.Join("key", "late"); !leader {
+		t.Fatal("request after the flight finished joined it instead of starting a new one")
+	}
+}
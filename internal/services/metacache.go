@@ -1,6 +1,7 @@
 package services
 
 import (
+	"strconv"
 	"sync"
 	"time"
 )
@@ -58,3 +59,22 @@ func (c *MetaCache) StartCleanup() {
 		}
 	}()
 }
+
+// Duration returns a cached URL's duration in seconds, or 0 if it isn't
+// cached or wasn't known.
+func (c *MetaCache) Duration(url string) float64 {
+	meta, ok := c.Get(url)
+	if !ok {
+		return 0
+	}
+	switch v := meta["duration"].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case string:
+		d, _ := strconv.ParseFloat(v, 64)
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+// OutputStore keeps the finished files handed out through download
+// tokens.
+type OutputStore interface {
+	// Save takes the file at path and returns the key it's kept under.
+	// Once it succeeds the caller no longer owns path.
+	Save(ctx context.Context, path, contentType string) (string, error)
+	// Open reads a saved file back, along with its size.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// URL is a link clients can fetch the file from directly until expiry,
+	// downloading it as fileName. ok is false if the store can't make one.
+	URL(key, fileName string, expiry time.Duration) (link string, ok bool)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalOutputs leaves outputs on this machine's disk where their jobs
+// wrote them, so a key is just the file's path.
+type LocalOutputs struct{}
+
+func (LocalOutputs) Save(ctx context.Context, path, contentType string) (string, error) {
+	return path, nil
+}
+
+func (LocalOutputs) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+func (LocalOutputs) URL(key, fileName string, expiry time.Duration) (string, bool) {
+	return "", false
+}
+
+func (LocalOutputs) Delete(ctx context.Context, key string) error {
+	err := os.Remove(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Outputs is where finished outputs are kept, picked by OUTPUT_STORAGE.
+var Outputs OutputStore = LocalOutputs{}
+
+// SetupOutputs switches Outputs to the store OUTPUT_STORAGE asks for.
+func SetupOutputs() {
+	if config.OutputStorage == "s3" {
+		Outputs = NewS3Outputs(S3Config{
+			Endpoint:       config.S3Endpoint,
+			PublicEndpoint: config.S3PublicEndpoint,
+			Region:         config.S3Region,
+			Bucket:         config.S3Bucket,
+			AccessKey:      config.S3AccessKey,
+			SecretKey:      config.S3SecretKey,
+			Prefix:         config.S3Prefix,
+		})
+		log.Printf("[Outputs] Keeping outputs in bucket %s at %s", config.S3Bucket, config.S3Endpoint)
+	}
+}
+
+// IsLocal reports whether the token's file is on this machine's disk.
+// Tokens made before outputs were saved to a store only have a FilePath.
+func (dl *BotDownload) IsLocal() bool {
+	return dl.StorageKey == "" || dl.StorageKey == dl.FilePath
+}
+
+// SaveOutput hands the token's file to Outputs and records where it went.
+func SaveOutput(ctx context.Context, dl *BotDownload) error {
+	key, err := Outputs.Save(ctx, dl.FilePath, dl.MimeType)
+	if err != nil {
+		return err
+	}
+	dl.StorageKey = key
+	return nil
+}
+
+// DeleteOutput removes the token's file from wherever it's kept.
+func DeleteOutput(dl *BotDownload) error {
+	if dl.IsLocal() {
+		return LocalOutputs{}.Delete(context.Background(), dl.FilePath)
+	}
+	return Outputs.Delete(context.Background(), dl.StorageKey)
+}
+
+// FetchOutput makes sure the token's file is on local disk, downloading
+// it into dir if it's kept elsewhere. cleanup removes any copy it made.
+func FetchOutput(ctx context.Context, dl *BotDownload, dir string) (path string, cleanup func(), err error) {
+	if dl.IsLocal() {
+		return dl.FilePath, func() {}, nil
+	}
+	body, _, err := Outputs.Open(ctx, dl.StorageKey)
+	if err != nil {
+		return "", nil, err
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp(dir, "fetched-*"+filepath.Ext(dl.FileName))
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
@@ -2,17 +2,18 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/util"
 )
 
@@ -100,47 +101,46 @@ func ProcessVideo(inputPath, outputPath string, opts ProcessVideoOpts) (*Process
 	return &ProcessResult{Path: outputPath, Ext: outputExt, Skipped: false}, nil
 }
 
-func StreamFile(w http.ResponseWriter, r *http.Request, filePath string, filename, ext, mimeType, downloadID, sourceURL, jobType string, onCleanup func()) {
-	info, err := os.Stat(filePath)
-	if err != nil {
-		http.Error(w, "File not found", 404)
-		return
-	}
-
-	safeFilename := util.SanitizeFilename(filename)
-	fullFilename := safeFilename + "." + ext
-	asciiFilename := toASCII(safeFilename) + "." + ext
-
+// StreamFile sends a streaming job's finished file and reports whether
+// the client got all of it. Its files are removed through the delivery's
+// download count (see Delivery), so a client that lost the connection
+// partway can still ask for the rest with Range.
+func StreamFile(w http.ResponseWriter, r *http.Request, filePath string, filename, ext, mimeType, downloadID, sourceURL, jobType string, onCleanup func()) bool {
 	Global.SendProgressSimple(downloadID, "sending", "Sending file to you...")
 	Global.ReleaseJob(downloadID)
 
-	w.Header().Set("Content-Type", mimeType)
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`,
-			asciiFilename, url.PathEscape(fullFilename)))
-
-	f, err := os.Open(filePath)
+	remove := func() {
+		if onCleanup != nil {
+			onCleanup()
+		}
+		util.CleanupJobFiles(downloadID)
+	}
+	sendStart := time.Now()
+	complete, err := ServeFile(w, r, Delivery{
+		Path:     filePath,
+		Name:     util.SanitizeFilename(filename) + "." + ext,
+		MimeType: mimeType,
+		Key:      downloadID,
+		Remove:   remove,
+	})
 	if err != nil {
-		log.Printf("[%s] Failed to open file for streaming: %v", downloadID, err)
-		Global.SendProgressSimple(downloadID, "error", "Failed to send file")
-		return
+		log.Printf("[%s] Failed to send file: %v", downloadID, err)
+		Global.SendProgressSimple(downloadID, "error", err.Error())
+		if errors.Is(err, ErrFileGone) {
+			go remove()
+		}
+		return false
 	}
-	defer f.Close()
-
-	// ServeContent handles Range requests, conditional GETs, and uses
-	// sendfile() syscall for zero-copy transfer when possible
-	http.ServeContent(w, r, fullFilename, info.ModTime(), f)
+	if !complete {
+		log.Printf("[%s] Client got part of the file, keeping it for a Range request", downloadID)
+		Global.UnregisterDownload(downloadID)
+		return false
+	}
+	metrics.ObserveStage("send", metrics.Site(sourceURL), sendStart)
 
 	Global.SendProgressSimple(downloadID, "complete", "Download complete!")
 	Global.UnregisterDownload(downloadID)
-
-	if onCleanup != nil {
-		onCleanup()
-	}
-
-	go func() {
-		util.CleanupJobFiles(downloadID)
-	}()
+	return true
 }
 
 func ProbeForGif(filePath string) bool {
@@ -197,15 +197,3 @@ func GetMimeType(ext string, isAudio, isGif bool) string {
 	}
 	return "video/mp4"
 }
-
-func toASCII(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		if r >= 0x20 && r <= 0x7E {
-			b.WriteRune(r)
-		} else {
-			b.WriteRune('_')
-		}
-	}
-	return b.String()
-}
@@ -0,0 +1,370 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+)
+
+var defaultJobDurations = map[string]time.Duration{
+	"playlist":   10 * time.Minute,
+	"convert":    time.Minute,
+	"compress":   3 * time.Minute,
+	"transcribe": 3 * time.Minute,
+	"fetchUrl":   30 * time.Second,
+}
+
+// JobRequest identifies a job asking for a slot. ClientID and Origin
+// decide its turn when the job type's lane is contended.
+type JobRequest struct {
+	Type     string
+	ID       string
+	ClientID string
+	Origin   string
+}
+
+type queuedJob struct {
+	id       string
+	jobType  string
+	clientID string
+	origin   string
+	enqueued time.Time
+	result   chan JobCheck
+
+	// prevStatus is the async job's status before it was shown as queued.
+	// Guarded by the AsyncJob's lock.
+	prevStatus string
+}
+
+// JobTicket is a place in a job type's queue. A ticket handed out by
+// EnqueueJob either already holds a slot or is waiting for one.
+type JobTicket struct {
+	s     *State
+	entry *queuedJob
+}
+
+// Queued reports whether the ticket is waiting for a slot.
+func (t *JobTicket) Queued() bool {
+	return t.entry != nil
+}
+
+// Wait blocks until the ticket is admitted, cancelled with CancelQueuedJob,
+// or ctx is done. Queue position and ETA are pushed through SendProgress
+// while waiting.
+func (t *JobTicket) Wait(ctx context.Context) JobCheck {
+	if t.entry == nil {
+		return JobCheck{true, ""}
+	}
+	s := t.s
+	entry := t.entry
+
+	s.announcePosition(entry)
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	// With resource admission a slot can open without any job finishing,
+	// so waiting jobs poll for it too.
+	var retry <-chan time.Time
+	if resourceAdmission() {
+		retryTicker := time.NewTicker(admissionRetry)
+		defer retryTicker.Stop()
+		retry = retryTicker.C
+	}
+
+	for {
+		select {
+		case check := <-entry.result:
+			if check.OK {
+				s.markAdmitted(entry)
+			}
+			return check
+		case <-ctx.Done():
+			if s.removeQueued(entry) {
+				s.announceQueue(entry.jobType)
+				return JobCheck{false, "Download cancelled"}
+			}
+			if check := <-entry.result; check.OK {
+				s.DecrementJob(entry.jobType)
+			}
+			return JobCheck{false, "Download cancelled"}
+		case <-ticker.C:
+			s.announcePosition(entry)
+		case <-retry:
+			s.admitWaiting()
+		}
+	}
+}
+
+// EnqueueJob takes a slot right away if one is free and nobody is waiting
+// ahead, otherwise it joins the job type's lane. It only fails when disk
+// space is low or the queue already holds MaxQueueSize jobs.
+func (s *State) EnqueueJob(req JobRequest) (*JobTicket, JobCheck) {
+	if req.Origin == "" {
+		req.Origin = OriginWeb
+	}
+	jobType, jobID := req.Type, req.ID
+
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+
+	if check, decided := s.tryAdmitLocked(req); decided {
+		return &JobTicket{s: s}, check
+	}
+
+	if s.queuedCountLocked() >= config.Get().MaxQueueSize {
+		return nil, JobCheck{false, fmt.Sprintf("Queue is full (%d jobs waiting), try again in a few minutes", config.Get().MaxQueueSize)}
+	}
+
+	entry := &queuedJob{
+		id:       jobID,
+		jobType:  jobType,
+		clientID: req.ClientID,
+		origin:   req.Origin,
+		enqueued: time.Now(),
+		result:   make(chan JobCheck, 1),
+	}
+	s.queues[jobType] = append(s.queues[jobType], entry)
+
+	short := jobID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	log.Printf("[Queue] %s job %s... (%s) queued, %d waiting", jobType, short, req.Origin, len(s.queues[jobType]))
+	return &JobTicket{s: s, entry: entry}, JobCheck{true, ""}
+}
+
+// WaitForJobSlot enqueues a job and waits for it to be admitted.
+func (s *State) WaitForJobSlot(ctx context.Context, req JobRequest) JobCheck {
+	ticket, check := s.EnqueueJob(req)
+	if !check.OK {
+		return check
+	}
+	return ticket.Wait(ctx)
+}
+
+// CancelQueuedJob removes a job that is still waiting for a slot.
+func (s *State) CancelQueuedJob(jobID string) bool {
+	s.muJobs.Lock()
+	var found *queuedJob
+	for _, lane := range s.queues {
+		for _, entry := range lane {
+			if entry.id == jobID {
+				found = entry
+				break
+			}
+		}
+	}
+	if found != nil {
+		s.removeQueuedLocked(found)
+		found.result <- JobCheck{false, "Download cancelled"}
+	}
+	s.muJobs.Unlock()
+
+	if found == nil {
+		return false
+	}
+	s.announceQueue(found.jobType)
+	return true
+}
+
+func (s *State) tryAdmitLocked(req JobRequest) (JobCheck, bool) {
+	jobType := req.Type
+	if s.draining && !s.drainExempt[req.ID] {
+		return JobCheck{false, "Server is restarting, try again in a minute"}, true
+	}
+	availGB := getDiskSpaceGB() - float64(s.outstandingDiskLocked())/(1<<30)
+	if availGB < float64(config.Get().DiskSpaceMinGB) {
+		return JobCheck{false, fmt.Sprintf("Low disk space (%.1fGB free after running jobs, need %dGB)", availGB, config.Get().DiskSpaceMinGB)}, true
+	}
+
+	if len(s.queues[jobType]) == 0 && !s.starvingLocked() && s.hasRoomLocked(jobType) {
+		s.startJobLocked(jobType, req.Origin, req.ClientID)
+		return JobCheck{true, ""}, true
+	}
+	return JobCheck{}, false
+}
+
+func (s *State) startJobLocked(jobType, origin, clientID string) {
+	s.jobsByType[jobType]++
+	s.fairLaneLocked(jobType).charge(origin, clientID)
+	s.chargeResourcesLocked(jobType)
+	metrics.JobsStarted.Inc(jobType)
+}
+
+// starvingLocked reports whether, with resource admission, some lane has
+// waited long enough that new jobs of other types must queue behind it.
+func (s *State) starvingLocked() bool {
+	if !resourceAdmission() || s.draining {
+		return false
+	}
+	for _, lane := range s.queues {
+		if len(lane) > 0 && time.Since(lane[0].enqueued) > starvationAge {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) admitQueuedLocked(jobType string) int {
+	admitted := 0
+	lane := s.fairLaneLocked(jobType)
+	for len(s.queues[jobType]) > 0 && s.hasRoomLocked(jobType) {
+		waiting := s.queues[jobType]
+		if s.draining {
+			waiting = s.drainExemptLocked(waiting)
+			if len(waiting) == 0 {
+				break
+			}
+		}
+		entry := waiting[lane.pick(waiting)]
+		s.removeQueuedLocked(entry)
+		s.startJobLocked(jobType, entry.origin, entry.clientID)
+		entry.result <- JobCheck{true, ""}
+		admitted++
+	}
+	return admitted
+}
+
+func (s *State) queuedCountLocked() int {
+	n := 0
+	for _, lane := range s.queues {
+		n += len(lane)
+	}
+	return n
+}
+
+func (s *State) removeQueued(entry *queuedJob) bool {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	return s.removeQueuedLocked(entry)
+}
+
+func (s *State) removeQueuedLocked(entry *queuedJob) bool {
+	lane := s.queues[entry.jobType]
+	for i, e := range lane {
+		if e == entry {
+			s.queues[entry.jobType] = append(lane[:i:i], lane[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) markAdmitted(entry *queuedJob) {
+	short := entry.id
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	log.Printf("[Queue] %s job %s... admitted after %s", entry.jobType, short, time.Since(entry.enqueued).Round(time.Second))
+
+	if aj := s.GetAsyncJob(entry.id); aj != nil {
+		aj.Lock()
+		if aj.Status == "queued" {
+			aj.Status = orStatus(entry.prevStatus, "starting")
+			aj.Message = "starting..."
+			aj.ETA = ""
+		}
+		aj.Unlock()
+	}
+	s.SendProgressSimple(entry.id, "starting", "Your turn! Starting...")
+}
+
+func (s *State) recordJobDuration(jobType string, d time.Duration) {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	prev, ok := s.jobDurations[jobType]
+	if !ok {
+		s.jobDurations[jobType] = d
+		return
+	}
+	s.jobDurations[jobType] = (prev*7 + d*3) / 10
+}
+
+func estimateQueueWait(position, limit int, avg time.Duration) time.Duration {
+	if limit < 1 {
+		limit = 1
+	}
+	waves := (position + limit - 1) / limit
+	return time.Duration(waves) * avg
+}
+
+// queueSnapshot returns a lane's waiting jobs in the order the scheduler
+// would admit them, plus the numbers needed to estimate their wait.
+func (s *State) queueSnapshot(jobType string) ([]*queuedJob, int, time.Duration) {
+	s.muJobs.Lock()
+	defer s.muJobs.Unlock()
+	lane := s.fairLaneLocked(jobType).order(s.queues[jobType])
+	avg, ok := s.jobDurations[jobType]
+	if !ok {
+		avg = defaultJobDurations[jobType]
+		if avg == 0 {
+			avg = time.Minute
+		}
+	}
+	return lane, s.slotEstimateLocked(jobType), avg
+}
+
+// announceQueue pushes fresh positions to every job waiting in a lane.
+func (s *State) announceQueue(jobType string) {
+	lane, limit, avg := s.queueSnapshot(jobType)
+	for i, entry := range lane {
+		s.sendQueuePosition(entry, i+1, len(lane), limit, avg)
+	}
+}
+
+func (s *State) announcePosition(entry *queuedJob) {
+	lane, limit, avg := s.queueSnapshot(entry.jobType)
+	for i, e := range lane {
+		if e == entry {
+			s.sendQueuePosition(entry, i+1, len(lane), limit, avg)
+			return
+		}
+	}
+}
+
+func (s *State) sendQueuePosition(entry *queuedJob, position, length, limit int, avg time.Duration) {
+	eta := estimateQueueWait(position, limit, avg)
+	msg := fmt.Sprintf("Waiting in queue (position %d of %d, about %s)", position, length, formatQueueWait(eta))
+
+	if aj := s.GetAsyncJob(entry.id); aj != nil {
+		aj.Lock()
+		switch aj.Status {
+		case "starting", "processing":
+			entry.prevStatus = aj.Status
+			fallthrough
+		case "queued":
+			aj.Status = "queued"
+			aj.Message = msg
+			aj.ETA = formatQueueWait(eta)
+		}
+		aj.Unlock()
+	}
+	s.SendProgress(entry.id, "queued", msg, nil, map[string]interface{}{
+		"queuePosition": position,
+		"queueLength":   length,
+		"queueEta":      int(eta.Seconds()),
+	})
+}
+
+func orStatus(status, fallback string) string {
+	if status == "" {
+		return fallback
+	}
+	return status
+}
+
+func formatQueueWait(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	mins := int(d.Round(time.Minute).Minutes())
+	if mins == 1 {
+		return "1 minute"
+	}
+	return fmt.Sprintf("%d minutes", mins)
+}
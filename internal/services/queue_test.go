@@ -0,0 +1,291 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestQueueAdmitsInOrderWhenSlotsFree(t *testing.T) {
+	state := newTestState()
+
+	first, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-1"})
+	if !check.OK || first.Queued() {
+		t.Fatal("first compress job should start immediately")
+	}
+	second, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-2"})
+	if !check.OK || !second.Queued() {
+		t.Fatal("second compress job should be queued")
+	}
+	third, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-3"})
+	if !check.OK || !third.Queued() {
+		t.Fatal("third compress job should be queued")
+	}
+
+	if fourth, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-4"}); !check.OK || !fourth.Queued() {
+		t.Fatal("a new job jumped ahead of queued jobs")
+	}
+	if !state.CancelQueuedJob("job-4") {
+		t.Fatal("could not cancel job-4")
+	}
+	if status := state.GetQueueStatus(); status["queued"] != 2 {
+		t.Fatalf("queued = %v, want 2", status["queued"])
+	}
+
+	admitted := make(chan string, 2)
+	var waiters sync.WaitGroup
+	defer waiters.Wait()
+	for id, ticket := range map[string]*JobTicket{"job-2": second, "job-3": third} {
+		waiters.Add(1)
+		go func(id string, ticket *JobTicket) {
+			defer waiters.Done()
+			if ticket.Wait(context.Background()).OK {
+				admitted <- id
+			}
+		}(id, ticket)
+	}
+
+	state.DecrementJob("compress")
+	select {
+	case id := <-admitted:
+		if id != "job-2" {
+			t.Fatalf("admitted %s first, want job-2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued job was not admitted after a slot freed up")
+	}
+
+	if !state.CancelQueuedJob("job-3") {
+		t.Fatal("could not cancel queued job")
+	}
+	if got := state.GetJobsByType()["compress"]; got != 1 {
+		t.Fatalf("compress count = %d, want 1", got)
+	}
+}
+
+func TestFairSchedulerInterleavesClientsAndOrigins(t *testing.T) {
+	state := newTestState()
+
+	if _, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "a-0", ClientID: "a"}); !check.OK {
+		t.Fatal("first job should start immediately")
+	}
+	for _, req := range []JobRequest{
+		{Type: "compress", ID: "a-1", ClientID: "a"},
+		{Type: "compress", ID: "a-2", ClientID: "a"},
+		{Type: "compress", ID: "a-3", ClientID: "a"},
+		{Type: "compress", ID: "b-1", ClientID: "b"},
+		{Type: "compress", ID: "bot-1", ClientID: "bot", Origin: OriginBot},
+	} {
+		if _, check := state.EnqueueJob(req); !check.OK {
+			t.Fatalf("enqueue %s: %s", req.ID, check.Reason)
+		}
+	}
+
+	lane, _, _ := state.queueSnapshot("compress")
+	var order []string
+	for _, e := range lane {
+		order = append(order, e.id)
+	}
+	want := []string{"bot-1", "b-1", "a-1", "a-2", "a-3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("admission order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestFairSchedulerSharesBotSlotsBetweenUsers(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.JobLimits = map[string]int{"download": 1} })
+
+	if _, check := state.EnqueueJob(JobRequest{Type: "download", ID: "flood-0", ClientID: "user:1", Origin: OriginBot}); !check.OK {
+		t.Fatal("first download should start immediately")
+	}
+	for _, id := range []string{"flood-1", "flood-2", "flood-3"} {
+		state.EnqueueJob(JobRequest{Type: "download", ID: id, ClientID: "user:1", Origin: OriginBot})
+	}
+	other, check := state.EnqueueJob(JobRequest{Type: "download", ID: "other-1", ClientID: "user:2", Origin: OriginBot})
+	if !check.OK || !other.Queued() {
+		t.Fatal("other user's download should be queued")
+	}
+
+	state.DecrementJob("download")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !other.Wait(ctx).OK {
+		t.Fatal("one user's backlog kept another user's download waiting")
+	}
+	if lane, _, _ := state.queueSnapshot("download"); len(lane) != 3 {
+		t.Fatalf("%d downloads still queued, want the 3 flood jobs", len(lane))
+	}
+}
+
+func TestDrainingOnlyAdmitsRunningJobs(t *testing.T) {
+	state := newTestState()
+
+	if _, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-1"}); !check.OK {
+		t.Fatal("job-1 should start")
+	}
+	state.SetAsyncJob("job-1", &AsyncJob{Status: "compressing", CreatedAt: time.Now()})
+
+	if !state.StartDraining() || state.StartDraining() {
+		t.Fatal("StartDraining should only report true the first time")
+	}
+	if _, check := state.EnqueueJob(JobRequest{Type: "convert", ID: "job-2"}); check.OK {
+		t.Fatal("new job admitted while draining")
+	}
+
+	state.ReleaseJob("job-1")
+	if _, check := state.EnqueueJob(JobRequest{Type: "convert", ID: "job-1"}); !check.OK {
+		t.Fatalf("running job's next stage rejected: %s", check.Reason)
+	}
+}
+
+func TestRaisingJobLimitAdmitsQueuedJobs(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) {})
+	prev := config.Get().JobLimits
+
+	if _, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-1"}); !check.OK {
+		t.Fatal("job-1 should start")
+	}
+	second, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-2"})
+	if !check.OK || !second.Queued() {
+		t.Fatal("job-2 should be queued")
+	}
+
+	state.SetJobLimit("compress", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !second.Wait(ctx).OK {
+		t.Fatal("job-2 was not admitted after raising the limit")
+	}
+	if prev["compress"] != 1 {
+		t.Fatal("SetJobLimit changed the previous limits map in place")
+	}
+}
+
+func TestZeroJobLimitRemovesIt(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.JobLimits = map[string]int{"compress": 1} })
+
+	if _, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-1"}); !check.OK {
+		t.Fatal("job-1 should start")
+	}
+	second, _ := state.EnqueueJob(JobRequest{Type: "compress", ID: "job-2"})
+	if !second.Queued() {
+		t.Fatal("job-2 should be queued")
+	}
+
+	state.SetJobLimit("compress", 0)
+	if _, limited := state.JobLimits()["compress"]; limited {
+		t.Fatal("a limit of 0 was kept instead of removed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !second.Wait(ctx).OK {
+		t.Fatal("job-2 was not admitted once compress was unlimited")
+	}
+}
+
+func TestListProcessesShowsProgress(t *testing.T) {
+	state := newTestState()
+	state.SetProcess("job-1", &ProcessInfo{JobType: "download"})
+	state.SendProgressWithPercent("job-1", "downloading", "Downloading...", 42)
+	state.SetProcess("job-2", &ProcessInfo{JobType: "compress"})
+	state.SetAsyncJob("job-2", &AsyncJob{Status: "compressing", Progress: 17, CreatedAt: time.Now()})
+
+	got := make(map[string]interface{})
+	for _, p := range state.ListProcesses() {
+		got[p["id"].(string)] = p["progress"]
+	}
+	if got["job-1"] != 42.0 || got["job-2"] != 17.0 {
+		t.Errorf("progress = %v, want job-1 at 42 and job-2 at 17", got)
+	}
+}
+
+func TestResourceAdmissionSharesCoresAcrossTypes(t *testing.T) {
+	state := newTestState()
+	prevMode, prevCores := config.AdmissionMode, config.CPUCores
+	defer func() { config.AdmissionMode, config.CPUCores = prevMode, prevCores }()
+	config.AdmissionMode, config.CPUCores = "resources", 8
+	useSettings(t, func(s *config.Settings) { s.JobLimits = map[string]int{} })
+	state.resources = resourceSample{at: time.Now().Add(time.Hour), load: -1, memoryMB: -1, diskMB: -1}
+
+	for _, id := range []string{"compress-1", "compress-2"} {
+		if ticket, check := state.EnqueueJob(JobRequest{Type: "compress", ID: id}); !check.OK || ticket.Queued() {
+			t.Fatalf("%s should start, 8 cores fit two compress jobs", id)
+		}
+	}
+	third, _ := state.EnqueueJob(JobRequest{Type: "compress", ID: "compress-3"})
+	convert, _ := state.EnqueueJob(JobRequest{Type: "convert", ID: "convert-1"})
+	if !third.Queued() || !convert.Queued() {
+		t.Fatal("jobs past the core budget should queue")
+	}
+
+	state.DecrementJob("compress")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !third.Wait(ctx).OK {
+		t.Fatal("oldest queued job was not admitted when cores freed up")
+	}
+	if got := state.GetJobsByType()["convert"]; got != 0 {
+		t.Fatalf("convert admitted without free cores, count = %d", got)
+	}
+
+	state.DecrementJob("compress")
+	if !convert.Wait(ctx).OK {
+		t.Fatal("convert job was not admitted after a compress job finished")
+	}
+}
+
+func TestJobLimitCapsResourceAdmission(t *testing.T) {
+	state := newTestState()
+	prevMode, prevCores := config.AdmissionMode, config.CPUCores
+	defer func() { config.AdmissionMode, config.CPUCores = prevMode, prevCores }()
+	config.AdmissionMode, config.CPUCores = "resources", 64
+	useSettings(t, func(s *config.Settings) { s.JobLimits = map[string]int{} })
+	state.resources = resourceSample{at: time.Now().Add(time.Hour), load: -1, memoryMB: -1, diskMB: -1}
+
+	state.SetJobLimit("compress", 1)
+	if _, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "compress-1"}); !check.OK {
+		t.Fatal("compress-1 should start")
+	}
+	second, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "compress-2"})
+	if !check.OK || !second.Queued() {
+		t.Fatal("compress-2 should queue at its job limit even with cores to spare")
+	}
+	if _, check := state.EnqueueJob(JobRequest{Type: "convert", ID: "convert-1"}); !check.OK {
+		t.Fatal("a type without a limit should still be admitted by resources")
+	}
+
+	state.SetJobLimit("compress", 2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if !second.Wait(ctx).OK {
+		t.Fatal("compress-2 was not admitted after raising the limit")
+	}
+}
+
+func TestDownloadsAreAdmittedBesideCPUHeavyJobs(t *testing.T) {
+	state := newTestState()
+	prevMode, prevCores := config.AdmissionMode, config.CPUCores
+	defer func() { config.AdmissionMode, config.CPUCores = prevMode, prevCores }()
+	config.AdmissionMode, config.CPUCores = "resources", 4
+	useSettings(t, func(s *config.Settings) { s.JobLimits = map[string]int{} })
+	state.resources = resourceSample{at: time.Now().Add(time.Hour), load: 8, memoryMB: -1, diskMB: -1}
+
+	if ticket, check := state.EnqueueJob(JobRequest{Type: "compress", ID: "compress-1"}); !check.OK || ticket.Queued() {
+		t.Fatal("compress-1 should start on an idle server")
+	}
+	if second, _ := state.EnqueueJob(JobRequest{Type: "compress", ID: "compress-2"}); !second.Queued() {
+		t.Fatal("compress-2 should wait for the cores compress-1 holds")
+	}
+	ticket, check := state.EnqueueJob(JobRequest{Type: "download", ID: "download-1", ClientID: "web"})
+	if !check.OK || ticket.Queued() {
+		t.Fatal("a download should start while a compress job holds every core")
+	}
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+// ResumedFile is a finished download waiting for its client to come back.
+type ResumedFile struct {
+	Path      string
+	Filename  string
+	Ext       string
+	MimeType  string
+	SourceURL string
+}
+
+// ResumedJob is a streaming download whose client went away mid-job. It
+// keeps running for ReconnectGrace, and if the client comes back
+// for it by job ID in that time the result goes out on the new
+// connection. Otherwise the job is cancelled and its files removed.
+type ResumedJob struct {
+	ClientID string
+
+	s        *State
+	jobID    string
+	short    string
+	cancel   func()
+	done     chan struct{}
+	mu       sync.Mutex
+	file     *ResumedFile
+	err      error
+	finished bool
+	attached bool
+	expired  bool
+	timer    *time.Timer
+}
+
+// DetachJob parks a running streaming job whose client disconnected.
+// cancel stops the job if nobody re-attaches within the grace window.
+func (s *State) DetachJob(jobID, clientID string, cancel func()) *ResumedJob {
+	s.muResumed.Lock()
+	defer s.muResumed.Unlock()
+	if rj := s.resumedJobs[jobID]; rj != nil {
+		return rj
+	}
+	short := jobID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	rj := &ResumedJob{
+		ClientID: clientID,
+		s:        s,
+		jobID:    jobID,
+		short:    short,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	rj.timer = time.AfterFunc(config.Get().ReconnectGrace, rj.expire)
+	s.resumedJobs[jobID] = rj
+	log.Printf("[Reconnect] Client left job %s..., keeping it for %s", short, config.Get().ReconnectGrace)
+	return rj
+}
+
+// Finish records the job's result. A job that finished after its grace
+// window ran out has its files removed straight away.
+func (rj *ResumedJob) Finish(file *ResumedFile, err error) {
+	rj.mu.Lock()
+	if rj.finished {
+		rj.mu.Unlock()
+		return
+	}
+	rj.file, rj.err, rj.finished = file, err, true
+	expired := rj.expired
+	close(rj.done)
+	rj.mu.Unlock()
+
+	if expired && file != nil {
+		util.CleanupJobFiles(rj.jobID)
+	}
+}
+
+// Finished reports whether the job has its result.
+func (rj *ResumedJob) Finished() bool {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	return rj.finished
+}
+
+// Attach claims the job for a reconnected client and stops the grace
+// timer. It fails if the job expired or another connection holds it.
+func (rj *ResumedJob) Attach() bool {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	if rj.expired || rj.attached {
+		return false
+	}
+	rj.attached = true
+	rj.timer.Stop()
+	return true
+}
+
+// Detach lets go of the job after the attached client dropped, restarting
+// the grace window.
+func (rj *ResumedJob) Detach() {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	if rj.expired {
+		return
+	}
+	rj.attached = false
+	rj.timer.Reset(config.Get().ReconnectGrace)
+}
+
+// Wait blocks until the job finishes and returns its result, or returns
+// ctx's error if ctx ends first.
+func (rj *ResumedJob) Wait(ctx context.Context) (*ResumedFile, error) {
+	select {
+	case <-rj.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+	return rj.file, rj.err
+}
+
+func (rj *ResumedJob) expire() {
+	rj.mu.Lock()
+	if rj.attached || rj.expired {
+		rj.mu.Unlock()
+		return
+	}
+	rj.expired = true
+	finished := rj.finished
+	file := rj.file
+	rj.mu.Unlock()
+
+	rj.s.muResumed.Lock()
+	if rj.s.resumedJobs[rj.jobID] == rj {
+		delete(rj.s.resumedJobs, rj.jobID)
+	}
+	rj.s.muResumed.Unlock()
+
+	if !finished {
+		log.Printf("[Reconnect] Nobody came back for job %s..., cancelling it", rj.short)
+		if rj.cancel != nil {
+			rj.cancel()
+		}
+		return
+	}
+	log.Printf("[Reconnect] Nobody came back for finished job %s..., removing its files", rj.short)
+	if file != nil {
+		util.CleanupJobFiles(rj.jobID)
+	}
+}
+
+// isDetached reports whether a job is parked waiting for its client.
+func (s *State) isDetached(jobID string) bool {
+	s.muResumed.Lock()
+	defer s.muResumed.Unlock()
+	return s.resumedJobs[jobID] != nil
+}
+
+// PendingProgress is a streaming job's last reported progress.
+func (s *State) PendingProgress(jobID string) (float64, bool) {
+	s.muPending.Lock()
+	defer s.muPending.Unlock()
+	job, ok := s.pendingJobs[jobID]
+	if !ok {
+		return 0, false
+	}
+	return job.Progress, true
+}
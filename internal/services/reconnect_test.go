@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestDetachedJobDeliversToReattachedClient(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.ReconnectGrace = time.Minute })
+
+	cancelled := false
+	rj := state.DetachJob("job-1", "client-1", func() { cancelled = true })
+	if again := state.DetachJob("job-1", "client-1", nil); again != rj {
+		t.Fatal("detaching twice parked the job twice")
+	}
+	if !rj.Attach() {
+		t.Fatal("attach failed on a parked job")
+	}
+	if rj.Attach() {
+		t.Fatal("a second connection attached to the same job")
+	}
+
+	go rj.Finish(&ResumedFile{Path: "/tmp/job-1-final.mp4"}, nil)
+	file, err := rj.Wait(context.Background())
+	if err != nil || file == nil || file.Path != "/tmp/job-1-final.mp4" {
+		t.Fatalf("Wait = %+v, %v", file, err)
+	}
+	if cancelled {
+		t.Fatal("attached job was cancelled")
+	}
+}
+
+func TestDetachedJobIsCancelledAfterGrace(t *testing.T) {
+	state := newTestState()
+	useSettings(t, func(s *config.Settings) { s.ReconnectGrace = 20 * time.Millisecond })
+
+	cancelled := make(chan struct{})
+	rj := state.DetachJob("job-1", "client-1", func() { close(cancelled) })
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("job wasn't cancelled after the grace window")
+	}
+	if state.GetResumedJob("job-1") != nil {
+		t.Fatal("expired job is still parked")
+	}
+	if rj.Attach() {
+		t.Fatal("attached to an expired job")
+	}
+	rj.Finish(nil, errors.New("cancelled"))
+}
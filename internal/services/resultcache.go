@@ -0,0 +1,271 @@
+package services
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
+)
+
+// ResultKey is what a download was asked for. Two requests with the same
+// key produce the same file, so the second can be served from the first.
+type ResultKey struct {
+	URL          string
+	Format       string
+	Quality      string
+	Container    string
+	AudioFormat  string
+	AudioBitrate string
+	TwitterGifs  bool
+}
+
+// Hash is the key as a fixed-length string.
+func (k ResultKey) Hash() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		NormalizeURL(k.URL), k.Format, k.Quality, k.Container,
+		k.AudioFormat, k.AudioBitrate, strconv.FormatBool(k.TwitterGifs),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// CachedResult is a finished download kept in the result cache.
+type CachedResult struct {
+	Path    string
+	Ext     string
+	IsAudio bool
+	IsGif   bool
+
+	key     string
+	size    int64
+	created time.Time
+}
+
+// ResultCache keeps finished downloads on disk, keyed by ResultKey, so
+// repeat requests skip the download and encode. It's bounded by
+// ResultCacheMaxMB, evicting the least recently used file first,
+// and entries expire after FileRetention like other temp files.
+type ResultCache struct {
+	mu      sync.Mutex
+	dir     string
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	size    int64
+}
+
+var resultCacheLookups = metrics.NewCounter("yoink_result_cache_lookups_total",
+	"Result cache lookups, by result (hit or miss).", "result")
+
+var Results = NewResultCache(config.TempDirs["cache"])
+
+func NewResultCache(dir string) *ResultCache {
+	return &ResultCache{
+		dir:     dir,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func resultCacheMaxBytes() int64 {
+	return int64(config.Get().ResultCacheMaxMB) << 20
+}
+
+// Get returns the cached file for key, if there is one that hasn't
+// expired.
+func (c *ResultCache) Get(key ResultKey) (*CachedResult, bool) {
+	if resultCacheMaxBytes() <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key.Hash()]
+	if ok {
+		entry := elem.Value.(*CachedResult)
+		if _, err := os.Stat(entry.Path); err != nil || time.Since(entry.created) > config.Get().FileRetention {
+			c.removeLocked(elem)
+			ok = false
+		}
+	}
+	if !ok {
+		resultCacheLookups.Inc("miss")
+		return nil, false
+	}
+	resultCacheLookups.Inc("hit")
+	c.lru.MoveToFront(elem)
+	hit := *elem.Value.(*CachedResult)
+	return &hit, true
+}
+
+// Link puts a hard link to the cached file for key in dir, named like a
+// job's output, so the job can hand it on and clean it up like any other.
+func (c *ResultCache) Link(key ResultKey, dir, jobID string) (*CachedResult, bool) {
+	hit, ok := c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	dst := filepath.Join(dir, jobID+"-final."+hit.Ext)
+	os.Remove(dst)
+	if err := LinkOrCopy(hit.Path, dst); err != nil {
+		log.Printf("[Cache] Failed to link cached result for %s: %v", jobID, err)
+		return nil, false
+	}
+	hit.Path = dst
+	return hit, true
+}
+
+// Put adds a finished download to the cache. The file is hard linked, so
+// the job can still remove its own copy.
+func (c *ResultCache) Put(key ResultKey, path, ext string, isAudio, isGif bool) {
+	maxBytes := resultCacheMaxBytes()
+	if maxBytes <= 0 {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > maxBytes {
+		return
+	}
+
+	hash := key.Hash()
+	dst := filepath.Join(c.dir, hash+"."+ext)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[hash]; ok {
+		c.removeLocked(elem)
+	}
+	os.MkdirAll(c.dir, 0755)
+	if err := LinkOrCopy(path, dst); err != nil {
+		log.Printf("[Cache] Failed to cache %s: %v", filepath.Base(path), err)
+		return
+	}
+
+	c.entries[hash] = c.lru.PushFront(&CachedResult{
+		Path:    dst,
+		Ext:     ext,
+		IsAudio: isAudio,
+		IsGif:   isGif,
+		key:     hash,
+		size:    info.Size(),
+		created: time.Now(),
+	})
+	c.size += info.Size()
+
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if time.Since(elem.Value.(*CachedResult).created) > config.Get().FileRetention {
+			c.removeLocked(elem)
+		}
+		elem = prev
+	}
+	for c.size > maxBytes && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// Size is the bytes the cache holds.
+func (c *ResultCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *ResultCache) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*CachedResult)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	os.Remove(entry.Path)
+}
+
+// trackingParams are query parameters that don't change what a URL points
+// to, so they're dropped before URLs are compared.
+var trackingParams = map[string]bool{
+	"si": true, "feature": true, "fbclid": true, "gclid": true,
+	"igshid": true, "igsh": true, "ref_src": true, "ref_url": true,
+}
+
+// significantParams are the only query parameters kept for hosts whose
+// other parameters are all share or tracking noise. An Instagram carousel
+// link's img_index picks which item is downloaded.
+var significantParams = map[string]map[string]bool{
+	"instagram.com": {"img_index": true},
+	"tiktok.com":    {},
+	"twitter.com":   {},
+}
+
+// NormalizeURL reduces the ways of writing a media URL to one, so share
+// links and tracking parameters don't defeat the result cache.
+func NormalizeURL(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, prefix := range []string{"www.", "m.", "mobile."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	query := u.Query()
+
+	switch host {
+	case "x.com":
+		host = "twitter.com"
+	case "youtu.be":
+		host = "youtube.com"
+		query.Set("v", strings.TrimPrefix(path, "/"))
+		path = "/watch"
+	case "youtube.com":
+		if id, ok := strings.CutPrefix(path, "/shorts/"); ok {
+			query.Set("v", id)
+			path = "/watch"
+		}
+	}
+
+	if host == "youtube.com" {
+		query.Del("t")
+	}
+	keep, allowlisted := significantParams[host]
+	for name := range query {
+		if trackingParams[name] || strings.HasPrefix(name, "utm_") || (allowlisted && !keep[name]) {
+			query.Del(name)
+		}
+	}
+
+	normalized := "https://" + host + path
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+// LinkOrCopy hard links src to dst, copying it when they're on different
+// filesystems.
+func LinkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
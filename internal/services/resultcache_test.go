@@ -0,0 +1,78 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestNormalizeURLMatchesShareLinks(t *testing.T) {
+	cases := []struct{ a, b string }{
+		{"https://youtu.be/abc123?si=xyz", "https://www.youtube.com/watch?v=abc123"},
+		{"https://m.youtube.com/shorts/abc123/", "https://youtube.com/watch?v=abc123&t=42"},
+		{"https://x.com/user/status/1?s=20&t=abc", "https://twitter.com/user/status/1"},
+		{"https://www.tiktok.com/@u/video/9?is_from_webapp=1", "https://tiktok.com/@u/video/9"},
+		{"https://example.com/v?id=1&utm_source=x", "https://EXAMPLE.com/v?id=1"},
+	}
+	for _, c := range cases {
+		if NormalizeURL(c.a) != NormalizeURL(c.b) {
+			t.Errorf("%s and %s normalized to %s and %s", c.a, c.b, NormalizeURL(c.a), NormalizeURL(c.b))
+		}
+	}
+	if NormalizeURL("https://example.com/v?id=1") == NormalizeURL("https://example.com/v?id=2") {
+		t.Error("different ids normalized to the same URL")
+	}
+	if NormalizeURL("https://www.instagram.com/p/abc/?img_index=2&igsh=x") == NormalizeURL("https://instagram.com/p/abc/?img_index=3") {
+		t.Error("different carousel items normalized to the same URL")
+	}
+	if got := NormalizeURL("https://www.instagram.com/p/abc/?img_index=2&igsh=x&hl=en"); got != "https://instagram.com/p/abc?img_index=2" {
+		t.Errorf("instagram link normalized to %s", got)
+	}
+}
+
+func TestResultCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	useSettings(t, func(s *config.Settings) {
+		s.ResultCacheMaxMB = 1
+		s.FileRetention = time.Hour
+	})
+
+	dir := t.TempDir()
+	cache := NewResultCache(filepath.Join(dir, "cache"))
+	put := func(url string) ResultKey {
+		src := filepath.Join(dir, "src.mp4")
+		if err := os.WriteFile(src, make([]byte, 400<<10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(src)
+		key := ResultKey{URL: url, Format: "video"}
+		cache.Put(key, src, "mp4", false, false)
+		return key
+	}
+
+	a := put("https://example.com/a")
+	b := put("https://example.com/b")
+	if _, ok := cache.Get(a); !ok {
+		t.Fatal("a should be cached after its job removed its copy")
+	}
+	c := put("https://example.com/c")
+
+	if _, ok := cache.Get(b); ok {
+		t.Error("b was least recently used and should have been evicted")
+	}
+	for _, key := range []ResultKey{a, c} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("%s should still be cached", key.URL)
+		}
+	}
+	if got := cache.Size(); got != 800<<10 {
+		t.Errorf("size = %d, want %d", got, 800<<10)
+	}
+
+	config.Update(func(s *config.Settings) { s.FileRetention = time.Nanosecond })
+	if _, ok := cache.Get(a); ok {
+		t.Error("entry older than FileRetention was served")
+	}
+}
@@ -0,0 +1,326 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Files bigger than s3MultipartThreshold are uploaded in s3PartSize
+	// parts, which also gets them past S3's 5GB limit on a single PUT.
+	s3MultipartThreshold = 256 << 20
+	s3PartSize           = 64 << 20
+
+	// s3MaxPresign is the longest a presigned link can last.
+	s3MaxPresign = 7 * 24 * time.Hour
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type S3Config struct {
+	Endpoint       string
+	PublicEndpoint string
+	Region         string
+	Bucket         string
+	AccessKey      string
+	SecretKey      string
+	Prefix         string
+}
+
+// S3Outputs keeps outputs in an S3-compatible bucket, such as MinIO, with
+// path-style addressing and SigV4 signed requests.
+type S3Outputs struct {
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3Outputs(cfg S3Config) *S3Outputs {
+	if cfg.PublicEndpoint == "" {
+		cfg.PublicEndpoint = cfg.Endpoint
+	}
+	return &S3Outputs{cfg: cfg, client: &http.Client{}, now: time.Now}
+}
+
+func (s *S3Outputs) Save(ctx context.Context, path, contentType string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	key := s.cfg.Prefix + uuid.New().String() + filepath.Ext(path)
+	if stat.Size() > s3MultipartThreshold {
+		err = s.putMultipart(ctx, key, f, stat.Size(), contentType)
+	} else {
+		var resp *http.Response
+		resp, err = s.do(ctx, "PUT", key, nil, io.NewSectionReader(f, 0, stat.Size()), stat.Size(),
+			http.Header{"Content-Type": {contentType}})
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	os.Remove(path)
+	return key, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (s *S3Outputs) putMultipart(ctx context.Context, key string, f *os.File, size int64, contentType string) error {
+	resp, err := s.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, 0, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	var started struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&started)
+	resp.Body.Close()
+	if err != nil || started.UploadID == "" {
+		return fmt.Errorf("S3 didn't start the upload: %v", err)
+	}
+	uploadID := started.UploadID
+
+	err = func() error {
+		var parts []s3CompletedPart
+		for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+s3PartSize {
+			length := min(s3PartSize, size-offset)
+			resp, err := s.do(ctx, "PUT", key, url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}},
+				io.NewSectionReader(f, offset, length), length, nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			parts = append(parts, s3CompletedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+		}
+
+		body, _ := xml.Marshal(s3CompleteUpload{Parts: parts})
+		resp, err := s.do(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		// Completing can fail after S3 has already answered 200, in which
+		// case the error is in the body.
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if bytes.Contains(reply, []byte("<Error>")) {
+			return fmt.Errorf("S3 failed to finish the upload: %s", reply)
+		}
+		return nil
+	}()
+	if err != nil {
+		if resp, abortErr := s.do(context.Background(), "DELETE", key, url.Values{"uploadId": {uploadID}}, nil, 0, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+func (s *S3Outputs) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(ctx, "GET", key, nil, nil, 0, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *S3Outputs) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", key, nil, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Outputs) URL(key, fileName string, expiry time.Duration) (string, bool) {
+	u, err := s.objectURL(s.cfg.PublicEndpoint, key)
+	if err != nil {
+		return "", false
+	}
+	extra := url.Values{}
+	if fileName != "" {
+		extra.Set("response-content-disposition", ContentDisposition(fileName))
+	}
+	return s.presign(u, extra, expiry), true
+}
+
+func (s *S3Outputs) objectURL(endpoint, key string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	return u, nil
+}
+
+// do sends a signed request for key, returning an error for anything but
+// a 2xx response.
+func (s *S3Outputs) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(s.cfg.Endpoint, key)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds SigV4 headers to req. The body isn't hashed, so uploads can
+// stream straight from disk.
+func (s *S3Outputs) sign(req *http.Request) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + unsignedPayload + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := s.scope(now)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, s.signature(now, canonical)))
+}
+
+// presign returns u with a SigV4 signature in its query, letting anyone
+// holding it GET the object until expiry.
+func (s *S3Outputs) presign(u *url.URL, extra url.Values, expiry time.Duration) string {
+	expiry = min(max(expiry, time.Second), s3MaxPresign)
+	now := s.now().UTC()
+	query := url.Values{}
+	for k, v := range extra {
+		query[k] = v
+	}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		"GET",
+		s3URIEncode(u.Path, false),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	query.Set("X-Amz-Signature", s.signature(now, canonical))
+
+	signed := *u
+	signed.RawQuery = s3CanonicalQuery(query)
+	return signed.String()
+}
+
+func (s *S3Outputs) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *S3Outputs) signature(t time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query the way SigV4 signs it: sorted, with
+// everything but unreserved characters escaped.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
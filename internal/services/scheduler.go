@@ -0,0 +1,187 @@
+package services
+
+import (
+	"math"
+	"strings"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+const (
+	OriginWeb = "web"
+	OriginBot = "bot"
+)
+
+// fairLane holds start-time fair queueing tags for one job type. Slots are
+// shared between origins by SchedulerWeights, and between clients
+// of the same origin equally. A flow's tag only advances when it is
+// admitted, so a client with one queued job is not stuck behind another
+// client's backlog.
+type fairLane struct {
+	clock        float64
+	origins      map[string]float64
+	clientClocks map[string]float64
+	clients      map[string]float64
+	admitted     map[string]int
+}
+
+func newFairLane() *fairLane {
+	return &fairLane{
+		origins:      make(map[string]float64),
+		clientClocks: make(map[string]float64),
+		clients:      make(map[string]float64),
+		admitted:     make(map[string]int),
+	}
+}
+
+func originWeight(origin string) float64 {
+	if w, ok := config.Get().SchedulerWeights[origin]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (l *fairLane) originTag(origin string) float64 {
+	return math.Max(l.clock, l.origins[origin])
+}
+
+func (l *fairLane) clientTag(origin, clientID string) float64 {
+	return math.Max(l.clientClocks[origin], l.clients[origin+"|"+clientID])
+}
+
+func (l *fairLane) charge(origin, clientID string) {
+	start := l.originTag(origin)
+	l.clock = start
+	l.origins[origin] = start + 1/originWeight(origin)
+
+	clientStart := l.clientTag(origin, clientID)
+	l.clientClocks[origin] = clientStart
+	l.clients[origin+"|"+clientID] = clientStart + 1
+	l.admitted[origin]++
+
+	if len(l.clients) > 256 {
+		for key, tag := range l.clients {
+			o, _, _ := strings.Cut(key, "|")
+			if tag <= l.clientClocks[o] {
+				delete(l.clients, key)
+			}
+		}
+	}
+}
+
+// pick returns the index of the waiting job that should be admitted next:
+// the origin with the smallest tag, then its client with the smallest tag,
+// then that client's oldest job.
+func (l *fairLane) pick(waiting []*queuedJob) int {
+	if len(waiting) == 0 {
+		return -1
+	}
+
+	bestOrigin := waiting[0].origin
+	bestTag := l.originTag(bestOrigin)
+	for _, e := range waiting[1:] {
+		if tag := l.originTag(e.origin); tag < bestTag {
+			bestOrigin, bestTag = e.origin, tag
+		}
+	}
+
+	best := -1
+	var bestClientTag float64
+	for i, e := range waiting {
+		if e.origin != bestOrigin {
+			continue
+		}
+		if tag := l.clientTag(e.origin, e.clientID); best == -1 || tag < bestClientTag {
+			best, bestClientTag = i, tag
+		}
+	}
+	return best
+}
+
+// order simulates admissions on a copy of the lane's tags.
+func (l *fairLane) order(waiting []*queuedJob) []*queuedJob {
+	sim := &fairLane{
+		clock:        l.clock,
+		origins:      make(map[string]float64, len(l.origins)),
+		clientClocks: make(map[string]float64, len(l.clientClocks)),
+		clients:      make(map[string]float64, len(l.clients)),
+		admitted:     make(map[string]int),
+	}
+	for k, v := range l.origins {
+		sim.origins[k] = v
+	}
+	for k, v := range l.clientClocks {
+		sim.clientClocks[k] = v
+	}
+	for k, v := range l.clients {
+		sim.clients[k] = v
+	}
+
+	rest := make([]*queuedJob, len(waiting))
+	copy(rest, waiting)
+	ordered := make([]*queuedJob, 0, len(waiting))
+	for len(rest) > 0 {
+		i := sim.pick(rest)
+		e := rest[i]
+		ordered = append(ordered, e)
+		sim.charge(e.origin, e.clientID)
+		rest = append(rest[:i:i], rest[i+1:]...)
+	}
+	return ordered
+}
+
+func (s *State) fairLaneLocked(jobType string) *fairLane {
+	l, ok := s.fair[jobType]
+	if !ok {
+		l = newFairLane()
+		s.fair[jobType] = l
+	}
+	return l
+}
+
+func (s *State) schedulerStatusLocked() map[string]interface{} {
+	types := make(map[string]interface{})
+	for jobType, active := range s.jobsByType {
+		queued := make(map[string]int)
+		for _, e := range s.queues[jobType] {
+			queued[e.origin]++
+		}
+		admitted := make(map[string]int)
+		share := make(map[string]float64)
+		if l, ok := s.fair[jobType]; ok {
+			total := 0
+			for origin, n := range l.admitted {
+				admitted[origin] = n
+				total += n
+			}
+			for origin, n := range l.admitted {
+				share[origin] = math.Round(float64(n)/float64(total)*1000) / 1000
+			}
+		}
+		entry := map[string]interface{}{
+			"active":   active,
+			"queued":   queued,
+			"admitted": admitted,
+			"share":    share,
+		}
+		if limit, ok := config.Get().JobLimits[jobType]; ok {
+			entry["limit"] = limit
+		}
+		types[jobType] = entry
+	}
+
+	var weightTotal float64
+	for _, w := range config.Get().SchedulerWeights {
+		weightTotal += w
+	}
+	targets := make(map[string]float64)
+	for origin, w := range config.Get().SchedulerWeights {
+		targets[origin] = math.Round(w/weightTotal*1000) / 1000
+	}
+
+	return map[string]interface{}{
+		"weights":      config.Get().SchedulerWeights,
+		"targetShares": targets,
+		"types":        types,
+	}
+}
@@ -0,0 +1,450 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+const (
+	// sharedPollInterval is how often subscribers check for new messages.
+	sharedPollInterval = 250 * time.Millisecond
+
+	// sharedEventTTL is how long a published message is kept for replicas
+	// that haven't read it yet.
+	sharedEventTTL = time.Minute
+)
+
+// sqliteBackend shares state between replicas through one SQLite database.
+// Every replica has to reach the file with working locks, so they should
+// run on one host or share a filesystem that supports them. Messages are
+// rows that subscribers poll for.
+type sqliteBackend struct {
+	db   *sql.DB
+	stop context.CancelFunc
+	once sync.Once
+}
+
+// OpenSQLiteBackend opens or creates the shared state database at path.
+func OpenSQLiteBackend(path string) (StateBackend, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS sessions (
+			client_id TEXT PRIMARY KEY,
+			last_heartbeat INTEGER NOT NULL,
+			last_activity INTEGER NOT NULL,
+			skip_heartbeat INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS job_owners (
+			job_id TEXT PRIMARY KEY,
+			client_id TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS job_owners_client ON job_owners (client_id)`,
+		`CREATE TABLE IF NOT EXISTS records (
+			tbl TEXT NOT NULL,
+			key TEXT NOT NULL,
+			data BLOB NOT NULL,
+			updated_at INTEGER NOT NULL,
+			PRIMARY KEY (tbl, key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS events (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT NOT NULL,
+			data BLOB NOT NULL,
+			created_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS events_channel ON events (channel, seq)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("create tables: %w", err)
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	b := &sqliteBackend{db: db, stop: stop}
+	go b.prune(ctx)
+	return b, nil
+}
+
+// prune drops old messages, and records a replica left behind when it
+// died once they're older than anything could still want.
+func (b *sqliteBackend) prune(ctx context.Context) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			b.exec("prune messages", "DELETE FROM events WHERE created_at < ?", now.Add(-sharedEventTTL).UnixMilli())
+			b.exec("prune records", "DELETE FROM records WHERE updated_at < ?", now.Add(-config.PlaylistDownloadExp).UnixMilli())
+		}
+	}
+}
+
+func (b *sqliteBackend) exec(what, query string, args ...interface{}) sql.Result {
+	res, err := b.db.Exec(query, args...)
+	if err != nil {
+		log.Printf("[SharedState] Failed to %s: %v", what, err)
+	}
+	return res
+}
+
+func (b *sqliteBackend) RegisterClient(clientID string) bool {
+	now := time.Now().UnixMilli()
+	res := b.exec("register client", `INSERT INTO sessions (client_id, last_heartbeat, last_activity, skip_heartbeat)
+		VALUES (?, ?, ?, ?) ON CONFLICT (client_id) DO NOTHING`,
+		clientID, now, now, newClientSession(clientID).SkipHeartbeat)
+	if res == nil {
+		return false
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true
+	}
+	b.exec("touch client", "UPDATE sessions SET last_activity = ? WHERE client_id = ?", now, clientID)
+	return false
+}
+
+func (b *sqliteBackend) Heartbeat(clientID string) bool {
+	res := b.exec("record heartbeat", "UPDATE sessions SET last_heartbeat = ? WHERE client_id = ?",
+		time.Now().UnixMilli(), clientID)
+	if res == nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (b *sqliteBackend) ClientJobs(clientID string) ([]string, bool) {
+	var exists int
+	if err := b.db.QueryRow("SELECT 1 FROM sessions WHERE client_id = ?", clientID).Scan(&exists); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[SharedState] Failed to look up client: %v", err)
+		}
+		return nil, false
+	}
+	return b.ownedJobs(b.db, clientID), true
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (b *sqliteBackend) ownedJobs(q querier, clientID string) []string {
+	rows, err := q.Query("SELECT job_id FROM job_owners WHERE client_id = ?", clientID)
+	if err != nil {
+		log.Printf("[SharedState] Failed to list client jobs: %v", err)
+		return nil
+	}
+	defer rows.Close()
+	var jobIDs []string
+	for rows.Next() {
+		var jobID string
+		if rows.Scan(&jobID) == nil {
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	return jobIDs
+}
+
+func (b *sqliteBackend) LinkJob(jobID, clientID string) {
+	res := b.exec("link job", `INSERT OR REPLACE INTO job_owners (job_id, client_id)
+		SELECT ?, client_id FROM sessions WHERE client_id = ?`, jobID, clientID)
+	if res == nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		b.exec("touch client", "UPDATE sessions SET last_activity = ? WHERE client_id = ?",
+			time.Now().UnixMilli(), clientID)
+	}
+}
+
+func (b *sqliteBackend) ReserveJob(jobID, clientID string, maxJobs int) (ok, created bool) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Printf("[SharedState] Failed to reserve job: %v", err)
+		return false, false
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	res, err := tx.Exec(`INSERT INTO sessions (client_id, last_heartbeat, last_activity, skip_heartbeat)
+		VALUES (?, ?, ?, ?) ON CONFLICT (client_id) DO NOTHING`,
+		clientID, now, now, newClientSession(clientID).SkipHeartbeat)
+	if err != nil {
+		log.Printf("[SharedState] Failed to reserve job: %v", err)
+		return false, false
+	}
+	n, _ := res.RowsAffected()
+	created = n > 0
+
+	var held int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM job_owners WHERE client_id = ?", clientID).Scan(&held); err != nil {
+		log.Printf("[SharedState] Failed to reserve job: %v", err)
+		return false, false
+	}
+	if held < maxJobs {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO job_owners (job_id, client_id) VALUES (?, ?)", jobID, clientID); err != nil {
+			log.Printf("[SharedState] Failed to reserve job: %v", err)
+			return false, false
+		}
+		tx.Exec("UPDATE sessions SET last_activity = ? WHERE client_id = ?", now, clientID)
+		ok = true
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[SharedState] Failed to reserve job: %v", err)
+		return false, false
+	}
+	return ok, created
+}
+
+func (b *sqliteBackend) JobOwner(jobID string) string {
+	var clientID string
+	err := b.db.QueryRow("SELECT client_id FROM job_owners WHERE job_id = ?", jobID).Scan(&clientID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[SharedState] Failed to look up job owner: %v", err)
+	}
+	return clientID
+}
+
+func (b *sqliteBackend) JobOwners() map[string]string {
+	owners := make(map[string]string)
+	rows, err := b.db.Query("SELECT job_id, client_id FROM job_owners")
+	if err != nil {
+		log.Printf("[SharedState] Failed to list job owners: %v", err)
+		return owners
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobID, clientID string
+		if rows.Scan(&jobID, &clientID) == nil {
+			owners[jobID] = clientID
+		}
+	}
+	return owners
+}
+
+func (b *sqliteBackend) UnlinkJob(jobID string) {
+	b.exec("touch client", `UPDATE sessions SET last_activity = ?
+		WHERE client_id = (SELECT client_id FROM job_owners WHERE job_id = ?)`, time.Now().UnixMilli(), jobID)
+	b.exec("unlink job", "DELETE FROM job_owners WHERE job_id = ?", jobID)
+}
+
+func (b *sqliteBackend) Sessions() map[string]ClientSession {
+	out := make(map[string]ClientSession)
+	rows, err := b.db.Query("SELECT client_id, last_heartbeat, last_activity, skip_heartbeat FROM sessions")
+	if err != nil {
+		log.Printf("[SharedState] Failed to list sessions: %v", err)
+		return out
+	}
+	for rows.Next() {
+		var clientID string
+		var heartbeat, activity int64
+		var skip bool
+		if rows.Scan(&clientID, &heartbeat, &activity, &skip) != nil {
+			continue
+		}
+		out[clientID] = ClientSession{
+			LastHeartbeat: time.UnixMilli(heartbeat),
+			LastActivity:  time.UnixMilli(activity),
+			ActiveJobs:    make(map[string]bool),
+			SkipHeartbeat: skip,
+		}
+	}
+	rows.Close()
+
+	for jobID, clientID := range b.JobOwners() {
+		if session, ok := out[clientID]; ok {
+			session.ActiveJobs[jobID] = true
+		}
+	}
+	return out
+}
+
+func (b *sqliteBackend) RemoveClient(clientID string) ([]string, bool) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Printf("[SharedState] Failed to remove client: %v", err)
+		return nil, false
+	}
+	defer tx.Rollback()
+	jobIDs := b.ownedJobs(tx, clientID)
+	res, err := tx.Exec("DELETE FROM sessions WHERE client_id = ?", clientID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM job_owners WHERE client_id = ?", clientID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("[SharedState] Failed to remove client: %v", err)
+		return nil, false
+	}
+	n, _ := res.RowsAffected()
+	return jobIDs, n > 0 || len(jobIDs) > 0
+}
+
+// ExpireSessions runs in one transaction, so when several replicas sweep
+// at once each expired session goes to just one of them.
+func (b *sqliteBackend) ExpireSessions(now time.Time) []ExpiredSession {
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Printf("[SharedState] Failed to expire sessions: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT s.client_id, s.last_heartbeat, s.last_activity, s.skip_heartbeat, COUNT(o.job_id)
+		FROM sessions s LEFT JOIN job_owners o ON o.client_id = s.client_id
+		GROUP BY s.client_id`)
+	if err != nil {
+		log.Printf("[SharedState] Failed to expire sessions: %v", err)
+		return nil
+	}
+	var expired []ExpiredSession
+	for rows.Next() {
+		var clientID string
+		var heartbeat, activity int64
+		var skip bool
+		var held int
+		if rows.Scan(&clientID, &heartbeat, &activity, &skip, &held) != nil {
+			continue
+		}
+		if held > 0 && !skip && now.Sub(time.UnixMilli(heartbeat)) > config.HeartbeatTimeout {
+			expired = append(expired, ExpiredSession{ClientID: clientID})
+		} else if held == 0 && now.Sub(time.UnixMilli(activity)) > config.SessionIdleTimeout {
+			expired = append(expired, ExpiredSession{ClientID: clientID, Idle: true})
+		}
+	}
+	rows.Close()
+
+	for i, e := range expired {
+		if !e.Idle {
+			expired[i].JobIDs = b.ownedJobs(tx, e.ClientID)
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE client_id = ?", e.ClientID); err != nil {
+			log.Printf("[SharedState] Failed to expire sessions: %v", err)
+			return nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[SharedState] Failed to expire sessions: %v", err)
+		return nil
+	}
+	return expired
+}
+
+func (b *sqliteBackend) Put(table, key string, data []byte) {
+	b.exec("save "+table, "INSERT OR REPLACE INTO records (tbl, key, data, updated_at) VALUES (?, ?, ?, ?)",
+		table, key, data, time.Now().UnixMilli())
+}
+
+func (b *sqliteBackend) Get(table, key string) ([]byte, bool) {
+	var data []byte
+	err := b.db.QueryRow("SELECT data FROM records WHERE tbl = ? AND key = ?", table, key).Scan(&data)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("[SharedState] Failed to load %s: %v", table, err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+func (b *sqliteBackend) Delete(table, key string) {
+	b.exec("delete "+table, "DELETE FROM records WHERE tbl = ? AND key = ?", table, key)
+}
+
+// Modify holds the database's write lock from reading the record to
+// writing it back, since transactions begin immediately.
+func (b *sqliteBackend) Modify(table, key string, change func(data []byte) []byte) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		log.Printf("[SharedState] Failed to update %s: %v", table, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var data []byte
+	err = tx.QueryRow("SELECT data FROM records WHERE tbl = ? AND key = ?", table, key).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("[SharedState] Failed to update %s: %v", table, err)
+		return
+	}
+	next := change(data)
+	if next == nil {
+		return
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO records (tbl, key, data, updated_at) VALUES (?, ?, ?, ?)",
+		table, key, next, time.Now().UnixMilli()); err != nil {
+		log.Printf("[SharedState] Failed to update %s: %v", table, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("[SharedState] Failed to update %s: %v", table, err)
+	}
+}
+
+func (b *sqliteBackend) Publish(channel string, data []byte) {
+	b.exec("publish", "INSERT INTO events (channel, data, created_at) VALUES (?, ?, ?)",
+		channel, data, time.Now().UnixMilli())
+}
+
+// Subscribe only sees messages published after it was called.
+func (b *sqliteBackend) Subscribe(ctx context.Context, channel string) <-chan []byte {
+	ch := make(chan []byte, 64)
+	var cursor int64
+	if err := b.db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM events").Scan(&cursor); err != nil {
+		log.Printf("[SharedState] Failed to subscribe to %s: %v", channel, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(sharedPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			rows, err := b.db.Query("SELECT seq, data FROM events WHERE channel = ? AND seq > ? ORDER BY seq", channel, cursor)
+			if err != nil {
+				continue
+			}
+			var batch [][]byte
+			for rows.Next() {
+				var data []byte
+				if rows.Scan(&cursor, &data) == nil {
+					batch = append(batch, data)
+				}
+			}
+			rows.Close()
+			for _, data := range batch {
+				select {
+				case ch <- data:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (b *sqliteBackend) Close() {
+	b.once.Do(func() {
+		b.stop()
+		b.db.Close()
+	})
+}
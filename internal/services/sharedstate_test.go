@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSQLiteBackendSharesStateBetweenReplicas(t *testing.T) {
+	backend, err := OpenSQLiteBackend(filepath.Join(t.TempDir(), "shared.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := newTestState(), newTestState()
+	a.UseBackend(backend)
+	b.UseBackend(backend)
+	defer a.CloseBackend()
+	defer b.CloseBackend()
+
+	if !a.TryReserveClientJob("job1", "client", 1) {
+		t.Fatal("first job was refused")
+	}
+	if b.TryReserveClientJob("job2", "client", 1) {
+		t.Error("the other replica let the client go over its job limit")
+	}
+	if owner := b.GetJobOwner("job1"); owner != "client" {
+		t.Errorf("owner seen by the other replica = %q, want client", owner)
+	}
+
+	a.SetBotDownload("tok", &BotDownload{FilePath: "/tmp/x.mp4", CreatedAt: time.Now()})
+	if dl := b.GetBotDownload("tok"); dl == nil || dl.FilePath != "/tmp/x.mp4" {
+		t.Errorf("download token seen by the other replica = %+v", dl)
+	}
+	a.SetAsyncJob("async", &AsyncJob{Status: "downloading", Type: "download", CreatedAt: time.Now()})
+	if job := b.GetAsyncJob("async"); job == nil || job.Status != "downloading" {
+		t.Errorf("async job seen by the other replica = %+v", job)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	progress := b.SubscribeProgress(ctx, "job1")
+	cancelled := make(chan string, 1)
+	a.HandleCancelRequests(func(jobID string) bool {
+		cancelled <- jobID
+		return true
+	})
+
+	a.SendProgressSimple("job1", "downloading", "halfway there")
+	select {
+	case data := <-progress:
+		if !strings.Contains(string(data), "halfway there") {
+			t.Errorf("progress event = %s", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("progress never reached the other replica")
+	}
+
+	if !b.RequestCancel("job1") {
+		t.Fatal("the other replica didn't know the job")
+	}
+	select {
+	case jobID := <-cancelled:
+		if jobID != "job1" {
+			t.Errorf("cancelled %s, want job1", jobID)
+		}
+	case <-ctx.Done():
+		t.Fatal("cancel request never reached the replica running the job")
+	}
+	if b.RequestCancel("unknown") {
+		t.Error("a job no replica knows was reported as cancelled")
+	}
+}
+
+// replicas opens n states each with its own connection to one shared
+// database, as separate processes would have.
+func replicas(t *testing.T, n int) []*State {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "shared.db")
+	states := make([]*State, n)
+	for i := range states {
+		backend, err := OpenSQLiteBackend(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states[i] = newTestState()
+		states[i].UseBackend(backend)
+		t.Cleanup(states[i].CloseBackend)
+	}
+	return states
+}
+
+func TestSharedCountersDontLoseUpdates(t *testing.T) {
+	states := replicas(t, 2)
+	claims := ClaimsFor("job1", &BotDownload{CreatedAt: time.Now()})
+	claims.MaxDownloads = 5
+	key, _ := states[0].CreateAPIKey(APIKey{Name: "bot", DailyJobs: 5})
+
+	var wg sync.WaitGroup
+	var downloads, jobs atomic.Int32
+	for i := 0; i < 20; i++ {
+		s := states[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.UseSignedToken(&claims) == nil {
+				downloads.Add(1)
+			}
+			if s.UseAPIKeyJob(key, "download") == nil {
+				jobs.Add(1)
+			}
+			s.RecordAPIKeyRequest(key.ID, 10)
+		}()
+	}
+	wg.Wait()
+
+	if downloads.Load() != 5 {
+		t.Errorf("%d downloads allowed across replicas, want 5", downloads.Load())
+	}
+	if err := states[1].CheckSignedToken(&claims); !errors.Is(err, ErrTokenUsedUp) {
+		t.Errorf("check after the limit: err = %v", err)
+	}
+	if jobs.Load() != 5 {
+		t.Errorf("%d jobs allowed across replicas, want 5", jobs.Load())
+	}
+	if usage := states[1].APIKeyUsage(key.ID); usage.Requests != 20 || usage.Bytes != 200 || usage.Jobs != 5 {
+		t.Errorf("usage = %+v, want 20 requests, 200 bytes and 5 jobs", usage)
+	}
+}
+
+func TestFinishedAsyncJobsAreNotRewritten(t *testing.T) {
+	states := replicas(t, 1)
+	s := states[0]
+	job := &AsyncJob{Status: "downloading", Type: "download", CreatedAt: time.Now()}
+	s.SetAsyncJob("async", job)
+
+	job.SetStatus("complete")
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		var rec asyncJobRecord
+		if s.sharedRecord(tableAsyncJobs, "async", &rec) && rec.Status == "complete" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("finished status never reached the backend")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	s.backend.Delete(tableAsyncJobs, "async")
+	time.Sleep(1500 * time.Millisecond)
+	if _, ok := s.backend.Get(tableAsyncJobs, "async"); ok {
+		t.Error("finished job was written again")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/metrics"
 	"github.com/coah80/yoink/internal/util"
 )
 
@@ -27,6 +29,7 @@ type ProcessInfo struct {
 	TempFile    string
 	TempDir     string
 	JobType     string
+	startedAt   time.Time
 }
 
 func (p *ProcessInfo) SetCancelled(v bool) {
@@ -94,76 +97,104 @@ type FailedVideo struct {
 	Reason string `json:"reason"`
 }
 
+// PipelineStage tracks one step of a pipeline job.
+type PipelineStage struct {
+	Type     string  `json:"type"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+}
+
 type AsyncJob struct {
 	mu                sync.RWMutex
-	Status            string        `json:"status"`
-	Progress          float64       `json:"progress"`
-	Message           string        `json:"message"`
-	CreatedAt         time.Time     `json:"-"`
-	Type              string        `json:"type,omitempty"`
-	URL               string        `json:"url,omitempty"`
-	Format            string        `json:"format,omitempty"`
-	OutputPath        string        `json:"-"`
-	OutputFilename    string        `json:"outputFilename,omitempty"`
-	MimeType          string        `json:"-"`
-	TextContent       string        `json:"textContent,omitempty"`
-	Error             string        `json:"error,omitempty"`
-	DownloadToken     string        `json:"downloadToken,omitempty"`
-	FileName          string        `json:"fileName,omitempty"`
-	FileSize          int64         `json:"fileSize,omitempty"`
-	PlaylistTitle     string        `json:"playlistTitle,omitempty"`
-	TotalVideos       int           `json:"totalVideos,omitempty"`
-	StartVideo        int           `json:"startVideo,omitempty"`
-	VideosCompleted   int           `json:"videosCompleted,omitempty"`
-	CurrentVideo      int           `json:"currentVideo,omitempty"`
-	CurrentVideoTitle string        `json:"currentVideoTitle,omitempty"`
-	FailedVideos      []FailedVideo `json:"failedVideos,omitempty"`
-	FailedCount       int           `json:"failedCount,omitempty"`
-	Speed             string        `json:"speed,omitempty"`
-	ETA               string        `json:"eta,omitempty"`
-	DebugError        string        `json:"debugError,omitempty"`
-	PlaylistInfo      interface{}   `json:"playlistInfo,omitempty"`
+	Status            string            `json:"status"`
+	Progress          float64           `json:"progress"`
+	Message           string            `json:"message"`
+	CreatedAt         time.Time         `json:"-"`
+	Type              string            `json:"type,omitempty"`
+	URL               string            `json:"url,omitempty"`
+	Format            string            `json:"format,omitempty"`
+	OutputPath        string            `json:"-"`
+	OutputFilename    string            `json:"outputFilename,omitempty"`
+	MimeType          string            `json:"-"`
+	TextContent       string            `json:"textContent,omitempty"`
+	Error             string            `json:"error,omitempty"`
+	DownloadToken     string            `json:"downloadToken,omitempty"`
+	FileName          string            `json:"fileName,omitempty"`
+	FileSize          int64             `json:"fileSize,omitempty"`
+	PlaylistTitle     string            `json:"playlistTitle,omitempty"`
+	TotalVideos       int               `json:"totalVideos,omitempty"`
+	StartVideo        int               `json:"startVideo,omitempty"`
+	VideosCompleted   int               `json:"videosCompleted,omitempty"`
+	CurrentVideo      int               `json:"currentVideo,omitempty"`
+	CurrentVideoTitle string            `json:"currentVideoTitle,omitempty"`
+	FailedVideos      []FailedVideo     `json:"failedVideos,omitempty"`
+	FailedCount       int               `json:"failedCount,omitempty"`
+	Speed             string            `json:"speed,omitempty"`
+	ETA               string            `json:"eta,omitempty"`
+	DebugError        string            `json:"debugError,omitempty"`
+	PlaylistInfo      interface{}       `json:"playlistInfo,omitempty"`
+	ResumeFrom        int               `json:"resumeFrom,omitempty"`
+	Origin            string            `json:"-"`
+	Requester         string            `json:"-"` // who a bot job is for, shared fairly within its origin
+	CallbackURL       string            `json:"-"`
+	WebhookStatus     string            `json:"webhookStatus,omitempty"`
+	WebhookDeliveries []WebhookDelivery `json:"webhookDeliveries,omitempty"`
+	Stages            []PipelineStage   `json:"stages,omitempty"`
+	CurrentStage      int               `json:"currentStage,omitempty"`
 }
 
 func (j *AsyncJob) SetStatus(status string) {
 	j.mu.Lock()
-	j.Status = status
+	if j.Status != "cancelled" {
+		j.Status = status
+	}
 	j.mu.Unlock()
 }
 
 func (j *AsyncJob) SetProgress(progress float64) {
 	j.mu.Lock()
-	j.Progress = progress
+	if j.Status != "cancelled" {
+		j.Progress = progress
+	}
 	j.mu.Unlock()
 }
 
 func (j *AsyncJob) SetMessage(message string) {
 	j.mu.Lock()
-	j.Message = message
+	if j.Status != "cancelled" {
+		j.Message = message
+	}
 	j.mu.Unlock()
 }
 
 func (j *AsyncJob) SetProgressAndMessage(progress float64, message string) {
 	j.mu.Lock()
-	j.Progress = progress
-	j.Message = message
+	if j.Status != "cancelled" {
+		j.Progress = progress
+		j.Message = message
+	}
 	j.mu.Unlock()
 }
 
 func (j *AsyncJob) SetError(errMsg string) {
 	j.mu.Lock()
-	j.Status = "error"
-	j.Error = errMsg
+	if j.Status != "cancelled" {
+		j.Status = "error"
+		j.Error = errMsg
+	}
 	j.mu.Unlock()
 }
 
 func (j *AsyncJob) SetComplete(outputPath, outputFilename, mimeType string) {
 	j.mu.Lock()
-	j.Status = "complete"
-	j.Progress = 100
-	j.OutputPath = outputPath
-	j.OutputFilename = outputFilename
-	j.MimeType = mimeType
+	if j.Status != "cancelled" {
+		j.Status = "complete"
+		j.Progress = 100
+		j.OutputPath = outputPath
+		j.OutputFilename = outputFilename
+		j.MimeType = mimeType
+	}
 	j.mu.Unlock()
 }
 
@@ -173,6 +204,28 @@ func (j *AsyncJob) SetTextContent(content string) {
 	j.mu.Unlock()
 }
 
+// Cancel marks a job cancelled wherever it's got to, reporting false if
+// it had already finished. The setters above leave a cancelled job as it
+// is, and a process registered for it later starts out cancelled, so a
+// job cancelled between steps or while still setting up stops at its
+// next one.
+func (j *AsyncJob) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if isFinishedStatus(j.Status) {
+		return false
+	}
+	j.Status = "cancelled"
+	j.Message = "Cancelled"
+	return true
+}
+
+func (j *AsyncJob) IsCancelled() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.Status == "cancelled"
+}
+
 func (j *AsyncJob) GetStatus() (status string, progress float64, message string, errMsg string, textContent string) {
 	j.mu.RLock()
 	status = j.Status
@@ -219,6 +272,7 @@ func (j *AsyncJob) GetPlaylistStatus() map[string]interface{} {
 		"fileSize":          j.FileSize,
 		"speed":             j.Speed,
 		"eta":               j.ETA,
+		"resumeFrom":        j.ResumeFrom,
 	}
 }
 
@@ -247,7 +301,38 @@ func (j *AsyncJob) GetBotStatus() map[string]interface{} {
 		"failedVideos":    fv,
 		"playlistInfo":    j.PlaylistInfo,
 		"outputFilename":  j.OutputFilename,
+		"resumeFrom":      j.ResumeFrom,
+	}
+}
+
+// GetJobStatus is the bot status plus the fields the other job kinds
+// report, so one shape works for every job type.
+func (j *AsyncJob) GetJobStatus() map[string]interface{} {
+	status := j.GetBotStatus()
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	status["type"] = j.Type
+	status["createdAt"] = j.CreatedAt
+	status["playlistTitle"] = j.PlaylistTitle
+	status["currentVideoTitle"] = j.CurrentVideoTitle
+	status["failedCount"] = j.FailedCount
+	status["hasResult"] = j.Status == "complete" && (j.DownloadToken != "" || j.OutputPath != "")
+	if j.CallbackURL != "" {
+		deliveries := make([]WebhookDelivery, len(j.WebhookDeliveries))
+		copy(deliveries, j.WebhookDeliveries)
+		status["webhookStatus"] = j.WebhookStatus
+		status["webhookDeliveries"] = deliveries
+	}
+	if len(j.Stages) > 0 {
+		stages := make([]PipelineStage, len(j.Stages))
+		copy(stages, j.Stages)
+		status["stages"] = stages
+		status["currentStage"] = j.CurrentStage
 	}
+	if j.TextContent != "" {
+		status["textContent"] = j.TextContent
+	}
+	return status
 }
 
 func (j *AsyncJob) Lock() {
@@ -260,6 +345,7 @@ func (j *AsyncJob) Unlock() {
 
 type BotDownload struct {
 	FilePath      string
+	StorageKey    string
 	FileName      string
 	FileSize      int64
 	MimeType      string
@@ -267,6 +353,18 @@ type BotDownload struct {
 	Downloaded    bool
 	IsWebPlaylist bool
 	IsPlaylist    bool
+	IsWebDownload bool
+}
+
+// Expiry is how long the token stays valid after CreatedAt.
+func (dl *BotDownload) Expiry() time.Duration {
+	switch {
+	case dl.IsPlaylist || dl.IsWebPlaylist:
+		return config.PlaylistDownloadExp
+	case dl.IsWebDownload:
+		return config.WebDownloadExpiry
+	}
+	return config.BotDownloadExpiry
 }
 
 type ChunkedUpload struct {
@@ -319,12 +417,6 @@ func (dw *DownloadWriter) WriteKeepAlive() {
 	dw.Flusher.Flush()
 }
 
-type ResumedJob struct {
-	Progress          float64
-	ClientReconnected bool
-	Response          http.ResponseWriter
-}
-
 type PendingJob struct {
 	Type      string
 	URL       string
@@ -343,12 +435,22 @@ type State struct {
 	muProcesses     sync.Mutex
 	activeProcesses map[string]*ProcessInfo
 
-	muJobs     sync.Mutex
-	jobsByType map[string]int
+	muJobs       sync.Mutex
+	jobsByType   map[string]int
+	queues       map[string][]*queuedJob
+	jobDurations map[string]time.Duration
+	fair         map[string]*fairLane
+	draining     bool
+	drainExempt  map[string]bool
+	resources    resourceSample
+
+	diskReservations map[string]*DiskReservation
 
-	muSessions  sync.Mutex
-	sessions    map[string]*ClientSession
-	jobToClient map[string]string
+	// backend holds sessions and job ownership, and when shared is set,
+	// copies of the records below and the messages other replicas need.
+	backend     StateBackend
+	shared      bool
+	stopSharing context.CancelFunc
 
 	muAsync   sync.RWMutex
 	asyncJobs map[string]*AsyncJob
@@ -362,14 +464,31 @@ type State struct {
 	muResumed   sync.Mutex
 	resumedJobs map[string]*ResumedJob
 
+	muLinks   sync.Mutex
+	keptLinks map[string]bool
+
 	muChunked      sync.Mutex
 	chunkedUploads map[string]*ChunkedUpload
 
 	muProgress     sync.Mutex
 	lastLoggedProg map[string]float64
+	lastProgress   map[string]float64
 
 	muFileRefs sync.Mutex
 	fileRefs   map[string]*FileRef
+
+	muSigned     sync.Mutex
+	signedTokens map[string]*signedTokenUse
+
+	muKeys   sync.Mutex
+	apiKeys  map[string]*APIKey
+	keyUsage map[string]*APIKeyUsage
+
+	store        *jobStore
+	stopFlushing context.CancelFunc
+
+	webhooksStop     chan struct{}
+	stopWebhooksOnce sync.Once
 }
 
 type FileRef struct {
@@ -387,39 +506,66 @@ func init() {
 		jobsByType: map[string]int{
 			"download":   0,
 			"playlist":   0,
+			"batch":      0,
 			"convert":    0,
 			"compress":   0,
 			"transcribe": 0,
 			"fetchUrl":   0,
 		},
-		sessions:       make(map[string]*ClientSession),
-		jobToClient:    make(map[string]string),
+		queues:         make(map[string][]*queuedJob),
+		jobDurations:   make(map[string]time.Duration),
+		fair:           make(map[string]*fairLane),
+		backend:        newMemoryBackend(),
 		asyncJobs:      make(map[string]*AsyncJob),
 		botDownloads:   make(map[string]*BotDownload),
 		pendingJobs:    make(map[string]*PendingJob),
 		resumedJobs:    make(map[string]*ResumedJob),
+		keptLinks:      make(map[string]bool),
 		chunkedUploads: make(map[string]*ChunkedUpload),
 		lastLoggedProg: make(map[string]float64),
+		lastProgress:   make(map[string]float64),
 		fileRefs:       make(map[string]*FileRef),
+		signedTokens:   make(map[string]*signedTokenUse),
+		apiKeys:        make(map[string]*APIKey),
+		keyUsage:       make(map[string]*APIKeyUsage),
+		webhooksStop:   make(chan struct{}),
+
+		diskReservations: make(map[string]*DiskReservation),
 	}
+	metrics.NewGaugeFunc("yoink_disk_free_gb", "Free space on the temp dir's disk in GB.", getDiskSpaceGB)
 }
 
 func (s *State) SetFileRef(token string, ref *FileRef) {
 	s.muFileRefs.Lock()
 	s.fileRefs[token] = ref
 	s.muFileRefs.Unlock()
+	if s.store != nil {
+		s.store.put(tableFileRefs, token, ref)
+	}
+	s.share(tableFileRefs, token, ref)
 }
 
 func (s *State) GetFileRef(token string) *FileRef {
 	s.muFileRefs.Lock()
-	defer s.muFileRefs.Unlock()
-	return s.fileRefs[token]
+	ref := s.fileRefs[token]
+	s.muFileRefs.Unlock()
+	if ref == nil {
+		var shared FileRef
+		if s.sharedRecord(tableFileRefs, token, &shared) {
+			ref = &shared
+		}
+	}
+	return ref
 }
 
 func (s *State) DeleteFileRef(token string) {
 	s.muFileRefs.Lock()
 	delete(s.fileRefs, token)
 	s.muFileRefs.Unlock()
+	if s.store != nil {
+		s.store.remove(tableFileRefs, token)
+	}
+	s.unshare(tableFileRefs, token)
 }
 
 func (s *State) RegisterDownload(id string, w http.ResponseWriter, f http.Flusher) *DownloadWriter {
@@ -436,10 +582,22 @@ func (s *State) UnregisterDownload(id string) {
 	s.muDownloads.Unlock()
 }
 
+// SetProcess registers the process running a job. If the job was
+// cancelled before it got this far, the process starts out cancelled.
 func (s *State) SetProcess(id string, info *ProcessInfo) {
+	if info.startedAt.IsZero() {
+		info.startedAt = time.Now()
+	}
 	s.muProcesses.Lock()
 	s.activeProcesses[id] = info
 	s.muProcesses.Unlock()
+
+	if job := s.GetAsyncJob(id); job != nil && job.IsCancelled() {
+		info.SetCancelled(true)
+		if info.CancelFunc != nil {
+			info.CancelFunc()
+		}
+	}
 }
 
 func (s *State) GetProcess(id string) *ProcessInfo {
@@ -459,30 +617,27 @@ type JobCheck struct {
 	Reason string
 }
 
-func (s *State) CanStartJob(jobType string) JobCheck {
-	s.muJobs.Lock()
-	defer s.muJobs.Unlock()
-
-	limit, exists := config.JobLimits[jobType]
-	if exists && s.jobsByType[jobType] >= limit {
-		return JobCheck{false, fmt.Sprintf("server is busy, too many %s jobs are running right now (limit: %d)", jobType, limit)}
-	}
-
-	availGB := getDiskSpaceGB()
-	if availGB < float64(config.DiskSpaceMinGB) {
-		return JobCheck{false, fmt.Sprintf("Low disk space (%.1fGB free, need %dGB)", availGB, config.DiskSpaceMinGB)}
-	}
-
-	s.jobsByType[jobType]++
-	return JobCheck{true, ""}
-}
-
 func (s *State) DecrementJob(jobType string) {
 	s.muJobs.Lock()
 	if s.jobsByType[jobType] > 0 {
 		s.jobsByType[jobType]--
+		metrics.JobsFinished.Inc(jobType)
+	}
+	if resourceAdmission() {
+		admitted := s.admitAllLocked()
+		s.muJobs.Unlock()
+		for _, t := range admitted {
+			s.announceQueue(t)
+		}
+		return
 	}
+	admitted := s.admitQueuedLocked(jobType)
+	waiting := len(s.queues[jobType])
 	s.muJobs.Unlock()
+
+	if admitted > 0 && waiting > 0 {
+		s.announceQueue(jobType)
+	}
 }
 
 func (s *State) GetQueueStatus() map[string]interface{} {
@@ -491,13 +646,29 @@ func (s *State) GetQueueStatus() map[string]interface{} {
 	for k, v := range s.jobsByType {
 		active[k] = v
 	}
+	queuedByType := make(map[string]int)
+	for k, lane := range s.queues {
+		if len(lane) > 0 {
+			queuedByType[k] = len(lane)
+		}
+	}
+	queued := s.queuedCountLocked()
+	scheduler := s.schedulerStatusLocked()
+	limits := config.Get().JobLimits
+	admission := s.resourceStatusLocked()
+	reserved := s.outstandingDiskLocked()
 	s.muJobs.Unlock()
 
 	return map[string]interface{}{
-		"active":      active,
-		"queued":      0,
-		"limits":      config.JobLimits,
-		"diskSpaceGB": getDiskSpaceGB(),
+		"active":       active,
+		"queued":       queued,
+		"queuedByType": queuedByType,
+		"maxQueueSize": config.Get().MaxQueueSize,
+		"limits":       limits,
+		"scheduler":    scheduler,
+		"admission":    admission,
+		"diskSpaceGB":  getDiskSpaceGB(),
+		"reservedGB":   math.Round(float64(reserved)/(1<<30)*100) / 100,
 	}
 }
 
@@ -512,149 +683,145 @@ func (s *State) GetJobsByType() map[string]int {
 }
 
 func (s *State) RegisterClient(clientID string) {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-
-	if _, exists := s.sessions[clientID]; !exists {
-		s.sessions[clientID] = &ClientSession{
-			LastHeartbeat: time.Now(),
-			LastActivity:  time.Now(),
-			ActiveJobs:    make(map[string]bool),
-			SkipHeartbeat: strings.HasPrefix(clientID, "ip:"),
-		}
-		short := clientID
-		if len(short) > 8 {
-			short = short[:8]
-		}
-		log.Printf("[Session] Client %s... connected", short)
-	} else {
-		s.sessions[clientID].LastActivity = time.Now()
+	if s.backend.RegisterClient(clientID) {
+		logClientConnected(clientID)
 	}
 }
 
-func (s *State) UpdateHeartbeat(clientID string) bool {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	session, exists := s.sessions[clientID]
-	if !exists {
-		return false
+func logClientConnected(clientID string) {
+	short := clientID
+	if len(short) > 8 {
+		short = short[:8]
 	}
-	session.LastHeartbeat = time.Now()
-	return true
+	log.Printf("[Session] Client %s... connected", short)
 }
 
-func (s *State) GetClientSession(clientID string) *ClientSession {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	return s.sessions[clientID]
+func (s *State) UpdateHeartbeat(clientID string) bool {
+	return s.backend.Heartbeat(clientID)
 }
 
 func (s *State) LinkJobToClient(jobID, clientID string) {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	session, exists := s.sessions[clientID]
-	if !exists || clientID == "" {
+	if clientID == "" {
 		return
 	}
-	session.ActiveJobs[jobID] = true
-	session.LastActivity = time.Now()
-	s.jobToClient[jobID] = clientID
+	s.backend.LinkJob(jobID, clientID)
 }
 
 func (s *State) TryReserveClientJob(jobID, clientID string, maxJobs int) bool {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
 	if clientID == "" {
 		return false
 	}
-	session, exists := s.sessions[clientID]
-	if !exists {
-		session = &ClientSession{
-			LastHeartbeat: time.Now(),
-			LastActivity:  time.Now(),
-			ActiveJobs:    make(map[string]bool),
-			SkipHeartbeat: strings.HasPrefix(clientID, "ip:"),
-		}
-		s.sessions[clientID] = session
-		short := clientID
-		if len(short) > 8 {
-			short = short[:8]
-		}
-		log.Printf("[Session] Client %s... connected", short)
-	}
-	if len(session.ActiveJobs) >= maxJobs {
-		return false
+	ok, created := s.backend.ReserveJob(jobID, clientID, maxJobs)
+	if created {
+		logClientConnected(clientID)
 	}
-	session.ActiveJobs[jobID] = true
-	session.LastActivity = time.Now()
-	s.jobToClient[jobID] = clientID
-	return true
+	return ok
 }
 
 func (s *State) GetJobOwner(jobID string) string {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	return s.jobToClient[jobID]
+	return s.backend.JobOwner(jobID)
 }
 
 func (s *State) UnlinkJobFromClient(jobID string) {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	clientID, exists := s.jobToClient[jobID]
-	if !exists {
+	s.muLinks.Lock()
+	kept := s.keptLinks[jobID]
+	s.muLinks.Unlock()
+	if kept {
 		return
 	}
-	if session, ok := s.sessions[clientID]; ok {
-		delete(session.ActiveJobs, jobID)
-		session.LastActivity = time.Now()
+	s.backend.UnlinkJob(jobID)
+}
+
+// KeepJobLinked keeps a job linked to its client through anything that
+// would unlink it, for a job made of steps that each run like a job of
+// their own, until the returned func lets it go and unlinks it.
+func (s *State) KeepJobLinked(jobID string) func() {
+	s.muLinks.Lock()
+	s.keptLinks[jobID] = true
+	s.muLinks.Unlock()
+	return func() {
+		s.muLinks.Lock()
+		delete(s.keptLinks, jobID)
+		s.muLinks.Unlock()
+		s.backend.UnlinkJob(jobID)
 	}
-	delete(s.jobToClient, jobID)
 }
 
 func (s *State) GetClientJobCount(clientID string) int {
-	s.muSessions.Lock()
-	defer s.muSessions.Unlock()
-	session, exists := s.sessions[clientID]
-	if !exists {
-		return 0
-	}
-	return len(session.ActiveJobs)
+	jobIDs, _ := s.backend.ClientJobs(clientID)
+	return len(jobIDs)
 }
 
 func (s *State) SetAsyncJob(id string, job *AsyncJob) {
 	s.muAsync.Lock()
 	s.asyncJobs[id] = job
 	s.muAsync.Unlock()
+	if s.store != nil || s.shared {
+		rec := job.record()
+		if s.store != nil {
+			s.store.put(tableAsyncJobs, id, rec)
+		}
+		s.share(tableAsyncJobs, id, rec)
+	}
 }
 
+// GetAsyncJob returns the job if it runs here, or otherwise a snapshot of
+// it from the replica running it. Changes to a snapshot aren't seen by
+// anyone else.
 func (s *State) GetAsyncJob(id string) *AsyncJob {
 	s.muAsync.RLock()
-	defer s.muAsync.RUnlock()
-	return s.asyncJobs[id]
+	job := s.asyncJobs[id]
+	s.muAsync.RUnlock()
+	if job == nil {
+		var rec asyncJobRecord
+		if s.sharedRecord(tableAsyncJobs, id, &rec) {
+			job = asyncJobFromRecord(rec)
+		}
+	}
+	return job
 }
 
 func (s *State) DeleteAsyncJob(id string) {
 	s.muAsync.Lock()
 	delete(s.asyncJobs, id)
 	s.muAsync.Unlock()
+	if s.store != nil {
+		s.store.remove(tableAsyncJobs, id)
+	}
+	s.unshare(tableAsyncJobs, id)
 }
 
 func (s *State) SetBotDownload(token string, dl *BotDownload) {
 	s.muBot.Lock()
 	s.botDownloads[token] = dl
 	s.muBot.Unlock()
+	if s.store != nil {
+		s.store.put(tableBotDownloads, token, dl)
+	}
+	s.share(tableBotDownloads, token, dl)
 }
 
 func (s *State) GetBotDownload(token string) *BotDownload {
 	s.muBot.RLock()
-	defer s.muBot.RUnlock()
-	return s.botDownloads[token]
+	dl := s.botDownloads[token]
+	s.muBot.RUnlock()
+	if dl == nil {
+		var shared BotDownload
+		if s.sharedRecord(tableBotDownloads, token, &shared) {
+			dl = &shared
+		}
+	}
+	return dl
 }
 
 func (s *State) DeleteBotDownload(token string) {
 	s.muBot.Lock()
 	delete(s.botDownloads, token)
 	s.muBot.Unlock()
+	if s.store != nil {
+		s.store.remove(tableBotDownloads, token)
+	}
+	s.unshare(tableBotDownloads, token)
 }
 
 func (s *State) ForEachBotDownload(fn func(token string, dl *BotDownload) bool) {
@@ -663,6 +830,10 @@ func (s *State) ForEachBotDownload(fn func(token string, dl *BotDownload) bool)
 	for token, dl := range s.botDownloads {
 		if fn(token, dl) {
 			delete(s.botDownloads, token)
+			if s.store != nil {
+				s.store.remove(tableBotDownloads, token)
+			}
+			s.unshare(tableBotDownloads, token)
 		}
 	}
 }
@@ -673,6 +844,10 @@ func (s *State) RegisterPendingJob(jobID string, job *PendingJob) {
 	job.Resumable = true
 	s.pendingJobs[jobID] = job
 	s.muPending.Unlock()
+	if s.store != nil {
+		s.store.put(tablePendingJobs, jobID, job)
+	}
+	s.share(tablePendingJobs, jobID, job)
 }
 
 func (s *State) UpdatePendingJob(jobID string, progress float64, status string) {
@@ -690,6 +865,10 @@ func (s *State) RemovePendingJob(jobID string) {
 	s.muPending.Lock()
 	delete(s.pendingJobs, jobID)
 	s.muPending.Unlock()
+	if s.store != nil {
+		s.store.remove(tablePendingJobs, jobID)
+	}
+	s.unshare(tablePendingJobs, jobID)
 }
 
 func (s *State) GetResumedJob(id string) *ResumedJob {
@@ -779,6 +958,8 @@ func (s *State) SendProgress(downloadID, stage, message string, progress *float6
 
 	if dw != nil {
 		dw.Write(jsonBytes)
+	} else if s.shared {
+		s.backend.Publish(progressChannel(downloadID), jsonBytes)
 	}
 
 	s.muProgress.Lock()
@@ -791,6 +972,7 @@ func (s *State) SendProgress(downloadID, stage, message string, progress *float6
 	}
 
 	if isProgressMsg {
+		s.lastProgress[downloadID] = *progress
 		if *progress >= 100 || *progress-lastProg >= 25 {
 			log.Printf("[%s] %s: %s", short, stage, message)
 			s.lastLoggedProg[downloadID] = *progress
@@ -820,6 +1002,11 @@ func (s *State) ReleaseJob(jobID string) bool {
 	s.muProcesses.Unlock()
 
 	if processInfo.JobType != "" {
+		if !processInfo.startedAt.IsZero() {
+			d := time.Since(processInfo.startedAt)
+			s.recordJobDuration(processInfo.JobType, d)
+			metrics.JobDuration.Observe(d.Seconds(), processInfo.JobType)
+		}
 		s.DecrementJob(processInfo.JobType)
 	}
 	s.RemovePendingJob(jobID)
@@ -827,101 +1014,87 @@ func (s *State) ReleaseJob(jobID string) bool {
 
 	s.muProgress.Lock()
 	delete(s.lastLoggedProg, jobID)
+	delete(s.lastProgress, jobID)
 	s.muProgress.Unlock()
 
 	return true
 }
 
-type sessionCleanupAction struct {
-	clientID string
-	jobIDs   []string
-	idle     bool
-}
-
 func (s *State) StartSessionCleanup(cleanupJobFiles func(string)) {
+	if s.shared {
+		lost := s.backend.Subscribe(context.Background(), lostJobsChannel)
+		go func() {
+			for data := range lost {
+				jobID := string(data)
+				if s.GetProcess(jobID) != nil || s.isDetached(jobID) {
+					s.dropLostJob(jobID, cleanupJobFiles)
+				}
+			}
+		}()
+	}
+
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
 		for range ticker.C {
-			var actions []sessionCleanupAction
-
-			s.muSessions.Lock()
-			now := time.Now()
-			for clientID, session := range s.sessions {
-				hasActive := len(session.ActiveJobs) > 0
-
-				if hasActive && !session.SkipHeartbeat && now.Sub(session.LastHeartbeat) > config.HeartbeatTimeout {
-					short := clientID
-					if len(short) > 8 {
-						short = short[:8]
-					}
-					log.Printf("[Session] Client %s... heartbeat timeout, cancelling %d jobs", short, len(session.ActiveJobs))
-
-					var jobIDs []string
-					for jobID := range session.ActiveJobs {
-						jobIDs = append(jobIDs, jobID)
-					}
-					actions = append(actions, sessionCleanupAction{clientID: clientID, jobIDs: jobIDs})
-					delete(s.sessions, clientID)
-
-				} else if !hasActive && now.Sub(session.LastActivity) > config.SessionIdleTimeout {
-					short := clientID
-					if len(short) > 8 {
-						short = short[:8]
-					}
-					log.Printf("[Session] Client %s... idle timeout", short)
-					actions = append(actions, sessionCleanupAction{clientID: clientID, idle: true})
-					delete(s.sessions, clientID)
+			for _, expired := range s.backend.ExpireSessions(time.Now()) {
+				short := expired.ClientID
+				if len(short) > 8 {
+					short = short[:8]
 				}
-			}
-			s.muSessions.Unlock()
-
-			for _, action := range actions {
-				if action.idle {
+				if expired.Idle {
+					log.Printf("[Session] Client %s... idle timeout", short)
 					continue
 				}
-				for _, jobID := range action.jobIDs {
-					aj := s.GetAsyncJob(jobID)
-					if aj != nil && aj.Type == "playlist" {
-						s.muSessions.Lock()
-						delete(s.jobToClient, jobID)
-						s.muSessions.Unlock()
-						continue
-					}
-
-					pi := s.GetProcess(jobID)
-					if pi != nil {
-						pi.SetCancelled(true)
-						pi.SignalProcess(syscall.SIGTERM)
-						if pi.CancelFunc != nil {
-							pi.CancelFunc()
-						}
-						s.SendProgressSimple(jobID, "cancelled", "Connection lost - task cancelled")
-					}
-
-					var jobType string
-					s.muProcesses.Lock()
-					if procInfo, ok := s.activeProcesses[jobID]; ok {
-						jobType = procInfo.JobType
-						delete(s.activeProcesses, jobID)
-					}
-					s.muProcesses.Unlock()
-					if jobType != "" {
-						s.DecrementJob(jobType)
-					}
-
-					s.RemovePendingJob(jobID)
-
-					s.muSessions.Lock()
-					delete(s.jobToClient, jobID)
-					s.muSessions.Unlock()
-
-					cleanupJobFiles(jobID)
+				log.Printf("[Session] Client %s... heartbeat timeout, cancelling %d jobs", short, len(expired.JobIDs))
+				for _, jobID := range expired.JobIDs {
+					s.dropLostJob(jobID, cleanupJobFiles)
 				}
 			}
 		}
 	}()
 }
 
+// dropLostJob cancels a job whose client stopped sending heartbeats.
+// Playlists and detached downloads keep going. A job running on another
+// replica is handed to it.
+func (s *State) dropLostJob(jobID string, cleanupJobFiles func(string)) {
+	aj := s.GetAsyncJob(jobID)
+	if (aj != nil && aj.Type == "playlist") || s.isDetached(jobID) {
+		s.UnlinkJobFromClient(jobID)
+		return
+	}
+
+	pi := s.GetProcess(jobID)
+	if pi == nil && s.shared {
+		s.UnlinkJobFromClient(jobID)
+		s.backend.Publish(lostJobsChannel, []byte(jobID))
+		return
+	}
+	if pi != nil {
+		pi.SetCancelled(true)
+		pi.SignalProcess(syscall.SIGTERM)
+		if pi.CancelFunc != nil {
+			pi.CancelFunc()
+		}
+		s.SendProgressSimple(jobID, "cancelled", "Connection lost - task cancelled")
+	}
+
+	var jobType string
+	s.muProcesses.Lock()
+	if procInfo, ok := s.activeProcesses[jobID]; ok {
+		jobType = procInfo.JobType
+		delete(s.activeProcesses, jobID)
+	}
+	s.muProcesses.Unlock()
+	if jobType != "" {
+		s.DecrementJob(jobType)
+	}
+
+	s.RemovePendingJob(jobID)
+	s.UnlinkJobFromClient(jobID)
+	cleanupJobFiles(jobID)
+}
+
 func (s *State) StartCounterReconciliation() {
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
@@ -937,12 +1110,17 @@ func (s *State) StartCounterReconciliation() {
 
 			s.muJobs.Lock()
 			leaked := false
+			var readmitted []string
 			for t, count := range s.jobsByType {
 				actual := actualCounts[t]
 				if count > actual {
 					log.Printf("[Queue] Counter leak detected: %s=%d but only %d active processes. Correcting.", t, count, actual)
+					metrics.CounterLeaks.Add(float64(count-actual), t)
 					s.jobsByType[t] = actual
 					leaked = true
+					if s.admitQueuedLocked(t) > 0 {
+						readmitted = append(readmitted, t)
+					}
 				}
 			}
 			if leaked {
@@ -950,6 +1128,10 @@ func (s *State) StartCounterReconciliation() {
 				log.Printf("[Queue] Counters corrected: %s", string(b))
 			}
 			s.muJobs.Unlock()
+
+			for _, t := range readmitted {
+				s.announceQueue(t)
+			}
 		}
 	}()
 }
@@ -961,7 +1143,7 @@ func (s *State) StartAsyncJobExpiry() {
 			s.muAsync.Lock()
 			now := time.Now()
 			for id, job := range s.asyncJobs {
-				timeout := config.AsyncJobTimeout
+				timeout := config.Get().AsyncJobTimeout
 				if job.Type == "playlist" {
 					timeout = config.PlaylistDownloadExp
 				}
@@ -973,6 +1155,10 @@ func (s *State) StartAsyncJobExpiry() {
 					status, _, _, _, _ := job.GetStatus()
 					log.Printf("[Bot] Job %s... expired (%s)", short, status)
 					delete(s.asyncJobs, id)
+					if s.store != nil {
+						s.store.remove(tableAsyncJobs, id)
+					}
+					s.unshare(tableAsyncJobs, id)
 				}
 			}
 			s.muAsync.Unlock()
@@ -3,6 +3,9 @@ package services
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
 )
 
 func newTestState() *State {
@@ -10,18 +13,36 @@ func newTestState() *State {
 		activeDownloads: make(map[string]*DownloadWriter),
 		activeProcesses: make(map[string]*ProcessInfo),
 		jobsByType:      make(map[string]int),
-		sessions:        make(map[string]*ClientSession),
-		jobToClient:     make(map[string]string),
+		queues:          make(map[string][]*queuedJob),
+		jobDurations:    make(map[string]time.Duration),
+		fair:            make(map[string]*fairLane),
+		backend:         newMemoryBackend(),
 		asyncJobs:       make(map[string]*AsyncJob),
 		botDownloads:    make(map[string]*BotDownload),
 		pendingJobs:     make(map[string]*PendingJob),
 		resumedJobs:     make(map[string]*ResumedJob),
+		keptLinks:       make(map[string]bool),
 		chunkedUploads:  make(map[string]*ChunkedUpload),
 		lastLoggedProg:  make(map[string]float64),
+		lastProgress:    make(map[string]float64),
 		fileRefs:        make(map[string]*FileRef),
+		signedTokens:    make(map[string]*signedTokenUse),
+		apiKeys:         make(map[string]*APIKey),
+		keyUsage:        make(map[string]*APIKeyUsage),
+		webhooksStop:    make(chan struct{}),
+
+		diskReservations: make(map[string]*DiskReservation),
 	}
 }
 
+// useSettings applies change to the settings in effect until t ends.
+func useSettings(t *testing.T, change func(s *config.Settings)) {
+	t.Helper()
+	prev := config.Current()
+	t.Cleanup(func() { config.Update(func(s *config.Settings) { *s = prev }) })
+	config.Update(change)
+}
+
 func TestTryReserveClientJobCapsPerClient(t *testing.T) {
 	state := newTestState()
 	clientID := "client-1"
@@ -49,3 +70,49 @@ func TestTryReserveClientJobCapsPerClient(t *testing.T) {
 		t.Fatal("reservation after release was rejected")
 	}
 }
+
+func TestKeptJobStaysLinkedBetweenSteps(t *testing.T) {
+	state := newTestState()
+	if !state.TryReserveClientJob("pipeline-1", "client-1", 1) {
+		t.Fatal("reservation rejected")
+	}
+	release := state.KeepJobLinked("pipeline-1")
+
+	state.SetProcess("pipeline-1", &ProcessInfo{})
+	state.ReleaseJob("pipeline-1")
+	state.UnlinkJobFromClient("pipeline-1")
+	if state.TryReserveClientJob("job-2", "client-1", 1) {
+		t.Fatal("a step finishing freed the pipeline's place in the client's job budget")
+	}
+
+	release()
+	if count := state.GetClientJobCount("client-1"); count != 0 {
+		t.Fatalf("client job count = %d after letting go, want 0", count)
+	}
+}
+
+func TestCancelledJobStaysCancelled(t *testing.T) {
+	state := newTestState()
+	job := &AsyncJob{Status: "processing"}
+	state.SetAsyncJob("job-1", job)
+
+	if !job.Cancel() {
+		t.Fatal("cancelling a running job was refused")
+	}
+	job.SetProgressAndMessage(50, "Converting...")
+	job.SetError("boom")
+	job.SetComplete("/tmp/out.mp4", "out.mp4", "video/mp4")
+	if status, _, message, _, _ := job.GetStatus(); status != "cancelled" || message != "Cancelled" {
+		t.Fatalf("status = %q (%q) after the worker carried on, want cancelled", status, message)
+	}
+	if job.Cancel() {
+		t.Fatal("cancelling a finished job was allowed")
+	}
+
+	stopped := false
+	info := &ProcessInfo{CancelFunc: func() { stopped = true }}
+	state.SetProcess("job-1", info)
+	if !info.IsCancelled() || !stopped {
+		t.Fatal("a process registered for a cancelled job wasn't cancelled")
+	}
+}
@@ -0,0 +1,467 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+const (
+	tableAsyncJobs    = "async_jobs"
+	tableBotDownloads = "bot_downloads"
+	tableFileRefs     = "file_refs"
+	tablePendingJobs  = "pending_jobs"
+	tableSignedTokens = "signed_tokens"
+	tableAPIKeys      = "api_keys"
+	tableAPIKeyUsage  = "api_key_usage"
+)
+
+type jobStore struct {
+	db *sql.DB
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func openJobStore(path string) (*jobStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %w", err)
+	}
+
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("enable WAL: %w", err)
+	}
+	if _, err := db.Exec("PRAGMA busy_timeout=5000"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("set busy timeout: %w", err)
+	}
+
+	for _, table := range []string{tableAsyncJobs, tableBotDownloads, tableFileRefs, tablePendingJobs, tableSignedTokens, tableAPIKeys, tableAPIKeyUsage} {
+		stmt := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			key TEXT PRIMARY KEY,
+			data TEXT NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`, table)
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("create %s: %w", table, err)
+		}
+	}
+
+	return &jobStore{db: db}, nil
+}
+
+func (js *jobStore) put(table, key string, v interface{}) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if js.closed {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[Store] Failed to encode %s/%s: %v", table, key, err)
+		return
+	}
+	_, err = js.db.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (key, data, updated_at) VALUES (?, ?, ?)", table),
+		key, string(data), time.Now().Unix())
+	if err != nil {
+		log.Printf("[Store] Failed to save %s/%s: %v", table, key, err)
+	}
+}
+
+func (js *jobStore) remove(table, key string) {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	if js.closed {
+		return
+	}
+	if _, err := js.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = ?", table), key); err != nil {
+		log.Printf("[Store] Failed to delete %s/%s: %v", table, key, err)
+	}
+}
+
+// close stops all further writes, so whatever was last flushed is what
+// the next start restores.
+func (js *jobStore) close() {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.closed {
+		return
+	}
+	js.closed = true
+	js.db.Close()
+}
+
+func (js *jobStore) loadAll(table string) (map[string][]byte, error) {
+	rows, err := js.db.Query(fmt.Sprintf("SELECT key, data FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string][]byte)
+	for rows.Next() {
+		var key, data string
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+		out[key] = []byte(data)
+	}
+	return out, rows.Err()
+}
+
+// asyncJobRecord is the persisted form of an AsyncJob. It includes the
+// fields AsyncJob hides from API responses (output path, mime type, age).
+type asyncJobRecord struct {
+	Status            string            `json:"status"`
+	Progress          float64           `json:"progress"`
+	Message           string            `json:"message"`
+	CreatedAt         time.Time         `json:"createdAt"`
+	Type              string            `json:"type"`
+	URL               string            `json:"url"`
+	Format            string            `json:"format"`
+	OutputPath        string            `json:"outputPath"`
+	OutputFilename    string            `json:"outputFilename"`
+	MimeType          string            `json:"mimeType"`
+	TextContent       string            `json:"textContent"`
+	Error             string            `json:"error"`
+	DownloadToken     string            `json:"downloadToken"`
+	FileName          string            `json:"fileName"`
+	FileSize          int64             `json:"fileSize"`
+	PlaylistTitle     string            `json:"playlistTitle"`
+	TotalVideos       int               `json:"totalVideos"`
+	StartVideo        int               `json:"startVideo"`
+	VideosCompleted   int               `json:"videosCompleted"`
+	CurrentVideo      int               `json:"currentVideo"`
+	CurrentVideoTitle string            `json:"currentVideoTitle"`
+	FailedVideos      []FailedVideo     `json:"failedVideos"`
+	FailedCount       int               `json:"failedCount"`
+	ResumeFrom        int               `json:"resumeFrom"`
+	PlaylistInfo      json.RawMessage   `json:"playlistInfo,omitempty"`
+	CallbackURL       string            `json:"callbackUrl,omitempty"`
+	WebhookStatus     string            `json:"webhookStatus,omitempty"`
+	WebhookDeliveries []WebhookDelivery `json:"webhookDeliveries,omitempty"`
+	Stages            []PipelineStage   `json:"stages,omitempty"`
+	CurrentStage      int               `json:"currentStage,omitempty"`
+}
+
+func (j *AsyncJob) record() asyncJobRecord {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	rec := asyncJobRecord{
+		Status:            j.Status,
+		Progress:          j.Progress,
+		Message:           j.Message,
+		CreatedAt:         j.CreatedAt,
+		Type:              j.Type,
+		URL:               j.URL,
+		Format:            j.Format,
+		OutputPath:        j.OutputPath,
+		OutputFilename:    j.OutputFilename,
+		MimeType:          j.MimeType,
+		TextContent:       j.TextContent,
+		Error:             j.Error,
+		DownloadToken:     j.DownloadToken,
+		FileName:          j.FileName,
+		FileSize:          j.FileSize,
+		PlaylistTitle:     j.PlaylistTitle,
+		TotalVideos:       j.TotalVideos,
+		StartVideo:        j.StartVideo,
+		VideosCompleted:   j.VideosCompleted,
+		CurrentVideo:      j.CurrentVideo,
+		CurrentVideoTitle: j.CurrentVideoTitle,
+		FailedVideos:      j.FailedVideos,
+		FailedCount:       j.FailedCount,
+		ResumeFrom:        j.ResumeFrom,
+		CallbackURL:       j.CallbackURL,
+		WebhookStatus:     j.WebhookStatus,
+		WebhookDeliveries: j.WebhookDeliveries,
+		Stages:            j.Stages,
+		CurrentStage:      j.CurrentStage,
+	}
+	if j.PlaylistInfo != nil {
+		rec.PlaylistInfo, _ = json.Marshal(j.PlaylistInfo)
+	}
+	return rec
+}
+
+func asyncJobFromRecord(rec asyncJobRecord) *AsyncJob {
+	job := &AsyncJob{
+		Status:            rec.Status,
+		Progress:          rec.Progress,
+		Message:           rec.Message,
+		CreatedAt:         rec.CreatedAt,
+		Type:              rec.Type,
+		URL:               rec.URL,
+		Format:            rec.Format,
+		OutputPath:        rec.OutputPath,
+		OutputFilename:    rec.OutputFilename,
+		MimeType:          rec.MimeType,
+		TextContent:       rec.TextContent,
+		Error:             rec.Error,
+		DownloadToken:     rec.DownloadToken,
+		FileName:          rec.FileName,
+		FileSize:          rec.FileSize,
+		PlaylistTitle:     rec.PlaylistTitle,
+		TotalVideos:       rec.TotalVideos,
+		StartVideo:        rec.StartVideo,
+		VideosCompleted:   rec.VideosCompleted,
+		CurrentVideo:      rec.CurrentVideo,
+		CurrentVideoTitle: rec.CurrentVideoTitle,
+		FailedVideos:      rec.FailedVideos,
+		FailedCount:       rec.FailedCount,
+		ResumeFrom:        rec.ResumeFrom,
+		CallbackURL:       rec.CallbackURL,
+		WebhookStatus:     rec.WebhookStatus,
+		WebhookDeliveries: rec.WebhookDeliveries,
+		Stages:            rec.Stages,
+		CurrentStage:      rec.CurrentStage,
+	}
+	if len(rec.PlaylistInfo) > 0 {
+		var info interface{}
+		if json.Unmarshal(rec.PlaylistInfo, &info) == nil {
+			job.PlaylistInfo = info
+		}
+	}
+	return job
+}
+
+// OpenStore attaches a SQLite job store to the state. Async jobs, bot
+// download tokens, file refs and pending jobs are written through to it
+// so they can be restored with RestoreFromStore after a restart.
+func (s *State) OpenStore(path string) error {
+	store, err := openJobStore(path)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	log.Printf("[Store] Job store opened at %s", path)
+
+	ctx, stop := context.WithCancel(context.Background())
+	s.stopFlushing = stop
+	go s.syncAsyncJobs(ctx, 5*time.Second, func(id string, data []byte) {
+		store.put(tableAsyncJobs, id, json.RawMessage(data))
+	})
+	return nil
+}
+
+// FlushStore writes the current state of every async job to the store,
+// finished or not.
+func (s *State) FlushStore() {
+	if s.store == nil {
+		return
+	}
+	s.muAsync.RLock()
+	jobs := make(map[string]*AsyncJob, len(s.asyncJobs))
+	for id, job := range s.asyncJobs {
+		jobs[id] = job
+	}
+	s.muAsync.RUnlock()
+
+	for id, job := range jobs {
+		s.store.put(tableAsyncJobs, id, job.record())
+	}
+}
+
+func isFinishedStatus(status string) bool {
+	return status == "complete" || status == "error" || status == "cancelled" || status == "interrupted"
+}
+
+// RestoreFromStore loads persisted jobs and tokens back into memory.
+// Jobs that were still running when the server stopped come back as
+// "interrupted"; playlists record the video they can be resumed from.
+// The returned set holds every file path that is still referenced and
+// must survive temp dir cleanup.
+func (s *State) RestoreFromStore() map[string]bool {
+	keep := make(map[string]bool)
+	if s.store == nil {
+		return keep
+	}
+	now := time.Now()
+	var restoredJobs, restoredTokens, restoredRefs, interrupted int
+
+	botRows, err := s.store.loadAll(tableBotDownloads)
+	if err != nil {
+		log.Printf("[Store] Failed to load bot downloads: %v", err)
+	}
+	for token, data := range botRows {
+		var dl BotDownload
+		if err := json.Unmarshal(data, &dl); err != nil {
+			s.store.remove(tableBotDownloads, token)
+			continue
+		}
+		if now.Sub(dl.CreatedAt) > dl.Expiry() {
+			if !dl.IsLocal() {
+				DeleteOutput(&dl)
+			}
+			s.store.remove(tableBotDownloads, token)
+			continue
+		}
+		if _, err := os.Stat(dl.FilePath); err != nil && dl.IsLocal() {
+			s.store.remove(tableBotDownloads, token)
+			continue
+		}
+		s.muBot.Lock()
+		s.botDownloads[token] = &dl
+		s.muBot.Unlock()
+		s.share(tableBotDownloads, token, &dl)
+		keep[dl.FilePath] = true
+		restoredTokens++
+	}
+
+	refRows, err := s.store.loadAll(tableFileRefs)
+	if err != nil {
+		log.Printf("[Store] Failed to load file refs: %v", err)
+	}
+	for token, data := range refRows {
+		var ref FileRef
+		if err := json.Unmarshal(data, &ref); err != nil {
+			s.store.remove(tableFileRefs, token)
+			continue
+		}
+		if now.Sub(ref.CreatedAt) > config.Get().FileRetention {
+			s.store.remove(tableFileRefs, token)
+			continue
+		}
+		if _, err := os.Stat(ref.FilePath); err != nil {
+			s.store.remove(tableFileRefs, token)
+			continue
+		}
+		s.muFileRefs.Lock()
+		s.fileRefs[token] = &ref
+		s.muFileRefs.Unlock()
+		s.share(tableFileRefs, token, &ref)
+		keep[ref.FilePath] = true
+		restoredRefs++
+	}
+
+	jobRows, err := s.store.loadAll(tableAsyncJobs)
+	if err != nil {
+		log.Printf("[Store] Failed to load async jobs: %v", err)
+	}
+	for id, data := range jobRows {
+		var rec asyncJobRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			s.store.remove(tableAsyncJobs, id)
+			continue
+		}
+		timeout := config.Get().AsyncJobTimeout
+		if rec.Type == "playlist" {
+			timeout = config.PlaylistDownloadExp
+		}
+		if now.Sub(rec.CreatedAt) > timeout {
+			s.store.remove(tableAsyncJobs, id)
+			continue
+		}
+
+		job := asyncJobFromRecord(rec)
+		if !isFinishedStatus(job.Status) {
+			markInterrupted(job)
+			interrupted++
+		}
+		if job.Status == "complete" && job.OutputPath != "" {
+			if _, err := os.Stat(job.OutputPath); err == nil {
+				keep[job.OutputPath] = true
+			} else {
+				job.Status = "error"
+				job.Error = "Output file no longer available"
+			}
+		}
+
+		s.muAsync.Lock()
+		s.asyncJobs[id] = job
+		s.muAsync.Unlock()
+		rec = job.record()
+		s.store.put(tableAsyncJobs, id, rec)
+		s.share(tableAsyncJobs, id, rec)
+		restoredJobs++
+
+		if job.CallbackURL != "" && (job.WebhookStatus == "" || job.WebhookStatus == "pending") {
+			go s.watchCallback(id, job)
+		}
+	}
+
+	signedRows, err := s.store.loadAll(tableSignedTokens)
+	if err != nil {
+		log.Printf("[Store] Failed to load signed token uses: %v", err)
+	}
+	for id, data := range signedRows {
+		var use signedTokenUse
+		if err := json.Unmarshal(data, &use); err != nil || now.After(use.Expires) {
+			s.store.remove(tableSignedTokens, id)
+			continue
+		}
+		s.muSigned.Lock()
+		s.signedTokens[id] = &use
+		s.muSigned.Unlock()
+		s.share(tableSignedTokens, id, &use)
+	}
+
+	keyRows, err := s.store.loadAll(tableAPIKeys)
+	if err != nil {
+		log.Printf("[Store] Failed to load API keys: %v", err)
+	}
+	usageRows, _ := s.store.loadAll(tableAPIKeyUsage)
+	for id, data := range keyRows {
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			s.store.remove(tableAPIKeys, id)
+			continue
+		}
+		s.muKeys.Lock()
+		s.apiKeys[id] = &key
+		s.muKeys.Unlock()
+		s.share(tableAPIKeys, id, &key)
+
+		var usage APIKeyUsage
+		if json.Unmarshal(usageRows[id], &usage) == nil {
+			s.muKeys.Lock()
+			s.keyUsage[id] = &usage
+			s.muKeys.Unlock()
+			s.share(tableAPIKeyUsage, id, &usage)
+		}
+	}
+
+	pendingRows, err := s.store.loadAll(tablePendingJobs)
+	if err != nil {
+		log.Printf("[Store] Failed to load pending jobs: %v", err)
+	}
+	for id := range pendingRows {
+		s.store.remove(tablePendingJobs, id)
+	}
+
+	log.Printf("[Store] Restored %d jobs (%d interrupted), %d download tokens, %d file refs; dropped %d streaming jobs",
+		restoredJobs, interrupted, restoredTokens, restoredRefs, len(pendingRows))
+	return keep
+}
+
+func markInterrupted(job *AsyncJob) {
+	job.Status = "interrupted"
+	job.Speed = ""
+	job.ETA = ""
+	if job.Type == "playlist" {
+		resumeFrom := job.CurrentVideo
+		if resumeFrom < 1 {
+			resumeFrom = job.StartVideo
+		}
+		if resumeFrom < 1 {
+			resumeFrom = 1
+		}
+		job.ResumeFrom = resumeFrom
+		job.Message = fmt.Sprintf("interrupted, resumable from video %d", resumeFrom)
+	} else {
+		job.Message = "interrupted by a server restart, please try again"
+	}
+	job.Error = job.Message
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestoreFromStoreKeepsTokensAndInterruptsPlaylists(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "state.db")
+	zipPath := filepath.Join(dir, "done.zip")
+	if err := os.WriteFile(zipPath, []byte("zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before := newTestState()
+	if err := before.OpenStore(dbPath); err != nil {
+		t.Fatal(err)
+	}
+	before.SetBotDownload("tok", &BotDownload{FilePath: zipPath, FileName: "done.zip", CreatedAt: time.Now(), IsWebPlaylist: true})
+	before.SetAsyncJob("running", &AsyncJob{Status: "downloading", Type: "playlist", CreatedAt: time.Now(), StartVideo: 1, CurrentVideo: 7})
+	before.SetAsyncJob("done", &AsyncJob{Status: "complete", Type: "playlist", CreatedAt: time.Now(), DownloadToken: "tok"})
+
+	after := newTestState()
+	after.store = before.store
+	keep := after.RestoreFromStore()
+
+	if !keep[zipPath] {
+		t.Fatal("completed output was not kept")
+	}
+	if dl := after.GetBotDownload("tok"); dl == nil || dl.FilePath != zipPath {
+		t.Fatal("download token did not survive restore")
+	}
+	running := after.GetAsyncJob("running")
+	if running == nil {
+		t.Fatal("running job was not restored")
+	}
+	if running.Status != "interrupted" || running.ResumeFrom != 7 {
+		t.Fatalf("running job = %q resumeFrom %d, want interrupted from 7", running.Status, running.ResumeFrom)
+	}
+	if done := after.GetAsyncJob("done"); done == nil || done.Status != "complete" {
+		t.Fatal("completed job was not restored as complete")
+	}
+}
+
+func TestSyncAsyncJobsWritesOnlyChanges(t *testing.T) {
+	s := newTestState()
+	running := &AsyncJob{Status: "downloading", CreatedAt: time.Now()}
+	s.SetAsyncJob("running", running)
+	s.SetAsyncJob("done", &AsyncJob{Status: "complete", CreatedAt: time.Now()})
+
+	var mu sync.Mutex
+	writes := make(map[string]int)
+	count := func(id string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes[id]
+	}
+	waitFor := func(id string, n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for count(id) < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s written %d times, want %d", id, count(id), n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.syncAsyncJobs(ctx, 10*time.Millisecond, func(id string, data []byte) {
+			mu.Lock()
+			writes[id]++
+			mu.Unlock()
+		})
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	waitFor("running", 1)
+	waitFor("done", 1)
+	time.Sleep(50 * time.Millisecond)
+	if count("running") != 1 || count("done") != 1 {
+		t.Fatalf("unchanged jobs rewritten: %v", writes)
+	}
+
+	running.SetProgress(40)
+	waitFor("running", 2)
+	running.SetStatus("complete")
+	waitFor("running", 3)
+	running.SetProgress(100)
+	time.Sleep(50 * time.Millisecond)
+	if n := count("running"); n != 3 {
+		t.Errorf("finished job written %d times, want 3", n)
+	}
+}
@@ -0,0 +1,316 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+var (
+	ErrInvalidToken = errors.New("Download not found or expired")
+	ErrTokenRevoked = errors.New("This download link has been revoked")
+	ErrTokenUsedUp  = errors.New("This download link has reached its download limit")
+)
+
+// DownloadClaims is what a signed download token vouches for: enough to
+// serve the file without any record of the token being kept. The file is
+// named relative to config.TempDir, so tokens don't reveal server paths.
+type DownloadClaims struct {
+	ID            string `json:"id"`
+	JobID         string `json:"job,omitempty"`
+	File          string `json:"file,omitempty"`
+	StorageKey    string `json:"key,omitempty"`
+	FileName      string `json:"name"`
+	FileSize      int64  `json:"size"`
+	MimeType      string `json:"mime"`
+	CreatedAt     int64  `json:"iat"`
+	ExpiresAt     int64  `json:"exp"`
+	MaxDownloads  int    `json:"max,omitempty"`
+	IsWebPlaylist bool   `json:"wp,omitempty"`
+	IsPlaylist    bool   `json:"pl,omitempty"`
+	IsWebDownload bool   `json:"wd,omitempty"`
+}
+
+// ClaimsFor describes a download token for dl, valid for as long as dl's
+// token would be.
+func ClaimsFor(jobID string, dl *BotDownload) DownloadClaims {
+	return DownloadClaims{
+		ID:            uuid.New().String(),
+		JobID:         jobID,
+		File:          tempRelPath(dl.FilePath),
+		StorageKey:    dl.StorageKey,
+		FileName:      dl.FileName,
+		FileSize:      dl.FileSize,
+		MimeType:      dl.MimeType,
+		CreatedAt:     dl.CreatedAt.Unix(),
+		ExpiresAt:     dl.CreatedAt.Add(dl.Expiry()).Unix(),
+		MaxDownloads:  config.DownloadTokenMaxUses,
+		IsWebPlaylist: dl.IsWebPlaylist,
+		IsPlaylist:    dl.IsPlaylist,
+		IsWebDownload: dl.IsWebDownload,
+	}
+}
+
+func (c *DownloadClaims) Expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// tempRelPath is path relative to config.TempDir, or "" for a file kept
+// anywhere else.
+func tempRelPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(config.TempDir, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		log.Printf("[Tokens] %s is outside %s, leaving it out of the token", path, config.TempDir)
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Download is the download the claims describe.
+func (c *DownloadClaims) Download() *BotDownload {
+	var filePath string
+	if rel := filepath.FromSlash(c.File); filepath.IsLocal(rel) {
+		filePath = filepath.Join(config.TempDir, rel)
+	}
+	return &BotDownload{
+		FilePath:      filePath,
+		StorageKey:    c.StorageKey,
+		FileName:      c.FileName,
+		FileSize:      c.FileSize,
+		MimeType:      c.MimeType,
+		CreatedAt:     time.Unix(c.CreatedAt, 0),
+		IsWebPlaylist: c.IsWebPlaylist,
+		IsPlaylist:    c.IsPlaylist,
+		IsWebDownload: c.IsWebDownload,
+	}
+}
+
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// TokenSigner signs download tokens and checks them against any of its
+// keys. A token is "<key id>.<claims>.<signature>", base64url encoded.
+type TokenSigner struct {
+	keys []signingKey
+}
+
+// NewTokenSigner signs with the first of secrets. With none it makes up a
+// key, so its tokens only work until the process exits.
+func NewTokenSigner(secrets []string) *TokenSigner {
+	if len(secrets) == 0 {
+		b := make([]byte, 32)
+		rand.Read(b)
+		secrets = []string{hex.EncodeToString(b)}
+	}
+	t := &TokenSigner{}
+	for _, secret := range secrets {
+		sum := sha256.Sum256([]byte(secret))
+		t.keys = append(t.keys, signingKey{id: hex.EncodeToString(sum[:4]), secret: []byte(secret)})
+	}
+	return t
+}
+
+func (t *TokenSigner) Sign(c DownloadClaims) string {
+	payload, _ := json.Marshal(c)
+	key := t.keys[0]
+	signed := key.id + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(key.sign(signed))
+}
+
+// Verify checks token's signature and expiry and returns its claims.
+func (t *TokenSigner) Verify(token string) (*DownloadClaims, error) {
+	keyID, rest, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	gotSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	for _, key := range t.keys {
+		if key.id != keyID {
+			continue
+		}
+		if !hmac.Equal(gotSig, key.sign(keyID+"."+payload)) {
+			return nil, ErrInvalidToken
+		}
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		var c DownloadClaims
+		if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+			return nil, ErrInvalidToken
+		}
+		if time.Now().After(c.Expires()) {
+			return nil, ErrInvalidToken
+		}
+		return &c, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+func (k signingKey) sign(s string) []byte {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// IsSignedToken reports whether token looks like one from a TokenSigner
+// rather than an older random one.
+func IsSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Tokens signs the download tokens this server hands out.
+var Tokens = NewTokenSigner(nil)
+
+// SetupTokens switches Tokens to the keys in DOWNLOAD_TOKEN_KEYS.
+func SetupTokens() {
+	if len(config.DownloadTokenKeys) > 0 {
+		Tokens = NewTokenSigner(config.DownloadTokenKeys)
+		log.Printf("[Tokens] Signing download tokens with %d key(s)", len(config.DownloadTokenKeys))
+	}
+}
+
+// signedTokenUse is what's kept about a signed token once it has been
+// downloaded under a limit or revoked.
+type signedTokenUse struct {
+	Uses    int       `json:"uses"`
+	Revoked bool      `json:"revoked"`
+	Expires time.Time `json:"expires"`
+}
+
+// signedTokenUseLocked finds what's known about a signed token, reading
+// through to other replicas first since any of them may have counted a
+// download or revoked it. Callers hold muSigned.
+func (s *State) signedTokenUseLocked(id string) *signedTokenUse {
+	var shared signedTokenUse
+	if s.sharedRecord(tableSignedTokens, id, &shared) {
+		s.signedTokens[id] = &shared
+		return &shared
+	}
+	return s.signedTokens[id]
+}
+
+// updateSignedTokenUseLocked runs change on what's known about a signed
+// token and saves it if change reports a change, with no other replica
+// able to count a download or revoke the token in between. Callers hold
+// muSigned.
+func (s *State) updateSignedTokenUseLocked(c *DownloadClaims, change func(use *signedTokenUse) bool) {
+	use := signedTokenUse{Expires: c.Expires()}
+	if local := s.signedTokens[c.ID]; local != nil {
+		use = *local
+	}
+	if !s.modifyShared(tableSignedTokens, c.ID, &use, func() bool { return change(&use) }) {
+		return
+	}
+	s.signedTokens[c.ID] = &use
+	if s.store != nil {
+		s.store.put(tableSignedTokens, c.ID, &use)
+	}
+}
+
+// UseSignedToken counts a download against a signed token, failing if
+// the token was revoked or has no downloads left.
+func (s *State) UseSignedToken(c *DownloadClaims) error {
+	s.muSigned.Lock()
+	defer s.muSigned.Unlock()
+	var err error
+	s.updateSignedTokenUseLocked(c, func(use *signedTokenUse) bool {
+		switch {
+		case use.Revoked:
+			err = ErrTokenRevoked
+			return false
+		case c.MaxDownloads <= 0:
+			return false
+		case use.Uses >= c.MaxDownloads:
+			err = ErrTokenUsedUp
+			return false
+		}
+		use.Uses++
+		return true
+	})
+	return err
+}
+
+// ReturnSignedToken gives back a download counted by UseSignedToken for
+// a transfer that didn't go through.
+func (s *State) ReturnSignedToken(c *DownloadClaims) {
+	if c.MaxDownloads <= 0 {
+		return
+	}
+	s.muSigned.Lock()
+	defer s.muSigned.Unlock()
+	s.updateSignedTokenUseLocked(c, func(use *signedTokenUse) bool {
+		if use.Uses == 0 {
+			return false
+		}
+		use.Uses--
+		return true
+	})
+}
+
+// CheckSignedToken fails if a signed token was revoked or has no
+// downloads left, without counting one against it.
+func (s *State) CheckSignedToken(c *DownloadClaims) error {
+	s.muSigned.Lock()
+	defer s.muSigned.Unlock()
+	use := s.signedTokenUseLocked(c.ID)
+	switch {
+	case use != nil && use.Revoked:
+		return ErrTokenRevoked
+	case use != nil && c.MaxDownloads > 0 && use.Uses >= c.MaxDownloads:
+		return ErrTokenUsedUp
+	}
+	return nil
+}
+
+// RevokeSignedToken denies a signed token from now until it would have
+// expired anyway.
+func (s *State) RevokeSignedToken(c *DownloadClaims) {
+	s.muSigned.Lock()
+	defer s.muSigned.Unlock()
+	s.updateSignedTokenUseLocked(c, func(use *signedTokenUse) bool {
+		use.Revoked = true
+		return true
+	})
+}
+
+// PruneSignedTokens forgets tokens that have expired, since their
+// signatures no longer pass anyway.
+func (s *State) PruneSignedTokens(now time.Time) {
+	s.muSigned.Lock()
+	defer s.muSigned.Unlock()
+	for id, use := range s.signedTokens {
+		if now.After(use.Expires) {
+			delete(s.signedTokens, id)
+			if s.store != nil {
+				s.store.remove(tableSignedTokens, id)
+			}
+			s.unshare(tableSignedTokens, id)
+		}
+	}
+}
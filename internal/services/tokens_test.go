@@ -0,0 +1,99 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestSignedTokensSurviveKeyRotation(t *testing.T) {
+	dl := &BotDownload{FilePath: filepath.Join(config.TempDir, "bot", "a.mp4"), FileName: "a.mp4", MimeType: "video/mp4", CreatedAt: time.Now()}
+	old := NewTokenSigner([]string{"old-key"})
+	token := old.Sign(ClaimsFor("job1", dl))
+
+	rotated := NewTokenSigner([]string{"new-key", "old-key"})
+	claims, err := rotated.Verify(token)
+	if err != nil {
+		t.Fatalf("token signed with a retired key was refused: %v", err)
+	}
+	if got := claims.Download(); got.FilePath != dl.FilePath || got.FileName != dl.FileName || claims.JobID != "job1" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if _, err := NewTokenSigner([]string{"new-key"}).Verify(token); err == nil {
+		t.Error("token signed with a dropped key was accepted")
+	}
+
+	parts := strings.Split(token, ".")
+	forged := old.Sign(ClaimsFor("job1", &BotDownload{FilePath: "/etc/passwd", CreatedAt: time.Now()}))
+	if _, err := rotated.Verify(parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]); err == nil {
+		t.Error("token with swapped claims was accepted")
+	}
+
+	expired := ClaimsFor("job1", &BotDownload{CreatedAt: time.Now().Add(-48 * time.Hour)})
+	if _, err := old.Verify(old.Sign(expired)); err == nil {
+		t.Error("expired token was accepted")
+	}
+}
+
+func TestSignedTokensDontCarryServerPaths(t *testing.T) {
+	signer := NewTokenSigner([]string{"key"})
+	token := signer.Sign(ClaimsFor("job1", &BotDownload{FilePath: filepath.Join(config.TempDir, "bot", "a.mp4"), CreatedAt: time.Now()}))
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), config.TempDir) {
+		t.Errorf("token payload %s contains the temp dir", payload)
+	}
+
+	for file, want := range map[string]string{
+		"bot/a.mp4":        filepath.Join(config.TempDir, "bot", "a.mp4"),
+		"../../etc/passwd": "",
+		"/etc/passwd":      "",
+	} {
+		claims := DownloadClaims{File: file}
+		if got := claims.Download().FilePath; got != want {
+			t.Errorf("file %q resolved to %q, want %q", file, got, want)
+		}
+	}
+}
+
+func TestSignedTokenLimitsAndRevocation(t *testing.T) {
+	s := newTestState()
+	claims := ClaimsFor("job1", &BotDownload{CreatedAt: time.Now()})
+	claims.MaxDownloads = 2
+
+	for i := 0; i < 2; i++ {
+		if err := s.CheckSignedToken(&claims); err != nil {
+			t.Fatalf("check before download %d: %v", i+1, err)
+		}
+		if err := s.UseSignedToken(&claims); err != nil {
+			t.Fatalf("download %d refused: %v", i+1, err)
+		}
+	}
+	if err := s.UseSignedToken(&claims); !errors.Is(err, ErrTokenUsedUp) {
+		t.Errorf("third download: err = %v, want ErrTokenUsedUp", err)
+	}
+	if err := s.CheckSignedToken(&claims); !errors.Is(err, ErrTokenUsedUp) {
+		t.Errorf("check after the limit: err = %v, want ErrTokenUsedUp", err)
+	}
+
+	other := ClaimsFor("job2", &BotDownload{CreatedAt: time.Now()})
+	s.RevokeSignedToken(&other)
+	if err := s.UseSignedToken(&other); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("revoked token: err = %v, want ErrTokenRevoked", err)
+	}
+	if err := s.CheckSignedToken(&other); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("check of revoked token: err = %v, want ErrTokenRevoked", err)
+	}
+
+	s.PruneSignedTokens(time.Now().Add(48 * time.Hour))
+	if len(s.signedTokens) != 0 {
+		t.Errorf("%d token uses left after they all expired", len(s.signedTokens))
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+var ErrTooManyTransfers = errors.New("Too many downloads at once. Wait for one to finish.")
+
+// egressChunk is how much is written between checks of the egress limits.
+const egressChunk = 32 * 1024
+
+// byteLimiter paces writes to a rate in bytes a second, letting up to a
+// second's worth through at once. A nil limiter doesn't limit.
+type byteLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait blocks until n more bytes may be sent. Each caller reserves its
+// bytes up front, so writers sharing a limiter take turns.
+func (l *byteLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	totalEgressOnce sync.Once
+	totalEgress     *byteLimiter
+
+	muTransfers sync.Mutex
+	transfers   = make(map[string]int)
+)
+
+// throttledWriter sends a response at no more than its own rate and the
+// server-wide EgressRateTotal.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx  context.Context
+	conn *byteLimiter
+}
+
+func (tw *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), egressChunk)]
+		if err := tw.conn.wait(tw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		if err := totalEgress.wait(tw.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// transferClient is who a transfer counts against: the request's API key
+// if it has one, otherwise its IP as the rate limiter sees it, so that
+// made-up forwarding headers don't count as new clients.
+func transferClient(r *http.Request) string {
+	if key := APIKeyFrom(r.Context()); key != nil {
+		return "key:" + key.ID
+	}
+	return util.TrustedClientIP(r)
+}
+
+// BeginTransfer starts sending a file for r. It returns the writer to send
+// the file through, paced to the egress limits, and a func to call once
+// the file is sent. It fails with ErrTooManyTransfers when the client is
+// already being sent MaxTransfersPerClient files.
+//
+// The writer only changes how fast bytes go out, so http.ServeContent
+// still answers Range and conditional requests through it.
+func BeginTransfer(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), error) {
+	client := transferClient(r)
+	muTransfers.Lock()
+	if config.MaxTransfersPerClient > 0 && transfers[client] >= config.MaxTransfersPerClient {
+		muTransfers.Unlock()
+		return nil, nil, ErrTooManyTransfers
+	}
+	transfers[client]++
+	muTransfers.Unlock()
+
+	var once sync.Once
+	done := func() {
+		once.Do(func() {
+			muTransfers.Lock()
+			if transfers[client]--; transfers[client] <= 0 {
+				delete(transfers, client)
+			}
+			muTransfers.Unlock()
+		})
+	}
+
+	totalEgressOnce.Do(func() { totalEgress = newByteLimiter(config.EgressRateTotal) })
+	if config.EgressRatePerTransfer <= 0 && totalEgress == nil {
+		return w, done, nil
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), conn: newByteLimiter(config.EgressRatePerTransfer)}, done, nil
+}
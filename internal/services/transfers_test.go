@@ -0,0 +1,58 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+func TestTransferLimit(t *testing.T) {
+	prev := config.MaxTransfersPerClient
+	config.MaxTransfersPerClient = 1
+	defer func() { config.MaxTransfersPerClient = prev }()
+
+	r := httptest.NewRequest("GET", "/api/bot/download/abc", nil)
+	_, done, err := BeginTransfer(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("first transfer refused: %v", err)
+	}
+	if _, _, err := BeginTransfer(httptest.NewRecorder(), r); !errors.Is(err, ErrTooManyTransfers) {
+		t.Errorf("second transfer: err = %v", err)
+	}
+	spoofed := httptest.NewRequest("GET", "/api/bot/download/abc", nil)
+	spoofed.Header.Set("X-Forwarded-For", "198.51.100.9")
+	if _, _, err := BeginTransfer(httptest.NewRecorder(), spoofed); !errors.Is(err, ErrTooManyTransfers) {
+		t.Errorf("transfer with a made-up X-Forwarded-For: err = %v", err)
+	}
+	done()
+	done()
+	_, done, err = BeginTransfer(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("transfer after the first finished refused: %v", err)
+	}
+	done()
+}
+
+func TestByteLimiterPaces(t *testing.T) {
+	l := newByteLimiter(1 << 20)
+	start := time.Now()
+	for sent := 0; sent < 3<<19; sent += egressChunk {
+		if err := l.wait(context.Background(), egressChunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first second's worth goes out at once and the rest at 1MB/s.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("1.5MB at 1MB/s took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 1<<20); err == nil {
+		t.Error("wait didn't stop when its request was cancelled")
+	}
+}
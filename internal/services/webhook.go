@@ -0,0 +1,223 @@
+package services
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+	"github.com/coah80/yoink/internal/util"
+)
+
+var errPrivateCallback = errors.New("callback address is private")
+
+// WebhookDelivery is one attempt at POSTing a job's callback.
+type WebhookDelivery struct {
+	Attempt    int       `json:"attempt"`
+	Event      string    `json:"event"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	At         time.Time `json:"at"`
+}
+
+var webhookClient = newWebhookClient(true)
+
+// newWebhookClient returns the client callbacks are POSTed with. With
+// guard set it refuses to connect to private addresses, checked at dial
+// time since a callback's host can resolve somewhere else after it was
+// validated.
+func newWebhookClient(guard bool) *http.Client {
+	dialer := &net.Dialer{Timeout: config.WebhookTimeout}
+	if guard {
+		dialer.Control = refusePrivateDial
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   config.WebhookTimeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func refusePrivateDial(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || util.IsPrivateIP(ip) {
+		return errPrivateCallback
+	}
+	return nil
+}
+
+// StopWebhooks abandons webhook retries that are waiting for their next
+// attempt, ahead of a shutdown. Their jobs are left pending so delivery
+// picks up again when they are restored.
+func (s *State) StopWebhooks() {
+	if s.webhooksStop == nil {
+		return
+	}
+	s.stopWebhooksOnce.Do(func() { close(s.webhooksStop) })
+}
+
+// WatchJob notifies callbackURL once the job completes, fails or is
+// cancelled. It does nothing when callbackURL is empty.
+func (s *State) WatchJob(jobID, callbackURL string) {
+	if callbackURL == "" {
+		return
+	}
+	job := s.GetAsyncJob(jobID)
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	job.CallbackURL = callbackURL
+	job.mu.Unlock()
+	go s.watchCallback(jobID, job)
+}
+
+func webhookEvent(status string) (string, bool) {
+	switch status {
+	case "complete", "error", "cancelled":
+		return status, true
+	case "interrupted":
+		return "error", true
+	}
+	return "", false
+}
+
+func (s *State) watchCallback(jobID string, job *AsyncJob) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		job.mu.RLock()
+		status := job.Status
+		job.mu.RUnlock()
+
+		if event, done := webhookEvent(status); done {
+			s.deliverWebhook(jobID, job, event)
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-s.webhooksStop:
+			return
+		}
+		if s.GetAsyncJob(jobID) != job {
+			return
+		}
+	}
+}
+
+func (s *State) deliverWebhook(jobID string, job *AsyncJob, event string) {
+	payload := job.GetBotStatus()
+	payload["jobId"] = jobID
+	payload["event"] = event
+	body, _ := json.Marshal(payload)
+
+	job.mu.Lock()
+	callbackURL := job.CallbackURL
+	job.WebhookStatus = "pending"
+	job.mu.Unlock()
+
+	short := jobID
+	if len(short) > 8 {
+		short = short[:8]
+	}
+
+	delay := config.WebhookRetryBase
+	for attempt := 1; attempt <= config.WebhookMaxAttempts; attempt++ {
+		code, err := postWebhook(callbackURL, event, body)
+		delivery := WebhookDelivery{Attempt: attempt, Event: event, StatusCode: code, At: time.Now()}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		job.mu.Lock()
+		job.WebhookDeliveries = append(job.WebhookDeliveries, delivery)
+		if err == nil {
+			job.WebhookStatus = "delivered"
+		}
+		job.mu.Unlock()
+		rec := job.record()
+		if s.store != nil {
+			s.store.put(tableAsyncJobs, jobID, rec)
+		}
+		s.share(tableAsyncJobs, jobID, rec)
+
+		if err == nil {
+			log.Printf("[Webhook] Job %s... %s delivered (attempt %d)", short, event, attempt)
+			return
+		}
+		log.Printf("[Webhook] Job %s... %s attempt %d failed: %v", short, event, attempt, err)
+		if attempt < config.WebhookMaxAttempts {
+			select {
+			case <-time.After(delay):
+			case <-s.webhooksStop:
+				log.Printf("[Webhook] Job %s... %s retries stopped for shutdown", short, event)
+				return
+			}
+			delay *= 2
+		}
+	}
+
+	job.mu.Lock()
+	job.WebhookStatus = "failed"
+	job.mu.Unlock()
+	rec := job.record()
+	if s.store != nil {
+		s.store.put(tableAsyncJobs, jobID, rec)
+	}
+	s.share(tableAsyncJobs, jobID, rec)
+	log.Printf("[Webhook] Job %s... giving up after %d attempts", short, config.WebhookMaxAttempts)
+}
+
+func postWebhook(callbackURL, event string, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "yoink/"+config.Version)
+	req.Header.Set("X-Yoink-Event", event)
+	req.Header.Set("X-Yoink-Timestamp", timestamp)
+	if config.WebhookSecret != "" {
+		req.Header.Set("X-Yoink-Signature", "sha256="+signWebhook(config.WebhookSecret, timestamp, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("callback returned HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body". Receivers
+// recompute it to check X-Yoink-Signature.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coah80/yoink/internal/config"
+)
+
+// allowLocalCallbacks lets webhooks reach the loopback test server.
+func allowLocalCallbacks(t *testing.T) {
+	prev := webhookClient
+	webhookClient = newWebhookClient(false)
+	t.Cleanup(func() { webhookClient = prev })
+}
+
+func TestWebhookDeliversSignedPayload(t *testing.T) {
+	state := newTestState()
+	allowLocalCallbacks(t)
+	config.WebhookSecret = "test-secret"
+
+	received := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := "sha256=" + signWebhook("test-secret", r.Header.Get("X-Yoink-Timestamp"), body)
+		if r.Header.Get("X-Yoink-Signature") != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload map[string]interface{}
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer srv.Close()
+
+	job := &AsyncJob{Status: "processing", CreatedAt: time.Now()}
+	state.SetAsyncJob("job-1", job)
+	state.WatchJob("job-1", srv.URL)
+	job.SetStatus("complete")
+
+	select {
+	case payload := <-received:
+		if payload["event"] != "complete" || payload["jobId"] != "job-1" || payload["status"] != "complete" {
+			t.Fatalf("unexpected payload %v", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if status := job.GetJobStatus(); status["webhookStatus"] == "delivered" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("webhook delivery was not recorded")
+}
+
+func TestWebhookRefusesPrivateAddresses(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer srv.Close()
+
+	if _, err := postWebhook(srv.URL, "complete", []byte("{}")); !errors.Is(err, errPrivateCallback) {
+		t.Fatalf("err = %v, want %v", err, errPrivateCallback)
+	}
+	if hits != 0 {
+		t.Fatal("callback reached a loopback address")
+	}
+}
+
+func TestStopWebhooksInterruptsRetries(t *testing.T) {
+	state := newTestState()
+	allowLocalCallbacks(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	job := &AsyncJob{Status: "complete", CreatedAt: time.Now(), CallbackURL: srv.URL}
+	state.SetAsyncJob("job-1", job)
+	done := make(chan struct{})
+	go func() {
+		state.deliverWebhook("job-1", job, "complete")
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(job.GetJobStatus()["webhookDeliveries"].([]WebhookDelivery)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first attempt was not made")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	state.StopWebhooks()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retry kept waiting after StopWebhooks")
+	}
+	if status := job.GetJobStatus()["webhookStatus"]; status != "pending" {
+		t.Fatalf("webhookStatus = %v, want pending so it is retried on restore", status)
+	}
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// workerClaimWait is how long a worker's claim waits for a job before
+	// it comes back empty and the worker asks again.
+	workerClaimWait = 25 * time.Second
+
+	// workerPickupTimeout is how long a job waits for any worker to take
+	// it before it fails.
+	workerPickupTimeout = 2 * time.Minute
+
+	// workerSilenceTimeout is how long a worker may go without reporting
+	// on a job before the job is failed. Workers heartbeat well inside it.
+	workerSilenceTimeout = time.Minute
+)
+
+var resultExtRe = regexp.MustCompile(`^[a-z0-9]{1,5}$`)
+
+// MediaSpec is the download a worker should run.
+type MediaSpec struct {
+	URL          string `json:"url"`
+	Format       string `json:"format"`
+	Quality      string `json:"quality"`
+	Container    string `json:"container"`
+	AudioFormat  string `json:"audioFormat"`
+	AudioBitrate string `json:"audioBitrate"`
+	TwitterGifs  bool   `json:"twitterGifs"`
+	Playlist     bool   `json:"playlist"`
+}
+
+// RemoteJob is a job handed to a worker process. The exported fields are
+// what the worker is sent. Kind is always "download" for now; the field
+// leaves room for jobs that need an input file sent to the worker.
+type RemoteJob struct {
+	ID    string    `json:"id"`
+	Kind  string    `json:"kind"`
+	Media MediaSpec `json:"media"`
+
+	dir       string
+	report    func(WorkerEvent)
+	worker    string
+	lastSeen  time.Time
+	uploading bool
+	cancelled bool
+	done      chan struct{}
+	result    *RemoteResult
+	err       error
+}
+
+// RemoteResult is the file a worker made for a job.
+type RemoteResult struct {
+	Path    string
+	Ext     string
+	IsAudio bool
+	IsGif   bool
+}
+
+// WorkerEvent is a progress report from a worker. An empty Stage is a
+// heartbeat.
+type WorkerEvent struct {
+	Stage    string                 `json:"stage"`
+	Message  string                 `json:"message"`
+	Progress *float64               `json:"progress,omitempty"`
+	Extra    map[string]interface{} `json:"extra,omitempty"`
+}
+
+// WorkerBroker hands jobs to worker processes, which claim them over HTTP,
+// report progress and upload the result. Nothing outside this process is
+// needed to queue them.
+type WorkerBroker struct {
+	mu      sync.Mutex
+	queue   []*RemoteJob
+	jobs    map[string]*RemoteJob
+	wake    chan struct{}
+	workers map[string]time.Time
+}
+
+var Workers = &WorkerBroker{
+	jobs:    make(map[string]*RemoteJob),
+	wake:    make(chan struct{}),
+	workers: make(map[string]time.Time),
+}
+
+// Run queues job for a worker and waits for its result, which is written
+// into dir. report gets the worker's progress. If ctx ends the worker is
+// told to stop.
+func (b *WorkerBroker) Run(ctx context.Context, job *RemoteJob, dir string, report func(WorkerEvent)) (*RemoteResult, error) {
+	job.dir = dir
+	job.report = report
+	job.done = make(chan struct{})
+	job.lastSeen = time.Now()
+
+	b.mu.Lock()
+	b.queue = append(b.queue, job)
+	b.jobs[job.ID] = job
+	close(b.wake)
+	b.wake = make(chan struct{})
+	b.mu.Unlock()
+	defer b.forget(job)
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.done:
+			return job.result, job.err
+		case <-ctx.Done():
+			b.mu.Lock()
+			job.cancelled = true
+			b.mu.Unlock()
+			return nil, fmt.Errorf("Download cancelled")
+		case <-ticker.C:
+			b.mu.Lock()
+			silent := time.Since(job.lastSeen)
+			worker, uploading := job.worker, job.uploading
+			b.mu.Unlock()
+			switch {
+			case worker == "" && silent > workerPickupTimeout:
+				b.finish(job, nil, fmt.Errorf("No workers are available to run this job, try again later"))
+			case worker != "" && !uploading && silent > workerSilenceTimeout:
+				log.Printf("[Workers] Worker %s went quiet on job %s, failing it", worker, job.ID)
+				b.finish(job, nil, fmt.Errorf("The worker running this job stopped responding"))
+			}
+		}
+	}
+}
+
+func (b *WorkerBroker) forget(job *RemoteJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.jobs, job.ID)
+	for i, queued := range b.queue {
+		if queued == job {
+			b.queue = append(b.queue[:i], b.queue[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *WorkerBroker) finish(job *RemoteJob, result *RemoteResult, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-job.done:
+		return
+	default:
+	}
+	job.result, job.err = result, err
+	close(job.done)
+}
+
+// Claim gives workerID the oldest queued job, waiting up to
+// workerClaimWait for one. It returns nil if none came.
+func (b *WorkerBroker) Claim(ctx context.Context, workerID string) *RemoteJob {
+	timeout := time.NewTimer(workerClaimWait)
+	defer timeout.Stop()
+	for {
+		b.mu.Lock()
+		b.workers[workerID] = time.Now()
+		if len(b.queue) > 0 {
+			job := b.queue[0]
+			b.queue = b.queue[1:]
+			job.worker = workerID
+			job.lastSeen = time.Now()
+			b.mu.Unlock()
+			log.Printf("[Workers] Worker %s claimed job %s", workerID, job.ID)
+			return job
+		}
+		wake := b.wake
+		b.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil
+		case <-timeout.C:
+			return nil
+		}
+	}
+}
+
+// claimedLocked returns job id if workerID is running it.
+func (b *WorkerBroker) claimedLocked(id, workerID string) *RemoteJob {
+	job := b.jobs[id]
+	if job == nil || job.worker != workerID {
+		return nil
+	}
+	return job
+}
+
+// Progress records a worker's report on a job. cancel tells the worker to
+// stop; ok is false if the job isn't the worker's any more.
+func (b *WorkerBroker) Progress(id, workerID string, ev WorkerEvent) (cancel, ok bool) {
+	b.mu.Lock()
+	b.workers[workerID] = time.Now()
+	job := b.claimedLocked(id, workerID)
+	if job == nil {
+		b.mu.Unlock()
+		return false, false
+	}
+	job.lastSeen = time.Now()
+	cancelled := job.cancelled
+	b.mu.Unlock()
+
+	if ev.Stage != "" && !cancelled {
+		job.report(ev)
+	}
+	return cancelled, true
+}
+
+// Complete stores the file a worker uploaded for a job and hands it to
+// the job's waiter.
+func (b *WorkerBroker) Complete(id, workerID string, body io.Reader, result RemoteResult) error {
+	if !resultExtRe.MatchString(result.Ext) {
+		return fmt.Errorf("invalid result extension %q", result.Ext)
+	}
+	b.mu.Lock()
+	job := b.claimedLocked(id, workerID)
+	if job != nil {
+		job.uploading = true
+	}
+	b.mu.Unlock()
+	if job == nil {
+		return fmt.Errorf("job %s isn't claimed by worker %s", id, workerID)
+	}
+
+	result.Path = filepath.Join(job.dir, fmt.Sprintf("%s-final.%s", id, result.Ext))
+	f, err := os.Create(result.Path)
+	if err != nil {
+		b.finish(job, nil, err)
+		return err
+	}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(result.Path)
+		b.finish(job, nil, fmt.Errorf("Failed to receive the result from the worker: %v", err))
+		return err
+	}
+	b.finish(job, &result, nil)
+	return nil
+}
+
+// Fail ends a job with the error a worker reported.
+func (b *WorkerBroker) Fail(id, workerID, message string) bool {
+	b.mu.Lock()
+	job := b.claimedLocked(id, workerID)
+	b.mu.Unlock()
+	if job == nil {
+		return false
+	}
+	b.finish(job, nil, fmt.Errorf("%s", message))
+	return true
+}
+
+// Status is the broker's queue and the workers heard from recently, for
+// the admin API.
+func (b *WorkerBroker) Status() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	workers := make(map[string]string)
+	for id, seen := range b.workers {
+		if time.Since(seen) > 2*workerClaimWait {
+			delete(b.workers, id)
+			continue
+		}
+		workers[id] = seen.Format(time.RFC3339)
+	}
+	return map[string]interface{}{
+		"queued":  len(b.queue),
+		"running": len(b.jobs) - len(b.queue),
+		"workers": workers,
+	}
+}
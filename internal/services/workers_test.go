@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerBrokerRunsJobOnWorker(t *testing.T) {
+	b := &WorkerBroker{
+		jobs:    make(map[string]*RemoteJob),
+		wake:    make(chan struct{}),
+		workers: make(map[string]time.Time),
+	}
+	dir := t.TempDir()
+
+	var stages []string
+	type outcome struct {
+		result *RemoteResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := b.Run(context.Background(), &RemoteJob{ID: "job1", Kind: "download"}, dir, func(ev WorkerEvent) {
+			stages = append(stages, ev.Stage)
+		})
+		done <- outcome{result, err}
+	}()
+
+	job := b.Claim(context.Background(), "w1")
+	if job == nil || job.ID != "job1" {
+		t.Fatalf("claimed %v, want job1", job)
+	}
+	if _, ok := b.Progress("job1", "w2", WorkerEvent{Stage: "downloading"}); ok {
+		t.Error("a worker that didn't claim the job could report on it")
+	}
+	if cancel, ok := b.Progress("job1", "w1", WorkerEvent{Stage: "downloading"}); cancel || !ok {
+		t.Errorf("Progress = %v, %v; want false, true", cancel, ok)
+	}
+	b.Progress("job1", "w1", WorkerEvent{})
+	if err := b.Complete("job1", "w1", strings.NewReader("data"), RemoteResult{Ext: "../x"}); err == nil {
+		t.Error("an unsafe extension was accepted")
+	}
+	if err := b.Complete("job1", "w1", strings.NewReader("data"), RemoteResult{Ext: "mp4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-done
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+	if data, err := os.ReadFile(got.result.Path); err != nil || string(data) != "data" {
+		t.Errorf("result file = %q, %v", data, err)
+	}
+	if len(stages) != 1 {
+		t.Errorf("reported stages %v, want just the one non-heartbeat event", stages)
+	}
+	if _, ok := b.Progress("job1", "w1", WorkerEvent{}); ok {
+		t.Error("finished job is still known to the broker")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/coah80/yoink/internal/metrics"
 )
 
 var CookiesFile string
@@ -150,6 +152,7 @@ func RefreshCookies(reason string) bool {
 
 	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
 		log.Printf("[Cookies] No refresh script at %s, skipping auto-refresh", scriptPath)
+		metrics.CookieRefreshes.Inc("missing")
 		disableCookiesTemporarily("refresh script missing")
 		return false
 	}
@@ -162,10 +165,12 @@ func RefreshCookies(reason string) bool {
 	)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
+		metrics.CookieRefreshes.Inc("failed")
 		disableCookiesTemporarily("refresh failed")
 		log.Printf("[Cookies] Refresh script failed: %v\n%s", err, string(output))
 		return false
 	}
+	metrics.CookieRefreshes.Inc("ok")
 	enableCookies()
 	log.Printf("[Cookies] Refresh script completed successfully")
 	return true
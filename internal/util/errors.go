@@ -86,5 +86,8 @@ func ToUserError(message string) string {
 	if strings.Contains(msg, "too many active jobs") {
 		return message
 	}
+	if strings.Contains(msg, "temp disk space") {
+		return message
+	}
 	return "Download failed"
 }
@@ -18,10 +18,10 @@ func SelectResolution(width, height, availableBitrateK int) ResolutionResult {
 		W, H       int
 		MinBitrate int
 	}{
-		{1920, 1080, config.BitrateThresholds[1080]},
-		{1280, 720, config.BitrateThresholds[720]},
-		{854, 480, config.BitrateThresholds[480]},
-		{640, 360, config.BitrateThresholds[360]},
+		{1920, 1080, config.Get().BitrateThresholds[1080]},
+		{1280, 720, config.Get().BitrateThresholds[720]},
+		{854, 480, config.Get().BitrateThresholds[480]},
+		{640, 360, config.Get().BitrateThresholds[360]},
 	}
 
 	for _, r := range resolutions {
@@ -15,7 +15,7 @@ import (
 var unsafeFilenameRe = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
 var multiSpaceRe = regexp.MustCompile(`\s+`)
 
-func ClearTempDir() {
+func ClearTempDir(keep map[string]bool) {
 	for _, dir := range config.TempDirs {
 		entries, err := os.ReadDir(dir)
 		if err != nil {
@@ -24,12 +24,28 @@ func ClearTempDir() {
 		}
 		for _, e := range entries {
 			p := filepath.Join(dir, e.Name())
+			if isKept(p, keep) {
+				continue
+			}
 			os.RemoveAll(p)
 		}
 	}
 	fmt.Println("✓ Cleared temp directories")
 }
 
+func isKept(p string, keep map[string]bool) bool {
+	if keep[p] {
+		return true
+	}
+	prefix := p + string(filepath.Separator)
+	for k := range keep {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func CleanupTempFiles() {
 	now := time.Now()
 	for _, dir := range config.TempDirs {
@@ -43,7 +59,7 @@ func CleanupTempFiles() {
 			if err != nil {
 				continue
 			}
-			if now.Sub(info.ModTime()) > config.FileRetention {
+			if now.Sub(info.ModTime()) > config.Get().FileRetention {
 				os.RemoveAll(p)
 				log.Printf("Cleaned up old temp: %s", e.Name())
 			}
@@ -52,8 +68,8 @@ func CleanupTempFiles() {
 
 	if ds, err := GetDiskSpace(config.TempDir); err == nil {
 		log.Printf("[DiskSpace] %.1fGB free / %.1fGB total (%.1fGB used)", ds.AvailGB, ds.TotalGB, ds.UsedGB)
-		if ds.AvailGB < float64(config.DiskSpaceMinGB) {
-			log.Printf("[DiskSpace] WARNING: Only %.1fGB free, below %dGB threshold!", ds.AvailGB, config.DiskSpaceMinGB)
+		if ds.AvailGB < float64(config.Get().DiskSpaceMinGB) {
+			log.Printf("[DiskSpace] WARNING: Only %.1fGB free, below %dGB threshold!", ds.AvailGB, config.Get().DiskSpaceMinGB)
 		}
 	}
 }
@@ -1,12 +1,24 @@
 package util
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"strings"
+
+	"github.com/coah80/yoink/internal/config"
 )
 
 func GetClientIP(r *http.Request) string {
+	if ip := forwardedIP(r); ip != "" {
+		return ip
+	}
+	return hostOf(r.RemoteAddr)
+}
+
+// forwardedIP is the client address a proxy put in the request's headers,
+// if any.
+func forwardedIP(r *http.Request) string {
 	if ip := r.Header.Get("CF-Connecting-IP"); ip != "" {
 		return ip
 	}
@@ -22,9 +34,58 @@ func GetClientIP(r *http.Request) string {
 		}
 		return strings.TrimSpace(forwarded)
 	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	return ""
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return r.RemoteAddr
+		return addr
 	}
 	return host
 }
+
+type peerAddrKey struct{}
+
+// WithPeerAddr remembers the address a connection really came from,
+// before anything rewrites RemoteAddr from the request's headers.
+func WithPeerAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, peerAddrKey{}, addr)
+}
+
+// PeerIP is the address of whoever opened the connection, which unlike
+// the forwarding headers the client can't make up.
+func PeerIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return hostOf(addr)
+	}
+	return hostOf(r.RemoteAddr)
+}
+
+// TrustedClientIP is the client's address for enforcing limits. The
+// forwarding headers are only believed when the connection comes from a
+// proxy in RATE_LIMIT_ALLOWLIST; otherwise anyone could claim any address.
+func TrustedClientIP(r *http.Request) string {
+	peer := PeerIP(r)
+	if !IsTrustedIP(peer) {
+		return peer
+	}
+	if ip := forwardedIP(r); ip != "" {
+		return ip
+	}
+	return peer
+}
+
+// IsTrustedIP reports whether ip is in RATE_LIMIT_ALLOWLIST.
+func IsTrustedIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, allowed := range config.RateLimitAllowIPs {
+		if allowed.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package util
+
+import "errors"
+
+var errNoSysload = errors.New("load and memory stats are only read on linux")
+
+func GetLoadAverage() (float64, error) {
+	return 0, errNoSysload
+}
+
+func GetAvailableMemoryMB() (int, error) {
+	return 0, errNoSysload
+}
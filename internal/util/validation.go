@@ -63,7 +63,9 @@ func init() {
 	}
 }
 
-func isPrivateIP(ip net.IP) bool {
+// IsPrivateIP reports whether ip is a loopback, private or link-local
+// address, one that URLs from users must not reach.
+func IsPrivateIP(ip net.IP) bool {
 	for _, network := range privateNets {
 		if network.Contains(ip) {
 			return true
@@ -83,7 +85,7 @@ func isPrivateHost(hostname string) bool {
 	}
 
 	if ip != nil {
-		return isPrivateIP(ip)
+		return IsPrivateIP(ip)
 	}
 
 	ips, err := net.LookupIP(hostname)
@@ -91,7 +93,7 @@ func isPrivateHost(hostname string) bool {
 		return true
 	}
 	for _, ip := range ips {
-		if isPrivateIP(ip) {
+		if IsPrivateIP(ip) {
 			return true
 		}
 	}
@@ -0,0 +1,230 @@
+// Package worker runs jobs for a yoink API server in WORKER_MODE=remote.
+// It long-polls the API for jobs, runs them on this machine, posts their
+// progress back and uploads the finished file.
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coah80/yoink/internal/services"
+	"github.com/coah80/yoink/internal/util"
+)
+
+const (
+	heartbeatInterval = 15 * time.Second
+	progressInterval  = time.Second
+	retryDelay        = 5 * time.Second
+)
+
+type Config struct {
+	APIURL      string
+	Secret      string
+	ID          string
+	Concurrency int
+
+	// Run does one job, reporting progress through report, and returns
+	// the file it made.
+	Run func(ctx context.Context, job *services.RemoteJob, report func(services.WorkerEvent)) (*services.RemoteResult, error)
+}
+
+type Worker struct {
+	cfg    Config
+	client *http.Client
+}
+
+func New(cfg Config) *Worker {
+	cfg.APIURL = strings.TrimRight(cfg.APIURL, "/")
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	return &Worker{cfg: cfg, client: &http.Client{}}
+}
+
+// Run takes jobs until ctx ends, running up to Concurrency at once. Jobs
+// still running when ctx ends are stopped and reported as failed.
+func (w *Worker) Run(ctx context.Context) {
+	log.Printf("[Worker] %s taking jobs from %s, %d at a time", w.cfg.ID, w.cfg.APIURL, w.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for range w.cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.loop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *Worker) loop(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := w.claim(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[Worker] Claim failed, retrying in %s: %v", retryDelay, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(retryDelay):
+				}
+			}
+			continue
+		}
+		if job != nil {
+			w.run(ctx, job)
+		}
+	}
+}
+
+func (w *Worker) claim(ctx context.Context) (*services.RemoteJob, error) {
+	resp, err := w.do(ctx, "POST", "/claim", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("claim returned %d", resp.StatusCode)
+	}
+	var job services.RemoteJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (w *Worker) run(ctx context.Context, job *services.RemoteJob) {
+	log.Printf("[Worker] Running %s job %s", job.Kind, job.ID)
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer util.CleanupJobFiles(job.ID)
+
+	// Progress is sent at most once a second, plus a heartbeat so the API
+	// knows the job is alive through long quiet stretches like encoding.
+	var mu sync.Mutex
+	var lastSent time.Time
+	send := func(ev services.WorkerEvent) {
+		stop, err := w.progress(jobCtx, job.ID, ev)
+		if err != nil {
+			log.Printf("[Worker] Progress for job %s failed: %v", job.ID, err)
+		}
+		if stop {
+			log.Printf("[Worker] Job %s was cancelled", job.ID)
+			cancel()
+		}
+	}
+	report := func(ev services.WorkerEvent) {
+		mu.Lock()
+		if ev.Stage == "downloading" && time.Since(lastSent) < progressInterval {
+			mu.Unlock()
+			return
+		}
+		lastSent = time.Now()
+		mu.Unlock()
+		send(ev)
+	}
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				send(services.WorkerEvent{})
+			}
+		}
+	}()
+
+	result, err := w.cfg.Run(jobCtx, job, report)
+	if err == nil {
+		err = w.upload(ctx, job.ID, result)
+	}
+	if err != nil {
+		log.Printf("[Worker] Job %s failed: %v", job.ID, err)
+		w.fail(job.ID, err)
+		return
+	}
+	log.Printf("[Worker] Job %s done", job.ID)
+}
+
+// progress posts an event and reports whether the API wants the job
+// stopped, either because it was cancelled or isn't ours any more.
+func (w *Worker) progress(ctx context.Context, id string, ev services.WorkerEvent) (bool, error) {
+	body, _ := json.Marshal(ev)
+	resp, err := w.do(ctx, "POST", "/jobs/"+id+"/progress", bytes.NewReader(body), "application/json")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return true, nil
+	}
+	var reply struct {
+		Cancel bool `json:"cancel"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return reply.Cancel, nil
+}
+
+func (w *Worker) upload(ctx context.Context, id string, result *services.RemoteResult) error {
+	f, err := os.Open(result.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	q := url.Values{}
+	q.Set("ext", result.Ext)
+	q.Set("audio", strconv.FormatBool(result.IsAudio))
+	q.Set("gif", strconv.FormatBool(result.IsGif))
+	resp, err := w.do(ctx, "PUT", "/jobs/"+id+"/result?"+q.Encode(), f, "application/octet-stream")
+	if err != nil {
+		return fmt.Errorf("Failed to send the result back: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Failed to send the result back: %d %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// fail reports a job's error. It uses a fresh context so the report still
+// goes out when the worker is shutting down.
+func (w *Worker) fail(id string, jobErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	body, _ := json.Marshal(map[string]string{"error": jobErr.Error()})
+	resp, err := w.do(ctx, "POST", "/jobs/"+id+"/fail", bytes.NewReader(body), "application/json")
+	if err != nil {
+		log.Printf("[Worker] Failed to report failure of job %s: %v", id, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (w *Worker) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, w.cfg.APIURL+"/api/worker"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.cfg.Secret)
+	req.Header.Set("X-Worker-ID", w.cfg.ID)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return w.client.Do(req)
+}